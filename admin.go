@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed admin requests carry the time they were signed, in Unix seconds, and the hex-encoded
+// HMAC-SHA256 of the request, as computed by signAdminRequest, in these headers.
+const (
+	adminTimestampHeader = "X-Crossstitch-Timestamp"
+	adminSignatureHeader = "X-Crossstitch-Signature"
+)
+
+const (
+	// adminMaxClockSkew is how far a signed request's timestamp may be from the current time.
+	adminMaxClockSkew = 5 * time.Minute
+	// adminMaxBodySize limits the body of admin requests, which is read whole to check its signature.
+	adminMaxBodySize = 1 << 20
+)
+
+// AdminConfig configures how requests to the admin API, and to trigger runs, are authenticated.
+// If neither is set, the admin API is disabled, and anyone may trigger runs.
+type AdminConfig struct {
+	// Token authenticates requests bearing it in an "Authorization: Bearer" header.
+	Token string `yaml:"token"`
+	// SigningKey authenticates requests signed with it, as computed by signAdminRequest. Unlike
+	// the token, it is never sent over the wire.
+	SigningKey string `yaml:"signingKey"`
+}
+
+func (c *AdminConfig) enabled() bool {
+	return c.Token != "" || c.SigningKey != ""
+}
+
+// signAdminRequest returns the signature of a request: the hex-encoded HMAC-SHA256, with the
+// signing key, of its timestamp, method, request URI and body, each followed by a newline.
+func signAdminRequest(key string, timestamp int64, method, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, requestURI)
+	mac.Write(body)
+	mac.Write([]byte("\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureCache remembers the signatures of accepted signed requests until their timestamps fall
+// outside the allowed clock skew, so that a signed request cannot be replayed while it is valid.
+type signatureCache struct {
+	mu sync.Mutex
+	// expires holds when each remembered signature may be forgotten.
+	expires map[string]time.Time
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{expires: map[string]time.Time{}}
+}
+
+// use remembers the signature until expiresAt, and reports whether it was not already remembered.
+// Signatures that have expired by now are forgotten.
+func (c *signatureCache) use(signature string, now, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for sig, expires := range c.expires {
+		if now.After(expires) {
+			delete(c.expires, sig)
+		}
+	}
+	if _, ok := c.expires[signature]; ok {
+		return false
+	}
+	c.expires[signature] = expiresAt
+	return true
+}
+
+// cloudFunctionSignatures remembers the signed requests accepted by this instance of the Cloud
+// Functions. Each instance remembers only its own.
+var cloudFunctionSignatures = newSignatureCache()
+
+// authenticate checks that the request bears the token or is signed with the signing key at a
+// time close to now, and that the signature was not used before, according to seen. It reads the
+// request's body, and replaces it with a copy.
+func (c *AdminConfig) authenticate(r *http.Request, now time.Time, seen *signatureCache) error {
+	if c.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+				return nil
+			}
+			return errors.New("invalid token")
+		}
+	}
+	signature := r.Header.Get(adminSignatureHeader)
+	if c.SigningKey == "" || signature == "" {
+		return errors.New("request is neither bearing a token nor signed")
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(adminTimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", adminTimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > adminMaxClockSkew || skew < -adminMaxClockSkew {
+		return fmt.Errorf("request was signed %s from now, more than the %s allowed", skew.Round(time.Second), adminMaxClockSkew)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, adminMaxBodySize))
+	if err != nil {
+		return fmt.Errorf("reading request body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	want := signAdminRequest(c.SigningKey, timestamp, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return errors.New("invalid signature")
+	}
+	if !seen.use(signature, now, time.Unix(timestamp, 0).Add(adminMaxClockSkew)) {
+		return errors.New("request was already accepted; sign each request anew")
+	}
+	return nil
+}
+
+// requireAdmin lets only authenticated requests through to h, remembering the signed ones in seen.
+// If no credentials are configured, requests are refused, unless authentication is optional, when
+// they are all let through.
+func requireAdmin(config AdminConfig, seen *signatureCache, optional bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.enabled() {
+			if optional {
+				h.ServeHTTP(w, r)
+				return
+			}
+			writeJSONError(w, http.StatusForbidden, errors.New("the admin API is disabled; configure admin.token or admin.signingKey"))
+			return
+		}
+		if err := config.authenticate(r, time.Now(), seen); err != nil {
+			slog.Warn("Refused unauthenticated request", "method", r.Method, "path", r.URL.Path, "err", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, err)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeJSONError writes err as the JSON body of a response with the status code.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// adminAPI serves the admin API, to operate the bot and inspect its state:
+//
+//	POST   /run                  check posts now, responding with the run's report
+//	GET    /posts                list in-progress and handled posts
+//	GET    /calendar             list scheduled competitions, and the phases of tracked competition posts
+//	GET    /posts/{id}           inspect a post's PageToken, handled marker and summons
+//	DELETE /posts/{id}           clear a post's PageToken and handled marker, as the reset command does
+//	POST   /posts/{id}/summon    summon contestants to a post, whether or not it looks like a competition post or was handled
+//	GET    /posts/{id}/preview   render the comments the next run would post to a post
+//	GET    /posts/{id}/entries   list the entries collected from a competition post
+//	GET    /posts/{id}/results   rank a competition post's entries, and show its winners announcement
+//	POST   /posts/{id}/results/approve  approve a drafted winners announcement, for the next run to submit
+//
+// Every endpoint takes an optional profile query parameter, naming the only profile to act on.
+// Actions that use the summoner run exclusively of the daemon's runs.
+type adminAPI struct {
+	// ctx is used by actions, rather than the request's context, so that a client hanging up
+	// does not cancel them part-way through.
+	ctx context.Context
+	d   *daemon
+}
+
+func newAdminAPI(ctx context.Context, d *daemon) *adminAPI {
+	return &adminAPI{ctx: ctx, d: d}
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	profile := r.URL.Query().Get("profile")
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := func(method string) bool {
+		if r.Method == method {
+			return true
+		}
+		w.Header().Set("Allow", method)
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not allowed", r.Method, r.URL.Path))
+		return false
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "run":
+		if route(http.MethodPost) {
+			a.run(w)
+		}
+	case len(parts) == 1 && parts[0] == "posts":
+		if route(http.MethodGet) {
+			a.listPosts(w, profile)
+		}
+	case len(parts) == 1 && parts[0] == "calendar":
+		if route(http.MethodGet) {
+			a.listCalendar(w, profile)
+		}
+	case len(parts) == 2 && parts[0] == "posts":
+		switch r.Method {
+		case http.MethodGet:
+			a.inspectPost(w, profile, postFullID(parts[1]))
+		case http.MethodDelete:
+			a.clearPost(w, profile, postFullID(parts[1]))
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not allowed", r.Method, r.URL.Path))
+		}
+	case len(parts) == 3 && parts[0] == "posts" && parts[2] == "summon":
+		if route(http.MethodPost) {
+			a.summonPost(w, profile, postFullID(parts[1]))
+		}
+	case len(parts) == 3 && parts[0] == "posts" && parts[2] == "preview":
+		if route(http.MethodGet) {
+			a.previewPost(w, profile, postFullID(parts[1]))
+		}
+	case len(parts) == 3 && parts[0] == "posts" && parts[2] == "entries":
+		if route(http.MethodGet) {
+			a.listEntries(w, profile, postFullID(parts[1]))
+		}
+	case len(parts) == 3 && parts[0] == "posts" && parts[2] == "results":
+		if route(http.MethodGet) {
+			a.showResults(w, profile, postFullID(parts[1]))
+		}
+	case len(parts) == 4 && parts[0] == "posts" && parts[2] == "results" && parts[3] == "approve":
+		if route(http.MethodPost) {
+			a.approveAnnouncement(w, profile, postFullID(parts[1]))
+		}
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s", r.URL.Path))
+	}
+}
+
+// fail responds with err, with a status code saying what kind of failure it is.
+func (a *adminAPI) fail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errUnknownProfile), errors.Is(err, errPostNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errPostBusy), errors.Is(err, errAnnouncementPosted):
+		status = http.StatusConflict
+	case errors.Is(err, errShuttingDown):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONError(w, status, err)
+}
+
+func (a *adminAPI) run(w http.ResponseWriter) {
+	report, err := a.d.run(a.ctx, "admin")
+	switch {
+	case report == nil:
+		a.fail(w, err)
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, report)
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func (a *adminAPI) listPosts(w http.ResponseWriter, profile string) {
+	profiles, err := a.d.s.profilesNamed(profile)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	statuses := []*profileStatus{}
+	for _, p := range profiles {
+		status, err := a.d.s.profileStatus(a.ctx, p)
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (a *adminAPI) listCalendar(w http.ResponseWriter, profile string) {
+	profiles, err := a.d.s.profilesNamed(profile)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	calendars := []*profileCalendar{}
+	for _, p := range profiles {
+		cal, err := a.d.s.profileCalendar(a.ctx, p)
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+		calendars = append(calendars, cal)
+	}
+	writeJSON(w, http.StatusOK, calendars)
+}
+
+func (a *adminAPI) inspectPost(w http.ResponseWriter, profile, postID string) {
+	p, err := a.d.s.storedPostProfile(a.ctx, profile, postID)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	state, err := a.d.s.postState(a.ctx, p, postID)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (a *adminAPI) clearPost(w http.ResponseWriter, profile, postID string) {
+	err := a.d.exclusive(func() error {
+		p, err := a.d.s.storedPostProfile(a.ctx, profile, postID)
+		if err != nil {
+			return err
+		}
+		return a.d.s.resetPost(a.ctx, p, postID)
+	})
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) summonPost(w http.ResponseWriter, profile, postID string) {
+	var rep *postReport
+	err := a.d.exclusive(func() error {
+		p, post, err := a.d.s.redditPostProfile(profile, postID)
+		if err != nil {
+			return err
+		}
+		rep, err = a.d.s.forceSummon(a.ctx, p, post)
+		return err
+	})
+	if err != nil && rep == nil {
+		a.fail(w, err)
+		return
+	}
+	status := http.StatusOK
+	if errors.Is(err, errPostBusy) {
+		status = http.StatusConflict
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, rep)
+}
+
+func (a *adminAPI) previewPost(w http.ResponseWriter, profile, postID string) {
+	var preview *postPreview
+	err := a.d.exclusive(func() error {
+		p, post, err := a.d.s.redditPostProfile(profile, postID)
+		if err != nil {
+			return err
+		}
+		preview, err = a.d.s.previewPost(a.ctx, p, post)
+		return err
+	})
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+func (a *adminAPI) listEntries(w http.ResponseWriter, profile, postID string) {
+	p, err := a.d.s.competitionPostProfile(a.ctx, profile, postID)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	entries, err := a.d.s.postEntries(a.ctx, p, postID)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *adminAPI) showResults(w http.ResponseWriter, profile, postID string) {
+	p, err := a.d.s.competitionPostProfile(a.ctx, profile, postID)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	results, err := a.d.s.postResults(a.ctx, p, postID)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (a *adminAPI) approveAnnouncement(w http.ResponseWriter, profile, postID string) {
+	var announcement *Announcement
+	err := a.d.exclusive(func() error {
+		p, err := a.d.s.competitionPostProfile(a.ctx, profile, postID)
+		if err != nil {
+			return err
+		}
+		announcement, err = a.d.s.approveAnnouncement(a.ctx, p, postID)
+		return err
+	})
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, announcement)
+}
+
+// HTTPAdmin is the method that is invoked in Google Cloud Functions when a request to the admin
+// API is received. See adminAPI for its endpoints, and AdminConfig for how requests are
+// authenticated.
+func HTTPAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	config, err := loadConfig(os.Getenv(configEnvVar), os.LookupEnv)
+	if err != nil {
+		slog.Error("Failed to load config", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("loading config: %w", err))
+		return
+	}
+	if err := setupLogging(config.Log); err != nil {
+		slog.Error("Failed to set up logging", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("setting up logging: %w", err))
+		return
+	}
+	requireAdmin(config.Admin, cloudFunctionSignatures, false /*optional*/, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := setupSummoner(ctx, config, false)
+		if err != nil {
+			slog.Error("Failed to setup summoner", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("setting up summoner: %w", err))
+			return
+		}
+		defer s.store.Close()
+		newAdminAPI(ctx, newDaemon(s, config.Serve)).ServeHTTP(w, r)
+	})).ServeHTTP(w, r)
+}
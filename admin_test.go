@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret-token"
+
+// adminServer serves the daemon handler of a summoner with an admin token configured.
+func adminServer(t *testing.T, s *summoner) *httptest.Server {
+	s.config.Admin = AdminConfig{Token: testAdminToken, SigningKey: "signing-key"}
+	d := newDaemon(s, ServeConfig{Interval: time.Hour, ShutdownTimeout: time.Second})
+	srv := httptest.NewServer(d.handler(context.Background()))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// adminRequest makes an authenticated request to the admin API, decoding the JSON response into v if set.
+func adminRequest(t *testing.T, srv *httptest.Server, method, path string, v interface{}) int {
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatalf("NewRequest call failed: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("%s %s returned invalid JSON: %v\n%s", method, path, err, body)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	config := AdminConfig{Token: testAdminToken, SigningKey: "signing-key"}
+	now := time.Now()
+	signed := func(timestamp time.Time, key, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/admin/run?profile=a", strings.NewReader(body))
+		r.Header.Set(adminTimestampHeader, fmt.Sprint(timestamp.Unix()))
+		r.Header.Set(adminSignatureHeader, signAdminRequest(key, timestamp.Unix(), http.MethodPost, "/admin/run?profile=a", []byte(body)))
+		return r
+	}
+	bearer := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/admin/run", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	for _, tc := range []struct {
+		name    string
+		r       *http.Request
+		wantErr bool
+	}{
+		{"token", bearer(testAdminToken), false},
+		{"wrong token", bearer("guess"), true},
+		{"signed", signed(now, "signing-key", "{}"), false},
+		{"signed with wrong key", signed(now, "other-key", "{}"), true},
+		{"signed long ago", signed(now.Add(-time.Hour), "signing-key", "{}"), true},
+		{"unauthenticated", httptest.NewRequest(http.MethodPost, "/admin/run", nil), true},
+	} {
+		err := config.authenticate(tc.r, now, newSignatureCache())
+		if (err != nil) != tc.wantErr {
+			t.Errorf("authenticate(%s) returned unexpected error: %v", tc.name, err)
+		}
+	}
+
+	// The body of a signed request can still be read after it was checked.
+	r := signed(now, "signing-key", `{"a":1}`)
+	seen := newSignatureCache()
+	if err := config.authenticate(r, now, seen); err != nil {
+		t.Fatalf("authenticate call failed: %v", err)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"a":1}` {
+		t.Fatalf("authenticate did not restore the request body (got: %q)", body)
+	}
+
+	// A signed request is accepted only once, while its signature is remembered, but a token may be reused.
+	if err := config.authenticate(signed(now, "signing-key", `{"a":1}`), now.Add(time.Minute), seen); err == nil {
+		t.Fatal("authenticate accepted a replayed signed request")
+	}
+	if err := config.authenticate(signed(now.Add(time.Second), "signing-key", `{"a":1}`), now.Add(time.Minute), seen); err != nil {
+		t.Fatalf("authenticate refused a request signed anew: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := config.authenticate(bearer(testAdminToken), now, seen); err != nil {
+			t.Fatalf("authenticate refused a reused token: %v", err)
+		}
+	}
+}
+
+func TestAdminAPIRequiresCredentials(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	d := newDaemon(s, ServeConfig{Interval: time.Hour, ShutdownTimeout: time.Second})
+	srv := httptest.NewServer(d.handler(context.Background()))
+	defer srv.Close()
+
+	// Without credentials configured, the admin API is disabled, but runs may still be triggered.
+	resp, err := http.Get(srv.URL + "/admin/posts")
+	if err != nil {
+		t.Fatalf("GET /admin/posts failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("disabled admin API returned unexpected status (got: %d, want: %d)", resp.StatusCode, http.StatusForbidden)
+	}
+
+	srv = adminServer(t, s)
+	for _, path := range []string{"/admin/posts", "/run"} {
+		resp, err := http.Post(srv.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("unauthenticated POST %s returned unexpected status (got: %d, want: %d)", path, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminAPIPosts(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(2*defaultMaxRedditTagsPerComment))
+	post.Subreddit = testProfile(s).Subreddit
+	startSummoning(t, s, post)
+	srv := adminServer(t, s)
+
+	var statuses []*profileStatus
+	if status := adminRequest(t, srv, http.MethodGet, "/admin/posts", &statuses); status != http.StatusOK {
+		t.Fatalf("GET /admin/posts returned unexpected status %d", status)
+	}
+	if len(statuses) != 1 || len(statuses[0].InProgress) != 1 || statuses[0].InProgress[0].NextIndex != defaultMaxRedditTagsPerComment {
+		t.Fatalf("GET /admin/posts returned unexpected status: %+v", statuses)
+	}
+
+	var state postState
+	if status := adminRequest(t, srv, http.MethodGet, "/admin/posts/12345", &state); status != http.StatusOK {
+		t.Fatalf("GET /admin/posts/12345 returned unexpected status %d", status)
+	}
+	if !state.Handled || state.Progress == nil || len(state.Summons) != defaultMaxRedditTagsPerComment {
+		t.Fatalf("GET /admin/posts/12345 returned unexpected state: %+v", state)
+	}
+
+	var preview postPreview
+	if status := adminRequest(t, srv, http.MethodGet, "/admin/posts/12345/preview", &preview); status != http.StatusOK {
+		t.Fatalf("GET /admin/posts/12345/preview returned unexpected status %d", status)
+	}
+	if !preview.Matched || preview.MainComment != "" || len(preview.SummonComments) != 1 {
+		t.Fatalf("GET /admin/posts/12345/preview returned unexpected preview: %+v", preview)
+	}
+
+	if status := adminRequest(t, srv, http.MethodDelete, "/admin/posts/12345", nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE /admin/posts/12345 returned unexpected status %d", status)
+	}
+	if handled, err := s.store.IsHandled(context.Background(), testProfile(s).Namespace, post.FullID); err != nil || handled {
+		t.Fatalf("DELETE /admin/posts/12345 did not clear the handled marker (got: %t, %v)", handled, err)
+	}
+	if status := adminRequest(t, srv, http.MethodGet, "/admin/posts/12345", nil); status != http.StatusNotFound {
+		t.Fatalf("GET of a cleared post returned unexpected status (got: %d, want: %d)", status, http.StatusNotFound)
+	}
+	if status := adminRequest(t, srv, http.MethodGet, "/admin/posts?profile=nope", nil); status != http.StatusNotFound {
+		t.Fatalf("GET of an unknown profile returned unexpected status (got: %d, want: %d)", status, http.StatusNotFound)
+	}
+}
+
+func TestAdminAPIForceSummon(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	// The post does not look like a competition post.
+	post := fakePost("t3_12345", "My finished piece")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(numUsers))
+	p := testProfile(s)
+	post.Subreddit = p.Subreddit
+	srv := adminServer(t, s)
+
+	// Another run is handling the post.
+	ctx := context.Background()
+	if _, err := s.store.AcquireLease(ctx, p.Namespace, post.FullID, "other-run", time.Now(), time.Minute); err != nil {
+		t.Fatalf("AcquireLease call failed: %v", err)
+	}
+	if status := adminRequest(t, srv, http.MethodPost, "/admin/posts/12345/summon", nil); status != http.StatusConflict {
+		t.Fatalf("summon of a leased post returned unexpected status (got: %d, want: %d)", status, http.StatusConflict)
+	}
+	if err := s.store.ReleaseLease(ctx, p.Namespace, post.FullID, "other-run"); err != nil {
+		t.Fatalf("ReleaseLease call failed: %v", err)
+	}
+
+	var rep postReport
+	if status := adminRequest(t, srv, http.MethodPost, "/admin/posts/12345/summon", &rep); status != http.StatusOK {
+		t.Fatalf("POST /admin/posts/12345/summon returned unexpected status %d", status)
+	}
+	if rep.Phase != phaseComplete || rep.UsersSummoned != numUsers {
+		t.Fatalf("POST /admin/posts/12345/summon returned unexpected progress: %+v", rep)
+	}
+
+	// Forcing summoning to a post that was already handled summons the users added since.
+	p.Subscribers.Usernames = generateFakeUsers(numUsers + 1)
+	if status := adminRequest(t, srv, http.MethodPost, "/admin/posts/12345/summon", &rep); status != http.StatusOK {
+		t.Fatalf("POST /admin/posts/12345/summon of a handled post returned unexpected status %d", status)
+	}
+	if rep.Phase != phaseComplete || rep.UsersSummoned != 1 {
+		t.Fatalf("POST /admin/posts/12345/summon of a handled post returned unexpected progress: %+v", rep)
+	}
+
+	var report runReport
+	if status := adminRequest(t, srv, http.MethodPost, "/admin/run", &report); status != http.StatusOK {
+		t.Fatalf("POST /admin/run returned unexpected status %d", status)
+	}
+	if len(report.Profiles) != 1 || report.Profiles[0].PostsSeen != 1 {
+		t.Fatalf("POST /admin/run returned unexpected report: %+v", report)
+	}
+}
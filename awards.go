@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWinnerMessageSubject = "Congratulations on winning {{.Month}}'s competition!"
+	defaultWinnerMessage        = "Congratulations, {{.Username}}! Your entry in r/{{.Subreddit}}'s {{.Month}} competition" +
+		"{{if .Theme}}, \"{{.Theme}}\",{{end}} placed:\n\n" +
+		"{{range .Places}}- **{{.Place}}{{if .Tied}} (tied){{end}}** in {{.Category}}, with {{.Score}} points\n{{end}}" +
+		"\nThe winners are announced in [this post]({{.AnnouncementLink}}). Thank you for taking part!"
+)
+
+// Reddit rejects longer user flair.
+const redditMaxFlairLength = 64
+
+// WinnersConfig configures rewarding the winners of a profile's competitions, once their winners
+// announcement is submitted.
+type WinnersConfig struct {
+	// Message sends each winner a private message.
+	Message bool `yaml:"message"`
+	// MessageSubject and MessageText are templates of the message, executed with the fields of
+	// winnerData, e.g. {{.Username}} and {{range .Places}}.
+	MessageSubject string `yaml:"messageSubject"`
+	MessageText    string `yaml:"messageText"`
+	// Flair, if set, is the template of the user flair winners are given in the subreddit,
+	// executed with the fields of winnerData, e.g. "Competition Winner – {{.MonthShort}} {{.Year}}".
+	Flair string `yaml:"flair"`
+	// FlairCSSClass is the CSS class of the flair, if any.
+	FlairCSSClass string `yaml:"flairCSSClass"`
+
+	messageSubjectTemplate *template.Template
+	messageTextTemplate    *template.Template
+	flairTemplate          *template.Template
+}
+
+func (c *WinnersConfig) applyDefaults() {
+	if c.MessageSubject == "" {
+		c.MessageSubject = defaultWinnerMessageSubject
+	}
+	if c.MessageText == "" {
+		c.MessageText = defaultWinnerMessage
+	}
+}
+
+func (c *WinnersConfig) validate(results *ResultsConfig) error {
+	if c.enabled() && !results.Tally {
+		return errors.New("message and flair require results.tally")
+	}
+	return nil
+}
+
+// compile parses the message and flair templates, and checks that they render for a sample winner.
+func (c *WinnersConfig) compile() error {
+	var errs []error
+	var err error
+	if c.messageSubjectTemplate, err = template.New("messageSubject").Parse(c.MessageSubject); err != nil {
+		errs = append(errs, err)
+	}
+	if c.messageTextTemplate, err = template.New("messageText").Parse(c.MessageText); err != nil {
+		errs = append(errs, err)
+	}
+	if c.flairTemplate, err = template.New("flair").Parse(c.Flair); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	sample := &winnerData{
+		Subreddit:        "CrossStitch",
+		Username:         fmt.Sprintf("u/%0*d", redditMaxUsernameLength, 0),
+		Month:            "September",
+		MonthShort:       "Sep",
+		Year:             2026,
+		Theme:            "Sample theme",
+		PostLink:         "https://redd.it/abcdef",
+		AnnouncementLink: "https://redd.it/ghijkl",
+		Places:           []*winnerPlace{{Category: "Overall", Place: "1st", Score: 100}},
+	}
+	if _, _, err := c.renderMessage(sample); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.renderFlair(sample); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// enabled reports whether winners are rewarded at all.
+func (c *WinnersConfig) enabled() bool {
+	return c.Message || c.Flair != ""
+}
+
+func (c *WinnersConfig) renderMessage(data *winnerData) (subject, text string, err error) {
+	var b strings.Builder
+	if err := c.messageSubjectTemplate.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	subject = strings.TrimSpace(b.String())
+	if subject == "" || len(subject) > redditMaxSubjectLength {
+		return "", "", fmt.Errorf("messageSubject renders to %d characters, want 1 to %d", len(subject), redditMaxSubjectLength)
+	}
+	b.Reset()
+	if err := c.messageTextTemplate.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	text = b.String()
+	if len(text) > redditMaxMessageLength {
+		return "", "", fmt.Errorf("messageText renders to %d characters, more than Reddit's limit of %d", len(text), redditMaxMessageLength)
+	}
+	return subject, text, nil
+}
+
+func (c *WinnersConfig) renderFlair(data *winnerData) (string, error) {
+	var b strings.Builder
+	if err := c.flairTemplate.Execute(&b, data); err != nil {
+		return "", err
+	}
+	flair := strings.TrimSpace(b.String())
+	if len(flair) > redditMaxFlairLength {
+		return "", fmt.Errorf("flair renders to %d characters, more than Reddit's limit of %d", len(flair), redditMaxFlairLength)
+	}
+	return flair, nil
+}
+
+// winnerData is what the winner message and flair templates are rendered with.
+type winnerData struct {
+	Subreddit string
+	// Username is the winner's, with the "u/" prefix.
+	Username string
+	// Month is the name of the month the competition post was made in, MonthShort its first
+	// three letters, and Year its year.
+	Month      string
+	MonthShort string
+	Year       int
+	Theme      string
+	// PostLink links to the competition post, and AnnouncementLink to the winners announcement.
+	PostLink         string
+	AnnouncementLink string
+	// Places lists the places the winner's entries took, in the order of the categories.
+	Places []*winnerPlace
+}
+
+// winnerPlace is a place a winner took in a category.
+type winnerPlace struct {
+	Category string
+	Place    string
+	Tied     bool
+	Score    int
+	Link     string
+}
+
+// Award records what was done to reward a winner of a competition post, so that it is done once.
+type Award struct {
+	PostID   string
+	Username string
+	// Places describes the places the winner took, e.g. "1st in Beginner".
+	Places []string `datastore:",noindex"`
+	// MessagedAt is when the winner was sent a message, and MessageError why sending it failed
+	// for good, if it did.
+	MessagedAt   time.Time
+	MessageError string `datastore:",noindex"`
+	// Flair is the flair the winner was given at FlairedAt, and FlairError why setting it failed
+	// for good, if it did.
+	Flair      string `datastore:",noindex"`
+	FlairedAt  time.Time
+	FlairError string `datastore:",noindex"`
+}
+
+func awardKeyName(postID, username string) string {
+	return postID + "/" + subscriptionKeyName(username)
+}
+
+// winners groups the announced places by user, in the order the users first placed.
+func winners(announced []announcedPlace) ([]string, map[string][]*winnerPlace) {
+	var usernames []string
+	places := map[string][]*winnerPlace{}
+	for _, w := range announced {
+		key := subscriptionKeyName(w.Username)
+		if places[key] == nil {
+			usernames = append(usernames, w.Username)
+		}
+		places[key] = append(places[key], &winnerPlace{Category: w.Category, Place: w.Place, Tied: w.Tied, Score: w.Score, Link: w.Link})
+	}
+	return usernames, places
+}
+
+// rewardWinners messages the winners of the profile's competitions whose winners announcement
+// was submitted, and sets their flair, as configured.
+func (s *summoner) rewardWinners(ctx context.Context, p *CompetitionProfile) error {
+	if !p.Winners.enabled() {
+		return nil
+	}
+	announcements, err := s.store.Announcements(ctx, p.Namespace)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to list Announcements", "err", err)
+		return err
+	}
+	for _, a := range announcements {
+		if s.shuttingDown() {
+			return nil
+		}
+		if a.Status != announcementPosted || a.WinnersRewarded {
+			continue
+		}
+		ctx := withLogAttrs(ctx, "post", a.PostID)
+		err := s.withPostLease(ctx, p, a.PostID, func() error {
+			return s.rewardPostWinners(ctx, p, a)
+		})
+		if err != nil {
+			s.postReport(p, a.PostID).Error = err.Error()
+			return err
+		}
+	}
+	return nil
+}
+
+// rewardPostWinners rewards the winners the announcement of one competition post names,
+// skipping what earlier runs did.
+func (s *summoner) rewardPostWinners(ctx context.Context, p *CompetitionProfile, a *Announcement) error {
+	logger := loggerFrom(ctx)
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, a.PostID)
+	if err != nil {
+		logger.Error("Failed to read CompetitionPost", "err", err)
+		return err
+	}
+	awards, err := s.store.Awards(ctx, p.Namespace, a.PostID)
+	if err != nil {
+		logger.Error("Failed to read Awards", "err", err)
+		return err
+	}
+	done := map[string]*Award{}
+	for _, award := range awards {
+		done[subscriptionKeyName(award.Username)] = award
+	}
+
+	results := newResultsData(p, cp, nil /*results*/)
+	usernames, places := winners(a.Winners)
+	for _, username := range usernames {
+		if s.shuttingDown() {
+			return nil
+		}
+		if err := s.renewPostLease(ctx, p, a.PostID); err != nil {
+			return err
+		}
+		award := done[subscriptionKeyName(username)]
+		if award == nil {
+			award = &Award{PostID: a.PostID, Username: username}
+		}
+		data := &winnerData{
+			Subreddit:        p.Subreddit,
+			Username:         username,
+			Month:            results.Month,
+			MonthShort:       results.Month[:3],
+			Year:             cp.CreatedAt.UTC().Year(),
+			Theme:            results.Theme,
+			PostLink:         results.PostLink,
+			AnnouncementLink: "https://redd.it/" + strings.TrimPrefix(a.SubmittedPostID, "t3_"),
+			Places:           places[subscriptionKeyName(username)],
+		}
+		award.Places = nil
+		for _, place := range data.Places {
+			award.Places = append(award.Places, place.Place+" in "+place.Category)
+		}
+		if err := s.rewardWinner(ctx, p, award, data); err != nil {
+			return err
+		}
+	}
+
+	a.WinnersRewarded = true
+	if err := s.store.PutAnnouncement(ctx, p.Namespace, a); err != nil {
+		logger.Error("Failed to save Announcement", "err", err)
+		return err
+	}
+	logger.Info("Rewarded winners", "winners", len(usernames))
+	return nil
+}
+
+// rewardWinner messages a winner and sets their flair, unless that was done already, saving the
+// award after each step. A step that fails for good, e.g. because the user blocks messages, is
+// recorded and not tried again.
+func (s *summoner) rewardWinner(ctx context.Context, p *CompetitionProfile, award *Award, data *winnerData) error {
+	logger := loggerFrom(ctx).With("winner", award.Username)
+	rep := s.postReport(p, award.PostID)
+	if p.Winners.Message && award.MessagedAt.IsZero() && award.MessageError == "" {
+		subject, text, err := p.Winners.renderMessage(data)
+		if err != nil {
+			logger.Error("Failed to render winner message", "err", err)
+			return err
+		}
+		if err := s.redditSession.SendMessage(strings.TrimPrefix(award.Username, "u/"), subject, text); err != nil {
+			logger.Error("Failed to message winner", "err", err)
+			if !isPermanentRedditError(err) {
+				return err
+			}
+			award.MessageError = err.Error()
+		} else {
+			award.MessagedAt = time.Now().UTC()
+			rep.WinnersMessaged++
+		}
+		if err := s.store.PutAward(ctx, p.Namespace, award); err != nil {
+			logger.Error("Failed to save Award", "err", err)
+			return err
+		}
+	}
+	if p.Winners.Flair != "" && award.FlairedAt.IsZero() && award.FlairError == "" {
+		flair, err := p.Winners.renderFlair(data)
+		if err != nil {
+			logger.Error("Failed to render winner flair", "err", err)
+			return err
+		}
+		if err := s.redditSession.SetUserFlair(p.Subreddit, strings.TrimPrefix(award.Username, "u/"), flair, p.Winners.FlairCSSClass); err != nil {
+			logger.Error("Failed to set winner flair", "err", err)
+			if !isPermanentRedditError(err) {
+				return err
+			}
+			award.FlairError = err.Error()
+		} else {
+			award.Flair, award.FlairedAt = flair, time.Now().UTC()
+			rep.FlairsSet++
+		}
+		if err := s.store.PutAward(ctx, p.Namespace, award); err != nil {
+			logger.Error("Failed to save Award", "err", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWinnersConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config  WinnersConfig
+		tally   bool
+		wantErr bool
+	}{
+		{WinnersConfig{}, false, false},
+		{WinnersConfig{Message: true, Flair: "Winner {{.Year}}"}, true, false},
+		{WinnersConfig{Message: true}, false, true},
+		{WinnersConfig{Flair: "Winner"}, false, true},
+	} {
+		if err := tc.config.validate(&ResultsConfig{Tally: tc.tally}); (err != nil) != tc.wantErr {
+			t.Errorf("validate(%+v) with tally %t returned unexpected error: %v", tc.config, tc.tally, err)
+		}
+	}
+
+	c := &WinnersConfig{Flair: "{{.Username}} won r/{{.Subreddit}}'s {{.Month}} {{.Year}} competition: {{.Theme}}"}
+	c.applyDefaults()
+	if err := c.compile(); err == nil {
+		t.Error("compile accepted a flair template too long for Reddit")
+	}
+}
+
+// announcedCompetition sets up a closed competition whose winners announcement was approved, for
+// the next run to submit, and whose winners are rewarded as the profile says.
+func announcedCompetition(t *testing.T, s *summoner) *CompetitionProfile {
+	p, cp := closedCompetition(t, s)
+	p.Winners.Message = true
+	p.Winners.Flair = "Competition Winner – {{.MonthShort}} {{.Year}}"
+	if err := p.Winners.compile(); err != nil {
+		t.Fatalf("compile call failed: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if _, err := s.approveAnnouncement(ctx, p, cp.PostID); err != nil {
+		t.Fatalf("approveAnnouncement call failed: %v", err)
+	}
+	return p
+}
+
+func TestRewardWinners(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := announcedCompetition(t, s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	ctx := context.Background()
+
+	report, err := s.checkPosts(ctx)
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if rep := report.profile(p).post("t3_12345"); rep.WinnersMessaged != 3 || rep.FlairsSet != 3 {
+		t.Fatalf("run reported unexpected rewards: %+v", rep)
+	}
+	if len(fsr.messages) != 3 {
+		t.Fatalf("run sent %d messages, want 3: %+v", len(fsr.messages), fsr.messages)
+	}
+	for _, msg := range fsr.messages {
+		if msg.To == "bob" && (msg.Subject != "Congratulations on winning January's competition!" ||
+			!strings.Contains(msg.Text, "**1st (tied)** in Advanced") || !strings.Contains(msg.Text, "https://redd.it/submitted1")) {
+			t.Errorf("run sent unexpected message: %+v", msg)
+		}
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if got, want := fsr.flair[username], "Competition Winner – Jan 2026"; got != want {
+			t.Errorf("flair of %s = %q, want %q", username, got, want)
+		}
+	}
+
+	// Winners are rewarded once.
+	fsr.flair = nil
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if len(fsr.messages) != 3 || len(fsr.flair) != 0 {
+		t.Fatalf("winners were rewarded again: %+v, %+v", fsr.messages, fsr.flair)
+	}
+	a, err := s.store.Announcement(ctx, p.Namespace, "t3_12345")
+	if err != nil || !a.WinnersRewarded {
+		t.Fatalf("rewarding winners was not recorded (got: %+v, %v)", a, err)
+	}
+}
+
+func TestRewardWinnersAsAnnounced(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := announcedCompetition(t, s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	ctx := context.Background()
+	// alice's entry was disqualified after the announcement was drafted, but it still names her.
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, "t3_12345")
+	if err != nil {
+		t.Fatalf("CompetitionPost call failed: %v", err)
+	}
+	entries, err := s.store.Entries(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		t.Fatalf("Entries call failed: %v", err)
+	}
+	for _, e := range entries {
+		if e.Author == "u/alice" {
+			e.Valid = false
+		}
+	}
+	if err := s.store.SaveEntries(ctx, p.Namespace, cp, entries); err != nil {
+		t.Fatalf("SaveEntries call failed: %v", err)
+	}
+
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	var to []string
+	for _, msg := range fsr.messages {
+		to = append(to, msg.To)
+	}
+	if strings.Join(to, ",") != "alice,bob,carol" {
+		t.Fatalf("run messaged %q, want the announced winners alice, bob and carol", to)
+	}
+}
+
+func TestRewardWinnersResumes(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := announcedCompetition(t, s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	blocked := &PermanentRedditError{Op: "message carol", Err: &redditAPIError{Method: http.MethodPost, Path: "/api/compose", StatusCode: http.StatusOK, Code: "NOT_WHITELISTED_BY_USER_MESSAGE"}}
+	fsr.failMessage = func(to string) error {
+		switch to {
+		case "bob":
+			return &redditAPIError{Method: http.MethodPost, Path: "/api/compose", StatusCode: http.StatusServiceUnavailable}
+		case "carol":
+			return blocked
+		}
+		return nil
+	}
+	ctx := context.Background()
+
+	if _, err := s.checkPosts(ctx); err == nil {
+		t.Fatal("checkPosts did not fail when messaging a winner failed")
+	}
+	fsr.failMessage = func(to string) error {
+		if to == "carol" {
+			return blocked
+		}
+		return nil
+	}
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	var to []string
+	for _, msg := range fsr.messages {
+		to = append(to, msg.To)
+	}
+	if strings.Join(to, ",") != "alice,bob" {
+		t.Fatalf("runs messaged %q, want alice once and bob once", to)
+	}
+	awards, err := s.store.Awards(ctx, p.Namespace, "t3_12345")
+	if err != nil {
+		t.Fatalf("Awards call failed: %v", err)
+	}
+	if len(awards) != 3 || awards[2].Username != "u/carol" || awards[2].MessageError == "" || awards[2].FlairedAt.IsZero() {
+		t.Fatalf("runs recorded unexpected awards: %+v", awards)
+	}
+
+	out, err := runCommand(t, s, "results", "12345")
+	if err != nil {
+		t.Fatalf("results command failed: %v", err)
+	}
+	for _, want := range []string{"Winners rewarded: 3", "u/bob", "1st in Advanced", "message failed", `flair "Competition Winner – Jan 2026"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("results command output lacks %q:\n%s", want, out)
+		}
+	}
+}
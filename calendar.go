@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"text/template"
+	"time"
+)
+
+const defaultReminderComment = "Only {{.DaysLeft}} day(s) left to enter {{.Month}}'s competition! Submissions close on {{.Deadline}}." +
+	" Subscribers who have not entered yet are tagged below."
+
+// Phases of a competition, as scheduled by its calendar.
+const (
+	// The competition post was made, but the competition has not opened yet.
+	competitionScheduled = "scheduled"
+	// Subscribers were summoned, and entries are being submitted.
+	competitionOpen = "open"
+	// Submissions closed, and voting goes on until the voting deadline.
+	competitionVoting = "voting"
+	// Voting ended.
+	competitionClosed = "closed"
+)
+
+// CalendarConfig schedules the phases of a profile's competitions: subscribers are summoned when
+// a competition opens; a reminder is posted before its submission deadline; and at its voting
+// deadline it closes, votes are tallied, and its post may be locked.
+type CalendarConfig struct {
+	// Competitions lists the dates of scheduled competitions. A competition post follows the
+	// dates of the first competition whose submission deadline is after the post was made. Other
+	// competition posts open when they are made, and take submissions for entries.submissionPeriod.
+	Competitions []*CompetitionDates `yaml:"competitions"`
+	// VotingPeriod is how long voting goes on after the submission deadline, for competitions
+	// whose voting deadline is not listed. By default, voting ends at the submission deadline.
+	VotingPeriod time.Duration `yaml:"votingPeriod"`
+	// ReminderBefore is how long before the submission deadline a reminder comment is posted,
+	// under which subscribers who have no valid entry yet are tagged. No reminder is posted if
+	// it is unset.
+	ReminderBefore time.Duration `yaml:"reminderBefore"`
+	// ReminderComment is the template of the reminder comment, executed with the fields of
+	// commentData, including {{.Deadline}} and {{.DaysLeft}}. Subscribers are tagged in replies
+	// to it, made with the summon comment template.
+	ReminderComment string `yaml:"reminderComment"`
+	// Lock locks competition posts once voting ends.
+	Lock bool `yaml:"lock"`
+
+	reminderCommentTemplate *template.Template
+}
+
+// CompetitionDates schedules one competition.
+type CompetitionDates struct {
+	Opens              time.Time `yaml:"opens" json:"opens"`
+	SubmissionDeadline time.Time `yaml:"submissionDeadline" json:"submissionDeadline"`
+	// VotingDeadline defaults to the submission deadline plus votingPeriod.
+	VotingDeadline time.Time `yaml:"votingDeadline" json:"votingDeadline,omitempty"`
+}
+
+func (c *CalendarConfig) applyDefaults() {
+	if c.ReminderComment == "" {
+		c.ReminderComment = defaultReminderComment
+	}
+	sort.SliceStable(c.Competitions, func(i, j int) bool { return c.Competitions[i].Opens.Before(c.Competitions[j].Opens) })
+}
+
+func (c *CalendarConfig) validate() error {
+	var errs []error
+	if c.VotingPeriod < 0 {
+		errs = append(errs, fmt.Errorf("votingPeriod must not be negative, got %s", c.VotingPeriod))
+	}
+	if c.ReminderBefore < 0 {
+		errs = append(errs, fmt.Errorf("reminderBefore must not be negative, got %s", c.ReminderBefore))
+	}
+	for i, d := range c.Competitions {
+		switch {
+		case d.Opens.IsZero() || d.SubmissionDeadline.IsZero():
+			errs = append(errs, fmt.Errorf("competitions[%d]: opens and submissionDeadline must be set", i))
+		case !d.Opens.Before(d.SubmissionDeadline):
+			errs = append(errs, fmt.Errorf("competitions[%d]: submissionDeadline must be after opens", i))
+		case !d.VotingDeadline.IsZero() && d.VotingDeadline.Before(d.SubmissionDeadline):
+			errs = append(errs, fmt.Errorf("competitions[%d]: votingDeadline must not be before submissionDeadline", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compile parses the reminder comment template, and checks that it renders a valid comment.
+func (c *CalendarConfig) compile(sample *commentData) error {
+	var err error
+	if c.reminderCommentTemplate, err = template.New("reminderComment").Parse(c.ReminderComment); err != nil {
+		return err
+	}
+	data := *sample
+	data.Deadline, data.DaysLeft = "Monday, September 21 at 00:00 UTC", 3
+	_, err = c.renderReminderComment(&data)
+	return err
+}
+
+func (c *CalendarConfig) renderReminderComment(data *commentData) (string, error) {
+	text, err := renderComment(c.reminderCommentTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	if len(text) > redditMaxCommentLength {
+		return "", fmt.Errorf("reminderComment renders to %d characters, more than Reddit's limit of %d", len(text), redditMaxCommentLength)
+	}
+	return text, nil
+}
+
+// enabled reports whether competitions are scheduled beyond opening when their post is made.
+func (c *CalendarConfig) enabled() bool {
+	return len(c.Competitions) > 0 || c.VotingPeriod > 0 || c.ReminderBefore > 0 || c.Lock
+}
+
+// dates returns when a competition whose post was made at created opens, when its submissions
+// close, and when voting ends.
+func (c *CalendarConfig) dates(created time.Time, entries *EntriesConfig) (opens, deadline, votingDeadline time.Time) {
+	for _, d := range c.Competitions {
+		if created.Before(d.SubmissionDeadline) {
+			votingDeadline = d.VotingDeadline
+			if votingDeadline.IsZero() {
+				votingDeadline = d.SubmissionDeadline.Add(c.VotingPeriod)
+			}
+			return d.Opens.UTC(), d.SubmissionDeadline.UTC(), votingDeadline.UTC()
+		}
+	}
+	deadline = entries.deadline(created)
+	return created, deadline, deadline.Add(c.VotingPeriod)
+}
+
+// tracksCompetitions reports whether the profile records its competition posts, to collect
+// entries from them or to advance them through their calendar.
+func (p *CompetitionProfile) tracksCompetitions() bool {
+	return p.Entries.Collect || p.Calendar.enabled()
+}
+
+// closesAt returns when voting ends and the competition closes.
+func (cp *CompetitionPost) closesAt() time.Time {
+	if cp.VotingDeadline.IsZero() {
+		return cp.Deadline
+	}
+	return cp.VotingDeadline
+}
+
+// phase returns the phase the competition is in at now.
+func (cp *CompetitionPost) phase(now time.Time) string {
+	switch {
+	case cp.Closed:
+		return competitionClosed
+	case now.Before(cp.OpensAt):
+		return competitionScheduled
+	case now.Before(cp.Deadline):
+		return competitionOpen
+	}
+	return competitionVoting
+}
+
+// competitionOpens returns when the competition of a tracked competition post opens, or the zero
+// time if the post is not tracked.
+func (s *summoner) competitionOpens(ctx context.Context, p *CompetitionProfile, postID string) (time.Time, error) {
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, postID)
+	if err == errNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to read CompetitionPost", "post", postID, "err", err)
+		return time.Time{}, err
+	}
+	return cp.OpensAt, nil
+}
+
+// advanceCompetitions advances each of the profile's competitions that is not closed through the
+// phases of its calendar.
+func (s *summoner) advanceCompetitions(ctx context.Context, p *CompetitionProfile) error {
+	if !p.tracksCompetitions() {
+		return nil
+	}
+	posts, err := s.store.CompetitionPosts(ctx, p.Namespace)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to list CompetitionPosts", "err", err)
+		return err
+	}
+	for _, cp := range posts {
+		if s.shuttingDown() {
+			return nil
+		}
+		if cp.Closed {
+			continue
+		}
+		if err := s.advanceCompetition(withLogAttrs(ctx, "post", cp.PostID), p, cp); err != nil {
+			s.postReport(p, cp.PostID).Error = err.Error()
+			return err
+		}
+	}
+	return nil
+}
+
+// advanceCompetition takes the actions due in the competition's calendar: summoning subscribers
+// once it opens, collecting entries, reminding subscribers who have not entered before the
+// deadline, and closing it once voting ends.
+func (s *summoner) advanceCompetition(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost) error {
+	now := time.Now().UTC()
+	if !now.Before(cp.OpensAt) {
+		if err := s.openCompetition(ctx, p, cp); err != nil {
+			return err
+		}
+	}
+	if p.Entries.Collect && !now.Before(cp.OpensAt) && !cp.Closed {
+		if err := s.collectPostEntries(ctx, p, cp, now); err != nil {
+			return err
+		}
+	}
+	if !cp.Closed {
+		if err := s.withPostLease(ctx, p, cp.PostID, func() error {
+			return s.remindContestants(ctx, p, cp, now)
+		}); err != nil {
+			return err
+		}
+	}
+	if !cp.Closed && now.After(cp.closesAt()) {
+		if err := s.closeCompetition(ctx, p, cp); err != nil {
+			return err
+		}
+	}
+	s.postReport(p, cp.PostID).Competition = cp.phase(now)
+	return nil
+}
+
+// openCompetition summons subscribers to an open competition's post, if that has not begun, e.g.
+// because the competition opened after its post dropped out of the subreddit's newest posts.
+func (s *summoner) openCompetition(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost) error {
+	handled, err := s.store.IsHandled(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to check whether post was handled", "err", err)
+		return err
+	}
+	if _, err := s.store.PageToken(ctx, p.Namespace, cp.PostID); handled || err != errNotFound {
+		return nil
+	}
+	post, err := s.redditSession.Post(p.Subreddit, cp.PostID)
+	if err != nil {
+		if isPermanentRedditError(err) {
+			loggerFrom(ctx).Warn("Closing competition whose post cannot be read", "err", err)
+			cp.Closed = true
+			return s.store.PutCompetitionPost(ctx, p.Namespace, cp)
+		}
+		loggerFrom(ctx).Error("Failed to fetch competition post", "err", err)
+		return err
+	}
+	loggerFrom(ctx).Info("Competition opened", "opens", cp.OpensAt)
+	return s.handlePossibleCompetitionPost(ctx, p, post)
+}
+
+// remindContestants posts the competition's reminder comment, once it is due, and tags the
+// subscribers who have no valid entry yet in replies to it, as many per run as are summoned.
+// Reminders not finished by the deadline are given up.
+func (s *summoner) remindContestants(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost, now time.Time) error {
+	before := p.Calendar.ReminderBefore
+	if before <= 0 || cp.ReminderDone || now.Before(cp.Deadline.Add(-before)) || now.Before(cp.OpensAt) {
+		return nil
+	}
+	logger := loggerFrom(ctx)
+	if !now.Before(cp.Deadline) {
+		logger.Info("Giving up reminder past the deadline", "tagged", cp.ReminderNextIndex, "users", len(cp.ReminderUsernames))
+		cp.ReminderDone = true
+		return s.store.PutCompetitionPost(ctx, p.Namespace, cp)
+	}
+	post, err := s.redditSession.Post(p.Subreddit, cp.PostID)
+	if err != nil {
+		logger.Error("Failed to fetch competition post", "err", err)
+		return s.giveUpReminder(ctx, p, cp, err)
+	}
+	data := newCommentData(p, &post.Submission, 0, now)
+	data.Deadline = cp.Deadline.UTC().Format("Monday, January 2 at 15:04 MST")
+	data.DaysLeft = int(math.Ceil(cp.Deadline.Sub(now).Hours() / 24))
+
+	if cp.ReminderCommentFullID == "" {
+		usernames, err := s.usersToRemind(ctx, p, cp, now)
+		if err != nil {
+			return err
+		}
+		data.SubscriberCount = len(usernames)
+		text, err := p.Calendar.renderReminderComment(data)
+		if err != nil {
+			logger.Error("Failed to render reminder comment", "err", err)
+			return err
+		}
+		comment, err := s.redditSession.Reply(&post.Submission, text)
+		if err != nil {
+			logger.Error("Failed to post reminder comment", "err", err)
+			s.recordComment(p, cp.PostID, "reminder", nil /*usernames*/, err)
+			return s.giveUpReminder(ctx, p, cp, err)
+		}
+		s.recordComment(p, cp.PostID, "reminder", nil /*usernames*/, nil /*err*/)
+		logger.Info("Posted reminder comment", "reminderComment", comment.FullID, "users", len(usernames))
+		cp.ReminderCommentFullID, cp.ReminderUsernames, cp.ReminderNextIndex = comment.FullID, usernames, 0
+		if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+			logger.Error("Failed to save reminder progress", "err", err)
+			return err
+		}
+	}
+
+	end := cp.ReminderNextIndex + s.config.MaxUsersPerSession
+	if end > len(cp.ReminderUsernames) {
+		end = len(cp.ReminderUsernames)
+	}
+	batches, err := s.buildSummonBatches(ctx, p, data, cp.ReminderUsernames[cp.ReminderNextIndex:end])
+	if err != nil {
+		return err
+	}
+	if len(batches) > 0 {
+		parent, err := s.redditSession.Comment(p.Subreddit, cp.ReminderCommentFullID)
+		if err != nil {
+			logger.Error("Failed to fetch reminder comment from Reddit", "reminderComment", cp.ReminderCommentFullID, "err", err)
+			return s.giveUpReminder(ctx, p, cp, err)
+		}
+		for _, batch := range batches {
+			if s.shuttingDown() {
+				return nil
+			}
+			if err := s.renewPostLease(ctx, p, cp.PostID); err != nil {
+				return err
+			}
+			if _, err := s.redditSession.Reply(parent, batch.text); err != nil {
+				logger.Error("Failed to tag subscribers under reminder comment", "err", err)
+				s.recordComment(p, cp.PostID, "reminder", batch.usernames, err)
+				return s.giveUpReminder(ctx, p, cp, err)
+			}
+			s.recordComment(p, cp.PostID, "reminder", batch.usernames, nil /*err*/)
+			cp.ReminderNextIndex += len(batch.usernames)
+			if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+				logger.Error("Failed to save reminder progress", "err", err)
+				return err
+			}
+		}
+	}
+	if cp.ReminderNextIndex < len(cp.ReminderUsernames) {
+		return nil
+	}
+	logger.Info("Reminder is complete", "users", len(cp.ReminderUsernames))
+	cp.ReminderDone = true
+	return s.store.PutCompetitionPost(ctx, p.Namespace, cp)
+}
+
+// giveUpReminder ends the reminder if err says the post or reminder comment was deleted or
+// locked, and otherwise returns err, so that the next run tries again.
+func (s *summoner) giveUpReminder(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost, err error) error {
+	if !isPermanentRedditError(err) {
+		return err
+	}
+	loggerFrom(ctx).Warn("Giving up reminder", "err", err)
+	cp.ReminderDone = true
+	return s.store.PutCompetitionPost(ctx, p.Namespace, cp)
+}
+
+// usersToRemind returns the profile's subscribers who have no valid entry in the competition.
+func (s *summoner) usersToRemind(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost, now time.Time) ([]string, error) {
+	subscribers, err := s.readSubscribers(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := s.redditSession.PostComments(p.Subreddit, cp.PostID)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to list comments on competition post", "err", err)
+		return nil, err
+	}
+	entered := map[string]bool{}
+	for _, e := range s.judgeEntries(p, cp, comments, nil /*previous*/, now) {
+		if e.Valid {
+			entered[subscriptionKeyName(e.Author)] = true
+		}
+	}
+	var usernames []string
+	for _, sub := range subscribers {
+		if !entered[subscriptionKeyName(sub.Username)] {
+			usernames = append(usernames, sub.Username)
+		}
+	}
+	return usernames, nil
+}
+
+// closeCompetition marks the competition closed once voting ended, locking its post if the
+// calendar says to.
+func (s *summoner) closeCompetition(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost) error {
+	logger := loggerFrom(ctx)
+	if p.Calendar.Lock && !cp.Locked {
+		if err := s.redditSession.LockPost(cp.PostID); err != nil {
+			logger.Error("Failed to lock competition post", "err", err)
+			if !isPermanentRedditError(err) {
+				return err
+			}
+		} else {
+			cp.Locked = true
+		}
+	}
+	cp.Closed = true
+	if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+		logger.Error("Failed to save CompetitionPost", "err", err)
+		return err
+	}
+	logger.Info("Closed competition", "votingDeadline", cp.closesAt(), "locked", cp.Locked)
+	return nil
+}
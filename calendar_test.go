@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+func TestCalendarDates(t *testing.T) {
+	jan := &CompetitionDates{
+		Opens:              time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		SubmissionDeadline: time.Date(2026, time.January, 21, 0, 0, 0, 0, time.UTC),
+		VotingDeadline:     time.Date(2026, time.January, 28, 0, 0, 0, 0, time.UTC),
+	}
+	feb := &CompetitionDates{
+		Opens:              time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC),
+		SubmissionDeadline: time.Date(2026, time.February, 21, 0, 0, 0, 0, time.UTC),
+	}
+	c := &CalendarConfig{Competitions: []*CompetitionDates{feb, jan}, VotingPeriod: 3 * 24 * time.Hour}
+	c.applyDefaults()
+	entries := &EntriesConfig{}
+	for _, tc := range []struct {
+		name                            string
+		created                         time.Time
+		opens, deadline, votingDeadline time.Time
+	}{
+		{"made before it opens", time.Date(2025, time.December, 30, 0, 0, 0, 0, time.UTC), jan.Opens, jan.SubmissionDeadline, jan.VotingDeadline},
+		{"made late", time.Date(2026, time.January, 25, 0, 0, 0, 0, time.UTC), feb.Opens, feb.SubmissionDeadline, feb.SubmissionDeadline.Add(c.VotingPeriod)},
+		{"not scheduled", time.Date(2026, time.March, 3, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 3, 0, 0, 0, 0, time.UTC), time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, time.April, 4, 0, 0, 0, 0, time.UTC)},
+	} {
+		opens, deadline, votingDeadline := c.dates(tc.created, entries)
+		if !opens.Equal(tc.opens) || !deadline.Equal(tc.deadline) || !votingDeadline.Equal(tc.votingDeadline) {
+			t.Errorf("%s: dates = %s, %s, %s, want %s, %s, %s", tc.name, opens, deadline, votingDeadline, tc.opens, tc.deadline, tc.votingDeadline)
+		}
+	}
+}
+
+func TestCalendarConfigValidate(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		config  CalendarConfig
+		wantErr bool
+	}{
+		{CalendarConfig{}, false},
+		{CalendarConfig{ReminderBefore: 48 * time.Hour, Lock: true, Competitions: []*CompetitionDates{{Opens: now, SubmissionDeadline: now.Add(time.Hour)}}}, false},
+		{CalendarConfig{VotingPeriod: -time.Hour}, true},
+		{CalendarConfig{Competitions: []*CompetitionDates{{Opens: now}}}, true},
+		{CalendarConfig{Competitions: []*CompetitionDates{{Opens: now, SubmissionDeadline: now.Add(-time.Hour)}}}, true},
+		{CalendarConfig{Competitions: []*CompetitionDates{{Opens: now, SubmissionDeadline: now.Add(2 * time.Hour), VotingDeadline: now.Add(time.Hour)}}}, true},
+	} {
+		if err := tc.config.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("validate(%+v) returned unexpected error: %v", tc.config, err)
+		}
+	}
+}
+
+func TestCompetitionOpensOnSchedule(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	post.DateCreated = float64(time.Now().Unix())
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(2))
+	p := testProfile(s)
+	p.Calendar.Competitions = []*CompetitionDates{{Opens: time.Now().Add(time.Hour), SubmissionDeadline: time.Now().Add(48 * time.Hour)}}
+	fsr := s.redditSession.(*fakeRedditSession)
+	ctx := context.Background()
+
+	report, err := s.checkPosts(ctx)
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if rep := report.profile(p).post(post.FullID); !strings.HasPrefix(rep.Skipped, "opens at") || rep.Competition != competitionScheduled {
+		t.Fatalf("run did not wait for the competition to open: %+v", rep)
+	}
+	if len(fsr.replies) != 0 {
+		t.Fatalf("run summoned to a competition that has not opened: %+v", fsr.replies)
+	}
+
+	// Once the competition opens, subscribers are summoned, though the post is no longer among
+	// the subreddit's newest.
+	fsr.submittions, fsr.older = nil, []*redditPost{post}
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, post.FullID)
+	if err != nil {
+		t.Fatalf("CompetitionPost call failed: %v", err)
+	}
+	cp.OpensAt = time.Now().Add(-time.Minute)
+	if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	if report, err = s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if rep := report.profile(p).post(post.FullID); rep.UsersSummoned != 2 || rep.Competition != competitionOpen {
+		t.Fatalf("run did not summon subscribers once the competition opened: %+v", rep)
+	}
+}
+
+// openCompetition sets up an open competition whose subscribers were summoned, with submissions
+// closing in a day, on a post Post finds.
+func openCompetition(t *testing.T, s *summoner) (*CompetitionProfile, *CompetitionPost) {
+	p := testProfile(s)
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s.redditSession.(*fakeRedditSession).older = []*redditPost{post}
+	now := time.Now().UTC()
+	cp := &CompetitionPost{PostID: post.FullID, Title: post.Title, CreatedAt: now.Add(-time.Hour), OpensAt: now.Add(-time.Hour), Deadline: now.Add(24 * time.Hour), VotingDeadline: now.Add(48 * time.Hour)}
+	if err := s.store.PutCompetitionPost(context.Background(), p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	if err := s.store.UpdatePost(context.Background(), p.Namespace, cp.PostID, &postUpdate{MarkHandled: true}); err != nil {
+		t.Fatalf("UpdatePost call failed: %v", err)
+	}
+	return p, cp
+}
+
+func TestReminder(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(6))
+	p, cp := openCompetition(t, s)
+	p.Calendar.ReminderBefore = 48 * time.Hour
+	fsr := s.redditSession.(*fakeRedditSession)
+	// user-0 entered, and user-1 has yet to link their piece.
+	fsr.comments = map[string][]*geddit.Comment{cp.PostID: {
+		fakeComment("t1_a", "user-0", "https://i.redd.it/zero.jpg", time.Now()),
+		fakeComment("t1_b", "user-1", "Almost done!", time.Now()),
+	}}
+	ctx := context.Background()
+
+	for run := 0; run < 2; run++ {
+		if _, err := s.checkPosts(ctx); err != nil {
+			t.Fatalf("checkPosts call failed: %v", err)
+		}
+	}
+	reminders := fsr.replies[cp.PostID]
+	if len(reminders) != 1 || !strings.Contains(reminders[0], "Only 1 day(s) left") {
+		t.Fatalf("runs posted unexpected reminder comments: %q", reminders)
+	}
+	tags := strings.Join(fsr.replies["uniqueComment"], "\n")
+	if len(fsr.replies["uniqueComment"]) != 2 || strings.Contains(tags, "u/user-0") {
+		t.Fatalf("runs tagged unexpected users under the reminder:\n%s", tags)
+	}
+	for i := 1; i < 6; i++ {
+		if !strings.Contains(tags, fakeUserName(i)) {
+			t.Errorf("reminder did not tag %s:\n%s", fakeUserName(i), tags)
+		}
+	}
+	if cp, err := s.store.CompetitionPost(ctx, p.Namespace, cp.PostID); err != nil || !cp.ReminderDone || cp.ReminderNextIndex != 5 {
+		t.Fatalf("reminder progress was not recorded (got: %+v, %v)", cp, err)
+	}
+}
+
+func TestReminderResumes(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(5))
+	s.config.MaxUsersPerSession = 3
+	p, cp := openCompetition(t, s)
+	p.Calendar.ReminderBefore = 48 * time.Hour
+	fsr := s.redditSession.(*fakeRedditSession)
+	ctx := context.Background()
+
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if cp, _ = s.store.CompetitionPost(ctx, p.Namespace, cp.PostID); cp.ReminderDone || cp.ReminderNextIndex != 3 {
+		t.Fatalf("first run recorded unexpected reminder progress: %+v", cp)
+	}
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if cp, _ = s.store.CompetitionPost(ctx, p.Namespace, cp.PostID); !cp.ReminderDone || cp.ReminderNextIndex != 5 {
+		t.Fatalf("second run recorded unexpected reminder progress: %+v", cp)
+	}
+	if len(fsr.replies[cp.PostID]) != 1 || len(fsr.replies["uniqueComment"]) != 2 {
+		t.Fatalf("runs posted unexpected comments: %+v", fsr.replies)
+	}
+}
+
+func TestCloseCompetition(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p, cp := openCompetition(t, s)
+	p.Calendar.Lock = true
+	cp.Deadline, cp.VotingDeadline = time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	if err := s.store.PutCompetitionPost(context.Background(), p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	fsr := s.redditSession.(*fakeRedditSession)
+
+	for run := 0; run < 2; run++ {
+		report, err := s.checkPosts(context.Background())
+		if err != nil {
+			t.Fatalf("checkPosts call failed: %v", err)
+		}
+		if run == 0 && report.profile(p).post(cp.PostID).Competition != competitionClosed {
+			t.Fatalf("run did not close the competition: %+v", report.profile(p).post(cp.PostID))
+		}
+	}
+	if len(fsr.locked) != 1 || fsr.locked[0] != cp.PostID {
+		t.Fatalf("runs locked unexpected posts: %q", fsr.locked)
+	}
+	if cp, err := s.store.CompetitionPost(context.Background(), p.Namespace, cp.PostID); err != nil || !cp.Closed || !cp.Locked {
+		t.Fatalf("closing was not recorded (got: %+v, %v)", cp, err)
+	}
+}
+
+func TestCalendarCommand(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p, cp := openCompetition(t, s)
+	opens := time.Date(2027, time.February, 1, 0, 0, 0, 0, time.UTC)
+	p.Calendar.Competitions = []*CompetitionDates{{Opens: opens, SubmissionDeadline: opens.AddDate(0, 0, 20)}}
+
+	out, err := runCommand(t, s, "calendar")
+	if err != nil {
+		t.Fatalf("calendar command failed: %v", err)
+	}
+	for _, want := range []string{"Scheduled: 1", "opens 2027-02-01T00:00:00Z", "Competitions: 1", cp.PostID, competitionOpen} {
+		if !strings.Contains(out, want) {
+			t.Errorf("calendar command output lacks %q:\n%s", want, out)
+		}
+	}
+}
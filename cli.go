@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand of the command-line interface.
+type command struct {
+	name string
+	// args describes the command's arguments in the usage message, and nargs counts them.
+	args  string
+	nargs int
+	help  string
+	run   func(c *cli, ctx context.Context, args []string) error
+}
+
+var commands = []*command{
+	{name: "run", help: "check posts once, summoning contestants to competition posts (the default)", run: (*cli).run},
+	{name: "dry-run", help: "print what run would post and write, without doing it", run: (*cli).dryRun},
+	{name: "serve", help: "check posts on a schedule and on request to POST /run, until SIGTERM", run: (*cli).serve},
+	{name: "status", help: "list the posts summoning is in progress for, and the posts already handled", run: (*cli).status},
+	{name: "resume", args: "<postID>", nargs: 1, help: "continue summoning to an in-progress post now", run: (*cli).resume},
+	{name: "reset", args: "<postID>", nargs: 1, help: "clear a post's handled marker and PageToken, so that the next run summons to it\nagain; users already summoned to it are not summoned again", run: (*cli).reset},
+	{name: "subscribers", help: "print each profile's subscribers, with warnings about entries that will be skipped", run: (*cli).subscribers},
+	{name: "calendar", help: "print each profile's scheduled competitions, and the phase and dates of the\ncompetitions it tracks", run: (*cli).calendar},
+	{name: "entries", args: "<postID>", nargs: 1, help: "list the entries collected from a competition post, and whether each is valid", run: (*cli).entries},
+	{name: "results", args: "<postID>", nargs: 1, help: "rank a competition post's entries in each category, and print its winners\nannouncement and how its winners were rewarded", run: (*cli).results},
+	{name: "approve", args: "<postID>", nargs: 1, help: "approve a competition post's drafted winners announcement, so that the next\nrun submits it", run: (*cli).approve},
+	{name: "preview", args: "<postID>", nargs: 1, help: "print whether a post is a competition post, and the comments the next run\nwould post to it", run: (*cli).preview},
+}
+
+// usage prints the usage message of the command-line interface.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: crossstitch-bot [flags] [command] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		name := strings.TrimSpace(cmd.name + " " + cmd.args)
+		fmt.Fprintf(w, "  %-18s %s\n", name, strings.ReplaceAll(cmd.help, "\n", "\n"+strings.Repeat(" ", 21)))
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommand returns the command named by the command-line arguments, run by default, and the
+// command's own arguments. The -dry-run flag turns run into dry-run.
+func parseCommand(args []string, dryRun bool) (*command, []string, error) {
+	name := "run"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if dryRun {
+		if name != "run" {
+			return nil, nil, fmt.Errorf("-dry-run cannot be used with %s", name)
+		}
+		name = "dry-run"
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if len(args) != cmd.nargs {
+			return nil, nil, fmt.Errorf("%s takes %d argument(s), got %d", name, cmd.nargs, len(args))
+		}
+		return cmd, args, nil
+	}
+	return nil, nil, fmt.Errorf("unknown command %q", name)
+}
+
+// cli runs commands with a summoner, writing their output to out.
+type cli struct {
+	s *summoner
+	// profile, if set, names the only profile commands act on.
+	profile string
+	out     io.Writer
+}
+
+// profiles returns the profiles commands act on.
+func (c *cli) profiles() ([]*CompetitionProfile, error) {
+	return c.s.profilesNamed(c.profile)
+}
+
+// checkPosts checks the posts of every profile, or, with -profile, only those of the named
+// profile. A profile summoning to winners posts is checked along with the profile whose
+// winners they are. The inbox is only checked when every profile is.
+func (c *cli) checkPosts(ctx context.Context) (*runReport, error) {
+	if c.profile == "" {
+		return c.s.checkPosts(ctx)
+	}
+	named, err := c.profiles()
+	if err != nil {
+		return nil, err
+	}
+	var profiles []*CompetitionProfile
+	for _, p := range named {
+		if p.resultsOf != nil {
+			p = p.resultsOf
+		}
+		if len(profiles) == 0 || profiles[len(profiles)-1] != p {
+			profiles = append(profiles, p)
+		}
+	}
+	return c.s.checkProfiles(ctx, profiles, false /*inbox*/)
+}
+
+func (c *cli) run(ctx context.Context, args []string) error {
+	_, err := c.checkPosts(ctx)
+	// Flush the run's metrics even if it failed, since failures are what they are for.
+	if flushErr := flushMetrics(ctx, c.s.config.Metrics); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func (c *cli) dryRun(ctx context.Context, args []string) error {
+	plan := c.s.enableDryRun()
+	_, err := c.checkPosts(ctx)
+	// Print the plan even if the run failed, to show what it would have done up to the failure.
+	if printErr := plan.print(c.out); err == nil {
+		err = printErr
+	}
+	return err
+}
+
+func (c *cli) serve(ctx context.Context, args []string) error {
+	ln, err := net.Listen("tcp", c.s.config.Serve.Addr)
+	if err != nil {
+		return err
+	}
+	return newDaemon(c.s, c.s.config.Serve).serve(ctx, ln)
+}
+
+func (c *cli) status(ctx context.Context, args []string) error {
+	profiles, err := c.profiles()
+	if err != nil {
+		return err
+	}
+	for i, p := range profiles {
+		if i > 0 {
+			fmt.Fprintln(c.out)
+		}
+		status, err := c.s.profileStatus(ctx, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Profile %s (r/%s, namespace %q)\n", p.Name, p.Subreddit, p.Namespace)
+		fmt.Fprintf(c.out, "In progress: %d\n", len(status.InProgress))
+		tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		for _, post := range status.InProgress {
+			total := "?"
+			if post.Subscribers >= 0 {
+				total = fmt.Sprint(post.Subscribers)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\tnext user %d of %s\tlast user %s\tmain comment %s\n",
+				post.PostID, post.Phase, post.NextIndex, total, orNone(post.LastProcessedUser), orNone(post.MainCommentFullID))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Handled: %d\n", len(status.Handled))
+		for _, postID := range status.Handled {
+			fmt.Fprintf(c.out, "  %s\n", postID)
+		}
+	}
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+func (c *cli) resume(ctx context.Context, args []string) error {
+	postID := postFullID(args[0])
+	p, err := c.s.inProgressProfile(ctx, c.profile, postID)
+	if err != nil {
+		return err
+	}
+	return c.s.handlePageToken(ctx, p, postID)
+}
+
+func (c *cli) reset(ctx context.Context, args []string) error {
+	postID := postFullID(args[0])
+	p, err := c.s.storedPostProfile(ctx, c.profile, postID)
+	if err != nil {
+		return err
+	}
+	if err := c.s.resetPost(ctx, p, postID); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Reset post %s of profile %s; the next run will summon to it again.\n", postID, p.Name)
+	return nil
+}
+
+func (c *cli) subscribers(ctx context.Context, args []string) error {
+	profiles, err := c.profiles()
+	if err != nil {
+		return err
+	}
+	for i, p := range profiles {
+		if i > 0 {
+			fmt.Fprintln(c.out)
+		}
+		subscribers, err := c.s.readSubscribers(ctx, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Profile %s: %d subscriber(s)\n", p.Name, len(subscribers))
+		for _, sub := range subscribers {
+			fmt.Fprintf(c.out, "  %s\n", sub.Username)
+		}
+		for _, warning := range subscriberWarnings(subscribers) {
+			fmt.Fprintf(c.out, "Warning: %s\n", warning)
+		}
+	}
+	return nil
+}
+
+func (c *cli) calendar(ctx context.Context, args []string) error {
+	profiles, err := c.profiles()
+	if err != nil {
+		return err
+	}
+	for i, p := range profiles {
+		if i > 0 {
+			fmt.Fprintln(c.out)
+		}
+		cal, err := c.s.profileCalendar(ctx, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Profile %s\n", p.Name)
+		fmt.Fprintf(c.out, "Scheduled: %d\n", len(cal.Scheduled))
+		tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		for _, d := range cal.Scheduled {
+			voting := "(after votingPeriod)"
+			if !d.VotingDeadline.IsZero() {
+				voting = d.VotingDeadline.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "  opens %s\tsubmissions until %s\tvoting until %s\n", d.Opens.Format(time.RFC3339), d.SubmissionDeadline.Format(time.RFC3339), voting)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Competitions: %d\n", len(cal.Competitions))
+		for _, cs := range cal.Competitions {
+			fmt.Fprintf(tw, "  %s\t%s\topens %s\tsubmissions until %s\tvoting until %s\t%q\n", cs.PostID, cs.Phase,
+				cs.OpensAt.Format(time.RFC3339), cs.Deadline.Format(time.RFC3339), cs.closesAt().Format(time.RFC3339), cs.Title)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) entries(ctx context.Context, args []string) error {
+	postID := postFullID(args[0])
+	p, err := c.s.competitionPostProfile(ctx, c.profile, postID)
+	if err != nil {
+		return err
+	}
+	pe, err := c.s.postEntries(ctx, p, postID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Post %s %q of profile %s: submissions until %s, %s\n", postID, pe.Post.Title, p.Name, pe.Post.Deadline.Format(time.RFC1123), pe.Post.phase(time.Now()))
+	fmt.Fprintf(c.out, "Entries: %d\n", len(pe.Entries))
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	for _, e := range pe.Entries {
+		verdict := "valid"
+		if !e.Valid {
+			verdict = "invalid: " + e.Problem
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\tscore %d\t%s\t%s\n",
+			e.CommentFullID, e.Author, e.SubmittedAt.Format(time.RFC3339), e.Score, verdict, orNone(strings.Join(e.ImageURLs, " ")))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) results(ctx context.Context, args []string) error {
+	postID := postFullID(args[0])
+	p, err := c.s.competitionPostProfile(ctx, c.profile, postID)
+	if err != nil {
+		return err
+	}
+	results, err := c.s.postResults(ctx, p, postID)
+	if err != nil {
+		return err
+	}
+	scores := "scores when entries were last collected"
+	if results.Post.Closed {
+		scores = "scores when votes were tallied"
+	}
+	fmt.Fprintf(c.out, "Results of post %s %q of profile %s, by %s\n", postID, results.Post.Title, p.Name, scores)
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	for _, cat := range results.Categories {
+		fmt.Fprintf(tw, "\n%s: %d entries\n", cat.Name, len(cat.Ranked))
+		for _, r := range cat.Ranked {
+			place := r.Place
+			if r.Tied {
+				place += " (tied)"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\tscore %d\t%s\n", place, r.Author, r.Score, orNone(r.Link))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	a := results.Announcement
+	if a == nil {
+		fmt.Fprintln(c.out, "\nNo winners announcement was drafted; one is once votes are tallied.")
+		return nil
+	}
+	fmt.Fprintf(c.out, "\nWinners announcement (%s", a.Status)
+	if a.SubmittedPostID != "" {
+		fmt.Fprintf(c.out, " as %s", a.SubmittedPostID)
+	}
+	fmt.Fprintf(c.out, "):\n%s\n\n%s\n", indent(a.Title), indent(a.Text))
+	if a.Error != "" {
+		fmt.Fprintf(c.out, "\nSubmitting it last failed: %s\n", a.Error)
+	}
+	if len(results.Awards) == 0 {
+		return nil
+	}
+	fmt.Fprintf(c.out, "\nWinners rewarded: %d\n", len(results.Awards))
+	tw = tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	for _, award := range results.Awards {
+		message, flair := "not messaged", "no flair"
+		switch {
+		case award.MessageError != "":
+			message = "message failed: " + award.MessageError
+		case !award.MessagedAt.IsZero():
+			message = "messaged " + award.MessagedAt.Format(time.RFC3339)
+		}
+		switch {
+		case award.FlairError != "":
+			flair = "flair failed: " + award.FlairError
+		case !award.FlairedAt.IsZero():
+			flair = fmt.Sprintf("flair %q", award.Flair)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", award.Username, strings.Join(award.Places, ", "), message, flair)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) approve(ctx context.Context, args []string) error {
+	postID := postFullID(args[0])
+	p, err := c.s.competitionPostProfile(ctx, c.profile, postID)
+	if err != nil {
+		return err
+	}
+	a, err := c.s.approveAnnouncement(ctx, p, postID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Approved the winners announcement %q of post %s; the next run will submit it.\n", a.Title, postID)
+	return nil
+}
+
+func (c *cli) preview(ctx context.Context, args []string) error {
+	p, post, err := c.s.redditPostProfile(c.profile, postFullID(args[0]))
+	if err != nil {
+		return err
+	}
+	preview, err := c.s.previewPost(ctx, p, post)
+	if err != nil {
+		return err
+	}
+	verdict := "is not"
+	if preview.Matched {
+		verdict = "is"
+	}
+	fmt.Fprintf(c.out, "Post %s %q %s a competition post of profile %s:\n%s\n", post.FullID, post.Title, verdict, p.Name, indent(preview.Explanation))
+	if preview.MainComment != "" {
+		fmt.Fprintf(c.out, "\nMain comment:\n%s\n", indent(preview.MainComment))
+	}
+	for i, text := range preview.SummonComments {
+		fmt.Fprintf(c.out, "\nSummon comment %d of %d:\n%s\n", i+1, len(preview.SummonComments), indent(text))
+	}
+	if len(preview.SummonComments) == 0 {
+		fmt.Fprintln(c.out, "\nNo one is left to summon.")
+	}
+	return nil
+}
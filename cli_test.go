@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		dryRun   bool
+		wantName string
+		wantErr  bool
+	}{
+		{args: nil, wantName: "run"},
+		{args: nil, dryRun: true, wantName: "dry-run"},
+		{args: []string{"run"}, dryRun: true, wantName: "dry-run"},
+		{args: []string{"status"}, wantName: "status"},
+		{args: []string{"resume", "t3_12345"}, wantName: "resume"},
+		{args: []string{"resume"}, wantErr: true},
+		{args: []string{"status", "extra"}, wantErr: true},
+		{args: []string{"serve"}, dryRun: true, wantErr: true},
+		{args: []string{"unknown"}, wantErr: true},
+	} {
+		cmd, _, err := parseCommand(tc.args, tc.dryRun)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseCommand(%q, %t) did not fail", tc.args, tc.dryRun)
+			}
+			continue
+		}
+		if err != nil || cmd.name != tc.wantName {
+			t.Errorf("parseCommand(%q, %t) returned unexpected command (got: %v, %v, want: %s)", tc.args, tc.dryRun, cmd, err, tc.wantName)
+		}
+	}
+}
+
+// runCommand runs a command with the CLI's summoner, returning its output.
+func runCommand(t *testing.T, s *summoner, args ...string) (string, error) {
+	cmd, args, err := parseCommand(args, false /*dryRun*/)
+	if err != nil {
+		t.Fatalf("parseCommand call failed: %v", err)
+	}
+	var out bytes.Buffer
+	err = cmd.run(&cli{s: s, out: &out}, context.Background(), args)
+	return out.String(), err
+}
+
+// startSummoning leaves a post part-way through summoning, with the first summon comment posted.
+func startSummoning(t *testing.T, s *summoner, post *redditPost) {
+	p := testProfile(s)
+	shutdown := make(chan struct{})
+	s.shutdown = shutdown
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.failReply = func(comment string) bool {
+		if strings.HasPrefix(comment, "Summoning") {
+			close(shutdown)
+			fsr.failReply = nil
+		}
+		return false
+	}
+	if err := s.handlePossibleCompetitionPost(context.Background(), p, post); err != nil {
+		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
+	}
+	s.shutdown = nil
+}
+
+func TestStatusCommand(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(2*defaultMaxRedditTagsPerComment))
+	startSummoning(t, s, post)
+
+	out, err := runCommand(t, s, "status")
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	for _, want := range []string{
+		"In progress: 1",
+		fmt.Sprintf("t3_12345  batches-in-progress  next user %d of %d  last user %s  main comment uniqueComment",
+			defaultMaxRedditTagsPerComment, 2*defaultMaxRedditTagsPerComment, fakeUserName(defaultMaxRedditTagsPerComment-1)),
+		"Handled: 1\n  t3_12345",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("status output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestResumeCommand(t *testing.T) {
+	const numUsers = 2 * defaultMaxRedditTagsPerComment
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	users := generateFakeUsers(numUsers)
+	s := fakeSummoner(nil /*redditSubmissions*/, users)
+	startSummoning(t, s, post)
+
+	if _, err := runCommand(t, s, "resume", "12345"); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	counts := summonedUsers(s.redditSession.(*fakeRedditSession))
+	for _, user := range users {
+		if counts[user] != 1 {
+			t.Errorf("user %s was summoned %d times, want 1", user, counts[user])
+		}
+	}
+	if _, err := runCommand(t, s, "resume", "t3_67890"); err == nil {
+		t.Fatal("resume did not fail for a post with no PageToken")
+	}
+}
+
+func TestResetCommand(t *testing.T) {
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(2*defaultMaxRedditTagsPerComment))
+	p := testProfile(s)
+	startSummoning(t, s, post)
+
+	// Another run is handling the post.
+	now := time.Now()
+	if _, err := s.store.AcquireLease(ctx, p.Namespace, post.FullID, "other-run", now, time.Minute); err != nil {
+		t.Fatalf("AcquireLease call failed: %v", err)
+	}
+	if _, err := runCommand(t, s, "reset", post.FullID); err == nil {
+		t.Fatal("reset did not fail for a post leased to another run")
+	}
+	if err := s.store.ReleaseLease(ctx, p.Namespace, post.FullID, "other-run"); err != nil {
+		t.Fatalf("ReleaseLease call failed: %v", err)
+	}
+
+	if _, err := runCommand(t, s, "reset", post.FullID); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	if _, err := s.store.PageToken(ctx, p.Namespace, post.FullID); err != errNotFound {
+		t.Fatalf("reset did not delete the PageToken: %v", err)
+	}
+	if handled, err := s.store.IsHandled(ctx, p.Namespace, post.FullID); err != nil || handled {
+		t.Fatalf("reset did not clear the handled marker (got: %t, %v)", handled, err)
+	}
+	// The ledger is kept, so users already summoned are not summoned again.
+	if records, err := s.store.SummonRecords(ctx, p.Namespace, post.FullID); err != nil || len(records) != defaultMaxRedditTagsPerComment {
+		t.Fatalf("reset did not keep the summon ledger (got: %d records, %v)", len(records), err)
+	}
+}
+
+func TestRunCommandActsOnlyOnProfile(t *testing.T) {
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(defaultMaxRedditTagsPerComment))
+	embroidery := *testProfile(s)
+	embroidery.Name, embroidery.Namespace, embroidery.Subreddit = "embroidery", "embroidery", "Embroidery"
+	s.config.Profiles = append(s.config.Profiles, &embroidery)
+
+	var out bytes.Buffer
+	if err := (&cli{s: s, profile: "embroidery", out: &out}).run(ctx, nil /*args*/); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if handled, err := s.store.IsHandled(ctx, embroidery.Namespace, post.FullID); err != nil || !handled {
+		t.Fatalf("run did not handle the post for the selected profile (got: %t, %v)", handled, err)
+	}
+	if handled, err := s.store.IsHandled(ctx, testProfile(s).Namespace, post.FullID); err != nil || handled {
+		t.Fatalf("run handled the post for a profile that was not selected (got: %t, %v)", handled, err)
+	}
+}
+
+func TestDryRunCommandPrintsPlanOnFailure(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, nil /*subscribers*/)
+	testProfile(s).Subscribers = SubscriberSourceConfig{Type: subscriberSourceFile, Path: t.TempDir() + "/missing.csv"}
+
+	var out bytes.Buffer
+	if err := (&cli{s: s, out: &out}).dryRun(context.Background(), nil /*args*/); err == nil {
+		t.Fatal("dry-run did not fail when the subscribers could not be read")
+	}
+	if want := "Matched competition post t3_12345"; !strings.Contains(out.String(), want) {
+		t.Fatalf("dry-run output does not contain %q:\n%s", want, out.String())
+	}
+}
+
+func TestSubscribersCommand(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, []string{"u/stitcher", "u/Stitcher", "u/x", "nobody"})
+
+	out, err := runCommand(t, s, "subscribers")
+	if err != nil {
+		t.Fatalf("subscribers failed: %v", err)
+	}
+	for _, want := range []string{"u/stitcher", "u/x", "nobody", "Warning:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("subscribers output does not contain %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "Warning:"); n != 3 {
+		t.Errorf("subscribers printed unexpected number of warnings (got: %d, want: 3):\n%s", n, out)
+	}
+}
+
+func TestPreviewCommand(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(defaultMaxRedditTagsPerComment+1))
+	post.Subreddit = testProfile(s).Subreddit
+
+	out, err := runCommand(t, s, "preview", "12345")
+	if err != nil {
+		t.Fatalf("preview failed: %v", err)
+	}
+	for _, want := range []string{"is a competition post", "Main comment:", "Summon comment 1 of 2:", "Summon comment 2 of 2:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("preview output does not contain %q:\n%s", want, out)
+		}
+	}
+	// Nothing was posted or saved.
+	if fsr := s.redditSession.(*fakeRedditSession); fsr.numComments != 0 {
+		t.Fatalf("preview made %d comments", fsr.numComments)
+	}
+	if handled, err := s.store.IsHandled(context.Background(), testProfile(s).Namespace, post.FullID); err != nil || handled {
+		t.Fatalf("preview marked the post handled (got: %t, %v)", handled, err)
+	}
+
+	if _, err := runCommand(t, s, "preview", "t3_67890"); err == nil {
+		t.Fatal("preview did not fail for a post that does not exist")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvVar names the environment variable holding the path of the config file.
+const configEnvVar = "CROSSSTITCH_BOT_CONFIG"
+
+// Default values, used for any setting the config file and environment leave unset.
+const (
+	defaultRedditClientID = "Kkfhbwt2W5C0Rw"
+	defaultRedditUsername = "CrossStitchBot"
+
+	defaultGoogleCloudProjectID  = "crossstitch-bot-1569769426365"
+	defaultGoogleCredentialsFile = "crossstitch-bot-1569769426365-7aaa0bc7606d.json"
+
+	defaultMaxUsersPerSession      = 48
+	defaultMaxRedditTagsPerComment = 3
+
+	defaultSubreddit  = "CrossStitch"
+	defaultSheetID    = "1BgsXzNY1L4cevQllAblDgCffO7DGNp0eOW4Bs1qbiMA"
+	defaultSheetRange = "SignedUp!A2:A"
+)
+
+// Reddit only notifies the first three users tagged in a single comment.
+const redditMaxNotifiedTags = 3
+
+// Config describes a deployment of the bot. It is read from a YAML (or JSON) file,
+// and any field may be overridden by its environment variable.
+type Config struct {
+	RedditClientID string `yaml:"redditClientID"`
+	RedditUsername string `yaml:"redditUsername"`
+
+	GoogleCloudProjectID  string `yaml:"googleCloudProjectID"`
+	GoogleCredentialsFile string `yaml:"googleCredentialsFile"`
+
+	MaxUsersPerSession      int `yaml:"maxUsersPerSession"`
+	MaxRedditTagsPerComment int `yaml:"maxRedditTagsPerComment"`
+
+	// Store selects where the bot keeps its state.
+	Store StoreConfig `yaml:"store"`
+	// Serve configures serve mode.
+	Serve ServeConfig `yaml:"serve"`
+	// Log configures the bot's logs.
+	Log LogConfig `yaml:"log"`
+	// Metrics configures where the metrics of one-shot runs are flushed to.
+	Metrics MetricsConfig `yaml:"metrics"`
+	// Admin configures how requests to the admin API and to trigger runs are authenticated.
+	Admin AdminConfig `yaml:"admin"`
+	// Notifications lists where moderators are notified of failures and finished summoning.
+	Notifications []*NotifierConfig `yaml:"notifications"`
+
+	// Profiles lists the competitions the bot runs, each in its own subreddit.
+	Profiles []*CompetitionProfile `yaml:"profiles"`
+}
+
+// CompetitionProfile describes one community's monthly competition.
+type CompetitionProfile struct {
+	// Name identifies the profile in logs.
+	Name string `yaml:"name"`
+	// Namespace is the Datastore namespace holding the profile's state. It must be unique
+	// across profiles; at most one profile may use the default (empty) namespace.
+	Namespace string `yaml:"namespace"`
+	Subreddit string `yaml:"subreddit"`
+
+	// Detection decides which posts are the profile's competition posts.
+	Detection *DetectionRule `yaml:"detection"`
+
+	// Subscribers selects where the list of users to summon comes from.
+	Subscribers SubscriberSourceConfig `yaml:"subscribers"`
+	// RedditSubscriptions is "off" (the default), "merge" or "replace", and controls whether
+	// users can subscribe with Reddit commands, and how those subscriptions combine with Subscribers.
+	RedditSubscriptions string `yaml:"redditSubscriptions"`
+
+	// MainComment is the template of the comment under which subscribers are summoned, and
+	// SummonComment that of each reply tagging subscribers. Both are Go text/templates,
+	// executed with the fields of commentData, e.g. {{.Month}}, {{.Theme}} and {{.Mentions}}.
+	MainComment   string `yaml:"mainComment"`
+	SummonComment string `yaml:"summonComment"`
+	// FormURL is the link to the subscription form, available to templates as {{.FormURL}}.
+	FormURL string `yaml:"formURL"`
+	// ThemeRegex extracts {{.Theme}} from the post title, from its "theme" group if it has one.
+	ThemeRegex string `yaml:"themeRegex"`
+
+	// Entries configures collecting competition entries from the comments on competition posts.
+	Entries EntriesConfig `yaml:"entries"`
+	// Results configures tallying votes on entries and announcing the winners.
+	Results ResultsConfig `yaml:"results"`
+	// Calendar schedules when competitions open, when subscribers are reminded, and when they close.
+	Calendar CalendarConfig `yaml:"calendar"`
+	// Winners configures messaging the winners of competitions and setting their flair.
+	Winners WinnersConfig `yaml:"winners"`
+	// ResultsSubscription configures summoning the users who opted in to results to winners posts.
+	ResultsSubscription ResultsSubscriptionConfig `yaml:"resultsSubscription"`
+
+	mainCommentTemplate   *template.Template
+	summonCommentTemplate *template.Template
+	themeRegex            *regexp.Regexp
+	// resultsOf is the profile whose winners posts this profile summons to, if it does.
+	resultsOf *CompetitionProfile
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{
+		RedditClientID:          defaultRedditClientID,
+		RedditUsername:          defaultRedditUsername,
+		GoogleCloudProjectID:    defaultGoogleCloudProjectID,
+		GoogleCredentialsFile:   defaultGoogleCredentialsFile,
+		MaxUsersPerSession:      defaultMaxUsersPerSession,
+		MaxRedditTagsPerComment: defaultMaxRedditTagsPerComment,
+		Profiles: []*CompetitionProfile{
+			{
+				Name:      defaultSubreddit,
+				Subreddit: defaultSubreddit,
+				Subscribers: SubscriberSourceConfig{
+					SheetID: defaultSheetID,
+				},
+			},
+		},
+	}
+	cfg.Store.applyDefaults()
+	cfg.Serve.applyDefaults()
+	cfg.Log.applyDefaults()
+	for _, p := range cfg.Profiles {
+		p.applyDefaults()
+		if err := p.compileTemplates(cfg.MaxRedditTagsPerComment); err != nil {
+			panic(fmt.Sprintf("invalid default comment templates: %v", err))
+		}
+	}
+	return cfg
+}
+
+// applyDefaults fills in the unset optional fields of the profile.
+func (p *CompetitionProfile) applyDefaults() {
+	if p.Name == "" {
+		p.Name = p.Subreddit
+	}
+	if p.Detection == nil {
+		p.Detection = defaultDetectionRule()
+	}
+	p.Subscribers.applyDefaults()
+	if p.RedditSubscriptions == "" {
+		p.RedditSubscriptions = redditSubscriptionsOff
+	}
+	if p.MainComment == "" {
+		p.MainComment = defaultMainComment
+	}
+	if p.SummonComment == "" {
+		p.SummonComment = defaultSummonComment
+	}
+	if p.FormURL == "" {
+		p.FormURL = defaultFormURL
+	}
+	if p.ThemeRegex == "" {
+		p.ThemeRegex = defaultThemeRegex
+	}
+	p.Entries.applyDefaults()
+	p.Results.applyDefaults()
+	p.Calendar.applyDefaults()
+	p.Winners.applyDefaults()
+	p.ResultsSubscription.applyDefaults()
+}
+
+// validate checks the profile, and compiles its rules and templates. maxTags is the most users
+// a summon comment may tag.
+func (p *CompetitionProfile) validate(maxTags int) error {
+	var errs []error
+	if p.Subreddit == "" {
+		errs = append(errs, errors.New("subreddit must be set"))
+	}
+	if err := p.Detection.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("detection: %w", err))
+	}
+	// Subscribers are not read at all when replaced by Reddit subscriptions.
+	if p.RedditSubscriptions != redditSubscriptionsReplace {
+		if err := p.Subscribers.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("subscribers: %w", err))
+		}
+	}
+	switch p.RedditSubscriptions {
+	case redditSubscriptionsOff, redditSubscriptionsMerge, redditSubscriptionsReplace:
+	default:
+		errs = append(errs, fmt.Errorf("redditSubscriptions must be %q, %q or %q, got %q",
+			redditSubscriptionsOff, redditSubscriptionsMerge, redditSubscriptionsReplace, p.RedditSubscriptions))
+	}
+	if err := p.compileTemplates(maxTags); err != nil {
+		errs = append(errs, err)
+	}
+	if err := p.Entries.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("entries: %w", err))
+	}
+	if err := p.Results.validate(&p.Entries); err != nil {
+		errs = append(errs, fmt.Errorf("results: %w", err))
+	}
+	if err := p.Calendar.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("calendar: %w", err))
+	}
+	if err := p.Winners.validate(&p.Results); err != nil {
+		errs = append(errs, fmt.Errorf("winners: %w", err))
+	}
+	if err := p.ResultsSubscription.validate(p); err != nil {
+		errs = append(errs, fmt.Errorf("resultsSubscription: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// loadConfig builds the bot configuration from the defaults, the file at path (if any) and
+// the environment, in increasing order of precedence. The result is validated before it is returned.
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := parseConfig(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+	if err := applyEnvOverrides(cfg, lookupEnv); err != nil {
+		return nil, err
+	}
+	cfg.Store.applyDefaults()
+	cfg.Serve.applyDefaults()
+	cfg.Log.applyDefaults()
+	for _, p := range cfg.Profiles {
+		p.applyDefaults()
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// parseConfig decodes YAML (or JSON, which YAML accepts) on top of the values already in cfg.
+// Unknown fields are rejected so that typos do not go unnoticed.
+func parseConfig(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// applyEnvOverrides replaces config values with those of any environment variables that are set.
+func applyEnvOverrides(cfg *Config, lookupEnv func(string) (string, bool)) error {
+	stringVars := map[string]*string{
+		"CROSSSTITCH_REDDIT_CLIENT_ID":        &cfg.RedditClientID,
+		"CROSSSTITCH_REDDIT_USERNAME":         &cfg.RedditUsername,
+		"CROSSSTITCH_GOOGLE_CLOUD_PROJECT_ID": &cfg.GoogleCloudProjectID,
+		"CROSSSTITCH_GOOGLE_CREDENTIALS_FILE": &cfg.GoogleCredentialsFile,
+		"CROSSSTITCH_STORE_TYPE":              &cfg.Store.Type,
+		"CROSSSTITCH_STORE_PATH":              &cfg.Store.Path,
+		"CROSSSTITCH_SERVE_ADDR":              &cfg.Serve.Addr,
+		"CROSSSTITCH_LOG_LEVEL":               &cfg.Log.Level,
+		"CROSSSTITCH_LOG_FORMAT":              &cfg.Log.Format,
+		"CROSSSTITCH_METRICS_FILE":            &cfg.Metrics.File,
+		"CROSSSTITCH_METRICS_PUSH_URL":        &cfg.Metrics.PushURL,
+		"CROSSSTITCH_ADMIN_TOKEN":             &cfg.Admin.Token,
+		"CROSSSTITCH_ADMIN_SIGNING_KEY":       &cfg.Admin.SigningKey,
+	}
+	for name, field := range stringVars {
+		if v, ok := lookupEnv(name); ok {
+			*field = v
+		}
+	}
+
+	intVars := map[string]*int{
+		"CROSSSTITCH_MAX_USERS_PER_SESSION":       &cfg.MaxUsersPerSession,
+		"CROSSSTITCH_MAX_REDDIT_TAGS_PER_COMMENT": &cfg.MaxRedditTagsPerComment,
+	}
+	for name, field := range intVars {
+		if v, ok := lookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("environment variable %s must be an integer, got %q", name, v)
+			}
+			*field = n
+		}
+	}
+
+	// These predate profiles, and override the settings of the first one, which by default is
+	// the only one.
+	profileVars := map[string]func(p *CompetitionProfile) *string{
+		"CROSSSTITCH_SUBREDDIT":                   func(p *CompetitionProfile) *string { return &p.Subreddit },
+		"CROSSSTITCH_GOOGLE_COMPETITION_SHEET_ID": func(p *CompetitionProfile) *string { return &p.Subscribers.SheetID },
+	}
+	for name, field := range profileVars {
+		if v, ok := lookupEnv(name); ok {
+			if len(cfg.Profiles) == 0 {
+				return fmt.Errorf("environment variable %s is set, but there is no profile for it to apply to", name)
+			}
+			*field(cfg.Profiles[0]) = v
+		}
+	}
+
+	durationVars := map[string]*time.Duration{
+		"CROSSSTITCH_SERVE_INTERVAL":         &cfg.Serve.Interval,
+		"CROSSSTITCH_SERVE_SHUTDOWN_TIMEOUT": &cfg.Serve.ShutdownTimeout,
+	}
+	for name, field := range durationVars {
+		if v, ok := lookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("environment variable %s must be a duration, got %q", name, v)
+			}
+			*field = d
+		}
+	}
+	return nil
+}
+
+// validate reports every problem with the config, not just the first one.
+func (c *Config) validate() error {
+	var errs []error
+	required := []struct {
+		name, value string
+	}{
+		{"redditClientID", c.RedditClientID},
+		{"redditUsername", c.RedditUsername},
+		{"googleCloudProjectID", c.GoogleCloudProjectID},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", r.name))
+		}
+	}
+	if err := c.Store.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Serve.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Log.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for i, n := range c.Notifications {
+		if err := n.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("notification %d: %w", i, err))
+		}
+	}
+	if c.MaxUsersPerSession < 1 {
+		errs = append(errs, fmt.Errorf("maxUsersPerSession must be positive, got %d", c.MaxUsersPerSession))
+	}
+	if c.MaxRedditTagsPerComment < 1 || c.MaxRedditTagsPerComment > redditMaxNotifiedTags {
+		errs = append(errs, fmt.Errorf("maxRedditTagsPerComment must be between 1 and %d, got %d", redditMaxNotifiedTags, c.MaxRedditTagsPerComment))
+	}
+	if len(c.Profiles) == 0 {
+		errs = append(errs, errors.New("at least one profile must be configured"))
+	}
+	namespaces := map[string]string{}
+	for i, p := range c.Profiles {
+		if err := p.validate(c.MaxRedditTagsPerComment); err != nil {
+			errs = append(errs, fmt.Errorf("profile %d (%s): %w", i, p.Name, err))
+		}
+		for _, sp := range []*CompetitionProfile{p, p.resultsProfile()} {
+			if sp == nil {
+				continue
+			}
+			if other, ok := namespaces[sp.Namespace]; ok {
+				errs = append(errs, fmt.Errorf("profiles %s and %s share namespace %q", other, sp.Name, sp.Namespace))
+			}
+			namespaces[sp.Namespace] = sp.Name
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fakeEnv(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig("" /*path*/, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Fatalf("loadConfig returned unexpected config (got: %+v, want: %+v)", cfg, defaultConfig())
+	}
+}
+
+func TestLoadConfigYAMLFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "redditUsername: EmbroideryBot\nmaxUsersPerSession: 12\n")
+	cfg, err := loadConfig(path, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if cfg.RedditUsername != "EmbroideryBot" || cfg.MaxUsersPerSession != 12 {
+		t.Fatalf("loadConfig did not apply file values: %+v", cfg)
+	}
+	if cfg.RedditClientID != defaultRedditClientID {
+		t.Fatalf("loadConfig did not keep default for unset field (got: %s, want: %s)", cfg.RedditClientID, defaultRedditClientID)
+	}
+}
+
+func TestLoadConfigJSONFile(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"redditUsername": "EmbroideryBot", "maxRedditTagsPerComment": 2}`)
+	cfg, err := loadConfig(path, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if cfg.RedditUsername != "EmbroideryBot" || cfg.MaxRedditTagsPerComment != 2 {
+		t.Fatalf("loadConfig did not apply file values: %+v", cfg)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "redditUsername: EmbroideryBot\n")
+	cfg, err := loadConfig(path, fakeEnv(map[string]string{
+		"CROSSSTITCH_REDDIT_USERNAME":       "TestBot",
+		"CROSSSTITCH_MAX_USERS_PER_SESSION": "6",
+	}))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if cfg.RedditUsername != "TestBot" || cfg.MaxUsersPerSession != 6 {
+		t.Fatalf("loadConfig did not apply environment overrides: %+v", cfg)
+	}
+}
+
+func TestLoadConfigEnvOverridesFirstProfile(t *testing.T) {
+	cfg, err := loadConfig("" /*path*/, fakeEnv(map[string]string{
+		"CROSSSTITCH_SUBREDDIT":                   "Embroidery",
+		"CROSSSTITCH_GOOGLE_COMPETITION_SHEET_ID": "sheet-1",
+	}))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if p := cfg.Profiles[0]; p.Subreddit != "Embroidery" || p.Subscribers.SheetID != "sheet-1" {
+		t.Fatalf("loadConfig did not apply environment overrides to the first profile: %+v", p)
+	}
+
+	path := writeConfigFile(t, "config.yaml", "profiles: []\n")
+	if _, err := loadConfig(path, fakeEnv(map[string]string{"CROSSSTITCH_SUBREDDIT": "Embroidery"})); err == nil {
+		t.Fatal("loadConfig ignored an environment override with no profile to apply to")
+	}
+}
+
+func TestLoadConfigRejectsUnknownField(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "redditUsernme: EmbroideryBot\n")
+	if _, err := loadConfig(path, fakeEnv(nil)); err == nil {
+		t.Fatal("loadConfig accepted a config file with an unknown field")
+	}
+}
+
+func TestLoadConfigRejectsNonIntegerEnv(t *testing.T) {
+	if _, err := loadConfig("" /*path*/, fakeEnv(map[string]string{"CROSSSTITCH_MAX_USERS_PER_SESSION": "lots"})); err == nil {
+		t.Fatal("loadConfig accepted a non-integer environment override")
+	}
+}
+
+func TestLoadConfigValidationReportsAllErrors(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "redditClientID: \"\"\nmaxRedditTagsPerComment: 5\n")
+	_, err := loadConfig(path, fakeEnv(nil))
+	if err == nil {
+		t.Fatal("loadConfig accepted an invalid config")
+	}
+	for _, want := range []string{"redditClientID must be set", "maxRedditTagsPerComment must be between 1 and 3"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("loadConfig error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfigProfiles(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: CrossStitch
+    subscribers:
+      sheetID: sheet-1
+  - name: embroidery
+    namespace: embroidery
+    subreddit: Embroidery
+    subscribers:
+      type: file
+      path: subscribers.csv
+    detection:
+      titleRegex: (?i)^\[contest\]
+    mainComment: Welcome to the contest!
+`)
+	cfg, err := loadConfig(path, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if len(cfg.Profiles) != 2 {
+		t.Fatalf("loadConfig returned wrong number of profiles (got: %d, want: %d)", len(cfg.Profiles), 2)
+	}
+
+	// Unset fields of the first profile take their defaults.
+	first := cfg.Profiles[0]
+	if first.Name != "CrossStitch" || first.Subscribers.SheetRange != defaultSheetRange || first.MainComment != defaultMainComment {
+		t.Fatalf("loadConfig did not apply profile defaults: %+v", first)
+	}
+	if !reflect.DeepEqual(first.Detection, defaultDetectionRule()) {
+		t.Fatalf("loadConfig did not apply default detection rule: %+v", first.Detection)
+	}
+
+	second := cfg.Profiles[1]
+	if second.Namespace != "embroidery" || second.Subscribers.Path != "subscribers.csv" || second.MainComment != "Welcome to the contest!" {
+		t.Fatalf("loadConfig did not apply profile values: %+v", second)
+	}
+	if second.Detection.TitleRegex != `(?i)^\[contest\]` || second.Detection.titleRegex == nil {
+		t.Fatalf("loadConfig did not compile detection rule: %+v", second.Detection)
+	}
+}
+
+func TestLoadConfigRejectsSharedNamespace(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: CrossStitch
+    subscribers:
+      sheetID: sheet-1
+  - subreddit: Embroidery
+    subscribers:
+      sheetID: sheet-2
+`)
+	_, err := loadConfig(path, fakeEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), "share namespace") {
+		t.Fatalf("loadConfig did not reject profiles sharing a namespace: %v", err)
+	}
+}
+
+func TestLoadConfigRejectsIncompleteProfile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "profiles:\n  - name: empty\n")
+	_, err := loadConfig(path, fakeEnv(nil))
+	if err == nil {
+		t.Fatal("loadConfig accepted an incomplete profile")
+	}
+	for _, want := range []string{"profile 0 (empty)", "subreddit must be set", "sheetID must be set for a sheets subscriber source"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("loadConfig error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownSubscriberSource(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "profiles:\n  - subreddit: CrossStitch\n    subscribers:\n      type: carrier-pigeon\n")
+	_, err := loadConfig(path, fakeEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), `unknown subscriber source type "carrier-pigeon"`) {
+		t.Fatalf("loadConfig did not reject unknown subscriber source: %v", err)
+	}
+}
+
+func TestLoadConfigRejectsInvalidDetectionRule(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: CrossStitch
+    subscribers:
+      type: memory
+    detection:
+      titleRegex: "[MOD"
+      any:
+        - {}
+`)
+	_, err := loadConfig(path, fakeEnv(nil))
+	if err == nil {
+		t.Fatal("loadConfig accepted an invalid detection rule")
+	}
+	for _, want := range []string{"detection: titleRegex: error parsing regexp", "any[0]: rule has no conditions"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("loadConfig error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfigRedditSubscriptions(t *testing.T) {
+	// A profile that only uses Reddit subscriptions needs no other subscriber source.
+	path := writeConfigFile(t, "config.yaml", "profiles:\n  - subreddit: CrossStitch\n    redditSubscriptions: replace\n")
+	if _, err := loadConfig(path, fakeEnv(nil)); err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+
+	path = writeConfigFile(t, "config.yaml", "profiles:\n  - subreddit: CrossStitch\n    subscribers:\n      type: memory\n    redditSubscriptions: sometimes\n")
+	if _, err := loadConfig(path, fakeEnv(nil)); err == nil || !strings.Contains(err.Error(), "redditSubscriptions must be") {
+		t.Fatalf("loadConfig did not reject unknown redditSubscriptions mode: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/khipkin/geddit"
+)
+
+// dryRunCommentPrefix marks the full IDs of comments that a dry run pretended to post.
+const dryRunCommentPrefix = "t1_dryrun"
+
+// dryRunPlan records what a run would have done, had it not been a dry run.
+type dryRunPlan struct {
+	steps []string
+}
+
+func (p *dryRunPlan) record(format string, args ...interface{}) {
+	p.steps = append(p.steps, fmt.Sprintf(format, args...))
+}
+
+// recordMatch notes that the post was detected as a competition post. It does nothing outside a dry run.
+func (p *dryRunPlan) recordMatch(profile *CompetitionProfile, post *geddit.Submission) {
+	if p == nil {
+		return
+	}
+	p.record("Matched competition post %s in r/%s (profile %s): %q", post.FullID, profile.Subreddit, profile.Name, post.Title)
+}
+
+// print writes the plan, one step per paragraph.
+func (p *dryRunPlan) print(w io.Writer) error {
+	if len(p.steps) == 0 {
+		_, err := fmt.Fprintln(w, "Dry run: nothing to do.")
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "Dry run: %d step(s) would have been taken.\n", len(p.steps)); err != nil {
+		return err
+	}
+	for i, step := range p.steps {
+		if _, err := fmt.Fprintf(w, "\n%d. %s\n", i+1, step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dryRunRedditSession reads from Reddit, but only records the comments it is asked to post.
+type dryRunRedditSession struct {
+	oAuthSession
+	plan        *dryRunPlan
+	numComments int
+}
+
+func (d *dryRunRedditSession) Reply(r geddit.Replier, comment string) (*geddit.Comment, error) {
+	parentID := "?"
+	switch parent := r.(type) {
+	case *geddit.Submission:
+		parentID = parent.FullID
+	case *geddit.Comment:
+		parentID = parent.FullID
+	}
+	d.numComments++
+	c := &geddit.Comment{FullID: fmt.Sprintf("%s%d", dryRunCommentPrefix, d.numComments)}
+	d.plan.record("Reply to %s (as %s):\n%s", parentID, c.FullID, indent(comment))
+	return c, nil
+}
+
+// bindContext bounds the calls of the session it reads from by ctx.
+func (d *dryRunRedditSession) bindContext(ctx context.Context) (restore func()) {
+	return bindRedditContext(d.oAuthSession, ctx)
+}
+
+// Comment does not look up comments that were only pretended to be posted.
+func (d *dryRunRedditSession) Comment(subreddit, fullID string) (*geddit.Comment, error) {
+	if strings.HasPrefix(fullID, dryRunCommentPrefix) {
+		return &geddit.Comment{FullID: fullID}, nil
+	}
+	return d.oAuthSession.Comment(subreddit, fullID)
+}
+
+func (d *dryRunRedditSession) SendMessage(to, subject, text string) error {
+	d.plan.record("Send message to %s: %q\n%s", to, subject, indent(text))
+	return nil
+}
+
+func (d *dryRunRedditSession) SubmitPost(subreddit, title, text string) (string, error) {
+	d.plan.record("Submit post to r/%s: %q\n%s", subreddit, title, indent(text))
+	return "t3_dryrun", nil
+}
+
+func (d *dryRunRedditSession) LockPost(fullID string) error {
+	d.plan.record("Lock post %s", fullID)
+	return nil
+}
+
+func (d *dryRunRedditSession) SetUserFlair(subreddit, username, text, cssClass string) error {
+	d.plan.record("Set flair of u/%s in r/%s: %q", username, subreddit, text)
+	return nil
+}
+
+func (d *dryRunRedditSession) MarkMessagesRead(fullIDs ...string) error {
+	if len(fullIDs) > 0 {
+		d.plan.record("Mark messages read: %s", strings.Join(fullIDs, ", "))
+	}
+	return nil
+}
+
+// dryRunBackend reads from the store, but only records writes. Written entities are kept in
+// memory so that later reads in the same run see them; listings do not see them.
+type dryRunBackend struct {
+	entityBackend
+	plan    *dryRunPlan
+	written map[entityKey]interface{} // nil values mark deleted entities
+}
+
+func (d *dryRunBackend) Get(ctx context.Context, key entityKey, dst interface{}) error {
+	src, ok := d.written[key]
+	if !ok {
+		return d.entityBackend.Get(ctx, key, dst)
+	}
+	if src == nil {
+		return errNotFound
+	}
+	srcVal, dstVal := reflect.ValueOf(src).Elem(), reflect.ValueOf(dst).Elem()
+	if srcVal.Type() != dstVal.Type() {
+		return fmt.Errorf("dry run wrote %s as %s, but it is read as %s", key, srcVal.Type(), dstVal.Type())
+	}
+	dstVal.Set(srcVal)
+	return nil
+}
+
+func (d *dryRunBackend) Put(ctx context.Context, key entityKey, src interface{}) error {
+	d.plan.record("Put %s: %+v", key, reflect.ValueOf(src).Elem().Interface())
+	d.written[key] = src
+	return nil
+}
+
+func (d *dryRunBackend) Delete(ctx context.Context, key entityKey) error {
+	d.plan.record("Delete %s", key)
+	d.written[key] = nil
+	return nil
+}
+
+// RunInTransaction runs f against the dry run's view of the store, recording its writes only if
+// it succeeds.
+func (d *dryRunBackend) RunInTransaction(ctx context.Context, f func(tx entityTx) error) error {
+	tx := &dryRunTx{ctx: ctx, backend: d}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, w := range tx.writes {
+		if err := w(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dryRunTx struct {
+	ctx     context.Context
+	backend *dryRunBackend
+	writes  []func() error
+}
+
+func (t *dryRunTx) Get(key entityKey, dst interface{}) error {
+	return t.backend.Get(t.ctx, key, dst)
+}
+
+func (t *dryRunTx) Put(key entityKey, src interface{}) error {
+	t.writes = append(t.writes, func() error { return t.backend.Put(t.ctx, key, src) })
+	return nil
+}
+
+func (t *dryRunTx) Delete(key entityKey) error {
+	t.writes = append(t.writes, func() error { return t.backend.Delete(t.ctx, key) })
+	return nil
+}
+
+func indent(text string) string {
+	return "    " + strings.ReplaceAll(text, "\n", "\n    ")
+}
+
+// enableDryRun makes the summoner record, rather than perform, every Reddit comment and
+// store write. It returns the plan the records are added to.
+func (s *summoner) enableDryRun() *dryRunPlan {
+	plan := &dryRunPlan{}
+	s.plan = plan
+	s.redditSession = &dryRunRedditSession{oAuthSession: s.redditSession, plan: plan}
+	es, ok := s.store.(*entityStore)
+	if !ok {
+		panic(fmt.Sprintf("dry run not supported for store %T", s.store))
+	}
+	s.store = newEntityStore(&dryRunBackend{entityBackend: es.backend, plan: plan, written: map[entityKey]interface{}{}})
+	return plan
+}
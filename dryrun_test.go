@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDryRunCheckPostsChangesNothing(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+		fakePost("t3_67890", "Look at my finished piece!"),
+	}
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
+	fsr := s.redditSession.(*fakeRedditSession)
+	fdc := fakeDatastore(s)
+	plan := s.enableDryRun()
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	if fsr.numComments != 0 {
+		t.Fatalf("dry run made unexpected number of comments (got: %d, want: %d)", fsr.numComments, 0)
+	}
+	for kind, entities := range fdc.entities {
+		if len(entities) != 0 {
+			t.Fatalf("dry run wrote %d %s entities to Datastore", len(entities), kind)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := plan.print(&out); err != nil {
+		t.Fatalf("print call failed: %v", err)
+	}
+	for _, want := range []string{
+		`Matched competition post t3_12345 in r/CrossStitch (profile CrossStitch): "[MOD] January's competition - more text"`,
+		"Put /Entity,t3_12345",
+		"Reply to t3_12345 (as t1_dryrun1):\n    This month's competition is live!",
+		"Reply to t1_dryrun1 (as t1_dryrun2):\n    Summoning contestants u/user-0, u/user-1, u/user-2",
+		"Reply to t1_dryrun1 (as t1_dryrun3):\n    Summoning contestants u/user-3",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("dry run plan does not contain %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "t3_67890") {
+		t.Fatalf("dry run plan mentions a post that is not a competition post:\n%s", out.String())
+	}
+}
+
+func TestDryRunReadsItsOwnWrites(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+	}
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
+	plan := s.enableDryRun()
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	// The duplicate post is recognized as handled, so only one batch of comments is planned.
+	var out bytes.Buffer
+	if err := plan.print(&out); err != nil {
+		t.Fatalf("print call failed: %v", err)
+	}
+	if n := strings.Count(out.String(), "Reply to t3_12345"); n != 1 {
+		t.Fatalf("dry run planned %d main comments, want 1:\n%s", n, out.String())
+	}
+}
+
+func TestDryRunPlanEmpty(t *testing.T) {
+	var out bytes.Buffer
+	if err := (&dryRunPlan{}).print(&out); err != nil {
+		t.Fatalf("print call failed: %v", err)
+	}
+	if got, want := out.String(), "Dry run: nothing to do.\n"; got != want {
+		t.Fatalf("print wrote unexpected output (got: %q, want: %q)", got, want)
+	}
+}
+
+func TestDryRunBackendRejectsTypeMismatch(t *testing.T) {
+	ctx := context.Background()
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	s.enableDryRun()
+	backend := s.store.(*entityStore).backend
+	key := entityKey{"", "PageToken", "t3_12345"}
+	if err := backend.Put(ctx, key, &PageToken{NextIndex: 3}); err != nil {
+		t.Fatalf("Put call failed: %v", err)
+	}
+
+	if err := backend.Get(ctx, key, &PageToken{}); err != nil {
+		t.Fatalf("Get call failed: %v", err)
+	}
+	if err := backend.Get(ctx, key, &Subscription{}); err == nil {
+		t.Fatal("Get read an entity written by the dry run into a value of another type")
+	}
+}
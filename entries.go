@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+// Hosts whose links count as image links by default, in addition to links to image files.
+var defaultImageHosts = []string{"i.redd.it", "preview.redd.it", "i.imgur.com", "imgur.com", "ibb.co", "i.ibb.co"}
+
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic"}
+
+// linkRegex matches links in comment text, whether bare or in markdown.
+var linkRegex = regexp.MustCompile(`https?://[^\s()\[\]<>"]+`)
+
+// Why an entry is not valid.
+const (
+	entryProblemDeleted   = "deleted"
+	entryProblemLate      = "submitted after the deadline"
+	entryProblemNoImage   = "no image link"
+	entryProblemDuplicate = "the user already entered"
+)
+
+// EntriesConfig configures how entries are collected from the comments on a profile's
+// competition posts. Each top-level comment is an entry, which is valid if it links to an image,
+// was made before the deadline, and is its author's first valid entry.
+type EntriesConfig struct {
+	// Collect enables collecting entries.
+	Collect bool `yaml:"collect"`
+	// SubmissionPeriod is how long after a competition post is made entries may be submitted.
+	// If unset, entries may be submitted until the end of the month (UTC) the post was made in.
+	SubmissionPeriod time.Duration `yaml:"submissionPeriod"`
+	// ImageHosts lists the hosts whose links count as image links, in addition to links to
+	// image files.
+	ImageHosts []string `yaml:"imageHosts"`
+}
+
+func (c *EntriesConfig) applyDefaults() {
+	if c.ImageHosts == nil {
+		c.ImageHosts = defaultImageHosts
+	}
+}
+
+func (c *EntriesConfig) validate() error {
+	if c.SubmissionPeriod < 0 {
+		return fmt.Errorf("submissionPeriod must not be negative, got %s", c.SubmissionPeriod)
+	}
+	return nil
+}
+
+// deadline returns when submissions close for a competition post made at created.
+func (c *EntriesConfig) deadline(created time.Time) time.Time {
+	if c.SubmissionPeriod > 0 {
+		return created.Add(c.SubmissionPeriod)
+	}
+	year, month, _ := created.UTC().Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// imageLinks returns the image links in comment text, in order, without duplicates.
+func (c *EntriesConfig) imageLinks(text string) []string {
+	var links []string
+	for _, link := range linkRegex.FindAllString(text, -1) {
+		link = strings.TrimRight(link, ".,;:!?*_~")
+		if c.isImageLink(link) && !containsString(links, link) {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func (c *EntriesConfig) isImageLink(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	for _, h := range c.ImageHosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	if host == "reddit.com" && strings.HasPrefix(u.Path, "/gallery/") {
+		return true
+	}
+	return containsString(imageExtensions, strings.ToLower(path.Ext(u.Path)))
+}
+
+// CompetitionPost records a competition post and its calendar, so that the competition advances
+// through its phases once the post drops out of the subreddit's newest posts.
+type CompetitionPost struct {
+	PostID    string
+	Title     string `datastore:",noindex"`
+	CreatedAt time.Time
+	// OpensAt is when subscribers are summoned, Deadline when submissions close, and
+	// VotingDeadline when voting ends and the competition closes. VotingDeadline is zero in
+	// records saved before it was introduced, when voting ends at the deadline.
+	OpensAt        time.Time
+	Deadline       time.Time
+	VotingDeadline time.Time
+	// EntriesCollectedAt is when entries were last collected.
+	EntriesCollectedAt time.Time
+	// The progress of the reminder comment: its full ID, the subscribers it tags in replies, in
+	// order, and the index of the next one to tag. ReminderDone is set once it is finished.
+	ReminderCommentFullID string
+	ReminderUsernames     []string `datastore:",noindex"`
+	ReminderNextIndex     int      `datastore:",noindex"`
+	ReminderDone          bool
+	// Locked is set once the post was locked.
+	Locked bool
+	// Closed is set once the competition no longer advances: after voting ended, or if the post
+	// was deleted.
+	Closed bool
+}
+
+// Entry is a top-level comment on a competition post, submitting a piece to the competition.
+type Entry struct {
+	PostID        string
+	CommentFullID string
+	// Author is the entrant's username, with the "u/" prefix.
+	Author      string
+	ImageURLs   []string `datastore:",noindex"`
+	SubmittedAt time.Time
+	Permalink   string `datastore:",noindex"`
+	// Score is the comment's score when entries were last collected.
+	Score int `datastore:",noindex"`
+	// Category is the results category the entry competes in.
+	Category string
+	// Valid is set if the entry follows the rules. Otherwise, Problem says which it breaks.
+	Valid   bool
+	Problem string `datastore:",noindex"`
+	// Deleted is set once the comment was deleted or removed. The entry is kept, so that it is
+	// known who made it, but it is no longer valid.
+	Deleted   bool
+	UpdatedAt time.Time
+}
+
+func entryKeyName(postID, commentFullID string) string {
+	return postID + "/" + commentFullID
+}
+
+// isDeletedComment reports whether the comment was deleted by its author or removed by moderators.
+func isDeletedComment(c *geddit.Comment) bool {
+	return c.Author == "[deleted]" || c.Body == "[deleted]" || c.Body == "[removed]"
+}
+
+// judgeEntries builds the entries of a competition post from its top-level comments, oldest first,
+// and the entries collected from it before, and checks them against the rules. Entries whose
+// comments were deleted since are kept, marked deleted. Entries whose comments are missing from
+// comments are kept as they were, since listings of comments may be incomplete.
+func (s *summoner) judgeEntries(p *CompetitionProfile, cp *CompetitionPost, comments []*geddit.Comment, previous []*Entry, now time.Time) []*Entry {
+	before := map[string]*Entry{}
+	for _, e := range previous {
+		before[e.CommentFullID] = e
+	}
+	var entries []*Entry
+	seen := map[string]bool{}
+	for _, c := range comments {
+		// The bot's own comments, such as the main comment, are not entries.
+		if strings.EqualFold(c.Author, s.config.RedditUsername) || strings.EqualFold(c.Author, "AutoModerator") {
+			continue
+		}
+		seen[c.FullID] = true
+		if isDeletedComment(c) {
+			if e, ok := before[c.FullID]; ok {
+				e.Deleted = true
+				entries = append(entries, e)
+			}
+			continue
+		}
+		entries = append(entries, &Entry{
+			PostID:        cp.PostID,
+			CommentFullID: c.FullID,
+			Author:        "u/" + c.Author,
+			ImageURLs:     p.Entries.imageLinks(c.Body),
+			Category:      p.Results.category(c.Body),
+			SubmittedAt:   time.Unix(int64(c.Created), 0).UTC(),
+			Permalink:     c.Permalink,
+			Score:         int(c.Score),
+		})
+	}
+	for _, e := range previous {
+		if !seen[e.CommentFullID] {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].SubmittedAt.Before(entries[j].SubmittedAt) })
+
+	entered := map[string]bool{}
+	for _, e := range entries {
+		e.Valid, e.Problem, e.UpdatedAt = false, "", now
+		author := subscriptionKeyName(e.Author)
+		switch {
+		case e.Deleted:
+			e.Problem = entryProblemDeleted
+		case e.SubmittedAt.After(cp.Deadline):
+			e.Problem = entryProblemLate
+		case len(e.ImageURLs) == 0:
+			e.Problem = entryProblemNoImage
+		case entered[author]:
+			e.Problem = entryProblemDuplicate
+		default:
+			e.Valid = true
+			entered[author] = true
+		}
+	}
+	return entries
+}
+
+// trackCompetitionPost records the post and its calendar, if it is one of the profile's
+// competition posts and the profile collects entries or schedules competitions.
+func (s *summoner) trackCompetitionPost(ctx context.Context, p *CompetitionProfile, post *redditPost) error {
+	if !p.tracksCompetitions() {
+		return nil
+	}
+	isCompetitionPost, err := p.Detection.matches(post, s.ruleEnv())
+	if err != nil || !isCompetitionPost {
+		return err
+	}
+	if _, err := s.store.CompetitionPost(ctx, p.Namespace, post.FullID); err != errNotFound {
+		return err
+	}
+	created := time.Now().UTC()
+	if post.DateCreated != 0 {
+		created = time.Unix(int64(post.DateCreated), 0).UTC()
+	}
+	cp := &CompetitionPost{PostID: post.FullID, Title: post.Title, CreatedAt: created}
+	cp.OpensAt, cp.Deadline, cp.VotingDeadline = p.Calendar.dates(created, &p.Entries)
+	loggerFrom(ctx).Info("Tracking competition post", "post", post.FullID, "opens", cp.OpensAt, "deadline", cp.Deadline, "votingDeadline", cp.VotingDeadline)
+	if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+		loggerFrom(ctx).Error("Failed to save CompetitionPost", "post", post.FullID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// unlistedEntryComments looks up the comments of the previous entries that are missing from the
+// listing of a post's comments, which Reddit may have truncated, so that only entries whose
+// comments Reddit reports deleted or removed are disqualified. Comments that cannot be looked up
+// are left out, and their entries kept as they were.
+func (s *summoner) unlistedEntryComments(ctx context.Context, p *CompetitionProfile, comments []*geddit.Comment, previous []*Entry) []*geddit.Comment {
+	listed := map[string]bool{}
+	for _, c := range comments {
+		listed[c.FullID] = true
+	}
+	var unlisted []*geddit.Comment
+	for _, e := range previous {
+		if listed[e.CommentFullID] {
+			continue
+		}
+		c, err := s.redditSession.Comment(p.Subreddit, e.CommentFullID)
+		if err != nil {
+			loggerFrom(ctx).Warn("Failed to look up comment of entry missing from listing", "comment", e.CommentFullID, "err", err)
+			continue
+		}
+		unlisted = append(unlisted, c)
+	}
+	return unlisted
+}
+
+// collectPostEntries reads the entries of a competition post from its comments, and saves them.
+// Once voting has ended, the votes on them are tallied, by the scores they have now.
+func (s *summoner) collectPostEntries(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost, now time.Time) error {
+	logger := loggerFrom(ctx)
+	comments, err := s.redditSession.PostComments(p.Subreddit, cp.PostID)
+	if err != nil {
+		if !isPermanentRedditError(err) {
+			logger.Error("Failed to list comments on competition post", "err", err)
+			return err
+		}
+		// The post is gone, so there is nothing left to collect.
+		logger.Warn("Closing competition post that cannot be read", "err", err)
+		cp.Closed = true
+		return s.store.PutCompetitionPost(ctx, p.Namespace, cp)
+	}
+	previous, err := s.store.Entries(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		logger.Error("Failed to read entries", "err", err)
+		return err
+	}
+	comments = append(comments, s.unlistedEntryComments(ctx, p, comments, previous)...)
+	entries := s.judgeEntries(p, cp, comments, previous, now)
+	cp.EntriesCollectedAt = now
+	// The announcement is drafted before the entries are saved, and the post closed, so that it is
+	// drafted again if saving fails.
+	if now.After(cp.closesAt()) && p.Results.Tally {
+		if err := s.draftAnnouncement(ctx, p, cp, entries); err != nil {
+			return err
+		}
+	}
+	if err := s.store.SaveEntries(ctx, p.Namespace, cp, entries); err != nil {
+		logger.Error("Failed to save entries", "err", err)
+		return err
+	}
+	valid := 0
+	for _, e := range entries {
+		if e.Valid {
+			valid++
+		}
+	}
+	logger.Info("Collected entries", "entries", len(entries), "valid", valid)
+	rep := s.postReport(p, cp.PostID)
+	rep.Entries, rep.ValidEntries = len(entries), valid
+	return nil
+}
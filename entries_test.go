@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+func fakeComment(fullID, author, body string, created time.Time) *geddit.Comment {
+	return &geddit.Comment{FullID: fullID, Author: author, Body: body, Created: float64(created.Unix())}
+}
+
+func TestImageLinks(t *testing.T) {
+	c := &EntriesConfig{}
+	c.applyDefaults()
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"My piece: https://i.redd.it/abc123.jpg", []string{"https://i.redd.it/abc123.jpg"}},
+		{"[finished!](https://imgur.com/a/xyz) and [wip](https://example.com/wip.PNG).", []string{"https://imgur.com/a/xyz", "https://example.com/wip.PNG"}},
+		{"Gallery https://www.reddit.com/gallery/1abcde, again https://www.reddit.com/gallery/1abcde", []string{"https://www.reddit.com/gallery/1abcde"}},
+		{"Pattern from https://example.com/patterns/42", nil},
+		{"Good luck everyone!", nil},
+	} {
+		if got := c.imageLinks(tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("imageLinks(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestEntriesDeadline(t *testing.T) {
+	created := time.Date(2026, time.December, 3, 15, 0, 0, 0, time.UTC)
+	c := &EntriesConfig{}
+	if got, want := c.deadline(created), time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("deadline without a submission period = %s, want the end of the month, %s", got, want)
+	}
+	c.SubmissionPeriod = 14 * 24 * time.Hour
+	if got, want := c.deadline(created), created.AddDate(0, 0, 14); !got.Equal(want) {
+		t.Errorf("deadline with a submission period = %s, want %s", got, want)
+	}
+}
+
+func TestJudgeEntries(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := testProfile(s)
+	deadline := time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)
+	cp := &CompetitionPost{PostID: "t3_12345", Deadline: deadline}
+	day := func(n int) time.Time { return time.Date(2026, time.January, n, 12, 0, 0, 0, time.UTC) }
+	comments := []*geddit.Comment{
+		fakeComment("t1_main", defaultRedditUsername, "This month's competition is live!", day(1)),
+		fakeComment("t1_a", "alice", "Still stitching, hope to finish in time", day(2)),
+		fakeComment("t1_b", "alice", "Done! https://i.redd.it/alice.jpg", day(3)),
+		fakeComment("t1_c", "Alice", "Another one https://i.redd.it/alice2.jpg", day(4)),
+		fakeComment("t1_d", "bob", "https://i.imgur.com/bob.png", day(5)),
+		fakeComment("t1_e", "[deleted]", "[deleted]", day(6)),
+		fakeComment("t1_f", "carol", "Late! https://i.redd.it/carol.jpg", deadline.Add(time.Hour)),
+	}
+	previous := []*Entry{
+		{PostID: cp.PostID, CommentFullID: "t1_e", Author: "u/dave", ImageURLs: []string{"https://i.redd.it/dave.jpg"}, SubmittedAt: day(6), Valid: true},
+		// Missing from the listing, which may be incomplete.
+		{PostID: cp.PostID, CommentFullID: "t1_gone", Author: "u/erin", ImageURLs: []string{"https://i.redd.it/erin.jpg"}, SubmittedAt: day(7), Valid: true},
+	}
+
+	entries := s.judgeEntries(p, cp, comments, previous, time.Now())
+	want := []struct {
+		id, author, problem string
+	}{
+		{"t1_a", "u/alice", entryProblemNoImage},
+		{"t1_b", "u/alice", ""},
+		{"t1_c", "u/Alice", entryProblemDuplicate},
+		{"t1_d", "u/bob", ""},
+		{"t1_e", "u/dave", entryProblemDeleted},
+		{"t1_gone", "u/erin", ""},
+		{"t1_f", "u/carol", entryProblemLate},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("judgeEntries returned %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.CommentFullID != w.id || e.Author != w.author || e.Problem != w.problem || e.Valid != (w.problem == "") {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+}
+
+func TestCollectEntries(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	created := time.Now().Add(-time.Hour)
+	post.DateCreated = float64(created.Unix())
+	s := fakeSummoner([]*redditPost{post}, nil /*subscribers*/)
+	p := testProfile(s)
+	p.Entries.Collect = true
+	p.Entries.SubmissionPeriod = 24 * time.Hour
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.comments = map[string][]*geddit.Comment{post.FullID: {
+		fakeComment("t1_a", "alice", "https://i.redd.it/alice.jpg", created.Add(time.Minute)),
+		fakeComment("t1_b", "bob", "Lovely theme", created.Add(2*time.Minute)),
+	}}
+	ctx := context.Background()
+
+	report, err := s.checkPosts(ctx)
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	rep := report.profile(p).post(post.FullID)
+	if rep.Entries != 2 || rep.ValidEntries != 1 {
+		t.Fatalf("run reported unexpected entries: %+v", rep)
+	}
+	entries, err := s.store.Entries(ctx, p.Namespace, post.FullID)
+	if err != nil {
+		t.Fatalf("Entries call failed: %v", err)
+	}
+	if len(entries) != 2 || !entries[0].Valid || entries[1].Valid {
+		t.Fatalf("run saved unexpected entries: %+v", entries)
+	}
+
+	// Once the post drops out of the newest posts, and submissions close, entries are collected
+	// once more, and then no longer.
+	fsr.submittions = nil
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, post.FullID)
+	if err != nil {
+		t.Fatalf("CompetitionPost call failed: %v", err)
+	}
+	cp.Deadline, cp.VotingDeadline = time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)
+	if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	fsr.comments[post.FullID] = append(fsr.comments[post.FullID], fakeComment("t1_c", "carol", "https://i.redd.it/carol.jpg", time.Now()))
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if cp, err = s.store.CompetitionPost(ctx, p.Namespace, post.FullID); err != nil || !cp.Closed {
+		t.Fatalf("collecting past the deadline did not close the post (got: %+v, %v)", cp, err)
+	}
+	entries, _ = s.store.Entries(ctx, p.Namespace, post.FullID)
+	if len(entries) != 3 || entries[2].Problem != entryProblemLate {
+		t.Fatalf("run saved unexpected entries: %+v", entries)
+	}
+
+	fsr.comments[post.FullID] = nil
+	report, err = s.checkPosts(ctx)
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if len(report.profile(p).Posts) != 0 {
+		t.Fatalf("entries of a closed post were collected: %+v", report.profile(p).Posts)
+	}
+}
+
+func TestCollectEntriesMissingFromListing(t *testing.T) {
+	ctx := context.Background()
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := testProfile(s)
+	now := time.Now()
+	cp := &CompetitionPost{PostID: "t3_12345", Deadline: now.Add(time.Hour), VotingDeadline: now.Add(time.Hour)}
+	previous := []*Entry{
+		{PostID: cp.PostID, CommentFullID: "t1_a", Author: "u/alice", ImageURLs: []string{"https://i.redd.it/alice.jpg"}, SubmittedAt: now.Add(-2 * time.Hour), Valid: true},
+		{PostID: cp.PostID, CommentFullID: "t1_b", Author: "u/bob", ImageURLs: []string{"https://i.redd.it/bob.jpg"}, SubmittedAt: now.Add(-time.Hour), Valid: true},
+	}
+	if err := s.store.SaveEntries(ctx, p.Namespace, cp, previous); err != nil {
+		t.Fatalf("SaveEntries call failed: %v", err)
+	}
+	// The listing was truncated, leaving out both entries, but only bob's comment was removed.
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.unlisted = map[string]*geddit.Comment{
+		"t1_a": fakeComment("t1_a", "alice", "https://i.redd.it/alice.jpg", now.Add(-2*time.Hour)),
+		"t1_b": fakeComment("t1_b", "bob", "[removed]", now.Add(-time.Hour)),
+	}
+
+	if err := s.collectPostEntries(ctx, p, cp, now); err != nil {
+		t.Fatalf("collectPostEntries call failed: %v", err)
+	}
+	entries, err := s.store.Entries(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		t.Fatalf("Entries call failed: %v", err)
+	}
+	if len(entries) != 2 || !entries[0].Valid || entries[0].Deleted || !entries[1].Deleted {
+		t.Fatalf("collectPostEntries saved unexpected entries: %+v", entries)
+	}
+}
+
+func TestCollectEntriesFromManyComments(t *testing.T) {
+	const numComments = 2*maxTransactionWrites + 1
+	ctx := context.Background()
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := testProfile(s)
+	now := time.Now()
+	cp := &CompetitionPost{PostID: "t3_12345", Deadline: now.Add(time.Hour), VotingDeadline: now.Add(time.Hour)}
+	var comments []*geddit.Comment
+	for i := 0; i < numComments; i++ {
+		comments = append(comments, fakeComment(fmt.Sprintf("t1_%d", i), fmt.Sprintf("user-%d", i), "Just saying hi!", now.Add(-time.Hour)))
+	}
+	s.redditSession.(*fakeRedditSession).comments = map[string][]*geddit.Comment{cp.PostID: comments}
+
+	if err := s.collectPostEntries(ctx, p, cp, now); err != nil {
+		t.Fatalf("collectPostEntries call failed: %v", err)
+	}
+	entries, err := s.store.Entries(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		t.Fatalf("Entries call failed: %v", err)
+	}
+	if len(entries) != numComments {
+		t.Fatalf("collectPostEntries saved unexpected number of entries (got: %d, want: %d)", len(entries), numComments)
+	}
+	saved, err := s.store.CompetitionPost(ctx, p.Namespace, cp.PostID)
+	if err != nil || !saved.EntriesCollectedAt.Equal(now) {
+		t.Fatalf("collectPostEntries did not save the post's record: %+v, %v", saved, err)
+	}
+}
+
+func TestEntriesCommand(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := testProfile(s)
+	ctx := context.Background()
+	cp := &CompetitionPost{PostID: "t3_12345", Title: "[MOD] January's competition", Deadline: time.Now()}
+	entries := []*Entry{
+		{PostID: cp.PostID, CommentFullID: "t1_a", Author: "u/alice", ImageURLs: []string{"https://i.redd.it/alice.jpg"}, Score: 12, Valid: true},
+		{PostID: cp.PostID, CommentFullID: "t1_b", Author: "u/bob", Problem: entryProblemNoImage},
+	}
+	if err := s.store.SaveEntries(ctx, p.Namespace, cp, entries); err != nil {
+		t.Fatalf("SaveEntries call failed: %v", err)
+	}
+
+	out, err := runCommand(t, s, "entries", "12345")
+	if err != nil {
+		t.Fatalf("entries command failed: %v", err)
+	}
+	for _, want := range []string{"Entries: 2", "u/alice", "score 12", "valid", "invalid: " + entryProblemNoImage} {
+		if !strings.Contains(out, want) {
+			t.Errorf("entries command output lacks %q:\n%s", want, out)
+		}
+	}
+	if _, err := runCommand(t, s, "entries", "67890"); err == nil {
+		t.Fatal("entries command did not fail for a post entries are not collected from")
+	}
+}
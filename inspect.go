@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// errUnknownProfile and errPostNotFound are returned when a post or profile asked about by an
+	// operator does not exist.
+	errUnknownProfile = errors.New("unknown profile")
+	errPostNotFound   = errors.New("post not found")
+	// errPostBusy is returned when an operator acts on a post another run holds the lease of.
+	errPostBusy = errors.New("post is being handled by another run; try again once it is done")
+)
+
+// postFullID returns the full ID of a post, given either it or the post's ID alone.
+func postFullID(id string) string {
+	if strings.HasPrefix(id, "t3_") {
+		return id
+	}
+	return "t3_" + id
+}
+
+// profilesNamed returns the profile with the name, or every profile if name is empty. The
+// profiles summoning to winners posts are included after those they are the results of.
+func (s *summoner) profilesNamed(name string) ([]*CompetitionProfile, error) {
+	var profiles []*CompetitionProfile
+	for _, p := range s.config.Profiles {
+		for _, sp := range []*CompetitionProfile{p, p.resultsProfile()} {
+			if sp != nil && (name == "" || sp.Name == name) {
+				profiles = append(profiles, sp)
+			}
+		}
+	}
+	if len(profiles) == 0 && name != "" {
+		return nil, fmt.Errorf("%w %q", errUnknownProfile, name)
+	}
+	return profiles, nil
+}
+
+// postProfile returns the profile a post belongs to: the one with the name, if set, or else the
+// only one for which has returns true.
+func (s *summoner) postProfile(name, postID string, has func(p *CompetitionProfile) (bool, error)) (*CompetitionProfile, error) {
+	profiles, err := s.profilesNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		return profiles[0], nil
+	}
+	var matches []*CompetitionProfile
+	for _, p := range profiles {
+		ok, err := has(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, p)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s does not belong to any profile", errPostNotFound, postID)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("post %s belongs to several profiles; choose one", postID)
+}
+
+// inProgressProfile returns the profile summoning to the post is in progress in.
+func (s *summoner) inProgressProfile(ctx context.Context, name, postID string) (*CompetitionProfile, error) {
+	return s.postProfile(name, postID, func(p *CompetitionProfile) (bool, error) {
+		_, err := s.store.PageToken(ctx, p.Namespace, postID)
+		if err == errNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// storedPostProfile returns the profile the store holds state of the post in.
+func (s *summoner) storedPostProfile(ctx context.Context, name, postID string) (*CompetitionProfile, error) {
+	return s.postProfile(name, postID, func(p *CompetitionProfile) (bool, error) {
+		if _, err := s.store.PageToken(ctx, p.Namespace, postID); err != errNotFound {
+			return err == nil, err
+		}
+		return s.store.IsHandled(ctx, p.Namespace, postID)
+	})
+}
+
+// competitionPostProfile returns the profile entries are collected from the post in.
+func (s *summoner) competitionPostProfile(ctx context.Context, name, postID string) (*CompetitionProfile, error) {
+	return s.postProfile(name, postID, func(p *CompetitionProfile) (bool, error) {
+		_, err := s.store.CompetitionPost(ctx, p.Namespace, postID)
+		if err == errNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// redditPostProfile fetches the post from Reddit, and returns it along with the profile whose
+// subreddit it is in.
+func (s *summoner) redditPostProfile(name, postID string) (*CompetitionProfile, *redditPost, error) {
+	var post *redditPost
+	findPost := func(p *CompetitionProfile) (bool, error) {
+		found, err := s.redditSession.Post(p.Subreddit, postID)
+		if err != nil {
+			if isPermanentRedditError(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if !strings.EqualFold(found.Subreddit, p.Subreddit) {
+			return false, nil
+		}
+		post = found
+		return true, nil
+	}
+	p, err := s.postProfile(name, postID, func(p *CompetitionProfile) (bool, error) {
+		// Winners posts are in the subreddit of the profile they are the results of.
+		if p.resultsOf != nil {
+			return false, nil
+		}
+		return findPost(p)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if post == nil {
+		found, err := findPost(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("%w: %s is not in r/%s", errPostNotFound, postID, p.Subreddit)
+		}
+	}
+	if rp := p.resultsProfile(); rp != nil && name == "" {
+		isWinnersPost, err := rp.Detection.matches(post, s.ruleEnv())
+		if err != nil {
+			return nil, nil, err
+		}
+		if isWinnersPost {
+			p = rp
+		}
+	}
+	return p, post, nil
+}
+
+// postProgress is the progress of summoning to a post, as recorded in its PageToken.
+type postProgress struct {
+	PostID            string `json:"postID"`
+	Phase             string `json:"phase"`
+	NextIndex         int    `json:"nextIndex"`
+	LastProcessedUser string `json:"lastProcessedUser,omitempty"`
+	MainCommentFullID string `json:"mainCommentFullID,omitempty"`
+	// Subscribers is the size of the post's subscriber snapshot, or -1 if it has none.
+	Subscribers int `json:"subscribers"`
+}
+
+func (s *summoner) postProgress(ctx context.Context, p *CompetitionProfile, postID string, pt *PageToken) *postProgress {
+	progress := &postProgress{
+		PostID:            postID,
+		Phase:             pt.phase(),
+		NextIndex:         pt.NextIndex,
+		LastProcessedUser: pt.LastProcessedUser,
+		MainCommentFullID: pt.MainCommentFullID,
+		Subscribers:       -1,
+	}
+	if snap, err := s.store.SubscriberSnapshot(ctx, p.Namespace, postID); err == nil {
+		progress.Subscribers = len(snap.Usernames)
+	}
+	return progress
+}
+
+// profileStatus is the state the store holds of a profile's posts.
+type profileStatus struct {
+	Profile    string          `json:"profile"`
+	Subreddit  string          `json:"subreddit"`
+	Namespace  string          `json:"namespace"`
+	InProgress []*postProgress `json:"inProgress"`
+	Handled    []string        `json:"handled"`
+}
+
+// profileStatus lists the posts of the profile that summoning is in progress for, or was begun for.
+func (s *summoner) profileStatus(ctx context.Context, p *CompetitionProfile) (*profileStatus, error) {
+	status := &profileStatus{Profile: p.Name, Subreddit: p.Subreddit, Namespace: p.Namespace, InProgress: []*postProgress{}}
+	posts, err := s.store.InProgressPosts(ctx, p.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, post := range posts {
+		status.InProgress = append(status.InProgress, s.postProgress(ctx, p, post.PostID, post.PageToken))
+	}
+	if status.Handled, err = s.store.HandledPosts(ctx, p.Namespace); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// postState is the state the store holds of one post.
+type postState struct {
+	Profile string `json:"profile"`
+	PostID  string `json:"postID"`
+	Handled bool   `json:"handled"`
+	// Progress is nil unless summoning to the post is in progress.
+	Progress *postProgress   `json:"progress,omitempty"`
+	Summons  []*SummonRecord `json:"summons"`
+}
+
+func (s *summoner) postState(ctx context.Context, p *CompetitionProfile, postID string) (*postState, error) {
+	state := &postState{Profile: p.Name, PostID: postID}
+	var err error
+	if state.Handled, err = s.store.IsHandled(ctx, p.Namespace, postID); err != nil {
+		return nil, err
+	}
+	pt, err := s.store.PageToken(ctx, p.Namespace, postID)
+	if err == nil {
+		state.Progress = s.postProgress(ctx, p, postID, pt)
+	} else if err != errNotFound {
+		return nil, err
+	}
+	if state.Summons, err = s.store.SummonRecords(ctx, p.Namespace, postID); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// resetPost clears the post's handled marker and PageToken, so that the next run summons to it
+// again. Its ledger is kept, so that users already summoned are not summoned again.
+func (s *summoner) resetPost(ctx context.Context, p *CompetitionProfile, postID string) error {
+	ctx = withLogAttrs(ctx, "post", postID)
+	reset := false
+	err := s.withPostLease(ctx, p, postID, func() error {
+		reset = true
+		return s.updatePost(ctx, p, postID, &postUpdate{Complete: true, ClearHandled: true})
+	})
+	if err != nil {
+		return err
+	}
+	if !reset {
+		return errPostBusy
+	}
+	loggerFrom(ctx).Info("Reset post", "profile", p.Name)
+	return nil
+}
+
+// forceSummon summons contestants to the post, whether or not the profile's detection rules
+// match it or it was already handled, and returns the progress made.
+func (s *summoner) forceSummon(ctx context.Context, p *CompetitionProfile, post *redditPost) (*postReport, error) {
+	report := &runReport{RunID: s.runID, StartedAt: time.Now()}
+	s.report = report
+	defer func() { s.report = nil }()
+	ctx = withLogAttrs(ctx, "runID", s.runID, "profile", p.Name, "post", post.FullID)
+	loggerFrom(ctx).Info("Forcing summoning to post")
+
+	summoned := false
+	err := s.withPostLease(ctx, p, post.FullID, func() error {
+		summoned = true
+		// Summon to a post that was already handled as if it were new. Its ledger is kept, so
+		// that users already summoned are not summoned again.
+		if _, err := s.store.PageToken(ctx, p.Namespace, post.FullID); err == errNotFound {
+			if err := s.updatePost(ctx, p, post.FullID, &postUpdate{ClearHandled: true}); err != nil {
+				loggerFrom(ctx).Error("Failed to clear handled marker of post", "err", err)
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		return s.handleCompetitionPost(ctx, p, post)
+	})
+	rep := report.profile(p).post(post.FullID)
+	if err != nil {
+		rep.Error = err.Error()
+		return rep, err
+	}
+	if !summoned {
+		return rep, errPostBusy
+	}
+	return rep, nil
+}
+
+// postEntries is what the store holds of a competition post's entries.
+type postEntries struct {
+	Profile string           `json:"profile"`
+	Post    *CompetitionPost `json:"post"`
+	Entries []*Entry         `json:"entries"`
+}
+
+func (s *summoner) postEntries(ctx context.Context, p *CompetitionProfile, postID string) (*postEntries, error) {
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, postID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.store.Entries(ctx, p.Namespace, postID)
+	if err != nil {
+		return nil, err
+	}
+	return &postEntries{Profile: p.Name, Post: cp, Entries: append([]*Entry{}, entries...)}, nil
+}
+
+// postResults is the ranked results of a competition post, and its winners announcement.
+type postResults struct {
+	Profile    string             `json:"profile"`
+	Post       *CompetitionPost   `json:"post"`
+	Categories []*categoryResults `json:"categories"`
+	// Announcement is nil until votes are tallied, once the post closes.
+	Announcement *Announcement `json:"announcement,omitempty"`
+	// Awards records what was done to reward each winner, once the announcement is submitted.
+	Awards []*Award `json:"awards"`
+}
+
+// postResults ranks the entries of a competition post by their scores when entries were last
+// collected, which are those the votes were tallied with once the post is closed.
+func (s *summoner) postResults(ctx context.Context, p *CompetitionProfile, postID string) (*postResults, error) {
+	pe, err := s.postEntries(ctx, p, postID)
+	if err != nil {
+		return nil, err
+	}
+	results := &postResults{Profile: p.Name, Post: pe.Post, Categories: p.Results.rankEntries(pe.Entries)}
+	results.Announcement, err = s.store.Announcement(ctx, p.Namespace, postID)
+	if err != nil && err != errNotFound {
+		return nil, err
+	}
+	if results.Awards, err = s.store.Awards(ctx, p.Namespace, postID); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// competitionStatus is a tracked competition post and the phase it is in.
+type competitionStatus struct {
+	*CompetitionPost
+	Phase string `json:"phase"`
+}
+
+// profileCalendar is a profile's scheduled competitions, and the competitions it tracks, the
+// latest to open first.
+type profileCalendar struct {
+	Profile      string               `json:"profile"`
+	Scheduled    []*CompetitionDates  `json:"scheduled"`
+	Competitions []*competitionStatus `json:"competitions"`
+}
+
+func (s *summoner) profileCalendar(ctx context.Context, p *CompetitionProfile) (*profileCalendar, error) {
+	cal := &profileCalendar{Profile: p.Name, Scheduled: append([]*CompetitionDates{}, p.Calendar.Competitions...), Competitions: []*competitionStatus{}}
+	posts, err := s.store.CompetitionPosts(ctx, p.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, cp := range posts {
+		cal.Competitions = append(cal.Competitions, &competitionStatus{CompetitionPost: cp, Phase: cp.phase(now)})
+	}
+	sort.SliceStable(cal.Competitions, func(i, j int) bool { return cal.Competitions[i].OpensAt.After(cal.Competitions[j].OpensAt) })
+	return cal, nil
+}
+
+// postPreview is what the next run would post to a post.
+type postPreview struct {
+	Profile string `json:"profile"`
+	PostID  string `json:"postID"`
+	Title   string `json:"title"`
+	// Matched reports whether the profile's detection rules match the post, and Explanation
+	// says which rules held.
+	Matched     bool   `json:"matched"`
+	Explanation string `json:"explanation"`
+	// MainComment is empty if the main comment was already posted.
+	MainComment    string   `json:"mainComment,omitempty"`
+	SummonComments []string `json:"summonComments"`
+}
+
+// previewPost renders the comments the next run would post to the post, as summonContestants would.
+func (s *summoner) previewPost(ctx context.Context, p *CompetitionProfile, post *redditPost) (*postPreview, error) {
+	preview := &postPreview{Profile: p.Name, PostID: post.FullID, Title: post.Title, SummonComments: []string{}}
+	var err error
+	if preview.Matched, preview.Explanation, err = s.explainCompetitionPost(p, post); err != nil {
+		return nil, err
+	}
+
+	pt, err := s.store.PageToken(ctx, p.Namespace, post.FullID)
+	if err == errNotFound {
+		pt = nil
+	} else if err != nil {
+		return nil, err
+	}
+	snap, firstIndex, err := s.subscriberSnapshot(ctx, p, post.FullID, pt)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := s.summonLedger(ctx, p, post.FullID)
+	if err != nil {
+		return nil, err
+	}
+	usernames, _ := selectUsersToSummon(ctx, snap.subscribers(), firstIndex, s.config.MaxUsersPerSession, ledger)
+	data := newCommentData(p, &post.Submission, len(snap.Usernames), time.Now())
+	if pt == nil || pt.phase() == phaseDiscovered {
+		if preview.MainComment, err = p.renderMainComment(data); err != nil {
+			return nil, err
+		}
+	}
+	batches, err := s.buildSummonBatches(ctx, p, data, usernames)
+	if err != nil {
+		return nil, err
+	}
+	for _, batch := range batches {
+		preview.SummonComments = append(preview.SummonComments, batch.text)
+	}
+	return preview, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// postLeaseDuration is how long a run may hold a post's lease without renewing it. Runs renew it
+// before each summon comment, and a reply, even a rate limited one, is retried for at most
+// redditMaxRetryTime, which must be well under this.
+const postLeaseDuration = 10 * time.Minute
+
+// errLeaseHeld is returned when another run holds the lease of a post.
+var errLeaseHeld = errors.New("lease held by another run")
+
+// errLeaseNotHeld is returned when a run writes to a post whose lease it no longer holds, because
+// the lease expired or was released.
+var errLeaseNotHeld = errors.New("lease not held by this run")
+
+// Lease gives one run of the bot the exclusive right to summon to a post until it expires, so that
+// overlapping runs, such as a scheduled invocation that fires while the previous one is still
+// posting, never read the same PageToken and post the same batch.
+type Lease struct {
+	// Owner is the ID of the run holding the lease.
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// newRunID returns an ID for this run of the bot, unique across hosts.
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// withPostLease runs f while holding the post's lease. If another run holds the lease, the post is
+// skipped; that run will make progress on it.
+func (s *summoner) withPostLease(ctx context.Context, p *CompetitionProfile, postID string, f func() error) error {
+	// A dry run writes nothing, so it cannot race another run.
+	if s.plan != nil {
+		return f()
+	}
+	lease, err := s.store.AcquireLease(ctx, p.Namespace, postID, s.runID, time.Now(), postLeaseDuration)
+	if err == errLeaseHeld {
+		loggerFrom(ctx).Info("Post is being handled by another run; skipping it", "post", postID, "owner", lease.Owner, "expiresAt", lease.ExpiresAt)
+		s.postReport(p, postID).Skipped = "being handled by run " + lease.Owner
+		return nil
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to acquire lease of post", "post", postID, "err", err)
+		return err
+	}
+	defer func() {
+		if err := s.store.ReleaseLease(ctx, p.Namespace, postID, s.runID); err != nil {
+			loggerFrom(ctx).Error("Failed to release lease of post", "post", postID, "err", err)
+		}
+	}()
+	return f()
+}
+
+// renewPostLease extends the run's lease of the post. If the lease expired and another run took
+// it, it fails, and the run must stop summoning to the post.
+func (s *summoner) renewPostLease(ctx context.Context, p *CompetitionProfile, postID string) error {
+	if s.plan != nil {
+		return nil
+	}
+	lease, err := s.store.AcquireLease(ctx, p.Namespace, postID, s.runID, time.Now(), postLeaseDuration)
+	if err == errLeaseHeld {
+		err = fmt.Errorf("lease of post %s was taken over by run %s", postID, lease.Owner)
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to renew lease of post", "post", postID, "err", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPostsSkipsPostLeasedByAnotherRun(t *testing.T) {
+	ctx := context.Background()
+	submissions := []*redditPost{fakePost("t3_12345", "[MOD] January's competition - more text")}
+	s := fakeSummoner(submissions, generateFakeUsers(defaultMaxRedditTagsPerComment+1))
+	p := testProfile(s)
+	if _, err := s.store.AcquireLease(ctx, p.Namespace, "t3_12345", "other-run", time.Now(), time.Minute); err != nil {
+		t.Fatalf("test failed to setup lease: %v", err)
+	}
+
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	if fsr := s.redditSession.(*fakeRedditSession); fsr.numComments != 0 {
+		t.Fatalf("checkPosts commented on a post leased by another run (got: %d comments, want: 0)", fsr.numComments)
+	}
+	if handled, err := s.store.IsHandled(ctx, p.Namespace, "t3_12345"); err != nil || handled {
+		t.Fatalf("checkPosts marked a post leased by another run handled (got: %t, %v)", handled, err)
+	}
+}
+
+func TestCheckPostsReleasesLeases(t *testing.T) {
+	ctx := context.Background()
+	submissions := []*redditPost{fakePost("t3_12345", "[MOD] January's competition - more text")}
+	s := fakeSummoner(submissions, generateFakeUsers(defaultMaxUsersPerSession+1))
+	p := testProfile(s)
+
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	// Another run can pick up where this one left off, without waiting for the lease to expire.
+	if _, err := s.store.AcquireLease(ctx, p.Namespace, "t3_12345", "other-run", time.Now(), time.Minute); err != nil {
+		t.Fatalf("checkPosts did not release the post's lease: %v", err)
+	}
+}
+
+func TestSummonContestantsStopsWhenLeaseIsTakenOver(t *testing.T) {
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(2*defaultMaxRedditTagsPerComment))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	// While the first summon comment is posted, this run stalls until its lease expires, and
+	// another run takes the post over.
+	fsr.failReply = func(comment string) bool {
+		if strings.HasPrefix(comment, "Summoning") {
+			s.store.AcquireLease(ctx, p.Namespace, post.FullID, "other-run", time.Now().Add(2*postLeaseDuration), postLeaseDuration)
+		}
+		return false
+	}
+
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err == nil {
+		t.Fatal("handlePossibleCompetitionPost kept summoning after losing the post's lease")
+	}
+	if got := len(fsr.replies["uniqueComment"]); got != 1 {
+		t.Fatalf("handlePossibleCompetitionPost made unexpected number of summon comments (got: %d, want: 1)", got)
+	}
+}
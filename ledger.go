@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statuses of a SummonRecord.
+const (
+	// summonPending users are about to be tagged. If the run dies before the comment is known to
+	// have been posted, they stay pending, and are not tagged again: better to miss a user than
+	// to tag them twice.
+	summonPending = "pending"
+	summonSent    = "sent"
+	summonFailed  = "failed"
+)
+
+// Users whose summon comment failed this many times are not retried again.
+const maxSummonAttempts = 3
+
+// SummonRecord is the ledger entry recording whether a user was tagged on a post.
+type SummonRecord struct {
+	PostID   string
+	Username string
+	Status   string
+	// CommentFullID is the comment the user was tagged in, once it was posted.
+	CommentFullID string `datastore:",noindex"`
+	Attempts      int    `datastore:",noindex"`
+	UpdatedAt     time.Time
+}
+
+// summonRecordKeyName identifies the record of a user on a post, ignoring the case of the username.
+func summonRecordKeyName(postID, username string) string {
+	return postID + "/" + strings.ToLower(strings.TrimPrefix(username, "u/"))
+}
+
+// summonLedger holds the records of the users tagged on one post.
+type summonLedger struct {
+	postID  string
+	records map[string]*SummonRecord // by key name
+}
+
+// summonLedger reads the records of every user tagged on the post.
+func (s *summoner) summonLedger(ctx context.Context, p *CompetitionProfile, postID string) (*summonLedger, error) {
+	records, err := s.store.SummonRecords(ctx, p.Namespace, postID)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to read summon ledger", "err", err)
+		return nil, err
+	}
+	l := &summonLedger{postID: postID, records: map[string]*SummonRecord{}}
+	for _, r := range records {
+		l.records[summonRecordKeyName(postID, r.Username)] = r
+	}
+	return l, nil
+}
+
+func (l *summonLedger) record(username string) *SummonRecord {
+	return l.records[summonRecordKeyName(l.postID, username)]
+}
+
+// retries returns the users whose summon comment failed and may be retried, oldest first.
+func (l *summonLedger) retries() []string {
+	var failed []*SummonRecord
+	for _, r := range l.records {
+		if r.Status == summonFailed && r.Attempts < maxSummonAttempts {
+			failed = append(failed, r)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].UpdatedAt.Before(failed[j].UpdatedAt)
+	})
+	usernames := make([]string, len(failed))
+	for i, r := range failed {
+		usernames[i] = r.Username
+	}
+	return usernames
+}
+
+// update sets the status of the users in the ledger, and returns their updated records.
+func (l *summonLedger) update(usernames []string, status, commentFullID string) []*SummonRecord {
+	records := make([]*SummonRecord, len(usernames))
+	for i, username := range usernames {
+		r := &SummonRecord{PostID: l.postID, Username: username}
+		if prev := l.record(username); prev != nil {
+			*r = *prev
+		}
+		if status == summonPending {
+			r.Attempts++
+		}
+		r.Status = status
+		r.CommentFullID = commentFullID
+		r.UpdatedAt = time.Now()
+		l.records[summonRecordKeyName(l.postID, username)] = r
+		records[i] = r
+	}
+	return records
+}
+
+// updateSummonLedger sets the status of the users in the ledger, and saves their records to the store.
+func (s *summoner) updateSummonLedger(ctx context.Context, p *CompetitionProfile, l *summonLedger, usernames []string, status, commentFullID string) error {
+	records := l.update(usernames, status, commentFullID)
+	if err := s.updatePost(ctx, p, l.postID, &postUpdate{Records: records}); err != nil {
+		loggerFrom(ctx).Error("Failed to record summons", "usernames", usernames, "status", status, "err", err)
+		return err
+	}
+	return nil
+}
+
+// selectUsersToSummon picks the users to tag in this session: first those whose summon failed
+// before, then those in the subscriber snapshot from firstIndex on, skipping any user already in
+// the ledger. At most maxUsersPerSession snapshot entries are looked at, less any retries. It
+// returns the users, and the index of the next snapshot entry to look at.
+func selectUsersToSummon(ctx context.Context, subscribers []Subscriber, firstIndex, maxUsersPerSession int, l *summonLedger) ([]string, int) {
+	usernames := l.retries()
+	if len(usernames) > maxUsersPerSession {
+		usernames = usernames[:maxUsersPerSession]
+	}
+	end := firstIndex + maxUsersPerSession - len(usernames)
+	if end > len(subscribers) {
+		end = len(subscribers)
+	}
+	i := firstIndex
+	for ; i < end; i++ {
+		username := subscribers[i].Username
+		if !strings.HasPrefix(username, "u/") {
+			// Skip subscribers with invalid usernames.
+			loggerFrom(ctx).Warn("Invalid Reddit username for subscriber", "index", i, "username", username)
+			continue
+		}
+		if r := l.record(username); r != nil {
+			loggerFrom(ctx).Debug("Not summoning user again", "username", username, "status", r.Status)
+			continue
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, i
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/khipkin/geddit"
+)
+
+func TestSummonContestantsRetriesOnlyFailedUsers(t *testing.T) {
+	const numUsers = 2*defaultMaxRedditTagsPerComment + 1
+	ctx := context.Background()
+	post := &geddit.Submission{FullID: "t3_12345"}
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.failReply = func(comment string) bool { return strings.Contains(comment, fakeUserName(3)) }
+
+	if err := summonUnderLease(ctx, s, p, post, nil /*PageToken*/); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+	ledger, err := s.summonLedger(ctx, p, post.FullID)
+	if err != nil {
+		t.Fatalf("summonLedger call failed: %v", err)
+	}
+	for i := 0; i < numUsers; i++ {
+		want := summonSent
+		if i >= 3 && i < 6 {
+			want = summonFailed
+		}
+		if r := ledger.record(fakeUserName(i)); r == nil || r.Status != want {
+			t.Fatalf("ledger has unexpected record for %s (got: %+v, want status: %s)", fakeUserName(i), r, want)
+		}
+	}
+	if got := ledger.record(fakeUserName(0)).CommentFullID; got != "uniqueComment" {
+		t.Fatalf("ledger recorded unexpected comment ID (got: %s, want: %s)", got, "uniqueComment")
+	}
+
+	// The post stays in progress until the failed users have been retried.
+	pt := &PageToken{}
+	if err := getPageToken(ctx, s, p, post.FullID, pt); err != nil {
+		t.Fatalf("failed to fetch pagetoken from datastore: %v", err)
+	}
+	fsr.failReply = nil
+	fsr.replies = nil
+	if err := summonUnderLease(ctx, s, p, post, pt); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+	want := []string{"Summoning contestants u/user-3, u/user-4, u/user-5"}
+	if got := fsr.replies["uniqueComment"]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("summonContestants made unexpected retry comments (got: %q, want: %q)", got, want)
+	}
+	if err := getPageToken(ctx, s, p, post.FullID, pt); err == nil {
+		t.Fatal("PageToken was not deleted after the failed users were retried")
+	}
+}
+
+func TestSummonContestantsGivesUpAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	post := &geddit.Submission{FullID: "t3_12345"}
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(1))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.failReply = func(comment string) bool { return strings.HasPrefix(comment, "Summoning") }
+
+	var pt *PageToken
+	for i := 0; i < maxSummonAttempts; i++ {
+		if err := summonUnderLease(ctx, s, p, post, pt); err != nil {
+			t.Fatalf("summonContestants call failed: %v", err)
+		}
+		pt = &PageToken{}
+		if err := getPageToken(ctx, s, p, post.FullID, pt); err != nil {
+			pt = nil
+		}
+	}
+	if pt != nil {
+		t.Fatalf("PageToken was not deleted after %d failed attempts: %+v", maxSummonAttempts, pt)
+	}
+}
+
+func TestSummonContestantsSkipsUsersInLedger(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	ctx := context.Background()
+	post := &geddit.Submission{FullID: "t3_12345"}
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	p := testProfile(s)
+	// A previous run died after recording these users, so they may already have been tagged.
+	ledger := &summonLedger{postID: post.FullID, records: map[string]*SummonRecord{}}
+	err := s.withPostLease(ctx, p, post.FullID, func() error {
+		return s.updateSummonLedger(ctx, p, ledger, []string{"u/USER-0", fakeUserName(2)}, summonPending, "")
+	})
+	if err != nil {
+		t.Fatalf("updateSummonLedger call failed: %v", err)
+	}
+
+	if err := summonUnderLease(ctx, s, p, post, nil /*PageToken*/); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+
+	counts := summonedUsers(s.redditSession.(*fakeRedditSession))
+	for i, want := range []int{0, 1, 0, 1} {
+		if counts[fakeUserName(i)] != want {
+			t.Errorf("user %s was summoned %d times, want %d", fakeUserName(i), counts[fakeUserName(i)], want)
+		}
+	}
+}
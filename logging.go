@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+
+	defaultLogLevel  = "info"
+	defaultLogFormat = logFormatJSON
+)
+
+// LogConfig configures the bot's logs.
+type LogConfig struct {
+	// Level is the least severe level logged: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is "json" (the default), which writes each record as a line of JSON whose severity
+	// and message Cloud Logging understands, or "text", which is easier to read in a terminal.
+	Format string `yaml:"format"`
+}
+
+func (c *LogConfig) applyDefaults() {
+	if c.Level == "" {
+		c.Level = defaultLogLevel
+	}
+	if c.Format == "" {
+		c.Format = defaultLogFormat
+	}
+}
+
+func (c *LogConfig) validate() error {
+	if _, err := c.level(); err != nil {
+		return err
+	}
+	switch c.Format {
+	case logFormatJSON, logFormatText:
+	default:
+		return fmt.Errorf("log: format must be %q or %q, got %q", logFormatJSON, logFormatText, c.Format)
+	}
+	return nil
+}
+
+func (c *LogConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return 0, fmt.Errorf("log: level must be debug, info, warn or error, got %q", c.Level)
+	}
+	return level, nil
+}
+
+// newLogHandler returns a handler writing records to w, as configured.
+func newLogHandler(w io.Writer, config LogConfig) (slog.Handler, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	level, _ := config.level()
+	if config.Format == logFormatText {
+		return slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}), nil
+	}
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: cloudLoggingAttr}), nil
+}
+
+// cloudLoggingAttr renames the level and message of JSON records to the severity and message
+// fields of Cloud Logging's structured logs. Other attributes end up in the entry's jsonPayload.
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		level, _ := a.Value.Any().(slog.Level)
+		return slog.String("severity", cloudLoggingSeverity(level))
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+// cloudLoggingSeverity returns the Cloud Logging severity of a level.
+func cloudLoggingSeverity(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < slog.LevelWarn:
+		return "INFO"
+	case level < slog.LevelError:
+		return "WARNING"
+	}
+	return "ERROR"
+}
+
+// setupLogging makes the configured handler the default, for both slog and the log package.
+func setupLogging(config LogConfig) error {
+	handler, err := newLogHandler(os.Stderr, config)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// withLogAttrs returns a context whose logger adds args to every record, as slog.Logger.With does.
+// Runs add their ID, and each post its profile and ID, so that the records of one post can be
+// found among those of others in flight.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With(args...))
+}
+
+// loggerFrom returns the logger of the context, or the default logger if it has none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogHandlerUsesCloudLoggingFields(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, LogConfig{Level: "info", Format: logFormatJSON})
+	if err != nil {
+		t.Fatalf("newLogHandler call failed: %v", err)
+	}
+	logger := slog.New(handler)
+	logger.With("runID", "run-1", "post", "t3_12345").Warn("Retrying", "attempt", 2)
+	logger.Debug("Not logged below the configured level")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("handler wrote unexpected number of records (got: %d, want: 1):\n%s", len(lines), buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("handler wrote a record that is not JSON: %v", err)
+	}
+	want := map[string]interface{}{"severity": "WARNING", "message": "Retrying", "runID": "run-1", "post": "t3_12345", "attempt": 2.0}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("record has unexpected %s (got: %v, want: %v)", key, record[key], value)
+		}
+	}
+	if _, ok := record["level"]; ok {
+		t.Errorf("record has a level field as well as a severity: %v", record)
+	}
+}
+
+func TestWithLogAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	ctx := withLogAttrs(context.Background(), "runID", "run-1")
+	loggerFrom(withLogAttrs(ctx, "post", "t3_12345")).Info("Summoning")
+	loggerFrom(ctx).Info("Finished")
+
+	out := buf.String()
+	if !strings.Contains(out, "msg=Summoning runID=run-1 post=t3_12345") || !strings.Contains(out, "msg=Finished runID=run-1\n") {
+		t.Fatalf("records do not carry the attributes of their context:\n%s", out)
+	}
+}
+
+func TestSelectUsersToSummonLogsWithContextAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	ctx := withLogAttrs(context.Background(), "runID", "run-1", "post", "t3_12345")
+	selectUsersToSummon(ctx, []Subscriber{{Username: "nobody"}}, 0 /*firstIndex*/, defaultMaxUsersPerSession, &summonLedger{records: map[string]*SummonRecord{}})
+
+	if out := buf.String(); !strings.Contains(out, "runID=run-1 post=t3_12345") {
+		t.Fatalf("selectUsersToSummon logged without the attributes of its context:\n%s", out)
+	}
+}
+
+func TestLoadConfigLog(t *testing.T) {
+	cfg, err := loadConfig("" /*path*/, fakeEnv(map[string]string{"CROSSSTITCH_LOG_LEVEL": "debug"}))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if cfg.Log.Level != "debug" || cfg.Log.Format != logFormatJSON {
+		t.Fatalf("loadConfig returned unexpected log config: %+v", cfg.Log)
+	}
+
+	for _, env := range []map[string]string{{"CROSSSTITCH_LOG_LEVEL": "loud"}, {"CROSSSTITCH_LOG_FORMAT": "xml"}} {
+		if _, err := loadConfig("" /*path*/, fakeEnv(env)); err == nil {
+			t.Errorf("loadConfig accepted invalid log config %v", env)
+		}
+	}
+}
@@ -3,397 +3,666 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-
 	"github.com/khipkin/geddit"
 
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 )
 
-const (
-	subreddit      = "CrossStitch"
-	redditClientID = "Kkfhbwt2W5C0Rw"
-	redditUsername = "CrossStitchBot"
-
-	googleCloudProjectID     = "crossstitch-bot-1569769426365"
-	googleCompetitionSheetID = "1BgsXzNY1L4cevQllAblDgCffO7DGNp0eOW4Bs1qbiMA"
-	googleCredentialsFile    = "crossstitch-bot-1569769426365-7aaa0bc7606d.json"
-
-	maxUsersPerSession      = 48
-	maxRedditTagsPerComment = 3
-)
-
-// PageToken for processing and tagging users on a competition post.
+// PageToken records the progress of summoning to a post, in the phases described in progress.go.
+// NextIndex is the index, in the post's SubscriberSnapshot, of the next user to summon.
 type PageToken struct {
+	Phase             string
 	MainCommentFullID string
 	LastProcessedUser string
+	NextIndex         int
 }
 
 type oAuthSession interface {
 	LoginAuth(username, password string) error
 	Reply(r geddit.Replier, comment string) (*geddit.Comment, error)
-	SubredditSubmissions(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*geddit.Submission, error)
+	SubredditPosts(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*redditPost, error)
+	Moderators(subreddit string) ([]string, error)
 	Throttle(interval time.Duration)
 	Comment(subreddit, fullID string) (*geddit.Comment, error)
-}
-
-type datastoreClient interface {
-	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
-	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) (keys []*datastore.Key, err error)
-	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
-	Delete(ctx context.Context, key *datastore.Key) error
+	Post(subreddit, fullID string) (*redditPost, error)
+	SendMessage(to, subject, text string) error
+	PostComments(subreddit, postFullID string) ([]*geddit.Comment, error)
+	SubmitPost(subreddit, title, text string) (string, error)
+	UnreadMessages() ([]*inboxMessage, error)
+	MarkMessagesRead(fullIDs ...string) error
+	LockPost(fullID string) error
+	SetUserFlair(subreddit, username, text, cssClass string) error
 }
 
 type summoner struct {
-	redditSession             oAuthSession
-	datastoreClient           datastoreClient
-	sheetsService             *sheets.Service
-	readSpreadsheetValuesFunc func(string, string) (*sheets.ValueRange, error)
-}
-
-func (s *summoner) readSpreadsheetRange(spreadsheetID, readRange string) (*sheets.ValueRange, error) {
-	return s.sheetsService.Spreadsheets.Values.Get(spreadsheetID, readRange).Do()
+	config        *Config
+	redditSession oAuthSession
+	store         store
+	sheetsService *sheets.Service
+	// runID identifies this run, as the owner of the post leases it holds.
+	runID string
+	// shutdown is closed when the bot is asked to stop. It is nil if the bot cannot be stopped.
+	shutdown <-chan struct{}
+	// plan records what would have been done, in a dry run.
+	plan *dryRunPlan
+	// report records what the run in progress did, if any.
+	report *runReport
+	// notifiers are sent notifications of failures and finished summoning.
+	notifiers []*configuredNotifier
+	// moderators caches the lowercased moderator usernames of each subreddit for one run.
+	moderators map[string]map[string]bool
 }
 
-func newSummoner(redditSession *geddit.OAuthSession, datastoreClient *datastore.Client, sheetsService *sheets.Service) *summoner {
-	s := &summoner{
-		redditSession:   redditSession,
-		datastoreClient: datastoreClient,
-		sheetsService:   sheetsService,
+func newSummoner(config *Config, redditSession oAuthSession, store store, sheetsService *sheets.Service) *summoner {
+	return &summoner{
+		config:        config,
+		redditSession: redditSession,
+		store:         store,
+		sheetsService: sheetsService,
+		runID:         newRunID(),
 	}
-	s.readSpreadsheetValuesFunc = s.readSpreadsheetRange
-	return s
 }
 
-// Build the contents of the Reddit comment that will summon challenge subscribers.
-// Return the list of comment strings and the last username processed, or else an error.
-func (s *summoner) buildSummonStrings(lastProccessedUser string) ([]string, string, error) {
-	const usernameIndex = 0 // Column A
-
-	// Read the range of values from the spreadsheet.
-	readRange := "SignedUp!A2:A"
-	resp, err := s.readSpreadsheetValuesFunc(googleCompetitionSheetID, readRange)
+// readSubscribers returns the users to summon to the profile's competition posts.
+func (s *summoner) readSubscribers(ctx context.Context, p *CompetitionProfile) ([]Subscriber, error) {
+	source, err := s.subscriberSource(p)
 	if err != nil {
-		log.Printf("Unable to retrieve data from Google Sheets: %v", err)
-		return nil, "", err
+		loggerFrom(ctx).Error("Failed to create subscriber source", "err", err)
+		return nil, err
 	}
-
-	// If we are starting from a specific last processed user, first find that user's index.
-	firstIndexToProcess := 0
-	if lastProccessedUser != "" {
-		for i, row := range resp.Values {
-			if lastProccessedUser == row[usernameIndex].(string) {
-				firstIndexToProcess = i + 1
-				break
-			}
-		}
+	subscribers, err := source.Subscribers(ctx)
+	if err != nil {
+		loggerFrom(ctx).Error("Unable to retrieve subscribers", "err", err)
+		return nil, err
 	}
+	return subscribers, nil
+}
 
-	// Build the summon strings, starting from user after the last processed user, up to the max number of users per session.
-	var usersToProcess = firstIndexToProcess + maxUsersPerSession
-	if len(resp.Values) < usersToProcess {
-		usersToProcess = len(resp.Values)
-	}
-	var summons = []string{}
-	var curr = ""
-	var seen = 0
-	var username = ""
-	for i := firstIndexToProcess; i < usersToProcess; i++ {
-		// Process the values from the spreadsheet row.
-		row := resp.Values[i]
-		username = row[usernameIndex].(string)
-		if !strings.HasPrefix(username, "u/") {
-			// Skip rows with invalid usernames.
-			log.Printf("Invalid Reddit username column %d, row %d: '%s'", usernameIndex, i, username)
-			continue
-		}
+// summonBatch is one summon comment, and the users it tags.
+type summonBatch struct {
+	usernames []string
+	text      string
+}
 
-		// Build the summon string.
-		if seen%maxRedditTagsPerComment == 0 {
-			curr = "Summoning contestants "
-		} else {
-			curr += ", "
+// Build the contents of the Reddit comments that will summon the given users, from the profile's summon template.
+func (s *summoner) buildSummonBatches(ctx context.Context, p *CompetitionProfile, data *commentData, usernames []string) ([]*summonBatch, error) {
+	var batches = []*summonBatch{}
+	for start := 0; start < len(usernames); start += s.config.MaxRedditTagsPerComment {
+		end := start + s.config.MaxRedditTagsPerComment
+		if end > len(usernames) {
+			end = len(usernames)
 		}
-		curr = curr + username
-		seen = seen + 1
-		if seen%maxRedditTagsPerComment == 0 && seen > 0 {
-			summons = append(summons, curr)
-			seen = 0
+		group := usernames[start:end]
+		text, err := p.renderSummonComment(data.withUsernames(group), s.config.MaxRedditTagsPerComment)
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to render summon comment", "err", err)
+			return nil, err
 		}
+		batches = append(batches, &summonBatch{usernames: group, text: text})
 	}
-	if seen > 0 {
-		summons = append(summons, curr)
-	}
-	// If we finished processing returned users, return empty last user.
-	if len(resp.Values) == usersToProcess {
-		username = ""
-	}
-	return summons, username, nil
+	return batches, nil
 }
 
-// Summons contestants to a Reddit competition post.
-func (s *summoner) summonContestants(ctx context.Context, post *geddit.Submission, pageToken *PageToken) error {
+// Summons contestants to a Reddit competition post, resuming from the phase recorded in its
+// PageToken, or discovering the post if pageToken is nil.
+func (s *summoner) summonContestants(ctx context.Context, p *CompetitionProfile, post *geddit.Submission, pageToken *PageToken) error {
+	logger := loggerFrom(ctx)
 	if pageToken != nil {
-		log.Printf("Summoning contestants under comment '%s' starting with %s!", pageToken.MainCommentFullID, pageToken.LastProcessedUser)
+		logger.Info("Summoning contestants under main comment", "mainComment", pageToken.MainCommentFullID, "lastUser", pageToken.LastProcessedUser)
 	} else {
-		log.Printf("Summoning contestants to post '%s'!", post.FullID)
+		logger.Info("Summoning contestants to post")
 	}
 
-	lpu := ""
-	if pageToken != nil {
-		lpu = pageToken.LastProcessedUser
+	// Summon the users in the post's subscriber snapshot, so that edits to the list while summoning
+	// is in progress do not cause anyone to be summoned twice or skipped.
+	snap, firstIndex, err := s.subscriberSnapshot(ctx, p, post.FullID, pageToken)
+	if err != nil {
+		return err
+	}
+	if pageToken == nil {
+		// Mark the post handled together with saving its snapshot and PageToken, before anything is
+		// posted, so that a run that dies part-way through is resumed rather than started over.
+		pageToken = newPageToken(phaseDiscovered, "", snap, 0)
+		if err := s.updatePost(ctx, p, post.FullID, &postUpdate{MarkHandled: true, Snapshot: snap, PageToken: pageToken}); err != nil {
+			logger.Error("Failed to record discovery of post", "err", err)
+			return err
+		}
+		snap.saved = true
 	}
-	// Build the summon string from Google Sheets data. If there are no subscribed users, we're done.
-	summons, lastUser, err := s.buildSummonStrings(lpu)
+	subscribers := snap.subscribers()
+	rep := s.postReport(p, post.FullID)
+	rep.Phase, rep.NextIndex, rep.Subscribers = pageToken.phase(), firstIndex, len(subscribers)
+	// Skip users the ledger says were already tagged, and retry those whose summon failed.
+	ledger, err := s.summonLedger(ctx, p, post.FullID)
 	if err != nil {
 		return err
 	}
-	if len(summons) == 0 {
-		return nil
+	usernames, nextIndex := selectUsersToSummon(ctx, subscribers, firstIndex, s.config.MaxUsersPerSession, ledger)
+	logger.Info("Selected users to summon", "users", len(usernames), "subscribers", len(subscribers), "nextIndex", nextIndex)
+	data := newCommentData(p, post, len(subscribers), time.Now())
+	// Build the summon strings. If there are no more users to summon, we're done.
+	batches, err := s.buildSummonBatches(ctx, p, data, usernames)
+	if err != nil {
+		return err
+	}
+	if len(batches) == 0 && nextIndex == len(subscribers) {
+		return s.finishSummoning(ctx, p, post.FullID, newSummonOutcome(snap, ledger), nil /*cause*/)
 	}
 
-	// If this is the first time processing this post, make the parent comment. Otherwise get the comment from the PageToken.
-	var mainCommentFullID = ""
+	// If the main comment on which all users will be summoned was not posted yet, post it.
+	// Otherwise get it from Reddit so we can make child comments.
 	var mainComment *geddit.Comment
-	if pageToken == nil {
-		// Make the main comment on which all users will be summoned.
-		mainCommentText := "This month's competition is live! Please submit your piece and/or vote for your favorite entries!\n\n" +
-			"To subscribe to future monthly competition posts, please fill out [this form](https://forms.gle/4seHL2YRRGTnT96E6)" +
-			" and our friendly robot will summon you. You may unsubscribe at any time using the same form!"
-		log.Print(mainCommentText)
-		var err error
-		mainComment, err = s.redditSession.Reply(post, mainCommentText)
+	if pageToken.phase() == phaseDiscovered {
+		text, err := p.renderMainComment(data)
 		if err != nil {
-			log.Printf("Failed to make parent Reddit comment on competition post: %v", err)
+			logger.Error("Failed to render main comment", "err", err)
+			return err
+		}
+		logger.Debug("Posting main comment", "text", text)
+		mainComment, err = s.redditSession.Reply(post, text)
+		if err != nil {
+			logger.Error("Failed to make parent Reddit comment on competition post", "err", err)
+			s.recordComment(p, post.FullID, "main", nil /*usernames*/, err)
+			if isPermanentRedditError(err) {
+				// The post was deleted or locked, so no one can be summoned to it.
+				return s.abandonSummoning(ctx, p, post.FullID, newSummonOutcome(snap, ledger), err)
+			}
+			return err
+		}
+		s.recordComment(p, post.FullID, "main", nil /*usernames*/, nil /*err*/)
+		pageToken = newPageToken(phaseMainCommentPosted, mainComment.FullID, snap, firstIndex)
+		if err := s.saveSummonProgress(ctx, p, post.FullID, snap, pageToken, nil /*records*/); err != nil {
 			return err
 		}
-		mainCommentFullID = mainComment.FullID
 	} else {
-		mainCommentFullID = pageToken.MainCommentFullID
-	}
-
-	// If we don't already have it, get the main comment from Reddit so we can make child comments.
-	if mainComment == nil {
-		mainComment, err = s.redditSession.Comment(subreddit, mainCommentFullID)
+		mainComment, err = s.redditSession.Comment(p.Subreddit, pageToken.MainCommentFullID)
 		if err != nil {
-			log.Printf("Failed to fetch main comment from Reddit: %v", err)
+			logger.Error("Failed to fetch main comment from Reddit", "mainComment", pageToken.MainCommentFullID, "err", err)
+			if isPermanentRedditError(err) {
+				// The main comment is gone, so there is nowhere left to summon anyone.
+				return s.abandonSummoning(ctx, p, post.FullID, newSummonOutcome(snap, ledger), err)
+			}
 			return err
 		}
 	}
 
-	ptKey := datastore.NameKey("PageToken", post.FullID, nil)
-	if lastUser != "" {
-		// If not all users can be processed, write or update the PageToken to Datastore.
-		pt := &PageToken{
-			MainCommentFullID: mainCommentFullID,
-			LastProcessedUser: lastUser,
+	// Make the child comments on the original Reddit comment, recording each user's summon in the
+	// ledger before and after, so that no one is tagged twice. Once a comment is posted, its users'
+	// records and the PageToken advanced past them are committed together.
+	ctx = withLogAttrs(ctx, "mainComment", mainComment.FullID)
+	logger = loggerFrom(ctx)
+	progress := newSnapshotProgress(snap, firstIndex)
+	for i, batch := range batches {
+		if s.shuttingDown() {
+			// Every comment posted so far is committed, so the next run resumes from here.
+			logger.Info("Stopping summoning to shut down", "lastUser", pageToken.LastProcessedUser)
+			return nil
 		}
-		log.Printf("Saving PageToken with main comment id %s and last user %s", pt.MainCommentFullID, pt.LastProcessedUser)
-		if _, err := s.datastoreClient.Put(ctx, ptKey, pt); err != nil {
-			log.Printf("Failed to post PageToken to Datastore: %v", err)
+		batchLogger := logger.With("batch", i+1, "batches", len(batches), "users", len(batch.usernames))
+		batchLogger.Info("Posting summon comment")
+		batchLogger.Debug("Summon comment", "text", batch.text)
+		if err := s.renewPostLease(ctx, p, post.FullID); err != nil {
 			return err
 		}
-	} else {
-		// If all users have been processed, delete the PageToken from Datastore.
-		if err := s.datastoreClient.Delete(ctx, ptKey); err != nil {
-			if err != datastore.ErrNoSuchEntity {
-				log.Printf("Failed to delete PageToken from Datastore: %v", err)
+		if err := s.updateSummonLedger(ctx, p, ledger, batch.usernames, summonPending, ""); err != nil {
+			return err
+		}
+		comment, err := s.redditSession.Reply(mainComment, batch.text)
+		if err != nil {
+			batchLogger.Error("Failed to make child Reddit comment on competition post", "err", err)
+			s.recordComment(p, post.FullID, "summon", batch.usernames, err)
+			if err := s.updateSummonLedger(ctx, p, ledger, batch.usernames, summonFailed, ""); err != nil {
 				return err
 			}
+			if isPermanentRedditError(err) {
+				// The post or main comment was deleted or locked, so no further summons can be made.
+				return s.abandonSummoning(ctx, p, post.FullID, newSummonOutcome(snap, ledger), err)
+			}
+			continue
+		}
+		s.recordComment(p, post.FullID, "summon", batch.usernames, nil /*err*/)
+		records := ledger.update(batch.usernames, summonSent, comment.FullID)
+		pageToken = newPageToken(phaseBatchesInProgress, mainComment.FullID, snap, progress.advance(batch.usernames))
+		if err := s.saveSummonProgress(ctx, p, post.FullID, snap, pageToken, records); err != nil {
+			return err
 		}
 	}
 
-	// Make the child comments on the original Reddit comment.
-	for _, summonText := range summons {
-		log.Printf("\t%s", summonText)
-		_, err = s.redditSession.Reply(mainComment, summonText)
-		if err != nil {
-			log.Printf("Failed to make child Reddit comment on competition post: %v", err)
-			continue
-		}
+	// If all users have been processed, and none are left to retry, summoning is complete.
+	// Otherwise, advance the PageToken past every user looked at in this session.
+	if nextIndex == len(subscribers) && len(ledger.retries()) == 0 {
+		return s.finishSummoning(ctx, p, post.FullID, newSummonOutcome(snap, ledger), nil /*cause*/)
 	}
-	return nil
+	return s.saveSummonProgress(ctx, p, post.FullID, snap, newPageToken(phaseBatchesInProgress, mainComment.FullID, snap, nextIndex), nil /*records*/)
 }
 
-func (s *summoner) handlePossibleCompetitionPost(ctx context.Context, post *geddit.Submission) error {
-	if strings.HasPrefix(post.Title, "[MOD]") && strings.Contains(post.Title, "competition") && !strings.Contains(post.Title, "winner") {
-		// Check if this post is already in progress. If so, continue where we left off.
-		postKey := datastore.NameKey("PageToken", post.FullID, nil)
-		pt := PageToken{}
-		if err := s.datastoreClient.Get(ctx, postKey, &pt); err == nil {
-			log.Printf("Competition post processing in progress! Continuing with user %s!", pt.LastProcessedUser)
-			if err := s.summonContestants(ctx, post, &pt); err != nil {
-				log.Printf("Failed to continue summoning contestants to post %s: %v", post.FullID, err)
-				return err
+// ruleEnv returns the environment in which detection rules are evaluated.
+func (s *summoner) ruleEnv() *ruleEnv {
+	return &ruleEnv{
+		now: time.Now(),
+		moderators: func(subreddit string) (map[string]bool, error) {
+			key := strings.ToLower(subreddit)
+			if mods, ok := s.moderators[key]; ok {
+				return mods, nil
 			}
-			return nil
-		}
-
-		// If the post is not in progress, check if this post has already been handled. If so, we're done!
-		postKey = datastore.NameKey("Entity", post.FullID, nil)
-		e := struct{}{}
-		if err := s.datastoreClient.Get(ctx, postKey, &e); err != datastore.ErrNoSuchEntity {
-			if err == nil {
-				log.Print("Post has already been processed!")
-				return nil
+			names, err := s.redditSession.Moderators(subreddit)
+			if err != nil {
+				return nil, err
+			}
+			mods := map[string]bool{}
+			for _, name := range names {
+				mods[strings.ToLower(name)] = true
+			}
+			if s.moderators == nil {
+				s.moderators = map[string]map[string]bool{}
 			}
-			log.Printf("Error checking for existence of Datastore entity for post: %v", err)
+			s.moderators[key] = mods
+			return mods, nil
+		},
+	}
+}
+
+// explainCompetitionPost reports whether the post is one of the profile's competition posts,
+// and explains which of the profile's detection rules held.
+func (s *summoner) explainCompetitionPost(p *CompetitionProfile, post *redditPost) (bool, string, error) {
+	return p.Detection.explain(post, s.ruleEnv())
+}
+
+func (s *summoner) handlePossibleCompetitionPost(ctx context.Context, p *CompetitionProfile, post *redditPost) error {
+	isCompetitionPost, err := p.Detection.matches(post, s.ruleEnv())
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to check whether post is a competition post", "post", post.FullID, "err", err)
+		return err
+	}
+	if !isCompetitionPost {
+		return nil
+	}
+	competitionPostsMatched.inc(p.Name)
+	s.profileReport(p).PostsMatched++
+	s.plan.recordMatch(p, &post.Submission)
+	ctx = withLogAttrs(ctx, "post", post.FullID)
+	// Subscribers are only summoned once the competition opens.
+	opens, err := s.competitionOpens(ctx, p, post.FullID)
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(opens) {
+		loggerFrom(ctx).Info("Competition has not opened yet", "opens", opens)
+		s.postReport(p, post.FullID).Skipped = "opens at " + opens.Format(time.RFC3339)
+		return nil
+	}
+	// Only one run at a time may read and advance the post's PageToken.
+	return s.withPostLease(ctx, p, post.FullID, func() error {
+		return s.handleCompetitionPost(ctx, p, post)
+	})
+}
+
+// handleCompetitionPost starts or continues summoning to a competition post. The caller must hold
+// the post's lease.
+func (s *summoner) handleCompetitionPost(ctx context.Context, p *CompetitionProfile, post *redditPost) error {
+	// Check if this post is already in progress. If so, continue where we left off.
+	logger := loggerFrom(ctx)
+	pt, err := s.store.PageToken(ctx, p.Namespace, post.FullID)
+	if err == nil {
+		logger.Info("Competition post processing in progress", "phase", pt.phase(), "lastUser", pt.LastProcessedUser)
+		if err := s.summonContestants(ctx, p, &post.Submission, pt); err != nil {
+			logger.Error("Failed to continue summoning contestants to post", "err", err)
 			return err
 		}
-		log.Print("Competition post has not been processed yet!")
+		return nil
+	}
+	if err != errNotFound {
+		logger.Error("Failed to fetch PageToken for post", "err", err)
+		return err
+	}
+
+	// If the post is not in progress, check if this post has already been handled. If so, we're done!
+	handled, err := s.store.IsHandled(ctx, p.Namespace, post.FullID)
+	if err != nil {
+		logger.Error("Failed to check whether post was handled", "err", err)
+		return err
+	}
+	if handled {
+		logger.Debug("Post has already been processed")
+		rep := s.postReport(p, post.FullID)
+		rep.Phase, rep.Skipped = phaseComplete, "already handled"
+		return nil
+	}
+	logger.Info("Competition post has not been processed yet")
+
+	// Handle the post. Summoning marks it handled before posting anything.
+	if err := s.summonContestants(ctx, p, &post.Submission, nil /*PageToken*/); err != nil {
+		logger.Error("Failed to summon contestants to post", "err", err)
+		return err
+	}
+	return nil
+}
 
-		// Record handling of this post. This must be done before the actual handling, otherwise
-		// posts will be handled again if the function times out.
-		if _, err := s.datastoreClient.Put(ctx, postKey, &e); err != nil {
-			log.Printf("Failed to create Datastore entity to record handling of post: %v", err)
+// handlePageToken continues summoning to an in-progress post, under the post's lease.
+func (s *summoner) handlePageToken(ctx context.Context, p *CompetitionProfile, postID string) error {
+	ctx = withLogAttrs(ctx, "post", postID)
+	logger := loggerFrom(ctx)
+	return s.withPostLease(ctx, p, postID, func() error {
+		// Read the PageToken again now that the lease is held, since the run that held it before
+		// may have advanced or finished it.
+		pt, err := s.store.PageToken(ctx, p.Namespace, postID)
+		if err == errNotFound {
+			return nil
+		}
+		if err != nil {
+			logger.Error("Failed to fetch PageToken for post", "err", err)
 			return err
 		}
+		logger.Info("Continuing summoning to in-progress post", "phase", pt.phase(), "lastUser", pt.LastProcessedUser)
 
-		// Handle the post.
-		if err := s.summonContestants(ctx, post, nil /*PageToken*/); err != nil {
-			log.Printf("Failed to summon contestants to post %s: %v", post.FullID, err)
+		// Get the reddit post
+		if err := s.summonContestants(ctx, p, &geddit.Submission{FullID: postID}, pt); err != nil {
+			logger.Error("Failed to continue summoning contestants to post", "err", err)
 			return err
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
-func (s *summoner) handlePageToken(ctx context.Context, postID string, pt *PageToken) error {
-	log.Printf("Page token handling in progress! Continuing with user %s!", pt.LastProcessedUser)
+// Fetches recent Reddit posts for every competition profile and acts on them as necessary.
+// A failure in one profile does not prevent the others from being processed. It returns a report
+// of what the run did, even if parts of it failed.
+func (s *summoner) checkPosts(ctx context.Context) (*runReport, error) {
+	return s.checkProfiles(ctx, s.config.Profiles, true /*inbox*/)
+}
 
-	// Get the reddit post
-	if err := s.summonContestants(ctx, &geddit.Submission{FullID: postID}, pt); err != nil {
-		log.Printf("Failed to continue summoning contestants to post '%s': %v", postID, err)
-		return err
+// checkProfiles is checkPosts for only the given profiles. Subscription commands in the inbox may
+// concern any profile, so they are only handled if inbox is set.
+func (s *summoner) checkProfiles(ctx context.Context, profiles []*CompetitionProfile, inbox bool) (*runReport, error) {
+	ctx = withLogAttrs(ctx, "runID", s.runID)
+	logger := loggerFrom(ctx)
+	report := &runReport{RunID: s.runID, StartedAt: time.Now(), DryRun: s.plan != nil}
+	s.report = report
+	defer func() { s.report = nil }()
+	// Retry Reddit calls only within the run's deadline, rather than that of the session.
+	defer bindRedditContext(s.redditSession, ctx)()
+
+	var errs []error
+	// Moderators may change between runs.
+	s.moderators = nil
+	// Handle subscription commands first, so that new subscribers are summoned right away.
+	if inbox {
+		if err := s.checkInbox(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("inbox: %w", err))
+		}
 	}
-	return nil
+	for _, p := range profiles {
+		if s.shuttingDown() {
+			break
+		}
+		pr := report.profile(p)
+		if err := s.checkProfilePosts(withLogAttrs(ctx, "profile", p.Name), p); err != nil {
+			logger.Error("Failed to process posts for profile", "profile", p.Name, "err", err)
+			pr.Error = err.Error()
+			errs = append(errs, fmt.Errorf("profile %s: %w", p.Name, err))
+		}
+	}
+
+	duration := time.Since(report.StartedAt)
+	report.Duration = duration.String()
+	report.Stopped = s.shuttingDown()
+	for _, err := range errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if s.plan != nil {
+		report.Plan = s.plan.steps
+	}
+	result := "success"
+	if len(errs) > 0 {
+		result = "failure"
+	}
+	runsTotal.inc(result)
+	runDuration.observe(duration.Seconds())
+	logger.Info("Finished checking posts", "errors", len(errs), "duration", duration)
+	if len(errs) > 0 {
+		s.notifyRunFailed(ctx, report)
+	}
+	return report, errors.Join(errs...)
 }
 
-// Fetches recent Reddit posts and acts on them as necessary.
-func (s *summoner) checkPosts(ctx context.Context) error {
+// Fetches recent Reddit posts in the profile's subreddit and acts on them as necessary.
+func (s *summoner) checkProfilePosts(ctx context.Context, p *CompetitionProfile) error {
 	// Get submissions from the subreddit, sorted by new, and process them.
-	submissions, err := s.redditSession.SubredditSubmissions(subreddit, geddit.NewSubmissions, geddit.ListingOptions{
+	submissions, err := s.redditSession.SubredditPosts(p.Subreddit, geddit.NewSubmissions, geddit.ListingOptions{
 		Limit: 20,
 	})
 	if err != nil {
-		log.Printf("Failed to list recent subreddit submissions: %v", err)
+		loggerFrom(ctx).Error("Failed to list recent submissions", "subreddit", p.Subreddit, "err", err)
 		return err
 	}
 	for _, post := range submissions {
+		if s.shuttingDown() {
+			return nil
+		}
+		postsScanned.inc(p.Name)
+		s.profileReport(p).PostsSeen++
+		// Record the competition post and its calendar, so that it advances through its phases
+		// from now on.
+		if err := s.trackCompetitionPost(ctx, p, post); err != nil {
+			s.postReport(p, post.FullID).Error = err.Error()
+			return err
+		}
 		// Check for monthly competition post.
-		if err := s.handlePossibleCompetitionPost(ctx, post); err != nil {
+		if err := s.handlePossibleCompetitionPost(ctx, p, post); err != nil {
+			s.postReport(p, post.FullID).Error = err.Error()
 			return err
 		}
+		// Check for a winners post, to summon the users who opted in to results.
+		if rp := p.resultsProfile(); rp != nil {
+			if err := s.handlePossibleCompetitionPost(withLogAttrs(ctx, "profile", rp.Name), rp, post); err != nil {
+				s.postReport(rp, post.FullID).Error = err.Error()
+				return err
+			}
+		}
 
 		// Add more checks here!
 	}
 
-	// Get PageToken entities from Datastore, and process them.
-	tokens := []*PageToken{}
-	keys, err := s.datastoreClient.GetAll(ctx, datastore.NewQuery("PageToken"), &tokens)
-	if err != nil {
-		log.Printf("Failed to list unresolved PageToken entities from Datastore: %v", err)
+	// Get the profile's in-progress posts from the store, and process them.
+	if err := s.handleInProgressPosts(ctx, p); err != nil {
+		return err
 	}
-	for i, key := range keys {
-		if err := s.handlePageToken(ctx, key.Name, tokens[i]); err != nil {
+	if rp := p.resultsProfile(); rp != nil {
+		if err := s.handleInProgressPosts(withLogAttrs(ctx, "profile", rp.Name), rp); err != nil {
 			return err
 		}
 	}
 
-	log.Print("DONE")
+	// Advance the profile's competitions that are not closed through their calendar.
+	if err := s.advanceCompetitions(ctx, p); err != nil {
+		return err
+	}
+	if err := s.submitAnnouncements(ctx, p); err != nil {
+		return err
+	}
+	return s.rewardWinners(ctx, p)
+}
+
+// handleInProgressPosts continues summoning to each of the profile's in-progress posts.
+func (s *summoner) handleInProgressPosts(ctx context.Context, p *CompetitionProfile) error {
+	posts, err := s.store.InProgressPosts(ctx, p.Namespace)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to list unresolved PageTokens", "err", err)
+	} else {
+		pageTokensOutstanding.set(float64(len(posts)), p.Name)
+	}
+	for _, post := range posts {
+		if s.shuttingDown() {
+			return nil
+		}
+		if err := s.handlePageToken(ctx, p, post.PostID); err != nil {
+			s.postReport(p, post.PostID).Error = err.Error()
+			return err
+		}
+	}
 	return nil
 }
 
-func setupSummoner(ctx context.Context, useCreds bool) (*summoner, error) {
+func setupSummoner(ctx context.Context, config *Config, useCreds bool) (*summoner, error) {
 	// Authenticate with Reddit.
 	redditClientSecret := os.Getenv("REDDIT_CLIENT_SECRET")
 	if redditClientSecret == "" {
-		log.Print("REDDIT_CLIENT_SECRET not set")
+		slog.Error("REDDIT_CLIENT_SECRET not set")
 		return nil, errors.New("REDDIT_CLIENT_SECRET not set")
 	}
-	redditSession, err := geddit.NewOAuthSession(
-		redditClientID,
+	gedditSession, err := geddit.NewOAuthSession(
+		config.RedditClientID,
 		redditClientSecret,
 		"gedditAgent v1 fork by khipkin",
 		"redirect.url",
 	)
 	if err != nil {
-		log.Printf("Failed to create new Reddit OAuth session: %v", err)
+		slog.Error("Failed to create new Reddit OAuth session", "err", err)
 		return nil, err
 	}
+	// Retry failed requests, logging in again when the token expires.
+	redditSession := newRetryingRedditSession(ctx, &redditClient{OAuthSession: gedditSession})
 	redditPassword := os.Getenv("REDDIT_PASSWORD")
 	if redditPassword == "" {
-		log.Print("REDDIT_PASSWORD not set")
+		slog.Error("REDDIT_PASSWORD not set")
 		return nil, errors.New("REDDIT_PASSWORD not set")
 	}
-	if err = redditSession.LoginAuth(redditUsername, redditPassword); err != nil {
-		log.Printf("Failed to authenticate with Reddit: %v", err)
+	if err = redditSession.LoginAuth(config.RedditUsername, redditPassword); err != nil {
+		slog.Error("Failed to authenticate with Reddit", "err", err)
 		return nil, err
 	}
 
 	// To prevent Reddit rate limiting errors, throttle requests.
 	redditSession.Throttle(5 * time.Second)
 
-	// Create an authenticated Google Cloud Datastore client.
-	var dsClient *datastore.Client
-	if useCreds {
-		dsClient, err = datastore.NewClient(ctx,
-			googleCloudProjectID,
-			option.WithCredentialsFile(googleCredentialsFile),
-		)
-	} else {
-		dsClient, err = datastore.NewClient(ctx, googleCloudProjectID)
-	}
+	// Open the store holding the bot's state.
+	st, err := openStore(ctx, config, useCreds)
 	if err != nil {
-		log.Printf("Failed to create a new Datastore client: %v", err)
+		slog.Error("Failed to open store", "err", err)
 		return nil, err
 	}
 
-	// Create an authenticated Google Sheets service.
+	// Create an authenticated Google Sheets service, if any profile reads its subscribers from Sheets.
 	var sheetsService *sheets.Service
-	if useCreds {
-		sheetsService, err = sheets.NewService(ctx,
-			option.WithScopes(sheets.SpreadsheetsReadonlyScope),
-			option.WithCredentialsFile(googleCredentialsFile),
-		)
-	} else {
-		sheetsService, err = sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsReadonlyScope))
+	if config.readsSheets() {
+		if useCreds {
+			sheetsService, err = sheets.NewService(ctx,
+				option.WithScopes(sheets.SpreadsheetsReadonlyScope),
+				option.WithCredentialsFile(config.GoogleCredentialsFile),
+			)
+		} else {
+			sheetsService, err = sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsReadonlyScope))
+		}
+		if err != nil {
+			slog.Error("Failed to create Google Sheets service", "err", err)
+			return nil, err
+		}
 	}
-	if err != nil {
-		log.Printf("Failed to create Google Sheets service: %v", err)
+
+	s := newSummoner(config, redditSession, st, sheetsService)
+	if s.notifiers, err = newNotifiers(config, redditSession); err != nil {
+		slog.Error("Failed to create notifiers", "err", err)
 		return nil, err
 	}
-
-	return newSummoner(redditSession, dsClient, sheetsService), nil
+	return s, nil
 }
 
 // HTTPInvoke is the method that is invoked in Google Cloud Functions when an HTTP request is received.
-func HTTPInvoke(http.ResponseWriter, *http.Request) {
-	ctx := context.Background()
-	s, err := setupSummoner(ctx, false)
+// The config file, if any, is named by the CROSSSTITCH_BOT_CONFIG environment variable.
+// If admin credentials are configured, requests must be authenticated with them, as those to the
+// admin API are. It responds with the run's report as JSON, with status 200 if the run succeeded
+// and 500 if any part of it failed. With the dry_run=true query parameter, nothing is posted or written; the
+// report holds the plan instead. The run, and its retries of Reddit calls, stop when the request
+// is canceled or its deadline passes.
+func HTTPInvoke(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	fail := func(msg string, err error) {
+		slog.Error(msg, "err", err)
+		writeJSON(w, http.StatusInternalServerError, &runReport{StartedAt: time.Now(), Errors: []string{fmt.Sprintf("%s: %v", msg, err)}})
+	}
+	config, err := loadConfig(os.Getenv(configEnvVar), os.LookupEnv)
+	if err != nil {
+		fail("Failed to load config", err)
+		return
+	}
+	if err := setupLogging(config.Log); err != nil {
+		fail("Failed to set up logging", err)
+		return
+	}
+	if config.Admin.enabled() {
+		if err := config.Admin.authenticate(r, time.Now(), cloudFunctionSignatures); err != nil {
+			slog.Warn("Refused unauthenticated request", "err", err)
+			writeJSONError(w, http.StatusUnauthorized, err)
+			return
+		}
+	}
+	s, err := setupSummoner(ctx, config, false)
 	if err != nil {
-		log.Fatalf("Failed to setup summoner: %v", err)
+		fail("Failed to setup summoner", err)
+		return
+	}
+	defer s.store.Close()
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if dryRun {
+		s.enableDryRun()
+	}
+	report, err := s.checkPosts(ctx)
+	if !dryRun {
+		if err := flushMetrics(ctx, config.Metrics); err != nil {
+			slog.Error("Failed to flush metrics", "err", err)
+		}
 	}
-	if err := s.checkPosts(ctx); err != nil {
-		log.Fatalf("Failed to process posts: %v", err)
+	status := http.StatusOK
+	if err != nil {
+		slog.Error("Failed to process posts", "err", err)
+		status = http.StatusInternalServerError
 	}
+	writeJSON(w, status, report)
 }
 
-// main is the method that is invoked when running the program locally.
+// main is the method that is invoked when running the program locally. It runs the command named
+// by its arguments; see usage.
 func main() {
-	ctx := context.Background()
-	s, err := setupSummoner(ctx, true)
+	configPath := flag.String("config", os.Getenv(configEnvVar), "path to the YAML or JSON config file")
+	dryRun := flag.Bool("dry-run", false, "print what would be posted and written, without doing it")
+	profile := flag.String("profile", "", "name of the only profile to act on")
+	flag.Usage = usage
+	flag.Parse()
+	cmd, args, err := parseCommand(flag.Args(), *dryRun)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config, err := loadConfig(*configPath, os.LookupEnv)
 	if err != nil {
-		log.Fatalf("Failed to setup summoner: %v", err)
+		fatal("Failed to load config", "err", err)
+	}
+	if err := setupLogging(config.Log); err != nil {
+		fatal("Failed to set up logging", "err", err)
 	}
-	if err := s.checkPosts(ctx); err != nil {
-		log.Fatalf("Failed to process posts: %v", err)
+	s, err := setupSummoner(ctx, config, true)
+	if err != nil {
+		fatal("Failed to setup summoner", "err", err)
+	}
+	defer s.store.Close()
+	s.shutdown = handleShutdownSignals(cancel, config.Serve.ShutdownTimeout)
+
+	c := &cli{s: s, profile: *profile, out: os.Stdout}
+	if err := cmd.run(c, ctx, args); err != nil {
+		fatal("Command failed", "command", cmd.name, "err", err)
 	}
 }
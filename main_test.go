@@ -2,169 +2,353 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"reflect"
 	"testing"
 	"time"
 
-	"google.golang.org/api/sheets/v4"
-
 	"cloud.google.com/go/datastore"
 	"github.com/khipkin/geddit"
 )
 
 type fakeRedditSession struct {
 	numComments int
-	submittions []*geddit.Submission
+	submittions []*redditPost
+	moderators  []string
+	// Unread inbox messages, and the IDs of those marked read.
+	inbox      []*inboxMessage
+	markedRead []string
+	// Text of every reply, by the full ID of the thing replied to.
+	replies map[string][]string
+	// failReply, if set, makes Reply fail for the comments it returns true for.
+	failReply func(comment string) bool
+	// Every private message sent.
+	messages []*sentMessage
+	// failMessage, if set, makes SendMessage fail with the error it returns for a recipient.
+	failMessage func(to string) error
+	// Top-level comments, by the full ID of the post they were made on.
+	comments map[string][]*geddit.Comment
+	// Comments that Comment finds, but that PostComments leaves out of its listing.
+	unlisted map[string]*geddit.Comment
+	// Posts that Post finds, but that are too old for SubredditPosts to list.
+	older []*redditPost
+	// Every post submitted.
+	posts []*submittedPost
+	// The full IDs of the posts locked.
+	locked []string
+	// User flair set, by username.
+	flair map[string]string
+}
+
+type submittedPost struct {
+	Subreddit, Title, Text string
+}
+
+type sentMessage struct {
+	To, Subject, Text string
 }
 
 func (frs *fakeRedditSession) LoginAuth(username, password string) error { return nil }
 func (frs *fakeRedditSession) Reply(r geddit.Replier, comment string) (*geddit.Comment, error) {
+	if frs.failReply != nil && frs.failReply(comment) {
+		return nil, errors.New("fake Reddit failure")
+	}
 	frs.numComments++
+	if frs.replies == nil {
+		frs.replies = map[string][]string{}
+	}
+	var parentID string
+	switch parent := r.(type) {
+	case *geddit.Submission:
+		parentID = parent.FullID
+	case *geddit.Comment:
+		parentID = parent.FullID
+	}
+	frs.replies[parentID] = append(frs.replies[parentID], comment)
 	return &geddit.Comment{FullID: "uniqueComment"}, nil
 }
-func (frs *fakeRedditSession) SubredditSubmissions(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*geddit.Submission, error) {
+func (frs *fakeRedditSession) SubredditPosts(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*redditPost, error) {
 	return frs.submittions, nil
 }
+func (frs *fakeRedditSession) Moderators(subreddit string) ([]string, error) {
+	return frs.moderators, nil
+}
 func (frs *fakeRedditSession) Throttle(interval time.Duration) {}
 func (frs *fakeRedditSession) Comment(subreddit, fullID string) (*geddit.Comment, error) {
+	if c, ok := frs.unlisted[fullID]; ok {
+		return c, nil
+	}
 	return &geddit.Comment{FullID: fullID}, nil
 }
+func (frs *fakeRedditSession) Post(subreddit, fullID string) (*redditPost, error) {
+	for _, post := range append(frs.submittions, frs.older...) {
+		if post.FullID == fullID {
+			return post, nil
+		}
+	}
+	return nil, &PermanentRedditError{Op: "get post " + fullID, Err: &redditAPIError{Method: http.MethodGet, Path: "/api/info", StatusCode: http.StatusNotFound}}
+}
+func (frs *fakeRedditSession) PostComments(subreddit, postFullID string) ([]*geddit.Comment, error) {
+	return frs.comments[postFullID], nil
+}
+func (frs *fakeRedditSession) SendMessage(to, subject, text string) error {
+	if frs.failMessage != nil {
+		if err := frs.failMessage(to); err != nil {
+			return err
+		}
+	}
+	frs.messages = append(frs.messages, &sentMessage{To: to, Subject: subject, Text: text})
+	return nil
+}
+func (frs *fakeRedditSession) SubmitPost(subreddit, title, text string) (string, error) {
+	frs.posts = append(frs.posts, &submittedPost{Subreddit: subreddit, Title: title, Text: text})
+	return fmt.Sprintf("t3_submitted%d", len(frs.posts)), nil
+}
+func (frs *fakeRedditSession) LockPost(fullID string) error {
+	frs.locked = append(frs.locked, fullID)
+	return nil
+}
+func (frs *fakeRedditSession) SetUserFlair(subreddit, username, text, cssClass string) error {
+	if frs.flair == nil {
+		frs.flair = map[string]string{}
+	}
+	frs.flair[username] = text
+	return nil
+}
+func (frs *fakeRedditSession) UnreadMessages() ([]*inboxMessage, error) {
+	read := map[string]bool{}
+	for _, id := range frs.markedRead {
+		read[id] = true
+	}
+	var unread []*inboxMessage
+	for _, msg := range frs.inbox {
+		if !read[msg.FullID] {
+			unread = append(unread, msg)
+		}
+	}
+	return unread, nil
+}
+func (frs *fakeRedditSession) MarkMessagesRead(fullIDs ...string) error {
+	frs.markedRead = append(frs.markedRead, fullIDs...)
+	return nil
+}
 
 type fakeDatastoreClient struct {
-	lastPut map[string]map[string]interface{}
+	// Entities by namespace and kind, then by key name.
+	entities map[string]map[string]interface{}
+}
+
+func fakeDatastoreKind(namespace, kind string) string {
+	return namespace + "/" + kind
 }
 
 func (fdc *fakeDatastoreClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
-	src, ok := fdc.lastPut[key.Kind][key.Name]
+	src, ok := fdc.entities[fakeDatastoreKind(key.Namespace, key.Kind)][key.Name]
 	if !ok {
 		return datastore.ErrNoSuchEntity
 	}
-	if dstPt, ok := dst.(*PageToken); ok {
-		srcPt := src.(*PageToken)
-		dstPt.LastProcessedUser = srcPt.LastProcessedUser
-		return nil
+	srcVal, dstVal := reflect.ValueOf(src).Elem(), reflect.ValueOf(dst).Elem()
+	if srcVal.Type() == dstVal.Type() {
+		dstVal.Set(srcVal)
 	}
 	return nil
 }
 func (fdc *fakeDatastoreClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) (keys []*datastore.Key, err error) {
-	vals := fdc.lastPut["PageToken"]
-	k := []*datastore.Key{}
-	dstPts := dst.(*[]*PageToken)
-	for id, val := range vals {
-		*dstPts = append(*dstPts, val.(*PageToken))
-		k = append(k, datastore.NameKey("PageToken", id, nil))
-	}
-	return k, nil
+	// datastore.Query does not expose its kind and namespace, so read them reflectively.
+	qVal := reflect.ValueOf(q).Elem()
+	namespace, kind := qVal.FieldByName("namespace").String(), qVal.FieldByName("kind").String()
+	dstVal := reflect.ValueOf(dst).Elem()
+	for name, val := range fdc.entities[fakeDatastoreKind(namespace, kind)] {
+		dstVal.Set(reflect.Append(dstVal, reflect.ValueOf(val)))
+		k := datastore.NameKey(kind, name, nil)
+		k.Namespace = namespace
+		keys = append(keys, k)
+	}
+	return keys, nil
 }
 func (fdc *fakeDatastoreClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
-	fdc.lastPut[key.Kind][key.Name] = src
+	kind := fakeDatastoreKind(key.Namespace, key.Kind)
+	if fdc.entities[kind] == nil {
+		fdc.entities[kind] = map[string]interface{}{}
+	}
+	fdc.entities[kind][key.Name] = src
 	return key, nil
 }
 func (fdc *fakeDatastoreClient) Delete(ctx context.Context, key *datastore.Key) error {
-	delete(fdc.lastPut[key.Kind], key.Name)
+	delete(fdc.entities[fakeDatastoreKind(key.Namespace, key.Kind)], key.Name)
+	return nil
+}
+func (fdc *fakeDatastoreClient) RunInTransaction(ctx context.Context, f func(tx datastoreTransaction) error) error {
+	tx := &fakeDatastoreTransaction{client: fdc}
+	if err := f(tx); err != nil {
+		return err
+	}
+	if len(tx.writes) > maxTransactionWrites {
+		return fmt.Errorf("datastore: cannot write more than %d entities in a single transaction (got: %d)", maxTransactionWrites, len(tx.writes))
+	}
+	for _, w := range tx.writes {
+		w()
+	}
+	return nil
+}
+func (fdc *fakeDatastoreClient) Close() error {
+	return nil
+}
+
+// fakeDatastoreTransaction holds back writes until the transaction commits.
+type fakeDatastoreTransaction struct {
+	client *fakeDatastoreClient
+	writes []func()
+}
+
+func (tx *fakeDatastoreTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return tx.client.Get(context.Background(), key, dst)
+}
+func (tx *fakeDatastoreTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	tx.writes = append(tx.writes, func() { tx.client.Put(context.Background(), key, src) })
+	return nil, nil
+}
+func (tx *fakeDatastoreTransaction) Delete(key *datastore.Key) error {
+	tx.writes = append(tx.writes, func() { tx.client.Delete(context.Background(), key) })
 	return nil
 }
 
-func fakeSummoner(redditSubmissions []*geddit.Submission, spreadsheetValues *sheets.ValueRange) *summoner {
+func fakeSummoner(redditSubmissions []*redditPost, subscribers []string) *summoner {
+	config := defaultConfig()
+	config.Profiles[0].Subscribers = SubscriberSourceConfig{Type: subscriberSourceMemory, Usernames: subscribers}
 	return &summoner{
+		config:        config,
 		redditSession: &fakeRedditSession{submittions: redditSubmissions},
-		datastoreClient: &fakeDatastoreClient{lastPut: map[string]map[string]interface{}{
-			"Entity":    map[string]interface{}{},
-			"PageToken": map[string]interface{}{},
-		}},
-		readSpreadsheetValuesFunc: func(string, string) (*sheets.ValueRange, error) { return spreadsheetValues, nil },
+		runID:         "test-run",
+		store:         newEntityStore(&datastoreBackend{client: &fakeDatastoreClient{entities: map[string]map[string]interface{}{}}}),
 	}
 }
 
+// fakeDatastore returns the fake Datastore client behind a summoner built by fakeSummoner.
+func fakeDatastore(s *summoner) *fakeDatastoreClient {
+	return s.store.(*entityStore).backend.(*datastoreBackend).client.(*fakeDatastoreClient)
+}
+
+// summonUnderLease summons contestants to the post while holding its lease, as runs do.
+func summonUnderLease(ctx context.Context, s *summoner, p *CompetitionProfile, post *geddit.Submission, pt *PageToken) error {
+	return s.withPostLease(ctx, p, post.FullID, func() error {
+		return s.summonContestants(ctx, p, post, pt)
+	})
+}
+
+// getPageToken loads the PageToken saved for a post into pt.
+func getPageToken(ctx context.Context, s *summoner, p *CompetitionProfile, postID string, pt *PageToken) error {
+	saved, err := s.store.PageToken(ctx, p.Namespace, postID)
+	if err != nil {
+		return err
+	}
+	*pt = *saved
+	return nil
+}
+
+func fakePost(fullID, title string) *redditPost {
+	return &redditPost{Submission: geddit.Submission{FullID: fullID, Title: title}}
+}
+
+// testProfile returns the only profile of a summoner built by fakeSummoner.
+func testProfile(s *summoner) *CompetitionProfile {
+	return s.config.Profiles[0]
+}
+
 func fakeUserName(num int) string {
 	return fmt.Sprintf("u/user-%d", num)
 }
 
-func generateFakeUsers(numUsers int) [][]interface{} {
-	values := make([][]interface{}, numUsers)
+func generateFakeUsers(numUsers int) []string {
+	usernames := make([]string, numUsers)
 	for i := 0; i < numUsers; i++ {
-		v := make([]interface{}, 1)
-		v[0] = fakeUserName(i)
-		values[i] = v
+		usernames[i] = fakeUserName(i)
 	}
-	return values
+	return usernames
 }
 
-func TestBuildSummonStringsNoValues(t *testing.T) {
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: [][]interface{}{}})
-	summons, lastUser, err := s.buildSummonStrings("" /*lastProcessedUser*/)
+// buildSummons selects the next users to summon and builds the summon strings for the subscribers of the summoner's test profile.
+func buildSummons(t *testing.T, s *summoner, firstIndex int) ([]string, int, int) {
+	p := testProfile(s)
+	subscribers, err := s.readSubscribers(context.Background(), p)
 	if err != nil {
-		t.Fatalf("buildSummonStrings call failed: %v", err)
+		t.Fatalf("readSubscribers call failed: %v", err)
 	}
-	if len(summons) != 0 {
-		t.Fatalf("buildSummonStrings returned non-empty results: %s", summons)
+	data := newCommentData(p, &geddit.Submission{Title: "[MOD] March competition"}, len(subscribers), time.Now())
+	usernames, nextIndex := selectUsersToSummon(context.Background(), subscribers, firstIndex, s.config.MaxUsersPerSession, &summonLedger{records: map[string]*SummonRecord{}})
+	batches, err := s.buildSummonBatches(context.Background(), p, data, usernames)
+	if err != nil {
+		t.Fatalf("buildSummonBatches call failed: %v", err)
 	}
-	if lastUser != "" {
-		t.Fatalf("buildSummonStrings returned non-blank last user for fewer than max results: %s", lastUser)
+	summons := make([]string, len(batches))
+	for i, b := range batches {
+		summons[i] = b.text
 	}
+	return summons, nextIndex, len(subscribers)
 }
 
-func TestBuildSummonStringsSomeValuesWithRemainder(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
-	summons, lastUser, err := s.buildSummonStrings("" /*lastProcessedUser*/)
-	if err != nil {
-		t.Fatalf("buildSummonStrings call failed: %v", err)
+func TestBuildSummonsNoValues(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	summons, nextIndex, numSubscribers := buildSummons(t, s, 0 /*firstIndex*/)
+	if len(summons) != 0 {
+		t.Fatalf("buildSummons returned non-empty results: %s", summons)
 	}
+	if nextIndex != numSubscribers {
+		t.Fatalf("buildSummons returned unfinished next index for fewer than max results: %d", nextIndex)
+	}
+}
+
+func TestBuildSummonsSomeValuesWithRemainder(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	summons, nextIndex, numSubscribers := buildSummons(t, s, 0 /*firstIndex*/)
 	if len(summons) != 2 {
-		t.Fatalf("buildSummonStrings returned results of wrong length: %s", summons)
+		t.Fatalf("buildSummons returned results of wrong length: %s", summons)
 	}
-	if lastUser != "" {
-		t.Fatalf("buildSummonStrings returned non-blank last user for fewer than max results: %s", lastUser)
+	if nextIndex != numSubscribers {
+		t.Fatalf("buildSummons returned unfinished next index for fewer than max results: %d", nextIndex)
 	}
 }
 
-func TestBuildSummonStringsSomeValuesNoRemainder(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
-	summons, lastUser, err := s.buildSummonStrings("" /*lastProcessedUser*/)
-	if err != nil {
-		t.Fatalf("buildSummonStrings call failed: %v", err)
-	}
+func TestBuildSummonsSomeValuesNoRemainder(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	summons, nextIndex, numSubscribers := buildSummons(t, s, 0 /*firstIndex*/)
 	if len(summons) != 1 {
-		t.Fatalf("buildSummonStrings returned results of wrong length: %s", summons)
+		t.Fatalf("buildSummons returned results of wrong length: %s", summons)
 	}
-	if lastUser != "" {
-		t.Fatalf("buildSummonStrings returned non-blank last user for fewer than max results: %s", lastUser)
+	if nextIndex != numSubscribers {
+		t.Fatalf("buildSummons returned unfinished next index for fewer than max results: %d", nextIndex)
 	}
 }
 
-func TestBuildSummonStringsMoreThanMaxValues(t *testing.T) {
-	const numUsers = maxUsersPerSession + 1
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
-	summons, lastUser, err := s.buildSummonStrings("" /*lastProcessedUser*/)
-	if err != nil {
-		t.Fatalf("buildSummonStrings call failed: %v", err)
-	}
-	if len(summons) != maxUsersPerSession/maxRedditTagsPerComment {
-		t.Fatalf("buildSummonStrings returned results of wrong length: %s", summons)
+func TestBuildSummonsMoreThanMaxValues(t *testing.T) {
+	const numUsers = defaultMaxUsersPerSession + 1
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	summons, nextIndex, _ := buildSummons(t, s, 0 /*firstIndex*/)
+	if len(summons) != defaultMaxUsersPerSession/defaultMaxRedditTagsPerComment {
+		t.Fatalf("buildSummons returned results of wrong length: %s", summons)
 	}
-	if lastUser == "" {
-		t.Fatalf("buildSummonStrings returned blank last user for more than max results: %s", lastUser)
+	if nextIndex != defaultMaxUsersPerSession {
+		t.Fatalf("buildSummons returned wrong next index for more than max results (got: %d, want: %d)", nextIndex, defaultMaxUsersPerSession)
 	}
 
-	summons, lastUser, err = s.buildSummonStrings(lastUser)
-	if err != nil {
-		t.Fatalf("buildSummonStrings call failed: %v", err)
-	}
+	summons, nextIndex, numSubscribers := buildSummons(t, s, nextIndex)
 	if len(summons) != 1 {
-		t.Fatalf("buildSummonStrings returned results of wrong length: %s", summons)
+		t.Fatalf("buildSummons returned results of wrong length: %s", summons)
 	}
-	if lastUser != "" {
-		t.Fatalf("buildSummonStrings returned blank last user for more than max results: %s", lastUser)
+	if nextIndex != numSubscribers {
+		t.Fatalf("buildSummons returned unfinished next index after the last results: %d", nextIndex)
 	}
 }
 
 func TestSummonContestantsNoUsers(t *testing.T) {
 	post := &geddit.Submission{FullID: "t3_12345"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: [][]interface{}{}})
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
 
-	if err := s.summonContestants(context.Background(), post, nil /*PageToken*/); err != nil {
+	if err := summonUnderLease(context.Background(), s, testProfile(s), post, nil /*PageToken*/); err != nil {
 		t.Fatalf("summonContestants call failed: %v", err)
 	}
 
@@ -176,12 +360,12 @@ func TestSummonContestantsNoUsers(t *testing.T) {
 }
 
 func TestSummonContestantsSomeUsers(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
+	const numUsers = defaultMaxRedditTagsPerComment + 1
 	const expectedNumComments = 3 // main comment, 2 child comments
 	post := &geddit.Submission{FullID: "t3_12345"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
 
-	if err := s.summonContestants(context.Background(), post, nil /*PageToken*/); err != nil {
+	if err := summonUnderLease(context.Background(), s, testProfile(s), post, nil /*PageToken*/); err != nil {
 		t.Fatalf("summonContestants call failed: %v", err)
 	}
 
@@ -193,14 +377,14 @@ func TestSummonContestantsSomeUsers(t *testing.T) {
 }
 
 func TestSummonContestantsMoreThanMaxUsers(t *testing.T) {
-	const numUsers = maxUsersPerSession*2 + 1
-	expectedNumComments := maxUsersPerSession/maxRedditTagsPerComment + 1 // main comment, maxUsersPerSession/maxRedditTagsPerComment child comments
+	const numUsers = defaultMaxUsersPerSession*2 + 1
+	expectedNumComments := defaultMaxUsersPerSession/defaultMaxRedditTagsPerComment + 1 // main comment, defaultMaxUsersPerSession/defaultMaxRedditTagsPerComment child comments
 	ctx := context.Background()
 	post := &geddit.Submission{FullID: "t3_12345"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
 
 	// Summon the first batch of contestants.
-	if err := s.summonContestants(ctx, post, nil /*PageToken*/); err != nil {
+	if err := summonUnderLease(ctx, s, testProfile(s), post, nil /*PageToken*/); err != nil {
 		t.Fatalf("summonContestants call failed: %v", err)
 	}
 
@@ -211,26 +395,26 @@ func TestSummonContestantsMoreThanMaxUsers(t *testing.T) {
 	}
 	// Make sure correct page token was written to Datastore.
 	pt := &PageToken{}
-	if err := s.datastoreClient.Get(ctx, datastore.NameKey("PageToken", post.FullID, nil), pt); err != nil {
+	if err := getPageToken(ctx, s, testProfile(s), post.FullID, pt); err != nil {
 		t.Fatalf("failed to fetch pagetoken from datastore: %v", err)
 	}
-	expectedLastProcessedUser := fakeUserName(maxUsersPerSession - 1)
+	expectedLastProcessedUser := fakeUserName(defaultMaxUsersPerSession - 1)
 	if pt.LastProcessedUser != expectedLastProcessedUser {
 		t.Fatalf("summonContestants wrote pagetoken with wrong LastProcessedUser (got: %s, want: %s)", pt.LastProcessedUser, expectedLastProcessedUser)
 	}
 
 	// Summon the second batch of contestants.
-	if err := s.summonContestants(ctx, post, pt); err != nil {
+	if err := summonUnderLease(ctx, s, testProfile(s), post, pt); err != nil {
 		t.Fatalf("summonContestants call failed: %v", err)
 	}
 
-	expectedLastProcessedUser = fakeUserName(maxUsersPerSession*2 - 1)
-	expectedNumComments += maxUsersPerSession / maxRedditTagsPerComment
+	expectedLastProcessedUser = fakeUserName(defaultMaxUsersPerSession*2 - 1)
+	expectedNumComments += defaultMaxUsersPerSession / defaultMaxRedditTagsPerComment
 	if fsr.numComments != expectedNumComments {
 		t.Fatalf("summonContestants made unexpected number of comments (got: %d, want: %d)", fsr.numComments, expectedNumComments)
 	}
 	// Make sure correct page token was written to Datastore.
-	if err := s.datastoreClient.Get(ctx, datastore.NameKey("PageToken", post.FullID, nil), pt); err != nil {
+	if err := getPageToken(ctx, s, testProfile(s), post.FullID, pt); err != nil {
 		t.Fatalf("failed to fetch pagetoken from datastore: %v", err)
 	}
 	if pt.LastProcessedUser != expectedLastProcessedUser {
@@ -238,27 +422,27 @@ func TestSummonContestantsMoreThanMaxUsers(t *testing.T) {
 	}
 
 	// Summon the third (last) batch of contestants.
-	if err := s.summonContestants(ctx, post, pt); err != nil {
+	if err := summonUnderLease(ctx, s, testProfile(s), post, pt); err != nil {
 		t.Fatalf("summonContestants call failed: %v", err)
 	}
 
-	expectedLastProcessedUser = fakeUserName(maxUsersPerSession * 2)
+	expectedLastProcessedUser = fakeUserName(defaultMaxUsersPerSession * 2)
 	expectedNumComments = expectedNumComments + 1
 	if fsr.numComments != expectedNumComments {
 		t.Fatalf("summonContestants made unexpected number of comments (got: %d, want: %d)", fsr.numComments, expectedNumComments)
 	}
 	// Make page token was deleted from Datastore.
-	if err := s.datastoreClient.Get(ctx, datastore.NameKey("PageToken", post.FullID, nil), pt); err != datastore.ErrNoSuchEntity {
+	if err := getPageToken(ctx, s, testProfile(s), post.FullID, pt); err != errNotFound {
 		t.Fatalf("Datastore did not return expected ErrNoSuchEntity: %v", err)
 	}
 }
 
 func TestHandlePossibleCompetitionPostIgnoresWinnersPost(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
-	post := &geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition winners - more text"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	post := fakePost("t3_12345", "[MOD] January's competition winners - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
 
-	if err := s.handlePossibleCompetitionPost(context.Background(), post); err != nil {
+	if err := s.handlePossibleCompetitionPost(context.Background(), testProfile(s), post); err != nil {
 		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
 	}
 
@@ -270,12 +454,12 @@ func TestHandlePossibleCompetitionPostIgnoresWinnersPost(t *testing.T) {
 }
 
 func TestHandlePossibleCompetitionPostNotHandledYet(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
+	const numUsers = defaultMaxRedditTagsPerComment + 1
 	const expectedNumComments = 3 // main comment, 2 child comments
-	post := &geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition - more text"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
 
-	if err := s.handlePossibleCompetitionPost(context.Background(), post); err != nil {
+	if err := s.handlePossibleCompetitionPost(context.Background(), testProfile(s), post); err != nil {
 		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
 	}
 
@@ -287,19 +471,19 @@ func TestHandlePossibleCompetitionPostNotHandledYet(t *testing.T) {
 }
 
 func TestHandlePossibleCompetitionPostInProgress(t *testing.T) {
-	const numUsers = maxUsersPerSession + 1
+	const numUsers = defaultMaxUsersPerSession + 1
 	ctx := context.Background()
-	post := &geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition - more text"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
 	val := PageToken{
 		MainCommentFullID: "t1_6789",
-		LastProcessedUser: fakeUserName(maxUsersPerSession - 1),
+		LastProcessedUser: fakeUserName(defaultMaxUsersPerSession - 1),
 	}
-	if _, err := s.datastoreClient.Put(ctx, datastore.NameKey("PageToken", post.FullID, nil), &val); err != nil {
+	if err := s.store.UpdatePost(ctx, testProfile(s).Namespace, post.FullID, &postUpdate{PageToken: &val}); err != nil {
 		t.Fatalf("test failed to setup datastore state: %v", err)
 	}
 
-	if err := s.handlePossibleCompetitionPost(ctx, post); err != nil {
+	if err := s.handlePossibleCompetitionPost(ctx, testProfile(s), post); err != nil {
 		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
 	}
 
@@ -309,22 +493,21 @@ func TestHandlePossibleCompetitionPostInProgress(t *testing.T) {
 		t.Fatalf("handlePossibleCompetitionPost made unexpected number of comments (got: %d, want: %d)", fsr.numComments, 1)
 	}
 	// Make page token was deleted from Datastore.
-	if err := s.datastoreClient.Get(ctx, datastore.NameKey("PageToken", post.FullID, nil), &val); err != datastore.ErrNoSuchEntity {
+	if err := getPageToken(ctx, s, testProfile(s), post.FullID, &val); err != errNotFound {
 		t.Fatalf("Datastore did not return expected ErrNoSuchEntity: %v", err)
 	}
 }
 
 func TestHandlePossibleCompetitionPostAlreadyHandled(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
+	const numUsers = defaultMaxRedditTagsPerComment + 1
 	ctx := context.Background()
-	post := &geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition - more text"}
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
-	val := struct{}{}
-	if _, err := s.datastoreClient.Put(ctx, datastore.NameKey("Entity", post.FullID, nil), &val); err != nil {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	if err := s.store.UpdatePost(ctx, testProfile(s).Namespace, post.FullID, &postUpdate{MarkHandled: true}); err != nil {
 		t.Fatalf("test failed to setup datastore state: %v", err)
 	}
 
-	if err := s.handlePossibleCompetitionPost(ctx, post); err != nil {
+	if err := s.handlePossibleCompetitionPost(ctx, testProfile(s), post); err != nil {
 		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
 	}
 
@@ -336,15 +519,15 @@ func TestHandlePossibleCompetitionPostAlreadyHandled(t *testing.T) {
 }
 
 func TestCheckPostsHandlesSeveralPosts(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
+	const numUsers = defaultMaxRedditTagsPerComment + 1
 	const expectedNumComments = 6 // 2 * (main comment, 2 child comments)
-	submissions := []*geddit.Submission{
-		&geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition - more text"},
-		&geddit.Submission{FullID: "t3_67890", Title: "[MOD] February's competition - more text"},
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+		fakePost("t3_67890", "[MOD] February's competition - more text"),
 	}
-	s := fakeSummoner(submissions, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
 
-	if err := s.checkPosts(context.Background()); err != nil {
+	if _, err := s.checkPosts(context.Background()); err != nil {
 		t.Fatalf("checkPosts call failed: %v", err)
 	}
 
@@ -356,15 +539,15 @@ func TestCheckPostsHandlesSeveralPosts(t *testing.T) {
 }
 
 func TestCheckPostsIgnoresDuplicatePosts(t *testing.T) {
-	const numUsers = maxRedditTagsPerComment + 1
+	const numUsers = defaultMaxRedditTagsPerComment + 1
 	const expectedNumComments = 3 // main comment, 2 child comments
-	submissions := []*geddit.Submission{
-		&geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition - more text"},
-		&geddit.Submission{FullID: "t3_12345", Title: "[MOD] January's competition - more text"},
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
 	}
-	s := fakeSummoner(submissions, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
 
-	if err := s.checkPosts(context.Background()); err != nil {
+	if _, err := s.checkPosts(context.Background()); err != nil {
 		t.Fatalf("checkPosts call failed: %v", err)
 	}
 
@@ -377,18 +560,18 @@ func TestCheckPostsIgnoresDuplicatePosts(t *testing.T) {
 
 func TestCheckPostsHandlesPageToken(t *testing.T) {
 	const (
-		numUsers = maxRedditTagsPerComment + 1
+		numUsers = defaultMaxRedditTagsPerComment + 1
 
 		commentID = "t1_12345"
 		postID    = "t3_12345"
 	)
-	s := fakeSummoner(nil /*redditSubmissions*/, &sheets.ValueRange{Values: generateFakeUsers(numUsers)})
-	pt := &PageToken{MainCommentFullID: commentID, LastProcessedUser: fakeUserName(numUsers - maxRedditTagsPerComment)}
-	if _, err := s.datastoreClient.Put(context.Background(), datastore.NameKey("PageToken", postID, nil), pt); err != nil {
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	pt := &PageToken{MainCommentFullID: commentID, LastProcessedUser: fakeUserName(numUsers - defaultMaxRedditTagsPerComment)}
+	if err := s.store.UpdatePost(context.Background(), testProfile(s).Namespace, postID, &postUpdate{PageToken: pt}); err != nil {
 		t.Fatalf("failed to set up Datastore state: %v", err)
 	}
 
-	if err := s.checkPosts(context.Background()); err != nil {
+	if _, err := s.checkPosts(context.Background()); err != nil {
 		t.Fatalf("checkPosts call failed: %v", err)
 	}
 
@@ -398,3 +581,31 @@ func TestCheckPostsHandlesPageToken(t *testing.T) {
 		t.Fatalf("checkPosts made unexpected number of comments (got: %d, want: %d)", fsr.numComments, 1)
 	}
 }
+
+func TestCheckPostsNamespacesProfiles(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	const expectedNumComments = 6 // 2 profiles * (main comment, 2 child comments)
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+	}
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
+	embroidery := *testProfile(s)
+	embroidery.Name, embroidery.Namespace, embroidery.Subreddit = "embroidery", "embroidery", "Embroidery"
+	s.config.Profiles = append(s.config.Profiles, &embroidery)
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	var fsr *fakeRedditSession
+	fsr = s.redditSession.(*fakeRedditSession)
+	if fsr.numComments != expectedNumComments {
+		t.Fatalf("checkPosts made unexpected number of comments (got: %d, want: %d)", fsr.numComments, expectedNumComments)
+	}
+	// Make sure each profile recorded handling of the post in its own namespace.
+	for _, p := range s.config.Profiles {
+		if handled, err := s.store.IsHandled(context.Background(), p.Namespace, "t3_12345"); err != nil || !handled {
+			t.Fatalf("profile %s did not record handling of post: %v", p.Name, err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The bot's metrics, exposed in the Prometheus text format at /metrics in serve mode, and
+// flushed to a file or Pushgateway after a one-shot run.
+var (
+	metricsRegistry = &registry{}
+
+	postsScanned = metricsRegistry.newCounter("crossstitch_posts_scanned_total",
+		"Posts looked at in each profile's subreddit.", "profile")
+	competitionPostsMatched = metricsRegistry.newCounter("crossstitch_competition_posts_matched_total",
+		"Posts found to be competition posts.", "profile")
+	commentsPosted = metricsRegistry.newCounter("crossstitch_comments_posted_total",
+		"Comments posted, by kind: main, summon or reminder.", "profile", "kind")
+	commentsFailed = metricsRegistry.newCounter("crossstitch_comments_failed_total",
+		"Comments Reddit did not accept, by kind and reason.", "profile", "kind", "reason")
+	usersTagged = metricsRegistry.newCounter("crossstitch_users_tagged_total",
+		"Users tagged in summon and reminder comments Reddit accepted.", "profile")
+	pageTokensOutstanding = metricsRegistry.newGauge("crossstitch_page_tokens_outstanding",
+		"Posts summoning was in progress for when the profile was last checked.", "profile")
+	notificationsSent = metricsRegistry.newCounter("crossstitch_notifications_total",
+		"Notifications sent to moderators, by notifier type, event and result: success or failure.", "type", "event", "result")
+	runsTotal = metricsRegistry.newCounter("crossstitch_runs_total",
+		"Runs checking posts, by result: success or failure.", "result")
+	runDuration = metricsRegistry.newHistogram("crossstitch_run_duration_seconds",
+		"How long runs checking posts took.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200})
+	callDuration = metricsRegistry.newHistogram("crossstitch_call_duration_seconds",
+		"Latency of calls to Reddit, Google Sheets and the store, by service and operation.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "service", "op")
+)
+
+// observeCall records the latency of a call to a service, which started at start.
+func observeCall(service, op string, start time.Time) {
+	callDuration.observe(time.Since(start).Seconds(), service, op)
+}
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// registry holds metrics, and writes them in the Prometheus text exposition format.
+type registry struct {
+	metrics []*metric
+}
+
+func (r *registry) register(m *metric) *metric {
+	m.series = map[string]*metricSeries{}
+	if len(m.labels) == 0 {
+		// Metrics without labels are exposed before anything is recorded.
+		m.get(nil)
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *registry) newCounter(name, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: metricCounter, labels: labels})
+}
+
+func (r *registry) newGauge(name, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: metricGauge, labels: labels})
+}
+
+func (r *registry) newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: metricHistogram, labels: labels, buckets: buckets})
+}
+
+// write writes every metric in the Prometheus text exposition format.
+func (r *registry) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// handler serves the metrics to Prometheus.
+func (r *registry) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.write(w); err != nil {
+			slog.Error("Failed to write metrics", "err", err)
+		}
+	})
+}
+
+// metric is a counter, gauge or histogram, with a series for each combination of label values.
+type metric struct {
+	name, help, kind string
+	labels           []string
+	// buckets are the upper bounds of a histogram's buckets, in increasing order.
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // by label values, joined
+}
+
+type metricSeries struct {
+	labelValues []string
+	// value is the value of a counter or gauge.
+	value float64
+	// counts are the number of a histogram's observations in each bucket, not cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// get returns the series with the label values, creating it if needed. The caller must hold m.mu,
+// unless m is being registered.
+func (m *metric) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", m.name, m.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if m.kind == metricHistogram {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to a counter or gauge.
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+// inc adds one to a counter or gauge.
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// set sets a gauge to v.
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+// observe adds an observation of v to a histogram.
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	s.counts[sort.SearchFloat64s(m.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+// value returns the value of a counter or gauge, or the number of observations of a histogram.
+func (m *metric) value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	if m.kind == metricHistogram {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, metricHelpEscaper.Replace(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(s.labelValues, ""), formatMetricValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(m.buckets) {
+				le = m.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.labelValues, formatMetricValue(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(s.labelValues, ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(s.labelValues, ""), s.count)
+	}
+}
+
+// labelString formats label values, and the le label of a histogram bucket if set, as {name="value",...}.
+func (m *metric) labelString(labelValues []string, le string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, name+`="`+metricLabelEscaper.Replace(labelValues[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	metricHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// MetricsConfig configures where the metrics of a one-shot run are flushed to when it finishes.
+// In serve mode, they are served at /metrics instead.
+type MetricsConfig struct {
+	// File, if set, is written with the metrics, e.g. for node_exporter's textfile collector.
+	File string `yaml:"file"`
+	// PushURL, if set, is a Prometheus Pushgateway group URL the metrics are pushed to, e.g.
+	// http://pushgateway:9091/metrics/job/crossstitch-bot.
+	PushURL string `yaml:"pushURL"`
+}
+
+// flushMetrics writes the metrics to the configured file and Pushgateway, if any.
+func flushMetrics(ctx context.Context, config MetricsConfig) error {
+	var buf bytes.Buffer
+	if err := metricsRegistry.write(&buf); err != nil {
+		return err
+	}
+	var errs []error
+	if config.File != "" {
+		if err := writeFileAtomically(config.File, buf.Bytes()); err != nil {
+			slog.Error("Failed to write metrics file", "path", config.File, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	if config.PushURL != "" {
+		if err := pushMetrics(ctx, config.PushURL, buf.Bytes()); err != nil {
+			slog.Error("Failed to push metrics", "url", config.PushURL, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeFileAtomically replaces the file at path with data, so that readers never see it half written.
+func writeFileAtomically(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// pushMetrics replaces the metrics of a Pushgateway group with data.
+func pushMetrics(ctx context.Context, url string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Pushgateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := &registry{}
+	runs := r.newCounter("test_runs_total", "Runs.")
+	comments := r.newCounter("test_comments_total", "Comments, by \"kind\".", "kind")
+	latency := r.newHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	runs.inc()
+	comments.add(2, "summon")
+	comments.inc(`main "first"`)
+	latency.observe(0.05, "Get")
+	latency.observe(0.5, "Get")
+	latency.observe(5, "Get")
+
+	var buf bytes.Buffer
+	if err := r.write(&buf); err != nil {
+		t.Fatalf("write call failed: %v", err)
+	}
+	want := `# HELP test_runs_total Runs.
+# TYPE test_runs_total counter
+test_runs_total 1
+# HELP test_comments_total Comments, by "kind".
+# TYPE test_comments_total counter
+test_comments_total{kind="main \"first\""} 1
+test_comments_total{kind="summon"} 2
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="Get",le="0.1"} 1
+test_latency_seconds_bucket{op="Get",le="1"} 2
+test_latency_seconds_bucket{op="Get",le="+Inf"} 3
+test_latency_seconds_sum{op="Get"} 5.55
+test_latency_seconds_count{op="Get"} 3
+`
+	if buf.String() != want {
+		t.Fatalf("write wrote unexpected metrics (got:\n%s\nwant:\n%s)", buf.String(), want)
+	}
+}
+
+func TestSummonRunMetrics(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+		fakePost("t3_67890", "My finished piece"),
+	}
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
+	p := testProfile(s)
+	before := map[string]float64{
+		"scanned": postsScanned.value(p.Name),
+		"matched": competitionPostsMatched.value(p.Name),
+		"main":    commentsPosted.value(p.Name, "main"),
+		"summon":  commentsPosted.value(p.Name, "summon"),
+		"tagged":  usersTagged.value(p.Name),
+		"runs":    runsTotal.value("success"),
+	}
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	after := map[string]float64{
+		"scanned": postsScanned.value(p.Name),
+		"matched": competitionPostsMatched.value(p.Name),
+		"main":    commentsPosted.value(p.Name, "main"),
+		"summon":  commentsPosted.value(p.Name, "summon"),
+		"tagged":  usersTagged.value(p.Name),
+		"runs":    runsTotal.value("success"),
+	}
+	want := map[string]float64{"scanned": 2, "matched": 1, "main": 1, "summon": 2, "tagged": numUsers, "runs": 1}
+	for name, delta := range want {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("run changed %s metric by %v, want %v", name, got, delta)
+		}
+	}
+}
+
+func TestCommentFailureReason(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&PermanentRedditError{Op: "reply", Err: newRedditCommentError([][]string{{"THREAD_LOCKED", "Comments are locked.", "parent"}})}, "thread_locked"},
+		{&redditAPIError{Method: http.MethodPost, Path: "/api/comment", StatusCode: http.StatusForbidden}, "http_403"},
+		{&PermanentRedditError{Op: "reply", Err: errors.New("token expired")}, "permanent"},
+		{errors.New("connection reset"), "transient"},
+	} {
+		if got := commentFailureReason(tc.err); got != tc.want {
+			t.Errorf("commentFailureReason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestFlushMetrics(t *testing.T) {
+	var pushed string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/crossstitch-bot" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		pushed = string(body)
+	}))
+	defer gateway.Close()
+	path := filepath.Join(t.TempDir(), "crossstitch-bot.prom")
+
+	config := MetricsConfig{File: path, PushURL: gateway.URL + "/metrics/job/crossstitch-bot"}
+	if err := flushMetrics(context.Background(), config); err != nil {
+		t.Fatalf("flushMetrics call failed: %v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("metrics file was not written: %v", err)
+	}
+	for name, text := range map[string]string{"file": string(written), "push": pushed} {
+		if !strings.Contains(text, "# TYPE crossstitch_runs_total counter") {
+			t.Errorf("metrics %s does not hold the bot's metrics:\n%s", name, text)
+		}
+	}
+
+	config = MetricsConfig{PushURL: gateway.URL + "/elsewhere"}
+	if err := flushMetrics(context.Background(), config); err == nil {
+		t.Fatal("flushMetrics did not report the rejected push")
+	}
+}
+
+func TestDaemonServesMetrics(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	d := newDaemon(s, ServeConfig{Interval: time.Hour, ShutdownTimeout: time.Second})
+	srv := httptest.NewServer(d.handler(context.Background()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "# TYPE crossstitch_call_duration_seconds histogram") {
+		t.Fatalf("GET /metrics returned unexpected response (got: %d):\n%s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Events moderators are notified of.
+const (
+	// A run failed to process the inbox or a profile's posts.
+	eventRunFailed = "run-failed"
+	// Summoning to a post finished, but some subscribers were not tagged.
+	eventSummonPartial = "summon-partial"
+	// Summoning to a post finished, and every subscriber was tagged.
+	eventSummonComplete = "summon-complete"
+	// Votes on a competition post were tallied, and its winners announcement awaits approval.
+	eventResultsDrafted = "results-drafted"
+)
+
+var notificationEvents = []string{eventRunFailed, eventSummonPartial, eventSummonComplete, eventResultsDrafted}
+
+// Kinds of notifier that can be selected in the config.
+const (
+	notifierModmail = "modmail"
+	notifierDiscord = "discord"
+	notifierSlack   = "slack"
+	notifierFile    = "file"
+)
+
+const (
+	// notificationMaxUntagged is the most untagged users listed in a notification's text. All of
+	// them are listed in its Untagged field.
+	notificationMaxUntagged = 100
+	// Reddit and Discord reject longer messages, and Slack cuts them short.
+	redditMaxSubjectLength  = 100
+	redditMaxMessageLength  = 10000
+	discordMaxContentLength = 2000
+	slackMaxTextLength      = 40000
+)
+
+// notification tells moderators about an event.
+type notification struct {
+	Event string    `json:"event"`
+	RunID string    `json:"runID"`
+	Time  time.Time `json:"time"`
+	// Profile and Subreddit are those the event concerns, if any.
+	Profile   string `json:"profile,omitempty"`
+	Subreddit string `json:"subreddit,omitempty"`
+	PostID    string `json:"postID,omitempty"`
+	// Subject summarizes the event in a line, and Text describes it in markdown.
+	Subject string   `json:"subject"`
+	Text    string   `json:"text"`
+	Errors  []string `json:"errors,omitempty"`
+	// The totals of a post summoning finished for, and the users who were not tagged.
+	Subscribers int      `json:"subscribers,omitempty"`
+	Tagged      int      `json:"tagged,omitempty"`
+	Comments    int      `json:"comments,omitempty"`
+	Untagged    []string `json:"untagged,omitempty"`
+}
+
+// Notifier delivers notifications to moderators.
+type Notifier interface {
+	Notify(ctx context.Context, n *notification) error
+}
+
+// NotifierConfig selects and configures a Notifier.
+type NotifierConfig struct {
+	// Type is one of "modmail", "discord", "slack" or "file".
+	Type string `yaml:"type"`
+	// Events lists the events to notify of. All of them are, if it is empty.
+	Events []string `yaml:"events"`
+
+	// Subreddit whose moderators are sent modmail about events not concerning any profile.
+	// Events concerning a profile are sent to its subreddit. It defaults to the first profile's.
+	Subreddit string `yaml:"subreddit"`
+	// URL of a Discord or Slack incoming webhook.
+	URL string `yaml:"url"`
+	// Path of a file each notification is appended to, as a line of JSON.
+	Path string `yaml:"path"`
+}
+
+func (c *NotifierConfig) validate() error {
+	var errs []error
+	switch c.Type {
+	case notifierModmail:
+	case notifierDiscord, notifierSlack:
+		if c.URL == "" {
+			errs = append(errs, fmt.Errorf("url must be set for a %s notifier", c.Type))
+		}
+	case notifierFile:
+		if c.Path == "" {
+			errs = append(errs, errors.New("path must be set for a file notifier"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown notifier type %q", c.Type))
+	}
+	for _, event := range c.Events {
+		if !containsString(notificationEvents, event) {
+			errs = append(errs, fmt.Errorf("unknown event %q; must be one of %s", event, strings.Join(notificationEvents, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredNotifier is a Notifier, and the events it is configured to be sent.
+type configuredNotifier struct {
+	Notifier
+	kind   string
+	events []string
+}
+
+func (n *configuredNotifier) wants(event string) bool {
+	return len(n.events) == 0 || containsString(n.events, event)
+}
+
+// newNotifiers creates the notifiers described by the config. Modmail is sent through session.
+func newNotifiers(config *Config, session oAuthSession) ([]*configuredNotifier, error) {
+	var notifiers []*configuredNotifier
+	for _, c := range config.Notifications {
+		var n Notifier
+		switch c.Type {
+		case notifierModmail:
+			subreddit := c.Subreddit
+			if subreddit == "" && len(config.Profiles) > 0 {
+				subreddit = config.Profiles[0].Subreddit
+			}
+			n = &modmailNotifier{session: session, subreddit: subreddit}
+		case notifierDiscord, notifierSlack:
+			n = &webhookNotifier{url: c.URL, kind: c.Type}
+		case notifierFile:
+			n = &fileNotifier{path: c.Path}
+		default:
+			return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+		}
+		notifiers = append(notifiers, &configuredNotifier{Notifier: n, kind: c.Type, events: c.Events})
+	}
+	return notifiers, nil
+}
+
+// modmailNotifier messages a subreddit's moderators.
+type modmailNotifier struct {
+	session   oAuthSession
+	subreddit string
+}
+
+func (m *modmailNotifier) Notify(ctx context.Context, n *notification) error {
+	subreddit := n.Subreddit
+	if subreddit == "" {
+		subreddit = m.subreddit
+	}
+	return m.session.SendMessage("/r/"+subreddit, truncateText(n.Subject, redditMaxSubjectLength), truncateText(n.Text, redditMaxMessageLength))
+}
+
+// webhookNotifier posts notifications to a Discord or Slack incoming webhook.
+type webhookNotifier struct {
+	url string
+	// kind is "discord" or "slack", which expect different payloads.
+	kind string
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n *notification) error {
+	var payload interface{}
+	if w.kind == notifierDiscord {
+		payload = map[string]string{"content": truncateText("**"+n.Subject+"**\n"+n.Text, discordMaxContentLength)}
+	} else {
+		// Slack's mrkdwn marks bold text with single asterisks.
+		payload = map[string]string{"text": truncateText("*"+n.Subject+"*\n"+n.Text, slackMaxTextLength)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s webhook returned %s: %s", w.kind, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// fileNotifier appends notifications to a file, one line of JSON each.
+type fileNotifier struct {
+	path string
+}
+
+func (f *fileNotifier) Notify(ctx context.Context, n *notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// truncateText shortens text to at most max bytes, marking where it was cut.
+func truncateText(text string, max int) string {
+	const marker = "…"
+	if len(text) <= max {
+		return text
+	}
+	cut := max - len(marker)
+	// Do not cut a UTF-8 sequence in two.
+	for cut > 0 && text[cut]&0xC0 == 0x80 {
+		cut--
+	}
+	return text[:cut] + marker
+}
+
+// notify sends the notification to every notifier configured to be sent its event. Failures are
+// logged rather than returned, so that they do not fail the run. In a dry run, the notification
+// is only recorded.
+func (s *summoner) notify(ctx context.Context, n *notification) {
+	n.RunID, n.Time = s.runID, time.Now()
+	if s.plan != nil {
+		s.plan.record("Notify moderators of %s: %s\n%s", n.Event, n.Subject, indent(n.Text))
+		return
+	}
+	logger := loggerFrom(ctx)
+	for _, notifier := range s.notifiers {
+		if !notifier.wants(n.Event) {
+			continue
+		}
+		if err := notifier.Notify(ctx, n); err != nil {
+			logger.Error("Failed to notify moderators", "notifier", notifier.kind, "event", n.Event, "err", err)
+			notificationsSent.inc(notifier.kind, n.Event, "failure")
+			continue
+		}
+		logger.Debug("Notified moderators", "notifier", notifier.kind, "event", n.Event)
+		notificationsSent.inc(notifier.kind, n.Event, "success")
+	}
+}
+
+// notifyRunFailed tells moderators which parts of a run failed.
+func (s *summoner) notifyRunFailed(ctx context.Context, report *runReport) {
+	n := &notification{
+		Event:   eventRunFailed,
+		Subject: fmt.Sprintf("crossstitch-bot run %s failed", report.RunID),
+		Errors:  report.Errors,
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run %s, started at %s, failed:\n\n", report.RunID, report.StartedAt.UTC().Format(time.RFC1123))
+	for _, err := range report.Errors {
+		fmt.Fprintf(&b, "* %s\n", err)
+	}
+	n.Text = b.String()
+	s.notify(ctx, n)
+}
+
+// summonOutcome counts the users tagged on a post, and lists those who were not.
+type summonOutcome struct {
+	Subscribers int
+	Tagged      int
+	Comments    int
+	Untagged    []string
+}
+
+// newSummonOutcome counts the users of the snapshot the ledger records as tagged.
+func newSummonOutcome(snap *SubscriberSnapshot, l *summonLedger) *summonOutcome {
+	outcome := &summonOutcome{}
+	comments := map[string]bool{}
+	for _, subscriber := range snap.subscribers() {
+		// Invalid usernames are never summoned.
+		if !strings.HasPrefix(subscriber.Username, "u/") {
+			continue
+		}
+		outcome.Subscribers++
+		if r := l.record(subscriber.Username); r != nil && r.Status == summonSent {
+			outcome.Tagged++
+			comments[r.CommentFullID] = true
+			continue
+		}
+		outcome.Untagged = append(outcome.Untagged, subscriber.Username)
+	}
+	outcome.Comments = len(comments)
+	return outcome
+}
+
+// notifySummonFinished tells moderators that summoning to a post finished, with its totals and
+// the users who were not tagged, if any. cause is the failure that made summoning stop, if any.
+func (s *summoner) notifySummonFinished(ctx context.Context, p *CompetitionProfile, postID string, outcome *summonOutcome, cause error) {
+	n := &notification{
+		Event:       eventSummonComplete,
+		Profile:     p.Name,
+		Subreddit:   p.Subreddit,
+		PostID:      postID,
+		Subscribers: outcome.Subscribers,
+		Tagged:      outcome.Tagged,
+		Comments:    outcome.Comments,
+		Untagged:    outcome.Untagged,
+	}
+	link := "https://redd.it/" + strings.TrimPrefix(postID, "t3_")
+	var b strings.Builder
+	fmt.Fprintf(&b, "Summoned %d of %d subscribers of r/%s (profile %s) to %s, in %d comments.\n",
+		outcome.Tagged, outcome.Subscribers, p.Subreddit, p.Name, link, outcome.Comments)
+	if cause == nil && len(outcome.Untagged) == 0 {
+		n.Subject = fmt.Sprintf("Summoning to %s is complete", postID)
+		n.Text = b.String()
+		s.notify(ctx, n)
+		return
+	}
+
+	n.Event = eventSummonPartial
+	n.Subject = fmt.Sprintf("%d subscribers were not summoned to %s", len(outcome.Untagged), postID)
+	if cause != nil {
+		n.Errors = []string{cause.Error()}
+		fmt.Fprintf(&b, "\nSummoning stopped early: %v\n", cause)
+	}
+	if len(outcome.Untagged) > 0 {
+		listed := outcome.Untagged
+		if len(listed) > notificationMaxUntagged {
+			listed = listed[:notificationMaxUntagged]
+		}
+		fmt.Fprintf(&b, "\nNot tagged: %s", strings.Join(listed, ", "))
+		if more := len(outcome.Untagged) - len(listed); more > 0 {
+			fmt.Fprintf(&b, ", and %d more", more)
+		}
+		b.WriteString("\n")
+	}
+	n.Text = b.String()
+	s.notify(ctx, n)
+}
+
+// notifyAnnouncementDrafted sends moderators the draft of a competition post's winners
+// announcement, for them to approve.
+func (s *summoner) notifyAnnouncementDrafted(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost, a *Announcement) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Votes on https://redd.it/%s (profile %s) were tallied. Once approved, for example with\n\n", strings.TrimPrefix(cp.PostID, "t3_"), p.Name)
+	fmt.Fprintf(&b, "    crossstitch-bot -profile %s approve %s\n\n", p.Name, cp.PostID)
+	fmt.Fprintf(&b, "the next run will submit this winners announcement:\n\n**%s**\n\n%s", a.Title, a.Text)
+	s.notify(ctx, &notification{
+		Event:     eventResultsDrafted,
+		Profile:   p.Name,
+		Subreddit: p.Subreddit,
+		PostID:    cp.PostID,
+		Subject:   fmt.Sprintf("The winners announcement of %s awaits approval", cp.PostID),
+		Text:      b.String(),
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNotifier records the notifications it is sent.
+type fakeNotifier struct {
+	notifications []*notification
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, n *notification) error {
+	f.notifications = append(f.notifications, n)
+	return nil
+}
+
+// addFakeNotifier makes the summoner send every notification to a fakeNotifier.
+func addFakeNotifier(s *summoner) *fakeNotifier {
+	f := &fakeNotifier{}
+	s.notifiers = append(s.notifiers, &configuredNotifier{Notifier: f, kind: "fake"})
+	return f
+}
+
+func TestNotifierConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config  NotifierConfig
+		wantErr bool
+	}{
+		{NotifierConfig{Type: notifierModmail}, false},
+		{NotifierConfig{Type: notifierDiscord, URL: "https://discord.test/api/webhooks/1/x"}, false},
+		{NotifierConfig{Type: notifierSlack}, true},
+		{NotifierConfig{Type: notifierFile, Path: "notifications.jsonl", Events: []string{eventRunFailed}}, false},
+		{NotifierConfig{Type: notifierFile}, true},
+		{NotifierConfig{Type: notifierModmail, Events: []string{"run-succeeded"}}, true},
+		{NotifierConfig{Type: "pager"}, true},
+	} {
+		if err := tc.config.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("validate(%+v) returned unexpected error: %v", tc.config, err)
+		}
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+	payloads := map[string]map[string]string{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payloads[r.URL.Path] = payload
+	}))
+	defer webhook.Close()
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	s.config.Notifications = []*NotifierConfig{
+		{Type: notifierModmail},
+		{Type: notifierDiscord, URL: webhook.URL + "/discord"},
+		{Type: notifierSlack, URL: webhook.URL + "/slack", Events: []string{eventSummonComplete}},
+		{Type: notifierFile, Path: path},
+	}
+	var err error
+	if s.notifiers, err = newNotifiers(s.config, s.redditSession); err != nil {
+		t.Fatalf("newNotifiers call failed: %v", err)
+	}
+	ctx := context.Background()
+	s.notifyRunFailed(ctx, &runReport{RunID: "test-run", Errors: []string{"profile CrossStitch: fake failure"}})
+	s.notifyRunFailed(ctx, &runReport{RunID: "test-run", Errors: []string{"inbox: fake failure"}})
+
+	messages := s.redditSession.(*fakeRedditSession).messages
+	if len(messages) != 2 || messages[0].To != "/r/"+defaultSubreddit || !strings.Contains(messages[0].Text, "fake failure") {
+		t.Fatalf("modmail notifier sent unexpected messages: %+v", messages)
+	}
+	if content := payloads["/discord"]["content"]; !strings.Contains(content, "inbox: fake failure") {
+		t.Fatalf("Discord notifier posted unexpected payload: %+v", payloads["/discord"])
+	}
+	if _, ok := payloads["/slack"]; ok {
+		t.Fatalf("Slack notifier was sent an event it was not configured for: %+v", payloads["/slack"])
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("file notifier did not write notifications: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var n notification
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &n) != nil || n.Event != eventRunFailed || n.RunID != "test-run" {
+		t.Fatalf("file notifier wrote unexpected notifications:\n%s", data)
+	}
+}
+
+func TestSlackNotifierPayload(t *testing.T) {
+	var payload map[string]string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer webhook.Close()
+
+	n := &notification{Subject: "Run failed", Text: strings.Repeat("x", 2*slackMaxTextLength)}
+	w := &webhookNotifier{url: webhook.URL, kind: notifierSlack}
+	if err := w.Notify(context.Background(), n); err != nil {
+		t.Fatalf("Notify call failed: %v", err)
+	}
+	if text := payload["text"]; !strings.HasPrefix(text, "*Run failed*\n") || len(text) > slackMaxTextLength {
+		t.Fatalf("Slack notifier posted unexpected text of length %d: %.40q", len(text), text)
+	}
+}
+
+func TestSummonCompleteNotification(t *testing.T) {
+	const numUsers = 2*defaultMaxRedditTagsPerComment + 1
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(numUsers))
+	notifier := addFakeNotifier(s)
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("run sent unexpected notifications: %+v", notifier.notifications)
+	}
+	n := notifier.notifications[0]
+	if n.Event != eventSummonComplete || n.PostID != post.FullID || n.Subscribers != numUsers || n.Tagged != numUsers || len(n.Untagged) != 0 {
+		t.Fatalf("run sent unexpected notification: %+v", n)
+	}
+	// Every summon comment has the same ID in the fake.
+	if n.Comments != 1 {
+		t.Fatalf("notification counted unexpected comments (got: %d, want: 1)", n.Comments)
+	}
+}
+
+func TestSummonPartialNotification(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(numUsers))
+	notifier := addFakeNotifier(s)
+	// The comment tagging the last user always fails.
+	last := fakeUserName(numUsers - 1)
+	s.redditSession.(*fakeRedditSession).failReply = func(comment string) bool {
+		return strings.Contains(comment, last)
+	}
+
+	// The failed summon is retried in later runs, until it has failed too often.
+	for run := 0; run < maxSummonAttempts && len(notifier.notifications) == 0; run++ {
+		if _, err := s.checkPosts(context.Background()); err != nil {
+			t.Fatalf("checkPosts call failed: %v", err)
+		}
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("runs sent unexpected notifications: %+v", notifier.notifications)
+	}
+	n := notifier.notifications[0]
+	if n.Event != eventSummonPartial || n.Tagged != numUsers-1 || len(n.Untagged) != 1 || n.Untagged[0] != last {
+		t.Fatalf("runs sent unexpected notification: %+v", n)
+	}
+	if !strings.Contains(n.Text, "Not tagged: "+last) {
+		t.Fatalf("notification does not list the untagged user:\n%s", n.Text)
+	}
+}
+
+func TestRunFailedNotification(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, nil /*subscribers*/)
+	notifier := addFakeNotifier(s)
+	testProfile(s).Subscribers = SubscriberSourceConfig{Type: subscriberSourceFile, Path: filepath.Join(t.TempDir(), "missing.csv")}
+
+	if _, err := s.checkPosts(context.Background()); err == nil {
+		t.Fatal("checkPosts did not fail to read subscribers")
+	}
+	if len(notifier.notifications) != 1 || notifier.notifications[0].Event != eventRunFailed || len(notifier.notifications[0].Errors) != 1 {
+		t.Fatalf("run sent unexpected notifications: %+v", notifier.notifications)
+	}
+}
+
+func TestDryRunRecordsNotifications(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(1))
+	notifier := addFakeNotifier(s)
+	plan := s.enableDryRun()
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("dry run sent notifications: %+v", notifier.notifications)
+	}
+	if last := plan.steps[len(plan.steps)-1]; !strings.HasPrefix(last, "Notify moderators of "+eventSummonComplete) {
+		t.Fatalf("dry run did not record the notification; last step: %s", last)
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	if got := truncateText("short", 10); got != "short" {
+		t.Errorf("truncateText changed short text: %q", got)
+	}
+	if got := truncateText("ééééé", 6); got != "é…" {
+		t.Errorf("truncateText(ééééé, 6) = %q, want %q", got, "é…")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Phases of summoning to a post. Each post moves through them in order:
+//
+//	discovered → main-comment-posted → batches-in-progress → complete
+//
+// A post is discovered when it is first detected as a competition post: it is marked handled,
+// and its subscriber snapshot and a PageToken are saved. Once the main comment is posted, its ID
+// is recorded in the PageToken. Each summon comment posted under it then advances the PageToken
+// past its users, and records them in the ledger. When every subscriber has been processed, the
+// post is complete: its PageToken and snapshot are deleted, leaving the handled marker and the
+// ledger.
+//
+// Each step's writes are committed together, so a run that dies between steps leaves the post in
+// the phase before or after the step, and the next run resumes from there. The only step that
+// can be repeated is the posting of the main comment, if the run dies after Reddit accepted it
+// but before its ID was committed.
+const (
+	phaseDiscovered        = "discovered"
+	phaseMainCommentPosted = "main-comment-posted"
+	phaseBatchesInProgress = "batches-in-progress"
+	phaseComplete          = "complete"
+)
+
+// phase returns the phase of summoning recorded in the PageToken.
+func (pt *PageToken) phase() string {
+	if pt.Phase != "" {
+		return pt.Phase
+	}
+	// PageTokens saved before phases were recorded were only saved once the main comment was posted.
+	return phaseBatchesInProgress
+}
+
+// postUpdate is the set of writes of one step of summoning to a post.
+type postUpdate struct {
+	// Owner is the run that must hold the post's lease, unexpired at Now, for the update to be
+	// committed, if any.
+	Owner       string
+	Now         time.Time
+	MarkHandled bool
+	// Snapshot and PageToken are saved, if set.
+	Snapshot  *SubscriberSnapshot
+	PageToken *PageToken
+	// Complete deletes the post's PageToken and snapshot.
+	Complete bool
+	// ClearHandled deletes the post's handled marker, so that the post is handled again as if new.
+	ClearHandled bool
+	// Records are saved to the post's summon ledger.
+	Records []*SummonRecord
+}
+
+// updatePost commits the writes of a step of summoning to a post, provided this run still holds
+// the post's lease.
+func (s *summoner) updatePost(ctx context.Context, p *CompetitionProfile, postID string, u *postUpdate) error {
+	if s.plan == nil {
+		u.Owner, u.Now = s.runID, time.Now()
+	}
+	return s.store.UpdatePost(ctx, p.Namespace, postID, u)
+}
+
+// newPageToken returns a PageToken for summoning to resume from the snapshot entry at nextIndex.
+func newPageToken(phase, mainCommentFullID string, snap *SubscriberSnapshot, nextIndex int) *PageToken {
+	pt := &PageToken{
+		Phase:             phase,
+		MainCommentFullID: mainCommentFullID,
+		NextIndex:         nextIndex,
+	}
+	if nextIndex > 0 {
+		pt.LastProcessedUser = snap.Usernames[nextIndex-1]
+	}
+	return pt
+}
+
+// saveSummonProgress commits the post's PageToken, along with the ledger records of the step,
+// and the subscriber snapshot the token indexes into, if it was not saved yet.
+func (s *summoner) saveSummonProgress(ctx context.Context, p *CompetitionProfile, postID string, snap *SubscriberSnapshot, pt *PageToken, records []*SummonRecord) error {
+	u := &postUpdate{PageToken: pt, Records: records}
+	if !snap.saved {
+		u.Snapshot = snap
+	}
+	logger := loggerFrom(ctx)
+	logger.Info("Saving PageToken", "phase", pt.Phase, "mainComment", pt.MainCommentFullID, "lastUser", pt.LastProcessedUser, "nextIndex", pt.NextIndex, "records", len(records))
+	if err := s.updatePost(ctx, p, postID, u); err != nil {
+		logger.Error("Failed to save PageToken", "err", err)
+		return err
+	}
+	snap.saved = true
+	rep := s.postReport(p, postID)
+	rep.Phase, rep.NextIndex = pt.Phase, pt.NextIndex
+	return nil
+}
+
+// finishSummoning completes summoning to the post, deleting its PageToken and subscriber
+// snapshot, if any, from the store, and notifies moderators of its outcome. cause is the failure
+// that made summoning stop early, if any.
+func (s *summoner) finishSummoning(ctx context.Context, p *CompetitionProfile, postID string, outcome *summonOutcome, cause error) error {
+	if err := s.updatePost(ctx, p, postID, &postUpdate{Complete: true}); err != nil {
+		loggerFrom(ctx).Error("Failed to delete PageToken and subscriber snapshot", "err", err)
+		return err
+	}
+	loggerFrom(ctx).Info("Summoning to post is complete", "phase", phaseComplete, "tagged", outcome.Tagged, "untagged", len(outcome.Untagged))
+	s.postReport(p, postID).Phase = phaseComplete
+	s.notifySummonFinished(ctx, p, postID, outcome, cause)
+	return nil
+}
+
+// abandonSummoning stops summoning to a post after a permanent failure, so that later runs do not
+// keep retrying it. It returns the failure.
+func (s *summoner) abandonSummoning(ctx context.Context, p *CompetitionProfile, postID string, outcome *summonOutcome, cause error) error {
+	loggerFrom(ctx).Warn("Giving up summoning contestants to post", "err", cause)
+	if err := s.finishSummoning(ctx, p, postID, outcome, cause); err != nil {
+		return err
+	}
+	return cause
+}
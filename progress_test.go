@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSummonContestantsResumesDiscoveredPost(t *testing.T) {
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(defaultMaxRedditTagsPerComment))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	// The first run fails to post the main comment.
+	fsr.failReply = func(comment string) bool { return true }
+
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err == nil {
+		t.Fatal("handlePossibleCompetitionPost did not report the failed main comment")
+	}
+	pt, err := s.store.PageToken(ctx, p.Namespace, post.FullID)
+	if err != nil || pt.phase() != phaseDiscovered {
+		t.Fatalf("post was not left in phase %s (got: %+v, %v)", phaseDiscovered, pt, err)
+	}
+	if handled, err := s.store.IsHandled(ctx, p.Namespace, post.FullID); err != nil || !handled {
+		t.Fatalf("discovered post was not marked handled (got: %t, %v)", handled, err)
+	}
+
+	// The next run posts the main comment and summons everyone.
+	fsr.failReply = nil
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err != nil {
+		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
+	}
+	if fsr.numComments != 2 {
+		t.Fatalf("handlePossibleCompetitionPost made unexpected number of comments (got: %d, want: %d)", fsr.numComments, 2)
+	}
+	if _, err := s.store.PageToken(ctx, p.Namespace, post.FullID); err != errNotFound {
+		t.Fatalf("PageToken of a complete post was not deleted: %v", err)
+	}
+}
+
+func TestSummonContestantsCommitsEachBatch(t *testing.T) {
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(2*defaultMaxRedditTagsPerComment))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	// Check what a run dying before the second summon comment would leave behind.
+	var phases []string
+	fsr.failReply = func(comment string) bool {
+		if pt, err := s.store.PageToken(ctx, p.Namespace, post.FullID); err == nil {
+			phases = append(phases, pt.phase())
+			if strings.Contains(comment, fakeUserName(defaultMaxRedditTagsPerComment)) && pt.NextIndex != defaultMaxRedditTagsPerComment {
+				t.Errorf("PageToken was not advanced past the first summon comment (got: %d, want: %d)", pt.NextIndex, defaultMaxRedditTagsPerComment)
+			}
+		}
+		return false
+	}
+
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err != nil {
+		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
+	}
+
+	want := []string{phaseDiscovered, phaseMainCommentPosted, phaseBatchesInProgress}
+	if strings.Join(phases, ",") != strings.Join(want, ",") {
+		t.Fatalf("post went through unexpected phases before each comment (got: %v, want: %v)", phases, want)
+	}
+	records, err := s.store.SummonRecords(ctx, p.Namespace, post.FullID)
+	if err != nil {
+		t.Fatalf("SummonRecords call failed: %v", err)
+	}
+	for _, r := range records {
+		if r.Status != summonSent || r.CommentFullID == "" {
+			t.Errorf("summon of %s was recorded as %s in comment %q", r.Username, r.Status, r.CommentFullID)
+		}
+	}
+}
+
+func TestSummonContestantsAbandonsPostItCannotComment(t *testing.T) {
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(defaultMaxRedditTagsPerComment))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	locked := &PermanentRedditError{Op: "reply", Err: newRedditCommentError([][]string{{"THREAD_LOCKED", "Comments are locked.", "parent"}})}
+	fsr.failReply = func(comment string) bool { return true }
+	s.redditSession = &lockedRedditSession{fakeRedditSession: fsr, err: locked}
+
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err == nil {
+		t.Fatal("handlePossibleCompetitionPost did not report the locked post")
+	}
+	if _, err := s.store.PageToken(ctx, p.Namespace, post.FullID); err != errNotFound {
+		t.Fatalf("PageToken was kept for a post that cannot be commented on: %v", err)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-querystring/query"
+	"github.com/khipkin/geddit"
+)
+
+const redditAPIBaseURL = "https://oauth.reddit.com"
+
+// redditClient adds the Reddit API endpoints the bot needs, but geddit does not implement,
+// to a geddit OAuth session.
+type redditClient struct {
+	*geddit.OAuthSession
+	// interval is the least time between requests, and last the time of the latest one.
+	interval time.Duration
+	last     time.Time
+}
+
+// Throttle spaces out requests, both those made by geddit and by the client itself, by at least interval.
+func (c *redditClient) Throttle(interval time.Duration) {
+	c.OAuthSession.Throttle(interval)
+	c.interval = interval
+}
+
+func (c *redditClient) wait() {
+	if c.interval == 0 {
+		return
+	}
+	if d := time.Until(c.last.Add(c.interval)); d > 0 {
+		time.Sleep(d)
+	}
+	c.last = time.Now()
+}
+
+// redditPost is a subreddit submission, with the moderation details that geddit does not decode.
+type redditPost struct {
+	geddit.Submission
+	LinkFlairCSSClass string `json:"link_flair_css_class"`
+	Stickied          bool   `json:"stickied"`
+	// Distinguished is "moderator" or "admin" for distinguished posts, and empty otherwise.
+	Distinguished string `json:"distinguished"`
+}
+
+// SubredditPosts returns the submissions on the given subreddit.
+func (c *redditClient) SubredditPosts(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*redditPost, error) {
+	v, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
+	var listing struct {
+		Data struct {
+			Children []struct {
+				Data *redditPost
+			}
+		}
+	}
+	if err := c.getJSON(fmt.Sprintf("/r/%s/%s.json?%s", subreddit, sort, v.Encode()), &listing); err != nil {
+		return nil, err
+	}
+	posts := make([]*redditPost, len(listing.Data.Children))
+	for i, child := range listing.Data.Children {
+		posts[i] = child.Data
+	}
+	return posts, nil
+}
+
+// Moderators returns the usernames of the subreddit's moderators.
+func (c *redditClient) Moderators(subreddit string) ([]string, error) {
+	var resp struct {
+		Data struct {
+			Children []struct {
+				Name string
+			}
+		}
+	}
+	if err := c.getJSON(fmt.Sprintf("/r/%s/about/moderators", subreddit), &resp); err != nil {
+		return nil, err
+	}
+	mods := make([]string, len(resp.Data.Children))
+	for i, child := range resp.Data.Children {
+		mods[i] = child.Name
+	}
+	return mods, nil
+}
+
+// inboxMessage is a private message, or a reply to one of the bot's comments, in the bot's inbox.
+type inboxMessage struct {
+	FullID  string `json:"name"`
+	Author  string `json:"author"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// WasComment is set for comment replies, in which case Subreddit is where the comment was made.
+	WasComment bool    `json:"was_comment"`
+	Subreddit  string  `json:"subreddit"`
+	Created    float64 `json:"created_utc"`
+}
+
+// UnreadMessages returns the unread messages and comment replies in the bot's inbox.
+func (c *redditClient) UnreadMessages() ([]*inboxMessage, error) {
+	var listing struct {
+		Data struct {
+			Children []struct {
+				Data *inboxMessage
+			}
+		}
+	}
+	if err := c.getJSON("/message/unread?limit=100", &listing); err != nil {
+		return nil, err
+	}
+	messages := make([]*inboxMessage, len(listing.Data.Children))
+	for i, child := range listing.Data.Children {
+		messages[i] = child.Data
+	}
+	return messages, nil
+}
+
+// MarkMessagesRead marks the inbox messages with the given full IDs as read.
+func (c *redditClient) MarkMessagesRead(fullIDs ...string) error {
+	if len(fullIDs) == 0 {
+		return nil
+	}
+	return c.postForm("/api/read_message", url.Values{"id": {strings.Join(fullIDs, ",")}}, nil)
+}
+
+// Reply posts a comment in reply to a submission or comment. Unlike geddit, it reports the HTTP
+// status of failed requests, so that errors can be classified.
+func (c *redditClient) Reply(r geddit.Replier, comment string) (*geddit.Comment, error) {
+	form := url.Values{
+		"api_type": {"json"},
+		"thing_id": {replierFullID(r)},
+		"text":     {comment},
+	}
+	var resp struct {
+		JSON struct {
+			Errors [][]string
+			Data   struct {
+				Things []struct {
+					Data map[string]interface{}
+				}
+			}
+		}
+	}
+	if err := c.postForm("/api/comment", form, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.JSON.Errors) > 0 {
+		return nil, newRedditCommentError(resp.JSON.Errors)
+	}
+	if len(resp.JSON.Data.Things) == 0 {
+		return nil, errors.New("Reddit API /api/comment returned no comment")
+	}
+	return commentFromData(resp.JSON.Data.Things[0].Data), nil
+}
+
+// Comment returns the comment with the given full ID, in the given subreddit.
+func (c *redditClient) Comment(subreddit, fullID string) (*geddit.Comment, error) {
+	var listing struct {
+		Data struct {
+			Children []struct {
+				Data map[string]interface{}
+			}
+		}
+	}
+	if err := c.getJSON(fmt.Sprintf("/r/%s/api/info?id=%s", subreddit, url.QueryEscape(fullID)), &listing); err != nil {
+		return nil, err
+	}
+	if len(listing.Data.Children) != 1 {
+		return nil, &redditAPIError{Method: http.MethodGet, Path: "/api/info", StatusCode: http.StatusNotFound,
+			Body: fmt.Sprintf("found %d comments with ID %s", len(listing.Data.Children), fullID)}
+	}
+	return commentFromData(listing.Data.Children[0].Data), nil
+}
+
+// Post returns the submission with the given full ID, posted on the subreddit.
+func (c *redditClient) Post(subreddit, fullID string) (*redditPost, error) {
+	var listing struct {
+		Data struct {
+			Children []struct {
+				Data *redditPost
+			}
+		}
+	}
+	if err := c.getJSON(fmt.Sprintf("/r/%s/api/info?id=%s", subreddit, url.QueryEscape(fullID)), &listing); err != nil {
+		return nil, err
+	}
+	if len(listing.Data.Children) != 1 {
+		return nil, &redditAPIError{Method: http.MethodGet, Path: "/api/info", StatusCode: http.StatusNotFound,
+			Body: fmt.Sprintf("found %d posts with ID %s", len(listing.Data.Children), fullID)}
+	}
+	return listing.Data.Children[0].Data, nil
+}
+
+// Reddit expands at most this many collapsed comments per request.
+const redditMaxMoreChildren = 100
+
+// PostComments returns the top-level comments on the submission with the given full ID, posted on
+// the subreddit, oldest first. Comments Reddit collapses into "load more comments" links are
+// fetched too.
+func (c *redditClient) PostComments(subreddit, postFullID string) ([]*geddit.Comment, error) {
+	var listings []struct {
+		Data struct {
+			Children []redditThing
+		}
+	}
+	path := fmt.Sprintf("/r/%s/comments/%s.json?depth=1&limit=500&sort=old&raw_json=1", subreddit, strings.TrimPrefix(postFullID, "t3_"))
+	if err := c.getJSON(path, &listings); err != nil {
+		return nil, err
+	}
+	if len(listings) != 2 {
+		return nil, fmt.Errorf("Reddit API %s returned %d listings, want 2", path, len(listings))
+	}
+	comments, more := topLevelComments(postFullID, listings[1].Data.Children)
+	for len(more) > 0 {
+		batch := more
+		if len(batch) > redditMaxMoreChildren {
+			batch = batch[:redditMaxMoreChildren]
+		}
+		more = more[len(batch):]
+		v := url.Values{
+			"api_type":       {"json"},
+			"link_id":        {postFullID},
+			"children":       {strings.Join(batch, ",")},
+			"limit_children": {"false"},
+			"depth":          {"1"},
+			"raw_json":       {"1"},
+		}
+		var resp struct {
+			JSON struct {
+				Data struct {
+					Things []redditThing
+				}
+			}
+		}
+		if err := c.getJSON("/api/morechildren?"+v.Encode(), &resp); err != nil {
+			return nil, err
+		}
+		expanded, moreIDs := topLevelComments(postFullID, resp.JSON.Data.Things)
+		comments = append(comments, expanded...)
+		more = append(more, moreIDs...)
+	}
+	sort.SliceStable(comments, func(i, j int) bool { return comments[i].Created < comments[j].Created })
+	return comments, nil
+}
+
+// redditThing is an item of a listing: a comment, or a link to more comments.
+type redditThing struct {
+	Kind string
+	Data map[string]interface{}
+}
+
+// topLevelComments returns the comments among things that reply to the post directly, and the IDs
+// of the collapsed comments still to fetch.
+func topLevelComments(postFullID string, things []redditThing) ([]*geddit.Comment, []string) {
+	var comments []*geddit.Comment
+	var more []string
+	for _, thing := range things {
+		switch thing.Kind {
+		case "t1":
+			if c := commentFromData(thing.Data); c.ParentID == postFullID {
+				comments = append(comments, c)
+			}
+		case "more":
+			// Links to replies deeper in the tree have a parent other than the post.
+			if parent, _ := thing.Data["parent_id"].(string); parent != postFullID {
+				continue
+			}
+			children, _ := thing.Data["children"].([]interface{})
+			for _, child := range children {
+				if id, ok := child.(string); ok {
+					more = append(more, id)
+				}
+			}
+		}
+	}
+	return comments, more
+}
+
+// SendMessage sends a private message to a user, or, if to is "/r/" and a subreddit's name, to the
+// subreddit's moderators through modmail.
+func (c *redditClient) SendMessage(to, subject, text string) error {
+	form := url.Values{
+		"api_type": {"json"},
+		"to":       {to},
+		"subject":  {subject},
+		"text":     {text},
+	}
+	var resp struct {
+		JSON struct {
+			Errors [][]string
+		}
+	}
+	if err := c.postForm("/api/compose", form, &resp); err != nil {
+		return err
+	}
+	if len(resp.JSON.Errors) > 0 {
+		return newRedditJSONError("/api/compose", resp.JSON.Errors)
+	}
+	return nil
+}
+
+// SubmitPost submits a text post to the subreddit, and returns its full ID.
+func (c *redditClient) SubmitPost(subreddit, title, text string) (string, error) {
+	form := url.Values{
+		"api_type": {"json"},
+		"kind":     {"self"},
+		"sr":       {subreddit},
+		"title":    {title},
+		"text":     {text},
+	}
+	var resp struct {
+		JSON struct {
+			Errors [][]string
+			Data   struct {
+				Name string
+			}
+		}
+	}
+	if err := c.postForm("/api/submit", form, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.JSON.Errors) > 0 {
+		return "", newRedditJSONError("/api/submit", resp.JSON.Errors)
+	}
+	if resp.JSON.Data.Name == "" {
+		return "", errors.New("Reddit API /api/submit returned no post")
+	}
+	return resp.JSON.Data.Name, nil
+}
+
+// LockPost locks the submission with the given full ID, so that only moderators can comment on it.
+func (c *redditClient) LockPost(fullID string) error {
+	return c.postForm("/api/lock", url.Values{"id": {fullID}}, nil)
+}
+
+// SetUserFlair sets the flair of a user in the subreddit.
+func (c *redditClient) SetUserFlair(subreddit, username, text, cssClass string) error {
+	form := url.Values{
+		"api_type":  {"json"},
+		"name":      {username},
+		"text":      {text},
+		"css_class": {cssClass},
+	}
+	path := "/r/" + subreddit + "/api/flair"
+	var resp struct {
+		JSON struct {
+			Errors [][]string
+		}
+	}
+	if err := c.postForm(path, form, &resp); err != nil {
+		return err
+	}
+	if len(resp.JSON.Errors) > 0 {
+		return newRedditJSONError(path, resp.JSON.Errors)
+	}
+	return nil
+}
+
+// replierFullID returns the full ID of the thing being replied to.
+func replierFullID(r geddit.Replier) string {
+	switch parent := r.(type) {
+	case *geddit.Submission:
+		return parent.FullID
+	case *geddit.Comment:
+		return parent.FullID
+	}
+	return ""
+}
+
+// commentFromData builds a comment from its JSON object, some of whose fields (e.g. "edited",
+// which is false or a timestamp) do not decode into geddit.Comment directly.
+func commentFromData(data map[string]interface{}) *geddit.Comment {
+	c := &geddit.Comment{}
+	c.Author, _ = data["author"].(string)
+	c.Body, _ = data["body"].(string)
+	c.Subreddit, _ = data["subreddit"].(string)
+	c.LinkID, _ = data["link_id"].(string)
+	c.ParentID, _ = data["parent_id"].(string)
+	c.FullID, _ = data["name"].(string)
+	c.Permalink, _ = data["permalink"].(string)
+	c.Score, _ = data["score"].(float64)
+	c.Created, _ = data["created_utc"].(float64)
+	return c
+}
+
+func (c *redditClient) getJSON(path string, d interface{}) error {
+	if c.Client == nil {
+		return errors.New("Reddit session is not authenticated")
+	}
+	c.wait()
+	resp, err := c.Client.Get(redditAPIBaseURL + path)
+	if err != nil {
+		return err
+	}
+	return decodeRedditResponse(resp, d)
+}
+
+func (c *redditClient) postForm(path string, form url.Values, d interface{}) error {
+	if c.Client == nil {
+		return errors.New("Reddit session is not authenticated")
+	}
+	c.wait()
+	resp, err := c.Client.PostForm(redditAPIBaseURL+path, form)
+	if err != nil {
+		return err
+	}
+	return decodeRedditResponse(resp, d)
+}
+
+// decodeRedditResponse closes the response body after decoding it into d, if d is not nil.
+// Unsuccessful responses are returned as a *redditAPIError.
+func decodeRedditResponse(resp *http.Response, d interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &redditAPIError{
+			Method:     resp.Request.Method,
+			Path:       resp.Request.URL.Path,
+			StatusCode: resp.StatusCode,
+			RetryAfter: retryAfter(resp.Header),
+			Body:       string(body),
+		}
+	}
+	if d == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(d)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// runReport summarizes what a run of checkPosts did.
+type runReport struct {
+	RunID     string    `json:"runID"`
+	StartedAt time.Time `json:"startedAt"`
+	Duration  string    `json:"duration"`
+	DryRun    bool      `json:"dryRun,omitempty"`
+	// Stopped is set if the run stopped early, at a safe point, to shut down.
+	Stopped  bool             `json:"stopped,omitempty"`
+	Profiles []*profileReport `json:"profiles"`
+	// Errors lists the failures that stopped the inbox or a profile from being fully processed.
+	Errors []string `json:"errors,omitempty"`
+	// Plan lists the steps a dry run would have taken.
+	Plan []string `json:"plan,omitempty"`
+}
+
+// profileReport summarizes what a run did for one competition profile.
+type profileReport struct {
+	Name         string `json:"name"`
+	PostsSeen    int    `json:"postsSeen"`
+	PostsMatched int    `json:"postsMatched"`
+	// Posts lists the competition posts and in-progress posts the run looked at.
+	Posts []*postReport `json:"posts,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// postReport records the progress a run made summoning to one post.
+type postReport struct {
+	PostID string `json:"postID"`
+	// Phase is the phase of summoning the run left the post in.
+	Phase string `json:"phase,omitempty"`
+	// Skipped says why the run did not summon to the post, if it did not.
+	Skipped        string `json:"skipped,omitempty"`
+	Subscribers    int    `json:"subscribers,omitempty"`
+	NextIndex      int    `json:"nextIndex,omitempty"`
+	CommentsPosted int    `json:"commentsPosted"`
+	CommentsFailed int    `json:"commentsFailed"`
+	UsersSummoned  int    `json:"usersSummoned"`
+	// Entries and ValidEntries count the competition entries collected from the post, if any.
+	Entries      int `json:"entries,omitempty"`
+	ValidEntries int `json:"validEntries,omitempty"`
+	// Competition is the phase the run left the post's competition in, if its calendar is tracked.
+	Competition string `json:"competition,omitempty"`
+	// Announcement is the status the run left the post's winners announcement in, if it
+	// drafted or submitted it.
+	Announcement string `json:"announcement,omitempty"`
+	// WinnersMessaged and FlairsSet count the winners of the post's competition the run
+	// messaged, and gave flair.
+	WinnersMessaged int    `json:"winnersMessaged,omitempty"`
+	FlairsSet       int    `json:"flairsSet,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// profile returns the report of a profile, adding it if needed.
+func (r *runReport) profile(p *CompetitionProfile) *profileReport {
+	for _, pr := range r.Profiles {
+		if pr.Name == p.Name {
+			return pr
+		}
+	}
+	pr := &profileReport{Name: p.Name}
+	r.Profiles = append(r.Profiles, pr)
+	return pr
+}
+
+// post returns the report of a post, adding it if needed.
+func (pr *profileReport) post(postID string) *postReport {
+	for _, r := range pr.Posts {
+		if r.PostID == postID {
+			return r
+		}
+	}
+	r := &postReport{PostID: postID}
+	pr.Posts = append(pr.Posts, r)
+	return r
+}
+
+// profileReport returns the report of the profile in the current run. Outside checkPosts, e.g. when
+// a post is resumed from the command line, the report is discarded.
+func (s *summoner) profileReport(p *CompetitionProfile) *profileReport {
+	if s.report == nil {
+		return &profileReport{Name: p.Name}
+	}
+	return s.report.profile(p)
+}
+
+// postReport returns the report of the post in the current run.
+func (s *summoner) postReport(p *CompetitionProfile, postID string) *postReport {
+	return s.profileReport(p).post(postID)
+}
+
+// recordComment records, in metrics and the run report, that a comment of a kind (main or
+// summon) tagging usernames was posted, or failed with err.
+func (s *summoner) recordComment(p *CompetitionProfile, postID, kind string, usernames []string, err error) {
+	rep := s.postReport(p, postID)
+	if err != nil {
+		commentsFailed.inc(p.Name, kind, commentFailureReason(err))
+		rep.CommentsFailed++
+		return
+	}
+	commentsPosted.inc(p.Name, kind)
+	rep.CommentsPosted++
+	if len(usernames) > 0 {
+		usersTagged.add(float64(len(usernames)), p.Name)
+		rep.UsersSummoned += len(usernames)
+	}
+}
+
+// writeJSON writes v as the JSON body of a response with the status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "err", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCheckPostsReport(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	submissions := []*redditPost{
+		fakePost("t3_12345", "[MOD] January's competition - more text"),
+		fakePost("t3_67890", "My finished piece"),
+	}
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
+
+	report, err := s.checkPosts(context.Background())
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if report.RunID != "test-run" || len(report.Errors) != 0 || len(report.Profiles) != 1 {
+		t.Fatalf("checkPosts returned unexpected report: %+v", report)
+	}
+	want := &profileReport{
+		Name:         defaultSubreddit,
+		PostsSeen:    2,
+		PostsMatched: 1,
+		Posts: []*postReport{{
+			PostID:         "t3_12345",
+			Phase:          phaseComplete,
+			Subscribers:    numUsers,
+			NextIndex:      numUsers,
+			CommentsPosted: 3,
+			UsersSummoned:  numUsers,
+		}},
+	}
+	if got := report.Profiles[0]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("checkPosts reported unexpected profile progress (got: %+v, want: %+v)", got.Posts[0], want.Posts[0])
+	}
+
+	// The next run finds the post already handled.
+	report, err = s.checkPosts(context.Background())
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if posts := report.Profiles[0].Posts; len(posts) != 1 || posts[0].Skipped != "already handled" || posts[0].CommentsPosted != 0 {
+		t.Fatalf("checkPosts reported unexpected progress on a handled post: %+v", posts[0])
+	}
+}
+
+func TestCheckPostsReportsFailures(t *testing.T) {
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	s := fakeSummoner([]*redditPost{post}, generateFakeUsers(defaultMaxRedditTagsPerComment))
+	s.redditSession.(*fakeRedditSession).failReply = func(comment string) bool { return true }
+
+	report, err := s.checkPosts(context.Background())
+	if err == nil {
+		t.Fatal("checkPosts did not report the failed main comment")
+	}
+	if len(report.Errors) != 1 || report.Profiles[0].Error == "" {
+		t.Fatalf("report does not hold the failure: %+v", report)
+	}
+	rep := report.Profiles[0].Posts[0]
+	if rep.Phase != phaseDiscovered || rep.CommentsFailed != 1 || rep.Error == "" {
+		t.Fatalf("report holds unexpected progress of the failed post: %+v", rep)
+	}
+}
+
+func TestHTTPInvokeReportsSetupFailure(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	t.Setenv(configEnvVar, "")
+	t.Setenv("REDDIT_CLIENT_SECRET", "")
+	t.Setenv("CROSSSTITCH_LOG_LEVEL", "error")
+
+	w := httptest.NewRecorder()
+	HTTPInvoke(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("HTTPInvoke responded with unexpected status (got: %d, want: %d)", w.Code, http.StatusInternalServerError)
+	}
+	var report runReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("HTTPInvoke did not respond with a JSON report: %v\n%s", err, w.Body.String())
+	}
+	if len(report.Errors) != 1 {
+		t.Fatalf("HTTPInvoke report does not hold the setup failure: %+v", report)
+	}
+}
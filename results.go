@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+const (
+	defaultResultsCategory   = "Overall"
+	defaultWinnerPlaces      = 3
+	defaultAnnouncementTitle = "[MOD] {{.Month}}'s competition winners{{if .Theme}} - {{.Theme}}{{end}}"
+	defaultAnnouncement      = "Congratulations to the winners of {{.Month}}'s competition{{if .Theme}}, \"{{.Theme}}\"{{end}}!" +
+		" Thank you to all {{.Entrants}} entrants, and to everyone who voted on [the competition post]({{.PostLink}}).\n" +
+		"{{range .Categories}}\n## {{.Name}}\n\n" +
+		"{{range .Winners}}- **{{.Place}}{{if .Tied}} (tied){{end}}:** {{.Author}}, with [this entry]({{.Link}}) ({{.Score}} points)\n{{end}}" +
+		"{{end}}"
+)
+
+// Reddit rejects posts with longer titles or text.
+const (
+	redditMaxTitleLength = 300
+	redditMaxPostLength  = 40000
+)
+
+// Statuses of a winners announcement.
+const (
+	// The announcement waits for moderators to approve it.
+	announcementDraft = "draft"
+	// Moderators approved the announcement, and the next run submits it.
+	announcementApproved = "approved"
+	// A run set out to submit the announcement. If it did not record the submitted post, the
+	// next run looks for the post before submitting the announcement again.
+	announcementSubmitting = "submitting"
+	// The announcement was submitted.
+	announcementPosted = "posted"
+)
+
+// errAnnouncementPosted is returned when approving an announcement that was already submitted.
+var errAnnouncementPosted = errors.New("winners announcement was already submitted")
+
+// ResultsConfig configures tallying the votes on a profile's competition posts once voting ends,
+// and announcing the winners. An entry's votes are its comment's score when they are tallied, on
+// the first run after voting ends, so votes cast between the end of voting and that run count.
+type ResultsConfig struct {
+	// Tally enables tallying votes and drafting a winners announcement, which is submitted once
+	// moderators approve it. It requires entries to be collected.
+	Tally bool `yaml:"tally"`
+	// Categories lists the categories entries compete in. An entry is in the first category its
+	// comment names, or else in the first category. It defaults to a single "Overall" category.
+	Categories []string `yaml:"categories"`
+	// Places is how many places are announced in each category. Entries tied for the last of
+	// them are all announced.
+	Places int `yaml:"places"`
+	// AnnouncementTitle and Announcement are templates of the title and markdown text of the
+	// winners announcement, executed with the fields of resultsData, e.g. {{.Month}} and
+	// {{range .Categories}}.
+	AnnouncementTitle string `yaml:"announcementTitle"`
+	Announcement      string `yaml:"announcement"`
+
+	categoryRegexes           []*regexp.Regexp
+	announcementTitleTemplate *template.Template
+	announcementTemplate      *template.Template
+}
+
+func (c *ResultsConfig) applyDefaults() {
+	if len(c.Categories) == 0 {
+		c.Categories = []string{defaultResultsCategory}
+	}
+	if c.Places == 0 {
+		c.Places = defaultWinnerPlaces
+	}
+	if c.AnnouncementTitle == "" {
+		c.AnnouncementTitle = defaultAnnouncementTitle
+	}
+	if c.Announcement == "" {
+		c.Announcement = defaultAnnouncement
+	}
+}
+
+func (c *ResultsConfig) validate(entries *EntriesConfig) error {
+	var errs []error
+	if c.Tally && !entries.Collect {
+		errs = append(errs, errors.New("tally requires entries.collect"))
+	}
+	if c.Places < 0 {
+		errs = append(errs, fmt.Errorf("places must not be negative, got %d", c.Places))
+	}
+	return errors.Join(errs...)
+}
+
+// compile parses the categories and announcement templates, and checks that the templates render
+// a valid post for sample results.
+func (c *ResultsConfig) compile() error {
+	var errs []error
+	c.categoryRegexes = nil
+	for _, name := range c.Categories {
+		if strings.TrimSpace(name) == "" {
+			errs = append(errs, errors.New("categories must not be empty"))
+			continue
+		}
+		c.categoryRegexes = append(c.categoryRegexes, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(strings.TrimSpace(name))+`\b`))
+	}
+	var err error
+	if c.announcementTitleTemplate, err = template.New("announcementTitle").Parse(c.AnnouncementTitle); err != nil {
+		errs = append(errs, err)
+	}
+	if c.announcementTemplate, err = template.New("announcement").Parse(c.Announcement); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	sample := &resultsData{
+		Subreddit: "CrossStitch",
+		PostTitle: "[MOD] January competition - Sample theme",
+		PostLink:  "https://redd.it/abcdef",
+		Month:     "September",
+		Theme:     "Sample theme",
+		Entrants:  c.Places,
+	}
+	for _, name := range c.Categories {
+		cat := &categoryResults{Name: name}
+		for i := 0; i < c.Places; i++ {
+			cat.Ranked = append(cat.Ranked, &rankedEntry{
+				Rank: i + 1, Place: ordinal(i + 1), Author: fmt.Sprintf("u/%0*d", redditMaxUsernameLength, i),
+				Score: 100, Link: "https://www.reddit.com/r/CrossStitch/comments/abcdef/sample/abcdefg/",
+			})
+		}
+		cat.Winners = cat.Ranked
+		sample.Categories = append(sample.Categories, cat)
+	}
+	_, _, err = c.renderAnnouncement(sample)
+	return err
+}
+
+// category returns the category of an entry with the comment text.
+func (c *ResultsConfig) category(text string) string {
+	for i, re := range c.categoryRegexes {
+		if re.MatchString(text) {
+			return c.Categories[i]
+		}
+	}
+	if len(c.Categories) == 0 {
+		return defaultResultsCategory
+	}
+	return c.Categories[0]
+}
+
+func (c *ResultsConfig) renderAnnouncement(data *resultsData) (title, text string, err error) {
+	var b strings.Builder
+	if err := c.announcementTitleTemplate.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	title = strings.TrimSpace(b.String())
+	if title == "" || len(title) > redditMaxTitleLength {
+		return "", "", fmt.Errorf("announcementTitle renders to %d characters, want 1 to %d", len(title), redditMaxTitleLength)
+	}
+	b.Reset()
+	if err := c.announcementTemplate.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	text = b.String()
+	if len(text) > redditMaxPostLength {
+		return "", "", fmt.Errorf("announcement renders to %d characters, more than Reddit's limit of %d", len(text), redditMaxPostLength)
+	}
+	return title, text, nil
+}
+
+// resultsData is what the announcement templates are rendered with.
+type resultsData struct {
+	Subreddit string
+	PostTitle string
+	// PostLink links to the competition post.
+	PostLink string
+	// Month is the name of the month the competition post was made in.
+	Month string
+	// Theme is the part of the post title matched by the profile's theme regex, if any.
+	Theme string
+	// Entrants counts the users with a valid entry.
+	Entrants   int
+	Categories []*categoryResults
+}
+
+// categoryResults ranks the valid entries in one category.
+type categoryResults struct {
+	Name string `json:"name"`
+	// Ranked lists every valid entry in the category by rank, and Winners those that placed.
+	Ranked  []*rankedEntry `json:"ranked"`
+	Winners []*rankedEntry `json:"winners"`
+}
+
+// rankedEntry is an entry's place in its category. Entries with the same score share the
+// higher place, and the places below are skipped: two entries tied for 1st are followed by 3rd.
+type rankedEntry struct {
+	Rank int `json:"rank"`
+	// Place is Rank as an ordinal, e.g. "2nd".
+	Place         string `json:"place"`
+	Tied          bool   `json:"tied,omitempty"`
+	Author        string `json:"author"`
+	Score         int    `json:"score"`
+	CommentFullID string `json:"commentFullID"`
+	// Link leads to the entry's comment, or else to its first image.
+	Link      string   `json:"link"`
+	ImageURLs []string `json:"imageURLs"`
+}
+
+// ordinal returns n as an English ordinal, e.g. "1st" or "12th".
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+func entryLink(e *Entry) string {
+	if e.Permalink != "" {
+		return "https://www.reddit.com" + e.Permalink
+	}
+	if len(e.ImageURLs) > 0 {
+		return e.ImageURLs[0]
+	}
+	return ""
+}
+
+// rankEntries ranks the valid entries in each of the profile's categories by score. Deleted and
+// otherwise invalid entries are not ranked. Entries tied on score are listed by submission time.
+func (c *ResultsConfig) rankEntries(entries []*Entry) []*categoryResults {
+	var results []*categoryResults
+	byName := map[string]*categoryResults{}
+	for _, name := range c.Categories {
+		cat := &categoryResults{Name: name, Ranked: []*rankedEntry{}, Winners: []*rankedEntry{}}
+		results = append(results, cat)
+		byName[name] = cat
+	}
+	valid := map[string][]*Entry{}
+	for _, e := range entries {
+		if !e.Valid {
+			continue
+		}
+		name := e.Category
+		if byName[name] == nil {
+			// The entry was categorized before the categories changed.
+			name = c.category("")
+		}
+		valid[name] = append(valid[name], e)
+	}
+	for _, cat := range results {
+		ranked := valid[cat.Name]
+		sort.SliceStable(ranked, func(i, j int) bool {
+			if ranked[i].Score != ranked[j].Score {
+				return ranked[i].Score > ranked[j].Score
+			}
+			return ranked[i].SubmittedAt.Before(ranked[j].SubmittedAt)
+		})
+		for i, e := range ranked {
+			r := &rankedEntry{Rank: i + 1, Author: e.Author, Score: e.Score, CommentFullID: e.CommentFullID, Link: entryLink(e), ImageURLs: e.ImageURLs}
+			if i > 0 && e.Score == ranked[i-1].Score {
+				prev := cat.Ranked[i-1]
+				r.Rank, r.Tied, prev.Tied = prev.Rank, true, true
+			}
+			r.Place = ordinal(r.Rank)
+			cat.Ranked = append(cat.Ranked, r)
+			if r.Rank <= c.Places {
+				cat.Winners = append(cat.Winners, r)
+			}
+		}
+	}
+	return results
+}
+
+// Announcement is the winners announcement of a competition post, keyed by the post's ID.
+type Announcement struct {
+	PostID string
+	Title  string `datastore:",noindex"`
+	Text   string `datastore:",noindex"`
+	Status string
+	// DraftedAt is when votes were tallied, and ApprovedAt when moderators approved the draft.
+	DraftedAt  time.Time
+	ApprovedAt time.Time
+	// SubmittedPostID is the full ID of the announcement post, once submitted.
+	SubmittedPostID string
+	SubmittedAt     time.Time
+	// Error is why submitting the announcement last failed, if it did.
+	Error string `datastore:",noindex"`
+	// Winners lists the places the announcement names, so that the winners rewarded are those
+	// announced, even if the entries or the config change after votes were tallied.
+	Winners []announcedPlace
+	// WinnersRewarded is set once every winner was messaged and given flair, as configured.
+	WinnersRewarded bool
+}
+
+// announcedPlace is a place a winner took in a category of a winners announcement.
+type announcedPlace struct {
+	Username string
+	Category string
+	Place    string
+	Tied     bool
+	Score    int
+	Link     string `datastore:",noindex"`
+}
+
+// announcedPlaces lists the places of the winners of each category, in the order of the categories.
+func announcedPlaces(results []*categoryResults) []announcedPlace {
+	var places []announcedPlace
+	for _, cat := range results {
+		for _, r := range cat.Winners {
+			places = append(places, announcedPlace{Username: r.Author, Category: cat.Name, Place: r.Place, Tied: r.Tied, Score: r.Score, Link: r.Link})
+		}
+	}
+	return places
+}
+
+// newResultsData describes the results of a competition post for the announcement templates.
+func newResultsData(p *CompetitionProfile, cp *CompetitionPost, results []*categoryResults) *resultsData {
+	data := &resultsData{
+		Subreddit:  p.Subreddit,
+		PostTitle:  cp.Title,
+		PostLink:   "https://redd.it/" + strings.TrimPrefix(cp.PostID, "t3_"),
+		Month:      cp.CreatedAt.UTC().Month().String(),
+		Theme:      p.theme(cp.Title),
+		Categories: results,
+	}
+	entrants := map[string]bool{}
+	for _, cat := range results {
+		for _, r := range cat.Ranked {
+			entrants[subscriptionKeyName(r.Author)] = true
+		}
+	}
+	data.Entrants = len(entrants)
+	return data
+}
+
+// draftAnnouncement tallies the votes on a competition post that has just closed, and saves a
+// draft of its winners announcement for moderators to approve. An announcement that moderators
+// already approved is left alone.
+func (s *summoner) draftAnnouncement(ctx context.Context, p *CompetitionProfile, cp *CompetitionPost, entries []*Entry) error {
+	logger := loggerFrom(ctx)
+	a, err := s.store.Announcement(ctx, p.Namespace, cp.PostID)
+	if err == nil && a.Status != announcementDraft {
+		logger.Info("Not redrafting approved winners announcement", "status", a.Status)
+		return nil
+	} else if err != nil && err != errNotFound {
+		logger.Error("Failed to read Announcement", "err", err)
+		return err
+	}
+	results := p.Results.rankEntries(entries)
+	title, text, err := p.Results.renderAnnouncement(newResultsData(p, cp, results))
+	if err != nil {
+		logger.Error("Failed to render winners announcement", "err", err)
+		return err
+	}
+	a = &Announcement{PostID: cp.PostID, Title: title, Text: text, Status: announcementDraft, DraftedAt: time.Now().UTC(), Winners: announcedPlaces(results)}
+	if err := s.store.PutAnnouncement(ctx, p.Namespace, a); err != nil {
+		logger.Error("Failed to save Announcement", "err", err)
+		return err
+	}
+	logger.Info("Drafted winners announcement", "title", title)
+	s.postReport(p, cp.PostID).Announcement = announcementDraft
+	s.notifyAnnouncementDrafted(ctx, p, cp, a)
+	return nil
+}
+
+// approveAnnouncement approves the drafted winners announcement of a competition post, so that
+// the next run submits it.
+func (s *summoner) approveAnnouncement(ctx context.Context, p *CompetitionProfile, postID string) (*Announcement, error) {
+	a, err := s.store.Announcement(ctx, p.Namespace, postID)
+	if err == errNotFound {
+		return nil, fmt.Errorf("%w: no winners announcement was drafted for %s", errPostNotFound, postID)
+	} else if err != nil {
+		return nil, err
+	}
+	if a.Status == announcementPosted {
+		return a, fmt.Errorf("%w as %s", errAnnouncementPosted, a.SubmittedPostID)
+	}
+	if a.Status == announcementDraft {
+		a.Status, a.ApprovedAt = announcementApproved, time.Now().UTC()
+		if err := s.store.PutAnnouncement(ctx, p.Namespace, a); err != nil {
+			return nil, err
+		}
+		loggerFrom(ctx).Info("Approved winners announcement", "profile", p.Name, "post", postID)
+	}
+	return a, nil
+}
+
+// submitAnnouncements submits the profile's approved winners announcements.
+func (s *summoner) submitAnnouncements(ctx context.Context, p *CompetitionProfile) error {
+	if !p.Results.Tally {
+		return nil
+	}
+	announcements, err := s.store.Announcements(ctx, p.Namespace)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to list Announcements", "err", err)
+		return err
+	}
+	for _, a := range announcements {
+		if s.shuttingDown() {
+			return nil
+		}
+		if a.Status != announcementApproved && a.Status != announcementSubmitting {
+			continue
+		}
+		ctx := withLogAttrs(ctx, "post", a.PostID)
+		err := s.withPostLease(ctx, p, a.PostID, func() error {
+			return s.submitAnnouncement(ctx, p, a)
+		})
+		if err != nil {
+			s.postReport(p, a.PostID).Error = err.Error()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *summoner) submitAnnouncement(ctx context.Context, p *CompetitionProfile, a *Announcement) error {
+	logger := loggerFrom(ctx)
+	// Another run may have submitted the announcement since it was listed.
+	current, err := s.store.Announcement(ctx, p.Namespace, a.PostID)
+	if err != nil {
+		return err
+	}
+	switch current.Status {
+	case announcementApproved:
+	case announcementSubmitting:
+		// An earlier run may have submitted the announcement, but failed to record it.
+		postID, err := s.findSubmittedAnnouncement(p, a)
+		if err != nil {
+			logger.Error("Failed to look for submitted winners announcement", "err", err)
+			return err
+		}
+		if postID != "" {
+			logger.Info("Found winners announcement submitted by an earlier run", "announcement", postID)
+			return s.recordSubmittedAnnouncement(ctx, p, a, postID)
+		}
+	default:
+		return nil
+	}
+
+	a.Status = announcementSubmitting
+	if err := s.store.PutAnnouncement(ctx, p.Namespace, a); err != nil {
+		logger.Error("Failed to save Announcement", "err", err)
+		return err
+	}
+	postID, err := s.redditSession.SubmitPost(p.Subreddit, a.Title, a.Text)
+	if err != nil {
+		// Reddit may have taken the post regardless, so the next run looks for it first.
+		logger.Error("Failed to submit winners announcement", "err", err)
+		a.Error = err.Error()
+		if putErr := s.store.PutAnnouncement(ctx, p.Namespace, a); putErr != nil {
+			logger.Error("Failed to save Announcement", "err", putErr)
+		}
+		return err
+	}
+	return s.recordSubmittedAnnouncement(ctx, p, a, postID)
+}
+
+// findSubmittedAnnouncement returns the full ID of the bot's recent post in the profile's
+// subreddit with the announcement's title, or empty if there is none.
+func (s *summoner) findSubmittedAnnouncement(p *CompetitionProfile, a *Announcement) (string, error) {
+	posts, err := s.redditSession.SubredditPosts(p.Subreddit, geddit.NewSubmissions, geddit.ListingOptions{
+		Limit: 100,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, post := range posts {
+		if strings.EqualFold(post.Author, s.config.RedditUsername) && post.Title == a.Title {
+			return post.FullID, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *summoner) recordSubmittedAnnouncement(ctx context.Context, p *CompetitionProfile, a *Announcement, postID string) error {
+	a.Status, a.SubmittedPostID, a.SubmittedAt, a.Error = announcementPosted, postID, time.Now().UTC(), ""
+	if err := s.store.PutAnnouncement(ctx, p.Namespace, a); err != nil {
+		loggerFrom(ctx).Error("Failed to save Announcement", "err", err)
+		return err
+	}
+	loggerFrom(ctx).Info("Submitted winners announcement", "announcement", postID)
+	s.postReport(p, a.PostID).Announcement = announcementPosted
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+func TestOrdinal(t *testing.T) {
+	for n, want := range map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 13: "13th", 21: "21st", 102: "102nd"} {
+		if got := ordinal(n); got != want {
+			t.Errorf("ordinal(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestResultsCategory(t *testing.T) {
+	c := &ResultsConfig{Categories: []string{"Beginner", "Advanced"}}
+	c.applyDefaults()
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile call failed: %v", err)
+	}
+	for text, want := range map[string]string{
+		"My ADVANCED entry https://i.redd.it/a.jpg": "Advanced",
+		"[beginner] first piece ever!":              "Beginner",
+		"Advancedness is not a category":            "Beginner",
+		"No category given":                         "Beginner",
+	} {
+		if got := c.category(text); got != want {
+			t.Errorf("category(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestRankEntries(t *testing.T) {
+	c := &ResultsConfig{Categories: []string{"Beginner", "Advanced"}, Places: 2}
+	c.applyDefaults()
+	day := func(n int) time.Time { return time.Date(2026, time.January, n, 12, 0, 0, 0, time.UTC) }
+	entries := []*Entry{
+		{CommentFullID: "t1_a", Author: "u/alice", Category: "Beginner", Score: 10, SubmittedAt: day(1), Valid: true},
+		{CommentFullID: "t1_b", Author: "u/bob", Category: "Beginner", Score: 25, SubmittedAt: day(2), Valid: true},
+		{CommentFullID: "t1_c", Author: "u/carol", Category: "Beginner", Score: 25, SubmittedAt: day(3), Valid: true},
+		{CommentFullID: "t1_d", Author: "u/dave", Category: "Beginner", Score: 40, SubmittedAt: day(4), Deleted: true, Problem: entryProblemDeleted},
+		{CommentFullID: "t1_e", Author: "u/erin", Category: "Advanced", Score: 5, SubmittedAt: day(5), Valid: true},
+		{CommentFullID: "t1_f", Author: "u/frank", Category: "Advanced", Score: 7, SubmittedAt: day(6), Valid: true},
+		{CommentFullID: "t1_g", Author: "u/grace", Category: "Advanced", Score: 7, SubmittedAt: day(7), Valid: true},
+		// Entries in categories that no longer exist are in the first category.
+		{CommentFullID: "t1_h", Author: "u/heidi", Category: "Speed", Score: 1, SubmittedAt: day(8), Valid: true},
+	}
+
+	results := c.rankEntries(entries)
+	if len(results) != 2 {
+		t.Fatalf("rankEntries returned %d categories, want 2", len(results))
+	}
+	describe := func(ranked []*rankedEntry) string {
+		var parts []string
+		for _, r := range ranked {
+			tied := ""
+			if r.Tied {
+				tied = "="
+			}
+			parts = append(parts, r.Place+tied+" "+r.Author)
+		}
+		return strings.Join(parts, ", ")
+	}
+	for _, tc := range []struct {
+		cat             *categoryResults
+		ranked, winners string
+	}{
+		{results[0], "1st= u/bob, 1st= u/carol, 3rd u/alice, 4th u/heidi", "1st= u/bob, 1st= u/carol"},
+		// Entries tied for the last place are all winners.
+		{results[1], "1st= u/frank, 1st= u/grace, 3rd u/erin", "1st= u/frank, 1st= u/grace"},
+	} {
+		if got := describe(tc.cat.Ranked); got != tc.ranked {
+			t.Errorf("%s ranked %s, want %s", tc.cat.Name, got, tc.ranked)
+		}
+		if got := describe(tc.cat.Winners); got != tc.winners {
+			t.Errorf("%s winners %s, want %s", tc.cat.Name, got, tc.winners)
+		}
+	}
+
+	c.Places = 3
+	if got, want := describe(c.rankEntries(entries)[1].Winners), "1st= u/frank, 1st= u/grace, 3rd u/erin"; got != want {
+		t.Errorf("Advanced winners with 3 places %s, want %s", got, want)
+	}
+}
+
+// closedCompetition sets up a competition post whose voting just ended, with entries in two
+// categories, for the next run to tally.
+func closedCompetition(t *testing.T, s *summoner) (*CompetitionProfile, *CompetitionPost) {
+	p := testProfile(s)
+	p.Entries.Collect = true
+	p.Results.Tally = true
+	p.Results.Categories = []string{"Beginner", "Advanced"}
+	if err := p.Results.compile(); err != nil {
+		t.Fatalf("compile call failed: %v", err)
+	}
+	created := time.Date(2026, time.January, 1, 12, 0, 0, 0, time.UTC)
+	cp := &CompetitionPost{PostID: "t3_12345", Title: "[MOD] January's competition - Hearts", CreatedAt: created, Deadline: time.Now().Add(-time.Minute)}
+	if err := s.store.PutCompetitionPost(context.Background(), p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	// Subscribers were summoned when it opened.
+	if err := s.store.UpdatePost(context.Background(), p.Namespace, cp.PostID, &postUpdate{MarkHandled: true}); err != nil {
+		t.Fatalf("UpdatePost call failed: %v", err)
+	}
+	comment := func(fullID, author, body string, score float64) *geddit.Comment {
+		c := fakeComment(fullID, author, body, created.Add(time.Hour))
+		c.Score, c.Permalink = score, "/r/CrossStitch/comments/12345/x/"+strings.TrimPrefix(fullID, "t1_")+"/"
+		return c
+	}
+	s.redditSession.(*fakeRedditSession).comments = map[string][]*geddit.Comment{cp.PostID: {
+		comment("t1_a", "alice", "Beginner: https://i.redd.it/alice.jpg", 12),
+		comment("t1_b", "bob", "Advanced https://i.redd.it/bob.jpg", 30),
+		comment("t1_c", "carol", "Advanced https://i.redd.it/carol.jpg", 30),
+		comment("t1_d", "dave", "Beginner, no picture yet", 50),
+	}}
+	return p, cp
+}
+
+func TestTallyAndAnnounceWinners(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	notifier := addFakeNotifier(s)
+	p, cp := closedCompetition(t, s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	ctx := context.Background()
+
+	report, err := s.checkPosts(ctx)
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if got := report.profile(p).post(cp.PostID).Announcement; got != announcementDraft {
+		t.Fatalf("run reported announcement %q, want %q", got, announcementDraft)
+	}
+	a, err := s.store.Announcement(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		t.Fatalf("Announcement call failed: %v", err)
+	}
+	if a.Status != announcementDraft || a.Title != "[MOD] January's competition winners - Hearts" {
+		t.Fatalf("run drafted unexpected announcement: %+v", a)
+	}
+	for _, want := range []string{"all 3 entrants", "## Beginner", "**1st:** u/alice", "## Advanced", "**1st (tied):** u/bob", "**1st (tied):** u/carol", "(30 points)"} {
+		if !strings.Contains(a.Text, want) {
+			t.Errorf("announcement lacks %q:\n%s", want, a.Text)
+		}
+	}
+	if strings.Contains(a.Text, "u/dave") {
+		t.Errorf("announcement lists an invalid entry:\n%s", a.Text)
+	}
+	if len(notifier.notifications) != 1 || notifier.notifications[0].Event != eventResultsDrafted || !strings.Contains(notifier.notifications[0].Text, a.Text) {
+		t.Fatalf("run sent unexpected notifications: %+v", notifier.notifications)
+	}
+	if len(fsr.posts) != 0 {
+		t.Fatalf("announcement was submitted before it was approved: %+v", fsr.posts)
+	}
+
+	// Nothing is submitted until moderators approve the draft.
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if len(fsr.posts) != 0 {
+		t.Fatalf("announcement was submitted before it was approved: %+v", fsr.posts)
+	}
+	out, err := runCommand(t, s, "approve", "12345")
+	if err != nil {
+		t.Fatalf("approve command failed: %v", err)
+	}
+	if !strings.Contains(out, "the next run will submit it") {
+		t.Fatalf("approve command printed unexpected output:\n%s", out)
+	}
+	for run := 0; run < 2; run++ {
+		if _, err := s.checkPosts(ctx); err != nil {
+			t.Fatalf("checkPosts call failed: %v", err)
+		}
+	}
+	if len(fsr.posts) != 1 || fsr.posts[0].Subreddit != p.Subreddit || fsr.posts[0].Title != a.Title || fsr.posts[0].Text != a.Text {
+		t.Fatalf("runs submitted unexpected posts: %+v", fsr.posts)
+	}
+	if a, err = s.store.Announcement(ctx, p.Namespace, cp.PostID); err != nil || a.Status != announcementPosted || a.SubmittedPostID != "t3_submitted1" {
+		t.Fatalf("submitted announcement was not recorded (got: %+v, %v)", a, err)
+	}
+	if _, err := runCommand(t, s, "approve", "12345"); !errors.Is(err, errAnnouncementPosted) {
+		t.Fatalf("approving a submitted announcement returned %v, want errAnnouncementPosted", err)
+	}
+}
+
+func TestSubmitAnnouncementAfterInterruptedRun(t *testing.T) {
+	for _, tc := range []struct {
+		author     string
+		wantPosts  int
+		wantPostID string
+	}{
+		// The interrupted run submitted the announcement, so it is not submitted again.
+		{defaultRedditUsername, 0, "t3_winners"},
+		// Someone else's post with the same title is not the announcement.
+		{"mimic", 1, "t3_submitted1"},
+	} {
+		s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+		p, cp := closedCompetition(t, s)
+		fsr := s.redditSession.(*fakeRedditSession)
+		ctx := context.Background()
+		if _, err := s.checkPosts(ctx); err != nil {
+			t.Fatalf("checkPosts call failed: %v", err)
+		}
+		a, err := s.store.Announcement(ctx, p.Namespace, cp.PostID)
+		if err != nil {
+			t.Fatalf("Announcement call failed: %v", err)
+		}
+		a.Status = announcementSubmitting
+		if err := s.store.PutAnnouncement(ctx, p.Namespace, a); err != nil {
+			t.Fatalf("PutAnnouncement call failed: %v", err)
+		}
+		post := fakePost("t3_winners", a.Title)
+		post.Author = tc.author
+		fsr.submittions = []*redditPost{post}
+
+		if err := s.submitAnnouncements(ctx, p); err != nil {
+			t.Fatalf("submitAnnouncements call failed: %v", err)
+		}
+		if len(fsr.posts) != tc.wantPosts {
+			t.Errorf("submitAnnouncements with a post by %s submitted unexpected posts (got: %+v, want: %d)", tc.author, fsr.posts, tc.wantPosts)
+		}
+		if a, err = s.store.Announcement(ctx, p.Namespace, cp.PostID); err != nil || a.Status != announcementPosted || a.SubmittedPostID != tc.wantPostID {
+			t.Errorf("submitAnnouncements with a post by %s recorded unexpected announcement (got: %+v, %v, want: %s)", tc.author, a, err, tc.wantPostID)
+		}
+	}
+}
+
+func TestTallyUsesScoresAtTallyTime(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p, cp := closedCompetition(t, s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	ctx := context.Background()
+	// Entries were collected while voting was still open.
+	cp.Deadline = time.Now().Add(time.Hour)
+	if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if _, err := s.store.Announcement(ctx, p.Namespace, cp.PostID); err != errNotFound {
+		t.Fatalf("votes were tallied before voting ended: %v", err)
+	}
+
+	// Voting ended, and alice's entry gained votes before the next run tallied them.
+	fsr.comments[cp.PostID][0].Score = 40
+	cp, err := s.store.CompetitionPost(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		t.Fatalf("CompetitionPost call failed: %v", err)
+	}
+	cp.Deadline = time.Now().Add(-time.Minute)
+	if err := s.store.PutCompetitionPost(ctx, p.Namespace, cp); err != nil {
+		t.Fatalf("PutCompetitionPost call failed: %v", err)
+	}
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	a, err := s.store.Announcement(ctx, p.Namespace, cp.PostID)
+	if err != nil {
+		t.Fatalf("Announcement call failed: %v", err)
+	}
+	if !strings.Contains(a.Text, "**1st:** u/alice") || !strings.Contains(a.Text, "(40 points)") {
+		t.Fatalf("announcement does not count the votes cast before the tally:\n%s", a.Text)
+	}
+}
+
+func TestResultsCommand(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	closedCompetition(t, s)
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	out, err := runCommand(t, s, "results", "12345")
+	if err != nil {
+		t.Fatalf("results command failed: %v", err)
+	}
+	for _, want := range []string{"scores when votes were tallied", "Beginner: 1 entries", "Advanced: 2 entries", "1st (tied)  u/bob", "Winners announcement (draft)", "## Advanced"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("results command output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestAdminAPIResults(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	_, cp := closedCompetition(t, s)
+	srv := adminServer(t, s)
+	if status := adminRequest(t, srv, http.MethodPost, "/admin/posts/12345/results/approve", nil); status != http.StatusNotFound {
+		t.Fatalf("approving an undrafted announcement returned status %d, want %d", status, http.StatusNotFound)
+	}
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	var results postResults
+	if status := adminRequest(t, srv, http.MethodGet, "/admin/posts/12345/results", &results); status != http.StatusOK {
+		t.Fatalf("GET results returned status %d", status)
+	}
+	if len(results.Categories) != 2 || len(results.Categories[1].Winners) != 2 || results.Announcement == nil || results.Announcement.PostID != cp.PostID {
+		t.Fatalf("GET results returned unexpected results: %+v", results)
+	}
+	var a Announcement
+	if status := adminRequest(t, srv, http.MethodPost, "/admin/posts/12345/results/approve", &a); status != http.StatusOK || a.Status != announcementApproved {
+		t.Fatalf("approve returned status %d and announcement %+v", status, a)
+	}
+}
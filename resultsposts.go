@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	defaultResultsMainComment = "The results of the competition are in! Congratulations to the winners, and thank you to everyone who took part.\n\n" +
+		"To be summoned when future results are announced, reply `!subscribe results` to this comment." +
+		" Reply `!unsubscribe results` at any time to stop."
+	defaultResultsSummonComment = "Summoning results subscribers {{.Mentions}}"
+)
+
+// subscriptionCategoryResults is the argument of subscription commands about winners posts, e.g.
+// "!subscribe results".
+const subscriptionCategoryResults = "results"
+
+// resultsProfileSuffix is appended to a profile's name to name the summoning to its winners posts.
+const resultsProfileSuffix = "-results"
+
+// ResultsSubscriptionConfig configures summoning the users who opted in to hear about results to
+// a profile's winners posts. Summoning to winners posts is kept apart from summoning to
+// competition posts, in its own namespace, with its own subscribers and comment templates.
+type ResultsSubscriptionConfig struct {
+	// Enabled turns on summoning to winners posts.
+	Enabled bool `yaml:"enabled"`
+	// Namespace is the Datastore namespace holding the state of summoning to winners posts. It
+	// defaults to the profile's namespace followed by "-results", or to "results".
+	Namespace string `yaml:"namespace"`
+	// Detection decides which posts are winners posts.
+	Detection *DetectionRule `yaml:"detection"`
+	// Subscribers and RedditSubscriptions select the users who opted in to results, as those of
+	// the profile do for competition posts. RedditSubscriptions defaults to "replace": users opt
+	// in with "!subscribe results".
+	Subscribers         SubscriberSourceConfig `yaml:"subscribers"`
+	RedditSubscriptions string                 `yaml:"redditSubscriptions"`
+	// MainComment and SummonComment are the templates of the comments made on winners posts,
+	// executed with the fields of commentData.
+	MainComment   string `yaml:"mainComment"`
+	SummonComment string `yaml:"summonComment"`
+
+	// profile summons to winners posts, if enabled.
+	profile *CompetitionProfile
+}
+
+// defaultResultsDetectionRule matches moderator posts announcing the winners of a competition.
+func defaultResultsDetectionRule() *DetectionRule {
+	r := &DetectionRule{TitleRegex: `(?i)^\s*\[mod\].*competition.*winner`}
+	if err := r.validate(); err != nil {
+		panic(fmt.Sprintf("invalid default results detection rule: %v", err))
+	}
+	return r
+}
+
+func (c *ResultsSubscriptionConfig) applyDefaults() {
+	if c.Detection == nil {
+		c.Detection = defaultResultsDetectionRule()
+	}
+	c.Subscribers.applyDefaults()
+	if c.RedditSubscriptions == "" {
+		c.RedditSubscriptions = redditSubscriptionsReplace
+	}
+	if c.MainComment == "" {
+		c.MainComment = defaultResultsMainComment
+	}
+	if c.SummonComment == "" {
+		c.SummonComment = defaultResultsSummonComment
+	}
+}
+
+func (c *ResultsSubscriptionConfig) validate(p *CompetitionProfile) error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if err := c.Detection.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("detection: %w", err))
+	}
+	switch c.RedditSubscriptions {
+	case redditSubscriptionsOff, redditSubscriptionsMerge:
+		if err := c.Subscribers.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("subscribers: %w", err))
+		}
+	case redditSubscriptionsReplace:
+	default:
+		errs = append(errs, fmt.Errorf("redditSubscriptions must be %q, %q or %q, got %q",
+			redditSubscriptionsOff, redditSubscriptionsMerge, redditSubscriptionsReplace, c.RedditSubscriptions))
+	}
+	if c.namespace(p) == p.Namespace {
+		errs = append(errs, fmt.Errorf("namespace must differ from the profile's, %q", p.Namespace))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *ResultsSubscriptionConfig) namespace(p *CompetitionProfile) string {
+	switch {
+	case c.Namespace != "":
+		return c.Namespace
+	case p.Namespace == "":
+		return subscriptionCategoryResults
+	}
+	return p.Namespace + resultsProfileSuffix
+}
+
+// compile builds the profile that summons to p's winners posts, and compiles its templates.
+func (c *ResultsSubscriptionConfig) compile(p *CompetitionProfile, maxTags int) error {
+	c.profile = nil
+	if !c.Enabled {
+		return nil
+	}
+	rp := &CompetitionProfile{
+		Name:                p.Name + resultsProfileSuffix,
+		Namespace:           c.namespace(p),
+		Subreddit:           p.Subreddit,
+		Detection:           c.Detection,
+		Subscribers:         c.Subscribers,
+		RedditSubscriptions: c.RedditSubscriptions,
+		MainComment:         c.MainComment,
+		SummonComment:       c.SummonComment,
+		FormURL:             p.FormURL,
+		ThemeRegex:          p.ThemeRegex,
+		resultsOf:           p,
+	}
+	rp.applyDefaults()
+	if err := rp.compileTemplates(maxTags); err != nil {
+		return err
+	}
+	c.profile = rp
+	return nil
+}
+
+// resultsProfile returns the profile that summons to p's winners posts, or nil if it is not
+// enabled.
+func (p *CompetitionProfile) resultsProfile() *CompetitionProfile {
+	return p.ResultsSubscription.profile
+}
+
+// subscriptionProfile returns the profile that subscription commands of the category apply to,
+// or nil if there is none.
+func (p *CompetitionProfile) subscriptionProfile(category string) *CompetitionProfile {
+	if category == subscriptionCategoryResults {
+		return p.resultsProfile()
+	}
+	return p
+}
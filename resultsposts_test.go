@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// enableResultsSubscription turns on summoning to the test profile's winners posts, and returns
+// the profile doing it.
+func enableResultsSubscription(t *testing.T, s *summoner) *CompetitionProfile {
+	t.Helper()
+	p := testProfile(s)
+	p.ResultsSubscription.Enabled = true
+	if err := p.ResultsSubscription.compile(p, s.config.MaxRedditTagsPerComment); err != nil {
+		t.Fatalf("compile call failed: %v", err)
+	}
+	return p.resultsProfile()
+}
+
+func TestLoadConfigResultsSubscription(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: CrossStitch
+    subscribers:
+      type: memory
+    resultsSubscription:
+      enabled: true
+      summonComment: "Results are out! {{.Mentions}}"
+`)
+	cfg, err := loadConfig(path, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	rp := cfg.Profiles[0].resultsProfile()
+	if rp == nil || rp.Name != "CrossStitch-results" || rp.Namespace != "results" || rp.RedditSubscriptions != redditSubscriptionsReplace ||
+		rp.MainComment != defaultResultsMainComment || rp.SummonComment != "Results are out! {{.Mentions}}" {
+		t.Fatalf("loadConfig returned unexpected results profile: %+v", rp)
+	}
+
+	path = writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: CrossStitch
+    subscribers:
+      type: memory
+    resultsSubscription:
+      enabled: true
+      namespace: embroidery
+      redditSubscriptions: merge
+  - subreddit: Embroidery
+    namespace: embroidery
+    subscribers:
+      type: memory
+`)
+	_, err = loadConfig(path, fakeEnv(nil))
+	for _, want := range []string{"resultsSubscription: subscribers: sheetID must be set", `share namespace "embroidery"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadConfig error %v does not mention %q", err, want)
+		}
+	}
+}
+
+func TestConfigReadsSheetsForResultsSubscribers(t *testing.T) {
+	for _, tc := range []struct {
+		redditSubscriptions string
+		want                bool
+	}{
+		{redditSubscriptionsReplace, false},
+		{redditSubscriptionsMerge, true},
+	} {
+		path := writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: CrossStitch
+    subscribers:
+      type: memory
+    resultsSubscription:
+      enabled: true
+      redditSubscriptions: `+tc.redditSubscriptions+`
+      subscribers:
+        sheetID: results-sheet
+`)
+		cfg, err := loadConfig(path, fakeEnv(nil))
+		if err != nil {
+			t.Fatalf("loadConfig call failed: %v", err)
+		}
+		if got := cfg.readsSheets(); got != tc.want {
+			t.Errorf("readsSheets with results subscriptions %q returned unexpected result (got: %t, want: %t)", tc.redditSubscriptions, got, tc.want)
+		}
+	}
+}
+
+func TestSummonResultsSubscribers(t *testing.T) {
+	competitionPost := fakePost("t3_12345", "[MOD] January's competition - Hearts")
+	winnersPost := fakePost("t3_67890", "[MOD] January's competition winners - Hearts")
+	s := fakeSummoner([]*redditPost{competitionPost, winnersPost}, generateFakeUsers(2))
+	winnersPost.Subreddit = testProfile(s).Subreddit
+	rp := enableResultsSubscription(t, s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.inbox = []*inboxMessage{
+		{FullID: "t4_1", Author: "alice", Body: "!subscribe results"},
+		{FullID: "t4_2", Author: "bob", Body: "!subscribe"},
+	}
+	ctx := context.Background()
+
+	report, err := s.checkPosts(ctx)
+	if err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if len(fsr.replies["t4_1"]) != 1 || !strings.Contains(fsr.replies["t4_1"][0], "subscribed to r/CrossStitch competition results") {
+		t.Fatalf("checkInbox did not confirm the results subscription: %q", fsr.replies["t4_1"])
+	}
+	// Subscribing to competition posts is still unavailable.
+	if len(fsr.replies["t4_2"]) != 1 || !strings.Contains(fsr.replies["t4_2"][0], "not available") {
+		t.Fatalf("checkInbox did not refuse the competition subscription: %q", fsr.replies["t4_2"])
+	}
+	if got := fsr.replies[competitionPost.FullID]; len(got) != 1 || got[0] == "" || strings.Contains(got[0], "results are in") {
+		t.Fatalf("run made unexpected comments on the competition post: %q", got)
+	}
+	if got := fsr.replies[winnersPost.FullID]; len(got) != 1 || !strings.Contains(got[0], "The results of the competition are in!") {
+		t.Fatalf("run made unexpected comments on the winners post: %q", got)
+	}
+	tags := strings.Join(fsr.replies["uniqueComment"], "\n")
+	if !strings.Contains(tags, "Summoning results subscribers u/alice") || strings.Contains(tags, "u/alice u/user") {
+		t.Fatalf("run made unexpected summon comments:\n%s", tags)
+	}
+	if rep := report.profile(rp).post(winnersPost.FullID); rep.UsersSummoned != 1 || rep.Phase != phaseComplete {
+		t.Fatalf("run reported unexpected summoning to the winners post: %+v", rep)
+	}
+
+	// Each kind of post is marked handled in its own namespace.
+	for _, tc := range []struct {
+		ns, postID string
+		want       bool
+	}{
+		{"", competitionPost.FullID, true},
+		{"", winnersPost.FullID, false},
+		{rp.Namespace, winnersPost.FullID, true},
+		{rp.Namespace, competitionPost.FullID, false},
+	} {
+		if handled, err := s.store.IsHandled(ctx, tc.ns, tc.postID); err != nil || handled != tc.want {
+			t.Errorf("IsHandled(%q, %s) = %t, %v, want %t", tc.ns, tc.postID, handled, err, tc.want)
+		}
+	}
+
+	comments := fsr.numComments
+	if _, err := s.checkPosts(ctx); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+	if fsr.numComments != comments {
+		t.Fatalf("second run made %d more comments", fsr.numComments-comments)
+	}
+
+	out, err := runCommand(t, s, "status")
+	if err != nil {
+		t.Fatalf("status command failed: %v", err)
+	}
+	if !strings.Contains(out, "Profile CrossStitch-results (r/CrossStitch, namespace \"results\")") {
+		t.Fatalf("status command output lacks the results profile:\n%s", out)
+	}
+	if out, err = runCommand(t, s, "preview", "67890"); err != nil {
+		t.Fatalf("preview command failed: %v", err)
+	}
+	if !strings.Contains(out, "is a competition post of profile CrossStitch-results") {
+		t.Fatalf("preview command did not preview the winners post as results:\n%s", out)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+// Reddit API calls are attempted at most this many times, waiting between attempts for an
+// exponentially growing, jittered delay. A call is not retried once doing so would take it past
+// redditMaxRetryTime from its first attempt, so that a run retrying a reply cannot outlive the
+// lease of the post it is summoning to.
+const (
+	redditMaxAttempts    = 5
+	redditRetryBaseDelay = time.Second
+	redditRetryMaxDelay  = time.Minute
+	redditMaxRetryTime   = 5 * time.Minute
+)
+
+// redditAPIError is an unsuccessful response from the Reddit API.
+type redditAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// Code is the error code Reddit reported in the response body, e.g. "RATELIMIT" or "THREAD_LOCKED".
+	Code string
+	// RetryAfter is how long Reddit asked to wait before retrying, if it said.
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *redditAPIError) Error() string {
+	msg := fmt.Sprintf("Reddit API %s %s returned %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// redditRetryInRegex finds the wait in Reddit's rate limit messages, e.g. "try again in 9 minutes".
+var redditRetryInRegex = regexp.MustCompile(`(?i)try again in (\d+) (second|minute)`)
+
+// newRedditCommentError reports the errors Reddit returns, with a successful status, for a comment
+// it did not post. Each error is a code, a message and the field it concerns.
+func newRedditCommentError(errs [][]string) error {
+	return newRedditJSONError("/api/comment", errs)
+}
+
+// newRedditJSONError reports the errors Reddit returns, with a successful status, in the JSON
+// response of a POST to path.
+func newRedditJSONError(path string, errs [][]string) error {
+	e := &redditAPIError{Method: http.MethodPost, Path: path, StatusCode: http.StatusOK}
+	var msgs []string
+	for _, fields := range errs {
+		if len(fields) == 0 {
+			continue
+		}
+		if e.Code == "" {
+			e.Code = fields[0]
+		}
+		msgs = append(msgs, strings.Join(fields, ": "))
+		if m := redditRetryInRegex.FindStringSubmatch(strings.Join(fields, " ")); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			e.RetryAfter = time.Duration(n) * time.Second
+			if strings.EqualFold(m[2], "minute") {
+				e.RetryAfter = time.Duration(n) * time.Minute
+			}
+		}
+	}
+	e.Body = strings.Join(msgs, "; ")
+	return e
+}
+
+// retryAfter returns how long the response headers ask clients to wait before retrying, or zero.
+func retryAfter(h http.Header) time.Duration {
+	for _, name := range []string{"Retry-After", "X-Ratelimit-Reset"} {
+		if secs, err := strconv.ParseFloat(h.Get(name), 64); err == nil && secs > 0 {
+			return time.Duration(secs * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// PermanentRedditError is a Reddit API failure that retrying cannot fix, e.g. because the post
+// was deleted or locked, or the bot is not allowed to comment.
+type PermanentRedditError struct {
+	Op  string
+	Err error
+}
+
+func (e *PermanentRedditError) Error() string {
+	return fmt.Sprintf("Reddit %s failed permanently: %v", e.Op, e.Err)
+}
+
+func (e *PermanentRedditError) Unwrap() error { return e.Err }
+
+// isPermanentRedditError reports whether err, or any error it wraps, is a PermanentRedditError.
+func isPermanentRedditError(err error) bool {
+	var perm *PermanentRedditError
+	return errors.As(err, &perm)
+}
+
+// commentFailureReason names why Reddit did not accept a comment, in metrics: by Reddit's error
+// code, e.g. thread_locked, or else its HTTP status, or whether the failure was permanent.
+func commentFailureReason(err error) string {
+	var apiErr *redditAPIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Code != "" {
+			return strings.ToLower(apiErr.Code)
+		}
+		return "http_" + strconv.Itoa(apiErr.StatusCode)
+	}
+	if isPermanentRedditError(err) {
+		return "permanent"
+	}
+	return "transient"
+}
+
+type redditErrorClass int
+
+const (
+	// Network errors and server errors are transient, and retried.
+	redditErrorTransient redditErrorClass = iota
+	// Rate limited requests are retried once Reddit says they may be.
+	redditErrorRateLimited
+	// Requests made with an expired token are retried after logging in again.
+	redditErrorAuthExpired
+	// Other failures are permanent, and not retried.
+	redditErrorPermanent
+)
+
+// classifyRedditError decides whether and how a failed call may be retried.
+func classifyRedditError(err error) redditErrorClass {
+	var apiErr *redditAPIError
+	if !errors.As(err, &apiErr) {
+		// Tokens from the password grant cannot be refreshed, so the OAuth client fails requests
+		// itself once its token expires.
+		if strings.Contains(err.Error(), "token expired") {
+			return redditErrorAuthExpired
+		}
+		return redditErrorTransient
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusTooManyRequests || apiErr.Code == "RATELIMIT":
+		return redditErrorRateLimited
+	case apiErr.StatusCode == http.StatusUnauthorized:
+		return redditErrorAuthExpired
+	case apiErr.StatusCode >= 500:
+		return redditErrorTransient
+	}
+	return redditErrorPermanent
+}
+
+// retryingRedditSession retries failed Reddit calls, within the deadline of its context. The
+// context is the one the session was created with, unless a run has bound its own.
+type retryingRedditSession struct {
+	oAuthSession
+	ctx                context.Context
+	username, password string
+	// sleep waits for the given time, or until the context is done.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryingRedditSession(ctx context.Context, session oAuthSession) *retryingRedditSession {
+	return &retryingRedditSession{oAuthSession: session, ctx: ctx, sleep: sleepContext}
+}
+
+// bindContext makes calls retry within ctx, until the returned function is called to restore the
+// context they retried within before.
+func (r *retryingRedditSession) bindContext(ctx context.Context) (restore func()) {
+	prev := r.ctx
+	r.ctx = ctx
+	return func() { r.ctx = prev }
+}
+
+// contextBoundSession is a Reddit session whose calls are bounded by a context that can be
+// replaced for the duration of a run.
+type contextBoundSession interface {
+	bindContext(ctx context.Context) (restore func())
+}
+
+// bindRedditContext bounds the session's calls by ctx, if they can be bounded, until the returned
+// function is called.
+func bindRedditContext(session oAuthSession, ctx context.Context) (restore func()) {
+	if b, ok := session.(contextBoundSession); ok {
+		return b.bindContext(ctx)
+	}
+	return func() {}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// backoff returns the jittered delay before the given retry, counting from zero.
+func backoff(retry int) time.Duration {
+	d := redditRetryBaseDelay << retry
+	if d > redditRetryMaxDelay || d <= 0 {
+		d = redditRetryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// call makes a Reddit API call, retrying it while it fails in a way that may be retried. Calls
+// that are not idempotent are only retried when Reddit certainly did not act on them. method names
+// the call in metrics, and op describes it, with its arguments, in errors and logs.
+func (r *retryingRedditSession) call(method, op string, idempotent bool, f func() error) error {
+	reauthenticated := false
+	first := time.Now()
+	var err error
+	for attempt := 0; attempt < redditMaxAttempts; attempt++ {
+		start := time.Now()
+		err = f()
+		observeCall("reddit", method, start)
+		if err == nil {
+			return nil
+		}
+
+		var delay time.Duration
+		switch classifyRedditError(err) {
+		case redditErrorPermanent:
+			return &PermanentRedditError{Op: op, Err: err}
+		case redditErrorAuthExpired:
+			if reauthenticated || r.password == "" {
+				return &PermanentRedditError{Op: op, Err: err}
+			}
+			loggerFrom(r.ctx).Warn("Reddit call failed with an expired token; logging in again", "op", op)
+			if err := r.oAuthSession.LoginAuth(r.username, r.password); err != nil {
+				return fmt.Errorf("logging in to Reddit again: %w", err)
+			}
+			reauthenticated = true
+			continue
+		case redditErrorRateLimited:
+			var apiErr *redditAPIError
+			errors.As(err, &apiErr)
+			delay = backoff(attempt)
+			if apiErr.RetryAfter > delay {
+				delay = apiErr.RetryAfter
+			}
+		case redditErrorTransient:
+			if !idempotent {
+				return err
+			}
+			delay = backoff(attempt)
+		}
+		if attempt == redditMaxAttempts-1 {
+			break
+		}
+		if waited := time.Since(first) + delay; waited > redditMaxRetryTime {
+			return fmt.Errorf("Reddit %s: not retrying, as waiting %s would take longer than %s in all: %w", op, delay, redditMaxRetryTime, err)
+		}
+		if deadline, ok := r.ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("Reddit %s: not retrying, as waiting %s would pass the deadline: %w", op, delay, err)
+		}
+		loggerFrom(r.ctx).Warn("Reddit call failed; retrying", "op", op, "attempt", attempt+1, "maxAttempts", redditMaxAttempts, "delay", delay.Round(time.Millisecond), "err", err)
+		if err := r.sleep(r.ctx, delay); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Reddit %s failed after %d attempts: %w", op, redditMaxAttempts, err)
+}
+
+// LoginAuth logs in, and remembers the credentials to log in again when the token expires.
+func (r *retryingRedditSession) LoginAuth(username, password string) error {
+	r.username, r.password = username, password
+	return r.oAuthSession.LoginAuth(username, password)
+}
+
+func (r *retryingRedditSession) Reply(parent geddit.Replier, comment string) (*geddit.Comment, error) {
+	var c *geddit.Comment
+	err := r.call("Reply", "reply to "+replierFullID(parent), false, func() (err error) {
+		c, err = r.oAuthSession.Reply(parent, comment)
+		return err
+	})
+	return c, err
+}
+
+func (r *retryingRedditSession) SubredditPosts(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*redditPost, error) {
+	var posts []*redditPost
+	err := r.call("SubredditPosts", "list posts of r/"+subreddit, true, func() (err error) {
+		posts, err = r.oAuthSession.SubredditPosts(subreddit, sort, params)
+		return err
+	})
+	return posts, err
+}
+
+func (r *retryingRedditSession) Moderators(subreddit string) ([]string, error) {
+	var mods []string
+	err := r.call("Moderators", "list moderators of r/"+subreddit, true, func() (err error) {
+		mods, err = r.oAuthSession.Moderators(subreddit)
+		return err
+	})
+	return mods, err
+}
+
+func (r *retryingRedditSession) Comment(subreddit, fullID string) (*geddit.Comment, error) {
+	var c *geddit.Comment
+	err := r.call("Comment", "get comment "+fullID, true, func() (err error) {
+		c, err = r.oAuthSession.Comment(subreddit, fullID)
+		return err
+	})
+	return c, err
+}
+
+func (r *retryingRedditSession) Post(subreddit, fullID string) (*redditPost, error) {
+	var post *redditPost
+	err := r.call("Post", "get post "+fullID, true, func() (err error) {
+		post, err = r.oAuthSession.Post(subreddit, fullID)
+		return err
+	})
+	return post, err
+}
+
+func (r *retryingRedditSession) PostComments(subreddit, postFullID string) ([]*geddit.Comment, error) {
+	var comments []*geddit.Comment
+	err := r.call("PostComments", "list comments on "+postFullID, true, func() (err error) {
+		comments, err = r.oAuthSession.PostComments(subreddit, postFullID)
+		return err
+	})
+	return comments, err
+}
+
+func (r *retryingRedditSession) SubmitPost(subreddit, title, text string) (string, error) {
+	var fullID string
+	err := r.call("SubmitPost", "submit post to r/"+subreddit, false, func() (err error) {
+		fullID, err = r.oAuthSession.SubmitPost(subreddit, title, text)
+		return err
+	})
+	return fullID, err
+}
+
+func (r *retryingRedditSession) LockPost(fullID string) error {
+	return r.call("LockPost", "lock post "+fullID, true, func() error {
+		return r.oAuthSession.LockPost(fullID)
+	})
+}
+
+func (r *retryingRedditSession) SetUserFlair(subreddit, username, text, cssClass string) error {
+	return r.call("SetUserFlair", "set flair of u/"+username, true, func() error {
+		return r.oAuthSession.SetUserFlair(subreddit, username, text, cssClass)
+	})
+}
+
+func (r *retryingRedditSession) SendMessage(to, subject, text string) error {
+	return r.call("SendMessage", "message "+to, false, func() error {
+		return r.oAuthSession.SendMessage(to, subject, text)
+	})
+}
+
+func (r *retryingRedditSession) UnreadMessages() ([]*inboxMessage, error) {
+	var messages []*inboxMessage
+	err := r.call("UnreadMessages", "list unread messages", true, func() (err error) {
+		messages, err = r.oAuthSession.UnreadMessages()
+		return err
+	})
+	return messages, err
+}
+
+func (r *retryingRedditSession) MarkMessagesRead(fullIDs ...string) error {
+	return r.call("MarkMessagesRead", "mark messages read", true, func() error {
+		return r.oAuthSession.MarkMessagesRead(fullIDs...)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+// flakyRedditSession fails calls with the queued errors, before succeeding.
+type flakyRedditSession struct {
+	fakeRedditSession
+	errs   []error
+	calls  int
+	logins int
+}
+
+func (f *flakyRedditSession) next() error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *flakyRedditSession) LoginAuth(username, password string) error {
+	f.logins++
+	return nil
+}
+func (f *flakyRedditSession) Reply(r geddit.Replier, comment string) (*geddit.Comment, error) {
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	return f.fakeRedditSession.Reply(r, comment)
+}
+func (f *flakyRedditSession) SubredditPosts(subreddit string, sort geddit.PopularitySort, params geddit.ListingOptions) ([]*redditPost, error) {
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	return f.fakeRedditSession.SubredditPosts(subreddit, sort, params)
+}
+
+// fakeRetryingSession returns a retrying session around a flaky one, and the delays it slept for.
+func fakeRetryingSession(ctx context.Context, errs ...error) (*retryingRedditSession, *flakyRedditSession, *[]time.Duration) {
+	flaky := &flakyRedditSession{errs: errs}
+	r := newRetryingRedditSession(ctx, flaky)
+	var delays []time.Duration
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	return r, flaky, &delays
+}
+
+func apiError(status int) error {
+	return &redditAPIError{Method: http.MethodGet, Path: "/r/CrossStitch/new.json", StatusCode: status}
+}
+
+func TestRetryingSessionRetriesTransientErrors(t *testing.T) {
+	r, flaky, delays := fakeRetryingSession(context.Background(), apiError(http.StatusServiceUnavailable), errors.New("connection reset"))
+
+	if _, err := r.SubredditPosts("CrossStitch", geddit.NewSubmissions, geddit.ListingOptions{}); err != nil {
+		t.Fatalf("SubredditPosts call failed: %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Fatalf("SubredditPosts made unexpected number of calls (got: %d, want: %d)", flaky.calls, 3)
+	}
+	if len(*delays) != 2 || (*delays)[0] < redditRetryBaseDelay/2 || (*delays)[1] < redditRetryBaseDelay {
+		t.Fatalf("SubredditPosts backed off for unexpected delays: %v", *delays)
+	}
+}
+
+func TestRetryingSessionGivesUpAfterMaxAttempts(t *testing.T) {
+	var errs []error
+	for i := 0; i < redditMaxAttempts; i++ {
+		errs = append(errs, apiError(http.StatusBadGateway))
+	}
+	r, flaky, _ := fakeRetryingSession(context.Background(), errs...)
+
+	_, err := r.SubredditPosts("CrossStitch", geddit.NewSubmissions, geddit.ListingOptions{})
+	if err == nil || isPermanentRedditError(err) {
+		t.Fatalf("SubredditPosts returned unexpected error: %v", err)
+	}
+	if flaky.calls != redditMaxAttempts {
+		t.Fatalf("SubredditPosts made unexpected number of calls (got: %d, want: %d)", flaky.calls, redditMaxAttempts)
+	}
+}
+
+func TestRetryingSessionDoesNotRetryTransientReplyErrors(t *testing.T) {
+	r, flaky, _ := fakeRetryingSession(context.Background(), apiError(http.StatusInternalServerError))
+
+	if _, err := r.Reply(&geddit.Submission{FullID: "t3_12345"}, "hello"); err == nil || isPermanentRedditError(err) {
+		t.Fatalf("Reply returned unexpected error: %v", err)
+	}
+	if flaky.calls != 1 {
+		t.Fatalf("Reply made unexpected number of calls (got: %d, want: %d)", flaky.calls, 1)
+	}
+}
+
+func TestRetryingSessionReportsPermanentErrors(t *testing.T) {
+	r, flaky, _ := fakeRetryingSession(context.Background(), newRedditCommentError([][]string{{"THREAD_LOCKED", "Comments are locked.", "parent"}}))
+
+	_, err := r.Reply(&geddit.Submission{FullID: "t3_12345"}, "hello")
+	var perm *PermanentRedditError
+	if !errors.As(err, &perm) {
+		t.Fatalf("Reply returned unexpected error (got: %v, want a PermanentRedditError)", err)
+	}
+	if !strings.Contains(perm.Error(), "THREAD_LOCKED") {
+		t.Fatalf("PermanentRedditError does not mention Reddit's error code: %v", perm)
+	}
+	if flaky.calls != 1 {
+		t.Fatalf("Reply made unexpected number of calls (got: %d, want: %d)", flaky.calls, 1)
+	}
+}
+
+func TestRetryingSessionLogsInAgainWhenTokenExpires(t *testing.T) {
+	r, flaky, delays := fakeRetryingSession(context.Background(), apiError(http.StatusUnauthorized))
+	if err := r.LoginAuth("CrossStitchBot", "hunter2"); err != nil {
+		t.Fatalf("LoginAuth call failed: %v", err)
+	}
+
+	if _, err := r.Reply(&geddit.Submission{FullID: "t3_12345"}, "hello"); err != nil {
+		t.Fatalf("Reply call failed: %v", err)
+	}
+	if flaky.logins != 2 || flaky.calls != 2 || len(*delays) != 0 {
+		t.Fatalf("Reply made unexpected calls (got: %d logins, %d calls, %d delays, want: 2, 2, 0)", flaky.logins, flaky.calls, len(*delays))
+	}
+}
+
+func TestRetryingSessionWaitsForRateLimit(t *testing.T) {
+	rateLimited := newRedditCommentError([][]string{{"RATELIMIT", "Looks like you've been doing that a lot. Take a break for 2 minutes before trying again. try again in 2 minutes.", "ratelimit"}})
+	r, flaky, delays := fakeRetryingSession(context.Background(), rateLimited)
+
+	if _, err := r.Reply(&geddit.Submission{FullID: "t3_12345"}, "hello"); err != nil {
+		t.Fatalf("Reply call failed: %v", err)
+	}
+	if flaky.calls != 2 || len(*delays) != 1 || (*delays)[0] != 2*time.Minute {
+		t.Fatalf("Reply made unexpected calls (got: %d calls, delays %v, want: 2 calls, delays [2m0s])", flaky.calls, *delays)
+	}
+}
+
+func TestRetryingSessionRetriesWithinLease(t *testing.T) {
+	if redditMaxRetryTime >= postLeaseDuration {
+		t.Fatalf("Reddit calls are retried for longer than a post's lease (got: %s, lease: %s)", redditMaxRetryTime, postLeaseDuration)
+	}
+	rateLimited := newRedditCommentError([][]string{{"RATELIMIT", "Take a break. try again in 9 minutes.", "ratelimit"}})
+	r, flaky, delays := fakeRetryingSession(context.Background(), rateLimited)
+
+	if _, err := r.Reply(&geddit.Submission{FullID: "t3_12345"}, "hello"); err == nil {
+		t.Fatal("Reply waited for longer than a post's lease instead of failing")
+	}
+	if flaky.calls != 1 || len(*delays) != 0 {
+		t.Fatalf("Reply made unexpected calls (got: %d calls, delays %v, want: 1 call, no delays)", flaky.calls, *delays)
+	}
+}
+
+func TestRetryingSessionRespectsDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	r, flaky, delays := fakeRetryingSession(ctx, &redditAPIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour})
+
+	if _, err := r.SubredditPosts("CrossStitch", geddit.NewSubmissions, geddit.ListingOptions{}); err == nil {
+		t.Fatal("SubredditPosts waited past the deadline instead of failing")
+	}
+	if flaky.calls != 1 || len(*delays) != 0 {
+		t.Fatalf("SubredditPosts made unexpected calls (got: %d calls, delays %v, want: 1 call, no delays)", flaky.calls, *delays)
+	}
+}
+
+func TestRetryingSessionStopsWhenRunDeadlinePassesWhileWaiting(t *testing.T) {
+	r, flaky, _ := fakeRetryingSession(context.Background(), apiError(http.StatusServiceUnavailable), apiError(http.StatusServiceUnavailable))
+	// Wait for the retry until the context the call was made within is done.
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			return errors.New("retry waited past the run's deadline")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redditRetryBaseDelay+500*time.Millisecond)
+	defer cancel()
+	defer r.bindContext(ctx)()
+
+	_, err := r.SubredditPosts("CrossStitch", geddit.NewSubmissions, geddit.ListingOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SubredditPosts returned unexpected error (got: %v, want: %v)", err, context.DeadlineExceeded)
+	}
+	if flaky.calls != 1 {
+		t.Fatalf("SubredditPosts made unexpected number of calls (got: %d, want: %d)", flaky.calls, 1)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Ratelimit-Reset", "42")
+	if got := retryAfter(h); got != 42*time.Second {
+		t.Fatalf("retryAfter returned unexpected delay (got: %s, want: %s)", got, 42*time.Second)
+	}
+}
+
+func TestSummonContestantsAbandonsLockedPost(t *testing.T) {
+	ctx := context.Background()
+	post := &geddit.Submission{FullID: "t3_12345"}
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(defaultMaxUsersPerSession+1))
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	locked := &PermanentRedditError{Op: "reply", Err: newRedditCommentError([][]string{{"THREAD_LOCKED", "Comments are locked.", "parent"}})}
+	fsr.failReply = func(comment string) bool { return strings.HasPrefix(comment, "Summoning") }
+	s.redditSession = &lockedRedditSession{fakeRedditSession: fsr, err: locked}
+
+	if err := summonUnderLease(ctx, s, p, post, nil /*PageToken*/); !errors.Is(err, locked) {
+		t.Fatalf("summonContestants returned unexpected error (got: %v, want: %v)", err, locked)
+	}
+	if err := getPageToken(ctx, s, p, post.FullID, &PageToken{}); err == nil {
+		t.Fatal("PageToken was kept for a post that can no longer be commented on")
+	}
+}
+
+// lockedRedditSession fails the replies its fake session fails with a given error.
+type lockedRedditSession struct {
+	*fakeRedditSession
+	err error
+}
+
+func (l *lockedRedditSession) Reply(r geddit.Replier, comment string) (*geddit.Comment, error) {
+	c, err := l.fakeRedditSession.Reply(r, comment)
+	if err != nil {
+		return nil, l.err
+	}
+	return c, nil
+}
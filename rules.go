@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DetectionRule decides which posts are competition posts. Every condition that is set must
+// hold for the rule to match; All, Any and Not combine further rules.
+type DetectionRule struct {
+	// TitleRegex must match the post title. Use the (?i) flag to ignore case.
+	TitleRegex string `yaml:"titleRegex"`
+	// FlairText and FlairCSSClass must equal the post's link flair, ignoring case.
+	FlairText     string `yaml:"flairText"`
+	FlairCSSClass string `yaml:"flairCSSClass"`
+	// If AuthorIsModerator is set or Authors is not empty, the post author must be a moderator
+	// of the subreddit or one of Authors (with or without the "u/" prefix).
+	AuthorIsModerator bool     `yaml:"authorIsModerator"`
+	Authors           []string `yaml:"authors"`
+	// Stickied and Distinguished, if set, must equal the post's status.
+	Stickied      *bool `yaml:"stickied"`
+	Distinguished *bool `yaml:"distinguished"`
+	// MaxAge is the greatest age of a matching post, e.g. "72h".
+	MaxAge time.Duration `yaml:"maxAge"`
+
+	All []*DetectionRule `yaml:"all"`
+	Any []*DetectionRule `yaml:"any"`
+	Not *DetectionRule   `yaml:"not"`
+
+	titleRegex *regexp.Regexp
+}
+
+// defaultDetectionRule matches moderator posts about a competition, but not its winners.
+func defaultDetectionRule() *DetectionRule {
+	r := &DetectionRule{
+		TitleRegex: `(?i)^\s*\[mod\].*competition`,
+		Not:        &DetectionRule{TitleRegex: `(?i)winner`},
+	}
+	if err := r.validate(); err != nil {
+		panic(fmt.Sprintf("invalid default detection rule: %v", err))
+	}
+	return r
+}
+
+// ruleEnv provides what rules need to know beyond the post itself.
+type ruleEnv struct {
+	now time.Time
+	// moderators returns the lowercased usernames of the subreddit's moderators.
+	moderators func(subreddit string) (map[string]bool, error)
+}
+
+// validate compiles the rule's regular expressions and checks that every rule has a condition.
+func (r *DetectionRule) validate() error {
+	var errs []error
+	if r.isEmpty() {
+		errs = append(errs, errors.New("rule has no conditions"))
+	}
+	if r.TitleRegex != "" {
+		re, err := regexp.Compile(r.TitleRegex)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("titleRegex: %w", err))
+		}
+		r.titleRegex = re
+	}
+	if r.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("maxAge must not be negative, got %s", r.MaxAge))
+	}
+	for i, sub := range r.All {
+		if err := sub.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("all[%d]: %w", i, err))
+		}
+	}
+	for i, sub := range r.Any {
+		if err := sub.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("any[%d]: %w", i, err))
+		}
+	}
+	if r.Not != nil {
+		if err := r.Not.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("not: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *DetectionRule) isEmpty() bool {
+	return r.TitleRegex == "" && r.FlairText == "" && r.FlairCSSClass == "" && !r.AuthorIsModerator &&
+		len(r.Authors) == 0 && r.Stickied == nil && r.Distinguished == nil && r.MaxAge == 0 &&
+		len(r.All) == 0 && len(r.Any) == 0 && r.Not == nil
+}
+
+// ruleCheck is the outcome of checking one condition of a rule, or of a combination of rules.
+type ruleCheck struct {
+	ok       bool
+	desc     string
+	children []*ruleCheck
+}
+
+func (c *ruleCheck) write(b *strings.Builder, depth int) {
+	mark := "✓"
+	if !c.ok {
+		mark = "✗"
+	}
+	fmt.Fprintf(b, "%s%s %s\n", strings.Repeat("  ", depth), mark, c.desc)
+	for _, child := range c.children {
+		child.write(b, depth+1)
+	}
+}
+
+// matches reports whether the post matches the rule.
+func (r *DetectionRule) matches(post *redditPost, env *ruleEnv) (bool, error) {
+	checks, err := r.evaluate(post, env)
+	if err != nil {
+		return false, err
+	}
+	return allOK(checks), nil
+}
+
+// explain reports whether the post matches the rule, along with a line for every condition
+// that was checked saying whether it held.
+func (r *DetectionRule) explain(post *redditPost, env *ruleEnv) (bool, string, error) {
+	checks, err := r.evaluate(post, env)
+	if err != nil {
+		return false, "", err
+	}
+	var b strings.Builder
+	for _, c := range checks {
+		c.write(&b, 0)
+	}
+	return allOK(checks), b.String(), nil
+}
+
+func allOK(checks []*ruleCheck) bool {
+	for _, c := range checks {
+		if !c.ok {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate checks every condition of the rule, rather than stopping at the first failure,
+// so that explanations are complete.
+func (r *DetectionRule) evaluate(post *redditPost, env *ruleEnv) ([]*ruleCheck, error) {
+	var checks []*ruleCheck
+	check := func(ok bool, format string, args ...interface{}) {
+		checks = append(checks, &ruleCheck{ok: ok, desc: fmt.Sprintf(format, args...)})
+	}
+
+	if r.TitleRegex != "" {
+		if r.titleRegex == nil {
+			re, err := regexp.Compile(r.TitleRegex)
+			if err != nil {
+				return nil, fmt.Errorf("titleRegex: %w", err)
+			}
+			r.titleRegex = re
+		}
+		check(r.titleRegex.MatchString(post.Title), "title %q matches /%s/", post.Title, r.TitleRegex)
+	}
+	if r.FlairText != "" {
+		check(strings.EqualFold(post.LinkFlairText, r.FlairText), "flair text %q is %q", post.LinkFlairText, r.FlairText)
+	}
+	if r.FlairCSSClass != "" {
+		check(strings.EqualFold(post.LinkFlairCSSClass, r.FlairCSSClass), "flair CSS class %q is %q", post.LinkFlairCSSClass, r.FlairCSSClass)
+	}
+	if r.AuthorIsModerator || len(r.Authors) > 0 {
+		allowed := false
+		for _, a := range r.Authors {
+			if strings.EqualFold(strings.TrimPrefix(a, "u/"), post.Author) {
+				allowed = true
+			}
+		}
+		if !allowed && r.AuthorIsModerator {
+			mods, err := env.moderators(post.Subreddit)
+			if err != nil {
+				return nil, fmt.Errorf("listing moderators of r/%s: %w", post.Subreddit, err)
+			}
+			allowed = mods[strings.ToLower(post.Author)]
+		}
+		check(allowed, "author u/%s is a moderator or allowed author", post.Author)
+	}
+	if r.Stickied != nil {
+		check(post.Stickied == *r.Stickied, "stickied is %t", *r.Stickied)
+	}
+	if r.Distinguished != nil {
+		check((post.Distinguished != "") == *r.Distinguished, "distinguished is %t", *r.Distinguished)
+	}
+	if r.MaxAge > 0 {
+		age := env.now.Sub(time.Unix(int64(post.DateCreated), 0))
+		check(age <= r.MaxAge, "age %s is at most %s", age.Round(time.Minute), r.MaxAge)
+	}
+
+	if len(r.All) > 0 {
+		c := &ruleCheck{ok: true, desc: "all of:"}
+		for _, sub := range r.All {
+			subChecks, err := sub.evaluate(post, env)
+			if err != nil {
+				return nil, err
+			}
+			c.ok = c.ok && allOK(subChecks)
+			c.children = append(c.children, subChecks...)
+		}
+		checks = append(checks, c)
+	}
+	if len(r.Any) > 0 {
+		c := &ruleCheck{desc: "any of:"}
+		for _, sub := range r.Any {
+			subChecks, err := sub.evaluate(post, env)
+			if err != nil {
+				return nil, err
+			}
+			// Group each alternative's conditions, so that it is clear which held together.
+			alt := &ruleCheck{ok: allOK(subChecks), desc: "alternative:", children: subChecks}
+			c.ok = c.ok || alt.ok
+			c.children = append(c.children, alt)
+		}
+		checks = append(checks, c)
+	}
+	if r.Not != nil {
+		subChecks, err := r.Not.evaluate(post, env)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, &ruleCheck{ok: !allOK(subChecks), desc: "not:", children: subChecks})
+	}
+	return checks, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+var ruleTestNow = time.Date(2023, time.January, 10, 12, 0, 0, 0, time.UTC)
+
+func fakeRuleEnv(moderators ...string) *ruleEnv {
+	return &ruleEnv{
+		now: ruleTestNow,
+		moderators: func(subreddit string) (map[string]bool, error) {
+			mods := map[string]bool{}
+			for _, m := range moderators {
+				mods[strings.ToLower(m)] = true
+			}
+			return mods, nil
+		},
+	}
+}
+
+// assertDetection fails the test, explaining which conditions held, if the rule's verdict
+// on the post is not the wanted one.
+func assertDetection(t *testing.T, rule *DetectionRule, post *redditPost, env *ruleEnv, want bool) {
+	t.Helper()
+	if err := rule.validate(); err != nil {
+		t.Fatalf("invalid rule: %v", err)
+	}
+	matched, explanation, err := rule.explain(post, env)
+	if err != nil {
+		t.Fatalf("explain call failed: %v", err)
+	}
+	if matched != want {
+		t.Fatalf("rule matched post %q: %t, want %t. Conditions checked:\n%s", post.Title, matched, want, explanation)
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestDefaultDetectionRule(t *testing.T) {
+	tests := []struct {
+		title string
+		want  bool
+	}{
+		{"[MOD] January's competition - more text", true},
+		{"[MOD] January's Competition - more text", true},
+		{"[mod] January COMPETITION", true},
+		{"[MOD] January's competition winners - more text", false},
+		{"[MOD] January's Competition Winners", false},
+		{"January's competition - more text", false},
+		{"[MOD] Rule changes", false},
+	}
+	for _, tc := range tests {
+		assertDetection(t, defaultDetectionRule(), fakePost("t3_12345", tc.title), fakeRuleEnv(), tc.want)
+	}
+}
+
+func TestDetectionRuleFlair(t *testing.T) {
+	rule := &DetectionRule{FlairText: "Competition", FlairCSSClass: "contest"}
+	post := fakePost("t3_12345", "January")
+	post.LinkFlairText, post.LinkFlairCSSClass = "competition", "contest"
+	assertDetection(t, rule, post, fakeRuleEnv(), true)
+
+	post.LinkFlairCSSClass = "finished"
+	assertDetection(t, rule, post, fakeRuleEnv(), false)
+}
+
+func TestDetectionRuleAuthor(t *testing.T) {
+	rule := &DetectionRule{AuthorIsModerator: true, Authors: []string{"u/GuestJudge"}}
+	env := fakeRuleEnv("ModAlice")
+	tests := []struct {
+		author string
+		want   bool
+	}{
+		{"modalice", true},
+		{"GuestJudge", true},
+		{"randomuser", false},
+	}
+	for _, tc := range tests {
+		post := fakePost("t3_12345", "January")
+		post.Author = tc.author
+		assertDetection(t, rule, post, env, tc.want)
+	}
+}
+
+func TestDetectionRuleModeratorLookupError(t *testing.T) {
+	rule := &DetectionRule{AuthorIsModerator: true}
+	env := &ruleEnv{moderators: func(string) (map[string]bool, error) { return nil, errors.New("forbidden") }}
+	if _, err := rule.matches(fakePost("t3_12345", "January"), env); err == nil {
+		t.Fatal("matches did not return the moderator lookup error")
+	}
+}
+
+func TestDetectionRuleStatusAndAge(t *testing.T) {
+	rule := &DetectionRule{Stickied: boolPtr(true), Distinguished: boolPtr(true), MaxAge: 48 * time.Hour}
+	post := fakePost("t3_12345", "January")
+	post.Stickied, post.Distinguished = true, "moderator"
+	post.DateCreated = float64(ruleTestNow.Add(-24 * time.Hour).Unix())
+	assertDetection(t, rule, post, fakeRuleEnv(), true)
+
+	post.DateCreated = float64(ruleTestNow.Add(-72 * time.Hour).Unix())
+	assertDetection(t, rule, post, fakeRuleEnv(), false)
+
+	post.DateCreated = float64(ruleTestNow.Unix())
+	post.Distinguished = ""
+	assertDetection(t, rule, post, fakeRuleEnv(), false)
+}
+
+func TestDetectionRuleCombinators(t *testing.T) {
+	// A competition post is either a moderator post titled "competition", or has the
+	// competition flair; in both cases it must not be about winners.
+	rule := &DetectionRule{
+		Any: []*DetectionRule{
+			{All: []*DetectionRule{{TitleRegex: `(?i)competition`}, {AuthorIsModerator: true}}},
+			{FlairText: "Competition"},
+		},
+		Not: &DetectionRule{TitleRegex: `(?i)winner`},
+	}
+	env := fakeRuleEnv("ModAlice")
+
+	post := fakePost("t3_1", "January competition")
+	post.Author = "ModAlice"
+	assertDetection(t, rule, post, env, true)
+
+	post = fakePost("t3_2", "January competition")
+	post.Author = "randomuser"
+	assertDetection(t, rule, post, env, false)
+
+	post = fakePost("t3_3", "Stitch along")
+	post.LinkFlairText = "Competition"
+	assertDetection(t, rule, post, env, true)
+
+	post = fakePost("t3_4", "January competition winners")
+	post.Author = "ModAlice"
+	assertDetection(t, rule, post, env, false)
+}
+
+func TestDetectionRuleExplain(t *testing.T) {
+	matched, explanation, err := defaultDetectionRule().explain(fakePost("t3_12345", "[MOD] January's competition winners"), fakeRuleEnv())
+	if err != nil {
+		t.Fatalf("explain call failed: %v", err)
+	}
+	if matched {
+		t.Fatal("explain matched a winners post")
+	}
+	want := "✓ title \"[MOD] January's competition winners\" matches /(?i)^\\s*\\[mod\\].*competition/\n" +
+		"✗ not:\n" +
+		"  ✓ title \"[MOD] January's competition winners\" matches /(?i)winner/\n"
+	if explanation != want {
+		t.Fatalf("explain returned unexpected explanation (got:\n%s\nwant:\n%s)", explanation, want)
+	}
+}
+
+func TestHandlePossibleCompetitionPostUsesProfileRule(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(numUsers))
+	s.redditSession.(*fakeRedditSession).moderators = []string{"ModAlice"}
+	testProfile(s).Detection = &DetectionRule{FlairText: "Competition", AuthorIsModerator: true}
+
+	post := &redditPost{Submission: geddit.Submission{FullID: "t3_12345", Title: "January", Author: "ModAlice", LinkFlairText: "Competition"}}
+	if matched, explanation, err := s.explainCompetitionPost(testProfile(s), post); err != nil || !matched {
+		t.Fatalf("explainCompetitionPost did not match post (err: %v):\n%s", err, explanation)
+	}
+	if err := s.handlePossibleCompetitionPost(context.Background(), testProfile(s), post); err != nil {
+		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
+	}
+
+	fsr := s.redditSession.(*fakeRedditSession)
+	if fsr.numComments != 2 {
+		t.Fatalf("handlePossibleCompetitionPost made unexpected number of comments (got: %d, want: %d)", fsr.numComments, 2)
+	}
+}
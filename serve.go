@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultServeInterval        = 15 * time.Minute
+	defaultServeAddr            = ":8080"
+	defaultServeShutdownTimeout = 25 * time.Second
+)
+
+// errShuttingDown is returned when a run is requested after the bot was asked to stop.
+var errShuttingDown = errors.New("shutting down")
+
+// ServeConfig configures serve mode, in which the bot runs as a long-lived server, checking posts
+// on a schedule and whenever its HTTP trigger is called.
+type ServeConfig struct {
+	// Interval between scheduled runs.
+	Interval time.Duration `yaml:"interval"`
+	// Addr is the address the HTTP trigger listens on.
+	Addr string `yaml:"addr"`
+	// ShutdownTimeout is how long a run is given to stop at a safe point after SIGTERM, before
+	// it is canceled.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+func (c *ServeConfig) applyDefaults() {
+	if c.Interval == 0 {
+		c.Interval = defaultServeInterval
+	}
+	if c.Addr == "" {
+		c.Addr = defaultServeAddr
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultServeShutdownTimeout
+	}
+}
+
+func (c *ServeConfig) validate() error {
+	var errs []error
+	if c.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("serve: interval must be positive, got %s", c.Interval))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("serve: shutdownTimeout must be positive, got %s", c.ShutdownTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+// handleShutdownSignals returns a channel that is closed on SIGTERM or interrupt, when runs
+// should stop at the next safe point. If they have not stopped after timeout, cancel is called.
+func handleShutdownSignals(cancel context.CancelFunc, timeout time.Duration) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	shutdown := make(chan struct{})
+	go func() {
+		sig := <-signals
+		slog.Info("Stopping at the next safe point", "signal", sig.String())
+		close(shutdown)
+		time.AfterFunc(timeout, func() {
+			slog.Warn("Run did not stop in time; canceling it", "timeout", timeout)
+			cancel()
+		})
+	}()
+	return shutdown
+}
+
+// shuttingDown reports whether the bot was asked to stop. Runs check it between posts and between
+// summon comments, once all progress so far has been committed.
+func (s *summoner) shuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// daemon runs a summoner's checks on a schedule and on request, one run at a time.
+type daemon struct {
+	s               *summoner
+	interval        time.Duration
+	shutdownTimeout time.Duration
+	// mu is held for the duration of a run, or of an exclusive call.
+	mu sync.Mutex
+}
+
+func newDaemon(s *summoner, config ServeConfig) *daemon {
+	return &daemon{s: s, interval: config.Interval, shutdownTimeout: config.ShutdownTimeout}
+}
+
+// run checks posts, after any run in progress has finished, and returns the run's report.
+func (d *daemon) run(ctx context.Context, trigger string) (*runReport, error) {
+	var report *runReport
+	err := d.exclusive(func() error {
+		// Give each run its own ID, so that its logs can be told apart from those of earlier runs.
+		d.s.runID = newRunID()
+		logger := slog.With("runID", d.s.runID, "trigger", trigger)
+		logger.Info("Starting run")
+		start := time.Now()
+		var err error
+		if report, err = d.s.checkPosts(ctx); err != nil {
+			logger.Error("Run failed", "duration", time.Since(start), "err", err)
+			return err
+		}
+		logger.Info("Run finished", "duration", time.Since(start))
+		return nil
+	})
+	return report, err
+}
+
+// exclusive calls f once no run or other exclusive call is in progress, unless the bot was asked
+// to stop. Calls using the summoner's per-run state must be exclusive.
+func (d *daemon) exclusive(f func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.s.shuttingDown() {
+		return errShuttingDown
+	}
+	return f()
+}
+
+// handler serves the HTTP trigger, POST /run, a health check, GET /healthz, the bot's metrics,
+// GET /metrics, and the admin API under /admin/. Triggered runs use ctx rather than the request's
+// context, so that a client hanging up does not cancel them, and respond with the run's report as
+// JSON, as HTTPInvoke does. If admin credentials are configured, the trigger requires them too.
+func (d *daemon) handler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	admin := d.s.config.Admin
+	seen := newSignatureCache()
+	mux.Handle("/run", requireAdmin(admin, seen, true /*optional*/, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := d.run(ctx, "triggered")
+		switch {
+		case err == errShuttingDown:
+			writeJSONError(w, http.StatusServiceUnavailable, err)
+		case report == nil:
+			writeJSONError(w, http.StatusInternalServerError, err)
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, report)
+		default:
+			writeJSON(w, http.StatusOK, report)
+		}
+	})))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	mux.Handle("/metrics", metricsRegistry.handler())
+	mux.Handle("/admin/", requireAdmin(admin, seen, false /*optional*/, http.StripPrefix("/admin", newAdminAPI(ctx, d))))
+	return mux
+}
+
+// serve checks posts right away, then every interval and on request to the HTTP trigger, until
+// the summoner is asked to shut down. It returns once runs in progress have stopped.
+func (d *daemon) serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: d.handler(ctx), ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	slog.Info("Serving", "addr", ln.Addr().String(), "interval", d.interval)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	d.run(ctx, "scheduled")
+	for {
+		select {
+		case <-ticker.C:
+			d.run(ctx, "scheduled")
+		case err := <-serveErr:
+			slog.Error("HTTP server failed", "err", err)
+			return err
+		case <-d.s.shutdown:
+			// Wait for triggered runs to stop.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), d.shutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Failed to shut down HTTP server", "err", err)
+				return err
+			}
+			slog.Info("Shut down")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonRunsOnScheduleAndTrigger(t *testing.T) {
+	const numUsers = defaultMaxRedditTagsPerComment + 1
+	const expectedNumComments = 3 // main comment, 2 child comments
+	submissions := []*redditPost{fakePost("t3_12345", "[MOD] January's competition - more text")}
+	s := fakeSummoner(submissions, generateFakeUsers(numUsers))
+	shutdown := make(chan struct{})
+	s.shutdown = shutdown
+	d := newDaemon(s, ServeConfig{Interval: time.Hour, ShutdownTimeout: time.Second})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- d.serve(context.Background(), ln)
+	}()
+	url := "http://" + ln.Addr().String()
+
+	resp, err := http.Post(url+"/run", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST /run failed: %v", err)
+	}
+	var report runReport
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || report.RunID == "" {
+		t.Fatalf("POST /run returned unexpected response (got: %d %+v, %v, want: 200 and a run report)", resp.StatusCode, report, err)
+	}
+	resp, err = http.Get(url + "/run")
+	if err != nil {
+		t.Fatalf("GET /run failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /run returned unexpected status (got: %d, want: %d)", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	close(shutdown)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve returned unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+	// The scheduled run at startup handled the post, so the triggered run found nothing to do.
+	if fsr := s.redditSession.(*fakeRedditSession); fsr.numComments != expectedNumComments {
+		t.Fatalf("daemon made unexpected number of comments (got: %d, want: %d)", fsr.numComments, expectedNumComments)
+	}
+	if _, err := d.run(context.Background(), "triggered"); err != errShuttingDown {
+		t.Fatalf("run after shutdown returned unexpected error (got: %v, want: %v)", err, errShuttingDown)
+	}
+}
+
+func TestSummonContestantsStopsAtSafePointOnShutdown(t *testing.T) {
+	const numUsers = 2 * defaultMaxRedditTagsPerComment
+	ctx := context.Background()
+	post := fakePost("t3_12345", "[MOD] January's competition - more text")
+	users := generateFakeUsers(numUsers)
+	s := fakeSummoner(nil /*redditSubmissions*/, users)
+	p := testProfile(s)
+	fsr := s.redditSession.(*fakeRedditSession)
+	// SIGTERM arrives while the first summon comment is being posted.
+	shutdown := make(chan struct{})
+	s.shutdown = shutdown
+	fsr.failReply = func(comment string) bool {
+		if strings.HasPrefix(comment, "Summoning") {
+			close(shutdown)
+			fsr.failReply = nil
+		}
+		return false
+	}
+
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err != nil {
+		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
+	}
+	pt, err := s.store.PageToken(ctx, p.Namespace, post.FullID)
+	if err != nil || pt.phase() != phaseBatchesInProgress || pt.NextIndex != defaultMaxRedditTagsPerComment {
+		t.Fatalf("shutdown left unexpected PageToken (got: %+v, %v)", pt, err)
+	}
+
+	// The next run picks up where the stopped one left off.
+	s.shutdown = nil
+	if err := s.handlePossibleCompetitionPost(ctx, p, post); err != nil {
+		t.Fatalf("handlePossibleCompetitionPost call failed: %v", err)
+	}
+	counts := summonedUsers(fsr)
+	for _, user := range users {
+		if counts[user] != 1 {
+			t.Errorf("user %s was summoned %d times, want 1", user, counts[user])
+		}
+	}
+}
+
+func TestLoadConfigServe(t *testing.T) {
+	cfg, err := loadConfig("" /*path*/, fakeEnv(map[string]string{"CROSSSTITCH_SERVE_INTERVAL": "5m"}))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if cfg.Serve.Interval != 5*time.Minute || cfg.Serve.Addr != defaultServeAddr {
+		t.Fatalf("loadConfig returned unexpected serve config: %+v", cfg.Serve)
+	}
+
+	if _, err := loadConfig("" /*path*/, fakeEnv(map[string]string{"CROSSSTITCH_SERVE_INTERVAL": "often"})); err == nil {
+		t.Fatal("loadConfig accepted a serve interval that is not a duration")
+	}
+	path := writeConfigFile(t, "config.yaml", "serve:\n  interval: -1m\n")
+	if _, err := loadConfig(path, fakeEnv(nil)); err == nil || !strings.Contains(err.Error(), "interval must be positive") {
+		t.Fatalf("loadConfig did not reject a negative serve interval: %v", err)
+	}
+}
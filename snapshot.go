@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// SubscriberSnapshot is the subscriber list as it was when summoning to a post began. Runs that
+// continue summoning to the post use the snapshot, rather than the current list, so that edits
+// to the list part-way through never cause users to be summoned twice or skipped.
+type SubscriberSnapshot struct {
+	Usernames []string `datastore:",noindex"`
+	CreatedAt time.Time
+
+	// saved is set for snapshots read from the store.
+	saved bool
+}
+
+func (snap *SubscriberSnapshot) subscribers() []Subscriber {
+	subscribers := make([]Subscriber, len(snap.Usernames))
+	for i, username := range snap.Usernames {
+		subscribers[i] = Subscriber{Username: username}
+	}
+	return subscribers
+}
+
+// newSubscriberSnapshot snapshots the profile's current subscribers. Users listed more than
+// once, in any case, are only kept once.
+func (s *summoner) newSubscriberSnapshot(ctx context.Context, p *CompetitionProfile) (*SubscriberSnapshot, error) {
+	subscribers, err := s.readSubscribers(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	snap := &SubscriberSnapshot{CreatedAt: time.Now()}
+	seen := map[string]bool{}
+	for _, sub := range subscribers {
+		key := strings.ToLower(sub.Username)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		snap.Usernames = append(snap.Usernames, sub.Username)
+	}
+	return snap, nil
+}
+
+// subscriberSnapshot returns the subscribers to summon to the post, and the index of the first
+// of them still to be summoned. Summoning to a new post (one without a PageToken) starts from a
+// fresh snapshot, which is not saved until the caller saves its PageToken.
+func (s *summoner) subscriberSnapshot(ctx context.Context, p *CompetitionProfile, postID string, pageToken *PageToken) (*SubscriberSnapshot, int, error) {
+	if pageToken == nil {
+		snap, err := s.newSubscriberSnapshot(ctx, p)
+		return snap, 0, err
+	}
+
+	snap, err := s.store.SubscriberSnapshot(ctx, p.Namespace, postID)
+	if err == nil {
+		snap.saved = true
+		return snap, pageToken.NextIndex, nil
+	}
+	if err != errNotFound {
+		loggerFrom(ctx).Error("Failed to fetch subscriber snapshot", "err", err)
+		return nil, 0, err
+	}
+
+	// PageTokens written before snapshots were taken only record the last user processed, so
+	// find that user in the current list.
+	loggerFrom(ctx).Warn("No subscriber snapshot for post; resuming after the last user processed", "lastUser", pageToken.LastProcessedUser)
+	snap, err = s.newSubscriberSnapshot(ctx, p)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, username := range snap.Usernames {
+		if username == pageToken.LastProcessedUser {
+			return snap, i + 1, nil
+		}
+	}
+	return snap, 0, nil
+}
+
+// snapshotProgress tracks how far into the subscriber snapshot the posted summons have reached.
+type snapshotProgress struct {
+	indexes map[string]int // by lowercased username
+	next    int
+}
+
+func newSnapshotProgress(snap *SubscriberSnapshot, firstIndex int) *snapshotProgress {
+	sp := &snapshotProgress{indexes: map[string]int{}, next: firstIndex}
+	for i, username := range snap.Usernames {
+		sp.indexes[strings.ToLower(username)] = i
+	}
+	return sp
+}
+
+// advance moves past the users of a posted summon comment, and returns the index of the next
+// snapshot entry to look at. Retried users are behind the progress already, so do not move it.
+func (sp *snapshotProgress) advance(usernames []string) int {
+	for _, username := range usernames {
+		if i, ok := sp.indexes[strings.ToLower(username)]; ok && i+1 > sp.next {
+			sp.next = i + 1
+		}
+	}
+	return sp.next
+}
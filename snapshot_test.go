@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/khipkin/geddit"
+)
+
+// summonedUsers counts how many times each user was tagged in the replies to the fake session.
+func summonedUsers(fsr *fakeRedditSession) map[string]int {
+	counts := map[string]int{}
+	for _, replies := range fsr.replies {
+		for _, reply := range replies {
+			for _, mention := range redditMentionRegex.FindAllString(reply, -1) {
+				counts[strings.TrimLeft(mention, " ,")]++
+			}
+		}
+	}
+	return counts
+}
+
+func TestSummonContestantsResumesFromSnapshotAfterListEdits(t *testing.T) {
+	const numUsers = defaultMaxUsersPerSession + defaultMaxRedditTagsPerComment
+	ctx := context.Background()
+	post := &geddit.Submission{FullID: "t3_12345"}
+	users := generateFakeUsers(numUsers)
+	s := fakeSummoner(nil /*redditSubmissions*/, users)
+	p := testProfile(s)
+
+	if err := summonUnderLease(ctx, s, p, post, nil /*PageToken*/); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+	pt := &PageToken{}
+	if err := getPageToken(ctx, s, p, post.FullID, pt); err != nil {
+		t.Fatalf("failed to fetch pagetoken from datastore: %v", err)
+	}
+	if pt.NextIndex != defaultMaxUsersPerSession {
+		t.Fatalf("summonContestants wrote pagetoken with wrong NextIndex (got: %d, want: %d)", pt.NextIndex, defaultMaxUsersPerSession)
+	}
+
+	// Between runs, the last processed user unsubscribes, a new user subscribes at the top and the
+	// list is reordered.
+	edited := append([]string{"u/newcomer"}, users[:defaultMaxUsersPerSession-1]...)
+	for i := len(users) - 1; i >= defaultMaxUsersPerSession; i-- {
+		edited = append(edited, users[i])
+	}
+	p.Subscribers.Usernames = edited
+
+	if err := summonUnderLease(ctx, s, p, post, pt); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+
+	counts := summonedUsers(s.redditSession.(*fakeRedditSession))
+	for _, user := range users {
+		if counts[user] != 1 {
+			t.Errorf("user %s was summoned %d times, want 1", user, counts[user])
+		}
+	}
+	if counts["u/newcomer"] != 0 {
+		t.Errorf("user who subscribed mid-run was summoned %d times, want 0", counts["u/newcomer"])
+	}
+	if _, err := s.store.PageToken(ctx, p.Namespace, post.FullID); err != errNotFound {
+		t.Errorf("PageToken was not deleted from the store after the last batch: %v", err)
+	}
+	if _, err := s.store.SubscriberSnapshot(ctx, p.Namespace, post.FullID); err != errNotFound {
+		t.Errorf("SubscriberSnapshot was not deleted from the store after the last batch: %v", err)
+	}
+}
+
+func TestNewSubscriberSnapshotRemovesDuplicates(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, []string{"u/alice", "u/bob", "u/Alice", "u/bob"})
+
+	snap, err := s.newSubscriberSnapshot(context.Background(), testProfile(s))
+	if err != nil {
+		t.Fatalf("newSubscriberSnapshot call failed: %v", err)
+	}
+	if got, want := strings.Join(snap.Usernames, ","), "u/alice,u/bob"; got != want {
+		t.Fatalf("newSubscriberSnapshot returned unexpected usernames (got: %s, want: %s)", got, want)
+	}
+}
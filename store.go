@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"google.golang.org/api/option"
+)
+
+// Kinds of store that can be selected in the config.
+const (
+	storeDatastore = "datastore"
+	storeFile      = "file"
+)
+
+const defaultStorePath = "crossstitch-bot.db"
+
+// maxTransactionWrites is the most entities written in one transaction, as Datastore commits at
+// most 500 mutations at a time.
+const maxTransactionWrites = 500
+
+// errNotFound is returned when looking up state that the store does not hold.
+var errNotFound = errors.New("not found in store")
+
+// store keeps the bot's state between runs. The state of each competition profile is kept apart,
+// in the profile's namespace.
+type store interface {
+	// PageToken returns the token of a post that summoning is in progress for, or errNotFound.
+	PageToken(ctx context.Context, ns, postID string) (*PageToken, error)
+	// InProgressPosts lists the posts that summoning is in progress for, ordered by post ID.
+	InProgressPosts(ctx context.Context, ns string) ([]*inProgressPost, error)
+	// IsHandled reports whether the post was marked handled, meaning summoning to it has begun.
+	IsHandled(ctx context.Context, ns, postID string) (bool, error)
+	// HandledPosts lists the IDs of the posts marked handled, in order.
+	HandledPosts(ctx context.Context, ns string) ([]string, error)
+	// SubscriberSnapshot returns the snapshot taken for a post, or errNotFound.
+	SubscriberSnapshot(ctx context.Context, ns, postID string) (*SubscriberSnapshot, error)
+	// SummonRecords returns the summon ledger of a post.
+	SummonRecords(ctx context.Context, ns, postID string) ([]*SummonRecord, error)
+	// UpdatePost commits the writes of a step of summoning to a post together, in one
+	// transaction. If the update has an owner, it fails with errLeaseHeld if another run holds
+	// the post's lease, and with errLeaseNotHeld if no run holds an unexpired lease.
+	UpdatePost(ctx context.Context, ns, postID string, u *postUpdate) error
+
+	// AcquireLease takes or renews the post's lease for owner, until now+ttl. If another owner
+	// holds an unexpired lease, it returns that lease and errLeaseHeld.
+	AcquireLease(ctx context.Context, ns, postID, owner string, now time.Time, ttl time.Duration) (*Lease, error)
+	// ReleaseLease gives up the post's lease, if owner still holds it.
+	ReleaseLease(ctx context.Context, ns, postID, owner string) error
+
+	// Subscriptions returns every subscription made with a Reddit command, ordered by username.
+	Subscriptions(ctx context.Context, ns string) ([]*Subscription, error)
+	PutSubscription(ctx context.Context, ns string, sub *Subscription) error
+
+	// CompetitionPosts lists the competition posts entries are collected from, ordered by post ID.
+	CompetitionPosts(ctx context.Context, ns string) ([]*CompetitionPost, error)
+	// CompetitionPost returns the record of a competition post, or errNotFound.
+	CompetitionPost(ctx context.Context, ns, postID string) (*CompetitionPost, error)
+	PutCompetitionPost(ctx context.Context, ns string, cp *CompetitionPost) error
+	// Entries returns the entries collected from a competition post, oldest first.
+	Entries(ctx context.Context, ns, postID string) ([]*Entry, error)
+	// SaveEntries saves the entries collected from a competition post, and then its record. The
+	// entries are written in as many transactions as it takes, the last of which writes the record,
+	// so the record only says they were collected once all of them are saved.
+	SaveEntries(ctx context.Context, ns string, cp *CompetitionPost, entries []*Entry) error
+
+	// Announcements lists the winners announcements of competition posts, ordered by post ID.
+	Announcements(ctx context.Context, ns string) ([]*Announcement, error)
+	// Announcement returns the winners announcement of a competition post, or errNotFound.
+	Announcement(ctx context.Context, ns, postID string) (*Announcement, error)
+	PutAnnouncement(ctx context.Context, ns string, a *Announcement) error
+	// Awards returns what was done to reward the winners of a competition post, ordered by
+	// username.
+	Awards(ctx context.Context, ns, postID string) ([]*Award, error)
+	PutAward(ctx context.Context, ns string, award *Award) error
+
+	Close() error
+}
+
+// inProgressPost is a post that summoning is in progress for.
+type inProgressPost struct {
+	PostID    string
+	PageToken *PageToken
+}
+
+// StoreConfig selects where the bot keeps its state.
+type StoreConfig struct {
+	// Type is "datastore" (the default), for Google Cloud Datastore, or "file", for an embedded
+	// database file, which lets the bot run outside Google Cloud.
+	Type string `yaml:"type"`
+	// Path of the database file of a file store.
+	Path string `yaml:"path"`
+}
+
+func (c *StoreConfig) applyDefaults() {
+	if c.Type == "" {
+		c.Type = storeDatastore
+	}
+	if c.Type == storeFile && c.Path == "" {
+		c.Path = defaultStorePath
+	}
+}
+
+func (c *StoreConfig) validate() error {
+	switch c.Type {
+	case storeDatastore, storeFile:
+		return nil
+	}
+	return fmt.Errorf("store type must be %q or %q, got %q", storeDatastore, storeFile, c.Type)
+}
+
+// openStore opens the store selected by the config. Only Datastore stores use Google credentials.
+func openStore(ctx context.Context, config *Config, useCreds bool) (store, error) {
+	if config.Store.Type == storeFile {
+		backend, err := openFileBackend(config.Store.Path)
+		if err != nil {
+			return nil, err
+		}
+		return newEntityStore(&instrumentedBackend{entityBackend: backend, service: storeFile}), nil
+	}
+
+	// Create an authenticated Google Cloud Datastore client.
+	var dsClient *datastore.Client
+	var err error
+	if useCreds {
+		dsClient, err = datastore.NewClient(ctx,
+			config.GoogleCloudProjectID,
+			option.WithCredentialsFile(config.GoogleCredentialsFile),
+		)
+	} else {
+		dsClient, err = datastore.NewClient(ctx, config.GoogleCloudProjectID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating Datastore client: %w", err)
+	}
+	return newEntityStore(&instrumentedBackend{entityBackend: &datastoreBackend{client: cloudDatastoreClient{dsClient}}, service: storeDatastore}), nil
+}
+
+// instrumentedBackend records the latency of each call to a backend in metrics, as that of service.
+type instrumentedBackend struct {
+	entityBackend
+	service string
+}
+
+func (b *instrumentedBackend) Get(ctx context.Context, key entityKey, dst interface{}) error {
+	defer observeCall(b.service, "Get", time.Now())
+	return b.entityBackend.Get(ctx, key, dst)
+}
+
+func (b *instrumentedBackend) Put(ctx context.Context, key entityKey, src interface{}) error {
+	defer observeCall(b.service, "Put", time.Now())
+	return b.entityBackend.Put(ctx, key, src)
+}
+
+func (b *instrumentedBackend) Delete(ctx context.Context, key entityKey) error {
+	defer observeCall(b.service, "Delete", time.Now())
+	return b.entityBackend.Delete(ctx, key)
+}
+
+func (b *instrumentedBackend) GetAll(ctx context.Context, namespace, kind, prefix string, dst interface{}) ([]entityKey, error) {
+	defer observeCall(b.service, "GetAll", time.Now())
+	return b.entityBackend.GetAll(ctx, namespace, kind, prefix, dst)
+}
+
+func (b *instrumentedBackend) RunInTransaction(ctx context.Context, f func(tx entityTx) error) error {
+	defer observeCall(b.service, "RunInTransaction", time.Now())
+	return b.entityBackend.RunInTransaction(ctx, f)
+}
+
+// entityKey identifies an entity, which is a struct saved and loaded whole, by namespace, kind and name.
+type entityKey struct {
+	Namespace string
+	Kind      string
+	Name      string
+}
+
+func (k entityKey) String() string {
+	if k.Namespace == "" {
+		return fmt.Sprintf("/%s,%s", k.Kind, k.Name)
+	}
+	return fmt.Sprintf("%s:/%s,%s", k.Namespace, k.Kind, k.Name)
+}
+
+// entityBackend is a database of entities, on which entityStore builds the bot's store.
+type entityBackend interface {
+	// Get loads the entity into dst, a pointer to a struct, or returns errNotFound.
+	Get(ctx context.Context, key entityKey, dst interface{}) error
+	Put(ctx context.Context, key entityKey, src interface{}) error
+	// Delete deletes the entity, if it exists.
+	Delete(ctx context.Context, key entityKey) error
+	// GetAll appends the entities of the kind whose names start with prefix to dst, a pointer
+	// to a slice of struct pointers, and returns their keys. Backends may return more entities
+	// than those matching the prefix, so callers must check.
+	GetAll(ctx context.Context, namespace, kind, prefix string, dst interface{}) ([]entityKey, error)
+	// RunInTransaction runs f in a transaction, whose writes are committed together if f returns
+	// nil, and discarded otherwise. If the transaction conflicts with another, f may be run again.
+	RunInTransaction(ctx context.Context, f func(tx entityTx) error) error
+	Close() error
+}
+
+// entityTx reads and writes entities within a transaction. Reads do not see the transaction's
+// own writes.
+type entityTx interface {
+	Get(key entityKey, dst interface{}) error
+	Put(key entityKey, src interface{}) error
+	Delete(key entityKey) error
+}
+
+// entityStore keeps the bot's state as entities, named as they always have been in Datastore.
+type entityStore struct {
+	backend entityBackend
+}
+
+func newEntityStore(backend entityBackend) *entityStore {
+	return &entityStore{backend: backend}
+}
+
+func (s *entityStore) PageToken(ctx context.Context, ns, postID string) (*PageToken, error) {
+	pt := &PageToken{}
+	if err := s.backend.Get(ctx, entityKey{ns, "PageToken", postID}, pt); err != nil {
+		return nil, err
+	}
+	return pt, nil
+}
+
+func (s *entityStore) InProgressPosts(ctx context.Context, ns string) ([]*inProgressPost, error) {
+	tokens := []*PageToken{}
+	keys, err := s.backend.GetAll(ctx, ns, "PageToken", "", &tokens)
+	if err != nil {
+		return nil, err
+	}
+	posts := make([]*inProgressPost, len(keys))
+	for i, key := range keys {
+		posts[i] = &inProgressPost{PostID: key.Name, PageToken: tokens[i]}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].PostID < posts[j].PostID })
+	return posts, nil
+}
+
+// handledMarker is the empty entity marking a post as handled. Its kind is "Entity" for
+// compatibility with the markers saved by earlier versions of the bot.
+type handledMarker struct{}
+
+func (s *entityStore) IsHandled(ctx context.Context, ns, postID string) (bool, error) {
+	err := s.backend.Get(ctx, entityKey{ns, "Entity", postID}, &handledMarker{})
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *entityStore) HandledPosts(ctx context.Context, ns string) ([]string, error) {
+	markers := []*handledMarker{}
+	keys, err := s.backend.GetAll(ctx, ns, "Entity", "", &markers)
+	if err != nil {
+		return nil, err
+	}
+	postIDs := make([]string, len(keys))
+	for i, key := range keys {
+		postIDs[i] = key.Name
+	}
+	sort.Strings(postIDs)
+	return postIDs, nil
+}
+
+func (s *entityStore) SubscriberSnapshot(ctx context.Context, ns, postID string) (*SubscriberSnapshot, error) {
+	snap := &SubscriberSnapshot{}
+	if err := s.backend.Get(ctx, entityKey{ns, "SubscriberSnapshot", postID}, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *entityStore) SummonRecords(ctx context.Context, ns, postID string) ([]*SummonRecord, error) {
+	records := []*SummonRecord{}
+	if _, err := s.backend.GetAll(ctx, ns, "SummonRecord", postID+"/", &records); err != nil {
+		return nil, err
+	}
+	var matching []*SummonRecord
+	for _, r := range records {
+		if r.PostID == postID {
+			matching = append(matching, r)
+		}
+	}
+	return matching, nil
+}
+
+func (s *entityStore) Subscriptions(ctx context.Context, ns string) ([]*Subscription, error) {
+	subs := []*Subscription{}
+	if _, err := s.backend.GetAll(ctx, ns, "Subscription", "", &subs); err != nil {
+		return nil, err
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subscriptionKeyName(subs[i].Username) < subscriptionKeyName(subs[j].Username)
+	})
+	return subs, nil
+}
+
+func (s *entityStore) PutSubscription(ctx context.Context, ns string, sub *Subscription) error {
+	return s.backend.Put(ctx, entityKey{ns, "Subscription", subscriptionKeyName(sub.Username)}, sub)
+}
+
+func (s *entityStore) CompetitionPosts(ctx context.Context, ns string) ([]*CompetitionPost, error) {
+	posts := []*CompetitionPost{}
+	if _, err := s.backend.GetAll(ctx, ns, "CompetitionPost", "", &posts); err != nil {
+		return nil, err
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].PostID < posts[j].PostID })
+	return posts, nil
+}
+
+func (s *entityStore) CompetitionPost(ctx context.Context, ns, postID string) (*CompetitionPost, error) {
+	cp := &CompetitionPost{}
+	if err := s.backend.Get(ctx, entityKey{ns, "CompetitionPost", postID}, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (s *entityStore) PutCompetitionPost(ctx context.Context, ns string, cp *CompetitionPost) error {
+	return s.backend.Put(ctx, entityKey{ns, "CompetitionPost", cp.PostID}, cp)
+}
+
+func (s *entityStore) Entries(ctx context.Context, ns, postID string) ([]*Entry, error) {
+	entries := []*Entry{}
+	if _, err := s.backend.GetAll(ctx, ns, "Entry", postID+"/", &entries); err != nil {
+		return nil, err
+	}
+	var matching []*Entry
+	for _, e := range entries {
+		if e.PostID == postID {
+			matching = append(matching, e)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool { return matching[i].SubmittedAt.Before(matching[j].SubmittedAt) })
+	return matching, nil
+}
+
+func (s *entityStore) SaveEntries(ctx context.Context, ns string, cp *CompetitionPost, entries []*Entry) error {
+	for {
+		// Leave room for the record in the last transaction.
+		n := min(len(entries), maxTransactionWrites-1)
+		chunk, rest := entries[:n], entries[n:]
+		err := s.backend.RunInTransaction(ctx, func(tx entityTx) error {
+			for _, e := range chunk {
+				if err := tx.Put(entityKey{ns, "Entry", entryKeyName(e.PostID, e.CommentFullID)}, e); err != nil {
+					return err
+				}
+			}
+			if len(rest) > 0 {
+				return nil
+			}
+			return tx.Put(entityKey{ns, "CompetitionPost", cp.PostID}, cp)
+		})
+		if err != nil || len(rest) == 0 {
+			return err
+		}
+		entries = rest
+	}
+}
+
+func (s *entityStore) Announcements(ctx context.Context, ns string) ([]*Announcement, error) {
+	announcements := []*Announcement{}
+	if _, err := s.backend.GetAll(ctx, ns, "Announcement", "", &announcements); err != nil {
+		return nil, err
+	}
+	sort.Slice(announcements, func(i, j int) bool { return announcements[i].PostID < announcements[j].PostID })
+	return announcements, nil
+}
+
+func (s *entityStore) Announcement(ctx context.Context, ns, postID string) (*Announcement, error) {
+	a := &Announcement{}
+	if err := s.backend.Get(ctx, entityKey{ns, "Announcement", postID}, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *entityStore) PutAnnouncement(ctx context.Context, ns string, a *Announcement) error {
+	return s.backend.Put(ctx, entityKey{ns, "Announcement", a.PostID}, a)
+}
+
+func (s *entityStore) Awards(ctx context.Context, ns, postID string) ([]*Award, error) {
+	awards := []*Award{}
+	if _, err := s.backend.GetAll(ctx, ns, "Award", postID+"/", &awards); err != nil {
+		return nil, err
+	}
+	var matching []*Award
+	for _, award := range awards {
+		if award.PostID == postID {
+			matching = append(matching, award)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].Username < matching[j].Username })
+	return matching, nil
+}
+
+func (s *entityStore) PutAward(ctx context.Context, ns string, award *Award) error {
+	return s.backend.Put(ctx, entityKey{ns, "Award", awardKeyName(award.PostID, award.Username)}, award)
+}
+
+func (s *entityStore) AcquireLease(ctx context.Context, ns, postID, owner string, now time.Time, ttl time.Duration) (*Lease, error) {
+	key := entityKey{ns, "Lease", postID}
+	var lease *Lease
+	err := s.backend.RunInTransaction(ctx, func(tx entityTx) error {
+		current := &Lease{}
+		err := tx.Get(key, current)
+		if err != nil && err != errNotFound {
+			return err
+		}
+		if err == nil && current.Owner != owner && now.Before(current.ExpiresAt) {
+			lease = current
+			return errLeaseHeld
+		}
+		lease = &Lease{Owner: owner, ExpiresAt: now.Add(ttl)}
+		return tx.Put(key, lease)
+	})
+	return lease, err
+}
+
+func (s *entityStore) ReleaseLease(ctx context.Context, ns, postID, owner string) error {
+	key := entityKey{ns, "Lease", postID}
+	return s.backend.RunInTransaction(ctx, func(tx entityTx) error {
+		current := &Lease{}
+		if err := tx.Get(key, current); err != nil {
+			if err == errNotFound {
+				return nil
+			}
+			return err
+		}
+		if current.Owner != owner {
+			return nil
+		}
+		return tx.Delete(key)
+	})
+}
+
+func (s *entityStore) UpdatePost(ctx context.Context, ns, postID string, u *postUpdate) error {
+	return s.backend.RunInTransaction(ctx, func(tx entityTx) error {
+		if u.Owner != "" {
+			lease := &Lease{}
+			err := tx.Get(entityKey{ns, "Lease", postID}, lease)
+			if err == errNotFound {
+				return errLeaseNotHeld
+			}
+			if err != nil {
+				return err
+			}
+			if lease.Owner != u.Owner {
+				return errLeaseHeld
+			}
+			if !u.Now.Before(lease.ExpiresAt) {
+				return errLeaseNotHeld
+			}
+		}
+		if u.MarkHandled {
+			if err := tx.Put(entityKey{ns, "Entity", postID}, &handledMarker{}); err != nil {
+				return err
+			}
+		}
+		if u.ClearHandled {
+			if err := tx.Delete(entityKey{ns, "Entity", postID}); err != nil {
+				return err
+			}
+		}
+		if u.Snapshot != nil {
+			if err := tx.Put(entityKey{ns, "SubscriberSnapshot", postID}, u.Snapshot); err != nil {
+				return err
+			}
+		}
+		if u.PageToken != nil {
+			if err := tx.Put(entityKey{ns, "PageToken", postID}, u.PageToken); err != nil {
+				return err
+			}
+		}
+		if u.Complete {
+			if err := tx.Delete(entityKey{ns, "PageToken", postID}); err != nil {
+				return err
+			}
+			if err := tx.Delete(entityKey{ns, "SubscriberSnapshot", postID}); err != nil {
+				return err
+			}
+		}
+		for _, r := range u.Records {
+			if err := tx.Put(entityKey{ns, "SummonRecord", summonRecordKeyName(r.PostID, r.Username)}, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *entityStore) Close() error {
+	return s.backend.Close()
+}
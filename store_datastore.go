@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreClient interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) (keys []*datastore.Key, err error)
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	RunInTransaction(ctx context.Context, f func(tx datastoreTransaction) error) error
+	Close() error
+}
+
+// datastoreTransaction is the part of *datastore.Transaction that the bot uses.
+type datastoreTransaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+	Delete(key *datastore.Key) error
+}
+
+// cloudDatastoreClient adapts *datastore.Client to datastoreClient.
+type cloudDatastoreClient struct {
+	*datastore.Client
+}
+
+func (c cloudDatastoreClient) RunInTransaction(ctx context.Context, f func(tx datastoreTransaction) error) error {
+	_, err := c.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(tx)
+	})
+	return err
+}
+
+// datastoreBackend keeps entities in Google Cloud Datastore.
+type datastoreBackend struct {
+	client datastoreClient
+}
+
+func datastoreKey(key entityKey) *datastore.Key {
+	k := datastore.NameKey(key.Kind, key.Name, nil)
+	k.Namespace = key.Namespace
+	return k
+}
+
+func (b *datastoreBackend) Get(ctx context.Context, key entityKey, dst interface{}) error {
+	err := b.client.Get(ctx, datastoreKey(key), dst)
+	if err == datastore.ErrNoSuchEntity {
+		return errNotFound
+	}
+	return err
+}
+
+func (b *datastoreBackend) Put(ctx context.Context, key entityKey, src interface{}) error {
+	_, err := b.client.Put(ctx, datastoreKey(key), src)
+	return err
+}
+
+func (b *datastoreBackend) Delete(ctx context.Context, key entityKey) error {
+	err := b.client.Delete(ctx, datastoreKey(key))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (b *datastoreBackend) GetAll(ctx context.Context, namespace, kind, prefix string, dst interface{}) ([]entityKey, error) {
+	q := datastore.NewQuery(kind).Namespace(namespace)
+	if prefix != "" {
+		// Key names sort by their UTF-8 bytes, so this range holds exactly the names with the prefix.
+		q = q.Filter("__key__ >=", datastoreKey(entityKey{namespace, kind, prefix})).
+			Filter("__key__ <", datastoreKey(entityKey{namespace, kind, prefix + "\U0010FFFF"}))
+	}
+	dsKeys, err := b.client.GetAll(ctx, q, dst)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]entityKey, len(dsKeys))
+	for i, k := range dsKeys {
+		keys[i] = entityKey{Namespace: k.Namespace, Kind: k.Kind, Name: k.Name}
+	}
+	return keys, nil
+}
+
+func (b *datastoreBackend) RunInTransaction(ctx context.Context, f func(tx entityTx) error) error {
+	return b.client.RunInTransaction(ctx, func(tx datastoreTransaction) error {
+		return f(&datastoreTx{tx: tx})
+	})
+}
+
+// datastoreTx reads and writes entities within a Datastore transaction.
+type datastoreTx struct {
+	tx datastoreTransaction
+}
+
+func (t *datastoreTx) Get(key entityKey, dst interface{}) error {
+	err := t.tx.Get(datastoreKey(key), dst)
+	if err == datastore.ErrNoSuchEntity {
+		return errNotFound
+	}
+	return err
+}
+
+func (t *datastoreTx) Put(key entityKey, src interface{}) error {
+	_, err := t.tx.Put(datastoreKey(key), src)
+	return err
+}
+
+func (t *datastoreTx) Delete(key entityKey) error {
+	err := t.tx.Delete(datastoreKey(key))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (b *datastoreBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fileBackend keeps entities, encoded as JSON, in an embedded bbolt database file. Each namespace
+// is a top-level bucket, holding a bucket per kind.
+type fileBackend struct {
+	db *bolt.DB
+}
+
+// openFileBackend opens the database file at path, creating it if need be. Only one process may
+// have the file open at a time.
+func openFileBackend(path string) (*fileBackend, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening store file %s: %w", path, err)
+	}
+	return &fileBackend{db: db}, nil
+}
+
+// namespaceBucketName prefixes namespaces, so that the default namespace has a non-empty name.
+func namespaceBucketName(namespace string) []byte {
+	return []byte("ns:" + namespace)
+}
+
+// kindBucket returns the bucket of the namespace and kind, or nil if it does not exist and
+// create is false.
+func kindBucket(tx *bolt.Tx, namespace, kind string, create bool) (*bolt.Bucket, error) {
+	if !create {
+		ns := tx.Bucket(namespaceBucketName(namespace))
+		if ns == nil {
+			return nil, nil
+		}
+		return ns.Bucket([]byte(kind)), nil
+	}
+	ns, err := tx.CreateBucketIfNotExists(namespaceBucketName(namespace))
+	if err != nil {
+		return nil, err
+	}
+	return ns.CreateBucketIfNotExists([]byte(kind))
+}
+
+func (b *fileBackend) Get(ctx context.Context, key entityKey, dst interface{}) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return (&fileTx{tx: tx}).Get(key, dst)
+	})
+}
+
+func (b *fileBackend) Put(ctx context.Context, key entityKey, src interface{}) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return (&fileTx{tx: tx}).Put(key, src)
+	})
+}
+
+func (b *fileBackend) Delete(ctx context.Context, key entityKey) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return (&fileTx{tx: tx}).Delete(key)
+	})
+}
+
+// RunInTransaction runs f in a read-write bbolt transaction. bbolt serializes those, so f is
+// never run again.
+func (b *fileBackend) RunInTransaction(ctx context.Context, f func(tx entityTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		ftx := &fileTx{tx: tx, pending: true}
+		if err := f(ftx); err != nil {
+			return err
+		}
+		for _, w := range ftx.writes {
+			if err := w(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// fileTx reads and writes entities within a bbolt transaction. Within RunInTransaction, writes
+// are held back until f returns, so that reads do not see them, as in Datastore.
+type fileTx struct {
+	tx      *bolt.Tx
+	pending bool
+	writes  []func() error
+}
+
+func (t *fileTx) Get(key entityKey, dst interface{}) error {
+	bucket, err := kindBucket(t.tx, key.Namespace, key.Kind, false)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if bucket != nil {
+		data = bucket.Get([]byte(key.Name))
+	}
+	if data == nil {
+		return errNotFound
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func (t *fileTx) Put(key entityKey, src interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return t.write(func() error {
+		bucket, err := kindBucket(t.tx, key.Namespace, key.Kind, true)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key.Name), data)
+	})
+}
+
+func (t *fileTx) Delete(key entityKey) error {
+	return t.write(func() error {
+		bucket, err := kindBucket(t.tx, key.Namespace, key.Kind, false)
+		if err != nil || bucket == nil {
+			return err
+		}
+		return bucket.Delete([]byte(key.Name))
+	})
+}
+
+func (t *fileTx) write(w func() error) error {
+	if !t.pending {
+		return w()
+	}
+	t.writes = append(t.writes, w)
+	return nil
+}
+
+func (b *fileBackend) GetAll(ctx context.Context, namespace, kind, prefix string, dst interface{}) ([]entityKey, error) {
+	dstVal := reflect.ValueOf(dst).Elem()
+	elemType := dstVal.Type().Elem().Elem()
+	var keys []entityKey
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket, err := kindBucket(tx, namespace, kind, false)
+		if err != nil || bucket == nil {
+			return err
+		}
+		c := bucket.Cursor()
+		for name, data := c.Seek([]byte(prefix)); name != nil && bytes.HasPrefix(name, []byte(prefix)); name, data = c.Next() {
+			elem := reflect.New(elemType)
+			if err := json.Unmarshal(data, elem.Interface()); err != nil {
+				return fmt.Errorf("decoding %s %s: %w", kind, name, err)
+			}
+			dstVal.Set(reflect.Append(dstVal, elem))
+			keys = append(keys, entityKey{Namespace: namespace, Kind: kind, Name: string(name)})
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (b *fileBackend) Close() error {
+	return b.db.Close()
+}
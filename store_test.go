@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores returns a store on each backend, keyed by backend name.
+func testStores(t *testing.T) map[string]store {
+	t.Helper()
+	fileBackend, err := openFileBackend(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("openFileBackend call failed: %v", err)
+	}
+	t.Cleanup(func() { fileBackend.Close() })
+	return map[string]store{
+		"datastore": newEntityStore(&datastoreBackend{client: &fakeDatastoreClient{entities: map[string]map[string]interface{}{}}}),
+		"file":      newEntityStore(fileBackend),
+	}
+}
+
+func TestStorePageTokens(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		if _, err := st.PageToken(ctx, "", "t3_12345"); err != errNotFound {
+			t.Fatalf("%s: PageToken returned unexpected error for a missing token (got: %v, want: %v)", name, err, errNotFound)
+		}
+		for _, id := range []string{"t3_67890", "t3_12345"} {
+			if err := st.UpdatePost(ctx, "", id, &postUpdate{PageToken: &PageToken{MainCommentFullID: "t1_" + id, NextIndex: 6}}); err != nil {
+				t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+			}
+		}
+		// Tokens of other namespaces are kept apart.
+		if err := st.UpdatePost(ctx, "embroidery", "t3_00000", &postUpdate{PageToken: &PageToken{}}); err != nil {
+			t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+		}
+
+		pt, err := st.PageToken(ctx, "", "t3_12345")
+		if err != nil {
+			t.Fatalf("%s: PageToken call failed: %v", name, err)
+		}
+		if pt.MainCommentFullID != "t1_t3_12345" || pt.NextIndex != 6 {
+			t.Fatalf("%s: PageToken returned unexpected token: %+v", name, pt)
+		}
+		posts, err := st.InProgressPosts(ctx, "")
+		if err != nil {
+			t.Fatalf("%s: InProgressPosts call failed: %v", name, err)
+		}
+		if len(posts) != 2 || posts[0].PostID != "t3_12345" || posts[1].PostID != "t3_67890" {
+			t.Fatalf("%s: InProgressPosts returned unexpected posts: %+v", name, posts)
+		}
+
+		if err := st.UpdatePost(ctx, "", "t3_12345", &postUpdate{Complete: true}); err != nil {
+			t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+		}
+		if err := st.UpdatePost(ctx, "", "t3_12345", &postUpdate{Complete: true}); err != nil {
+			t.Fatalf("%s: UpdatePost failed to complete a post without a token: %v", name, err)
+		}
+		if _, err := st.PageToken(ctx, "", "t3_12345"); err != errNotFound {
+			t.Fatalf("%s: PageToken was not deleted: %v", name, err)
+		}
+	}
+}
+
+func TestStoreHandledMarkers(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		if handled, err := st.IsHandled(ctx, "", "t3_12345"); err != nil || handled {
+			t.Fatalf("%s: IsHandled returned unexpected result for an unhandled post (got: %t, %v)", name, handled, err)
+		}
+		if err := st.UpdatePost(ctx, "", "t3_12345", &postUpdate{MarkHandled: true}); err != nil {
+			t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+		}
+		if handled, err := st.IsHandled(ctx, "", "t3_12345"); err != nil || !handled {
+			t.Fatalf("%s: IsHandled returned unexpected result for a handled post (got: %t, %v)", name, handled, err)
+		}
+		if handled, err := st.IsHandled(ctx, "embroidery", "t3_12345"); err != nil || handled {
+			t.Fatalf("%s: IsHandled saw a post handled in another namespace (got: %t, %v)", name, handled, err)
+		}
+	}
+}
+
+func TestStoreSummonRecords(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for name, st := range testStores(t) {
+		for _, r := range []*SummonRecord{
+			{PostID: "t3_12345", Username: "u/alice", Status: summonSent, UpdatedAt: now},
+			{PostID: "t3_12345", Username: "u/bob", Status: summonFailed, Attempts: 2, UpdatedAt: now},
+			// A post whose ID starts with the other's must not share its ledger.
+			{PostID: "t3_123456", Username: "u/carol", Status: summonSent, UpdatedAt: now},
+		} {
+			if err := st.UpdatePost(ctx, "", r.PostID, &postUpdate{Records: []*SummonRecord{r}}); err != nil {
+				t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+			}
+		}
+
+		records, err := st.SummonRecords(ctx, "", "t3_12345")
+		if err != nil {
+			t.Fatalf("%s: SummonRecords call failed: %v", name, err)
+		}
+		byUser := map[string]*SummonRecord{}
+		for _, r := range records {
+			byUser[r.Username] = r
+		}
+		if len(records) != 2 || byUser["u/alice"] == nil || byUser["u/bob"] == nil {
+			t.Fatalf("%s: SummonRecords returned unexpected records: %+v", name, records)
+		}
+		if r := byUser["u/bob"]; r.Status != summonFailed || r.Attempts != 2 || !r.UpdatedAt.Equal(now) {
+			t.Fatalf("%s: SummonRecords returned unexpected record: %+v", name, r)
+		}
+	}
+}
+
+func TestStoreSubscriberSnapshots(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		snap := &SubscriberSnapshot{Usernames: []string{"u/alice", "u/bob"}, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+		if err := st.UpdatePost(ctx, "", "t3_12345", &postUpdate{Snapshot: snap}); err != nil {
+			t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+		}
+		got, err := st.SubscriberSnapshot(ctx, "", "t3_12345")
+		if err != nil {
+			t.Fatalf("%s: SubscriberSnapshot call failed: %v", name, err)
+		}
+		if len(got.Usernames) != 2 || got.Usernames[1] != "u/bob" || !got.CreatedAt.Equal(snap.CreatedAt) {
+			t.Fatalf("%s: SubscriberSnapshot returned unexpected snapshot: %+v", name, got)
+		}
+		if err := st.UpdatePost(ctx, "", "t3_12345", &postUpdate{Complete: true}); err != nil {
+			t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+		}
+		if _, err := st.SubscriberSnapshot(ctx, "", "t3_12345"); err != errNotFound {
+			t.Fatalf("%s: SubscriberSnapshot was not deleted: %v", name, err)
+		}
+	}
+}
+
+func TestFileStoreKeepsStateAcrossRuns(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultConfig()
+	cfg.Store = StoreConfig{Type: storeFile, Path: filepath.Join(t.TempDir(), "state.db")}
+
+	st, err := openStore(ctx, cfg, false /*useCreds*/)
+	if err != nil {
+		t.Fatalf("openStore call failed: %v", err)
+	}
+	if err := st.UpdatePost(ctx, "", "t3_12345", &postUpdate{PageToken: &PageToken{NextIndex: 3}}); err != nil {
+		t.Fatalf("UpdatePost call failed: %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close call failed: %v", err)
+	}
+
+	st, err = openStore(ctx, cfg, false /*useCreds*/)
+	if err != nil {
+		t.Fatalf("openStore call failed: %v", err)
+	}
+	defer st.Close()
+	pt, err := st.PageToken(ctx, "", "t3_12345")
+	if err != nil || pt.NextIndex != 3 {
+		t.Fatalf("PageToken returned unexpected result after reopening the store (got: %+v, %v)", pt, err)
+	}
+}
+
+func TestLoadConfigStore(t *testing.T) {
+	cfg, err := loadConfig("" /*path*/, fakeEnv(map[string]string{"CROSSSTITCH_STORE_TYPE": storeFile}))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	if cfg.Store.Type != storeFile || cfg.Store.Path != defaultStorePath {
+		t.Fatalf("loadConfig returned unexpected store config: %+v", cfg.Store)
+	}
+
+	path := writeConfigFile(t, "config.yaml", "store:\n  type: sqlite\n")
+	if _, err := loadConfig(path, fakeEnv(nil)); err == nil {
+		t.Fatal("loadConfig accepted an unknown store type")
+	}
+}
+
+func TestStoreLeases(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for name, st := range testStores(t) {
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-a", now, time.Minute); err != nil {
+			t.Fatalf("%s: AcquireLease call failed: %v", name, err)
+		}
+		// The owner can renew its lease, but no one else can take it before it expires.
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-a", now.Add(30*time.Second), time.Minute); err != nil {
+			t.Fatalf("%s: AcquireLease failed to renew the lease: %v", name, err)
+		}
+		lease, err := st.AcquireLease(ctx, "", "t3_12345", "run-b", now.Add(80*time.Second), time.Minute)
+		if err != errLeaseHeld || lease.Owner != "run-a" || !lease.ExpiresAt.Equal(now.Add(90*time.Second)) {
+			t.Fatalf("%s: AcquireLease returned unexpected result for a held lease (got: %+v, %v)", name, lease, err)
+		}
+		// Releasing someone else's lease does nothing.
+		if err := st.ReleaseLease(ctx, "", "t3_12345", "run-b"); err != nil {
+			t.Fatalf("%s: ReleaseLease call failed: %v", name, err)
+		}
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-b", now.Add(80*time.Second), time.Minute); err != errLeaseHeld {
+			t.Fatalf("%s: ReleaseLease released a lease held by another owner: %v", name, err)
+		}
+
+		// Once it expires, the lease can be taken over.
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-b", now.Add(2*time.Minute), time.Minute); err != nil {
+			t.Fatalf("%s: AcquireLease failed to take over an expired lease: %v", name, err)
+		}
+		if err := st.ReleaseLease(ctx, "", "t3_12345", "run-b"); err != nil {
+			t.Fatalf("%s: ReleaseLease call failed: %v", name, err)
+		}
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-a", now, time.Minute); err != nil {
+			t.Fatalf("%s: AcquireLease failed after the lease was released: %v", name, err)
+		}
+	}
+}
+
+func TestStoreUpdatePost(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for name, st := range testStores(t) {
+		record := &SummonRecord{PostID: "t3_12345", Username: "u/alice", Status: summonSent, UpdatedAt: now}
+		// Without the post's lease, nothing is written.
+		u := &postUpdate{Owner: "run-a", Now: now, MarkHandled: true}
+		if err := st.UpdatePost(ctx, "", "t3_12345", u); err != errLeaseNotHeld {
+			t.Fatalf("%s: UpdatePost returned unexpected error for a post without a lease (got: %v, want: %v)", name, err, errLeaseNotHeld)
+		}
+		if handled, err := st.IsHandled(ctx, "", "t3_12345"); err != nil || handled {
+			t.Fatalf("%s: UpdatePost wrote to a post without a lease (got: %t, %v)", name, handled, err)
+		}
+
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-a", now, time.Minute); err != nil {
+			t.Fatalf("%s: AcquireLease call failed: %v", name, err)
+		}
+		u = &postUpdate{
+			Owner:       "run-a",
+			Now:         now,
+			MarkHandled: true,
+			Snapshot:    &SubscriberSnapshot{Usernames: []string{"u/alice"}, CreatedAt: now},
+			PageToken:   &PageToken{Phase: phaseBatchesInProgress, NextIndex: 1},
+			Records:     []*SummonRecord{record},
+		}
+		if err := st.UpdatePost(ctx, "", "t3_12345", u); err != nil {
+			t.Fatalf("%s: UpdatePost call failed: %v", name, err)
+		}
+		if handled, err := st.IsHandled(ctx, "", "t3_12345"); err != nil || !handled {
+			t.Fatalf("%s: UpdatePost did not mark the post handled (got: %t, %v)", name, handled, err)
+		}
+		if pt, err := st.PageToken(ctx, "", "t3_12345"); err != nil || pt.Phase != phaseBatchesInProgress {
+			t.Fatalf("%s: UpdatePost did not save the PageToken (got: %+v, %v)", name, pt, err)
+		}
+		if records, err := st.SummonRecords(ctx, "", "t3_12345"); err != nil || len(records) != 1 {
+			t.Fatalf("%s: UpdatePost did not save the summon record (got: %+v, %v)", name, records, err)
+		}
+
+		// Once the lease has expired, nothing is written.
+		u = &postUpdate{Owner: "run-a", Now: now.Add(time.Minute), PageToken: &PageToken{Phase: phaseBatchesInProgress, NextIndex: 2}, Complete: true}
+		if err := st.UpdatePost(ctx, "", "t3_12345", u); err != errLeaseNotHeld {
+			t.Fatalf("%s: UpdatePost returned unexpected error for an expired lease (got: %v, want: %v)", name, err, errLeaseNotHeld)
+		}
+
+		// Once another run holds the post's lease, nothing is written.
+		if _, err := st.AcquireLease(ctx, "", "t3_12345", "run-b", now.Add(time.Minute), time.Minute); err != nil {
+			t.Fatalf("%s: AcquireLease call failed: %v", name, err)
+		}
+		u = &postUpdate{Owner: "run-a", Now: now.Add(time.Minute), PageToken: &PageToken{Phase: phaseBatchesInProgress, NextIndex: 2}, Complete: true}
+		if err := st.UpdatePost(ctx, "", "t3_12345", u); err != errLeaseHeld {
+			t.Fatalf("%s: UpdatePost returned unexpected error for a post leased by another run (got: %v, want: %v)", name, err, errLeaseHeld)
+		}
+		if pt, err := st.PageToken(ctx, "", "t3_12345"); err != nil || pt.NextIndex != 1 {
+			t.Fatalf("%s: UpdatePost wrote to a post leased by another run (got: %+v, %v)", name, pt, err)
+		}
+	}
+}
+
+func TestStoreEntries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	for name, st := range testStores(t) {
+		cp := &CompetitionPost{PostID: "t3_12345", Title: "January's competition", Deadline: now}
+		if err := st.SaveEntries(ctx, "", cp, []*Entry{
+			{PostID: cp.PostID, CommentFullID: "t1_b", Author: "u/bob", SubmittedAt: now.Add(time.Minute)},
+			{PostID: cp.PostID, CommentFullID: "t1_a", Author: "u/alice", SubmittedAt: now, Valid: true},
+		}); err != nil {
+			t.Fatalf("%s: SaveEntries call failed: %v", name, err)
+		}
+		// A post whose ID starts with the other's must not share its entries.
+		other := &CompetitionPost{PostID: "t3_123456", Closed: true}
+		if err := st.SaveEntries(ctx, "", other, []*Entry{{PostID: other.PostID, CommentFullID: "t1_c", Author: "u/carol"}}); err != nil {
+			t.Fatalf("%s: SaveEntries call failed: %v", name, err)
+		}
+
+		entries, err := st.Entries(ctx, "", cp.PostID)
+		if err != nil {
+			t.Fatalf("%s: Entries call failed: %v", name, err)
+		}
+		if len(entries) != 2 || entries[0].Author != "u/alice" || !entries[0].Valid || entries[1].Author != "u/bob" {
+			t.Fatalf("%s: Entries returned unexpected entries: %+v", name, entries)
+		}
+		posts, err := st.CompetitionPosts(ctx, "")
+		if err != nil {
+			t.Fatalf("%s: CompetitionPosts call failed: %v", name, err)
+		}
+		if len(posts) != 2 || posts[0].PostID != cp.PostID || !posts[0].Deadline.Equal(now) || !posts[1].Closed {
+			t.Fatalf("%s: CompetitionPosts returned unexpected posts: %+v", name, posts)
+		}
+		if _, err := st.CompetitionPost(ctx, "", "t3_67890"); err != errNotFound {
+			t.Fatalf("%s: CompetitionPost of an unknown post returned %v, want errNotFound", name, err)
+		}
+	}
+}
+
+func TestStoreAnnouncements(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		for _, a := range []*Announcement{
+			{PostID: "t3_67890", Title: "February's winners", Status: announcementDraft},
+			{PostID: "t3_12345", Title: "January's winners", Status: announcementPosted, SubmittedPostID: "t3_abcde"},
+		} {
+			if err := st.PutAnnouncement(ctx, "", a); err != nil {
+				t.Fatalf("%s: PutAnnouncement call failed: %v", name, err)
+			}
+		}
+		announcements, err := st.Announcements(ctx, "")
+		if err != nil {
+			t.Fatalf("%s: Announcements call failed: %v", name, err)
+		}
+		if len(announcements) != 2 || announcements[0].SubmittedPostID != "t3_abcde" || announcements[1].Status != announcementDraft {
+			t.Fatalf("%s: Announcements returned unexpected announcements: %+v", name, announcements)
+		}
+		if _, err := st.Announcement(ctx, "", "t3_11111"); err != errNotFound {
+			t.Fatalf("%s: Announcement of an unknown post returned %v, want errNotFound", name, err)
+		}
+	}
+}
+
+func TestStoreAwards(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testStores(t) {
+		for _, award := range []*Award{
+			{PostID: "t3_12345", Username: "u/bob", Places: []string{"1st in Advanced"}, MessagedAt: time.Now().UTC()},
+			{PostID: "t3_12345", Username: "u/alice", Places: []string{"1st in Beginner"}, FlairError: "blocked"},
+			// A post whose ID starts with the other's.
+			{PostID: "t3_123456", Username: "u/carol"},
+		} {
+			if err := st.PutAward(ctx, "", award); err != nil {
+				t.Fatalf("%s: PutAward call failed: %v", name, err)
+			}
+		}
+		awards, err := st.Awards(ctx, "", "t3_12345")
+		if err != nil {
+			t.Fatalf("%s: Awards call failed: %v", name, err)
+		}
+		if len(awards) != 2 || awards[0].Username != "u/alice" || awards[0].FlairError != "blocked" || awards[1].MessagedAt.IsZero() {
+			t.Fatalf("%s: Awards returned unexpected awards: %+v", name, awards)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Kinds of subscriber source that can be selected in the config.
+const (
+	subscriberSourceSheets = "sheets"
+	subscriberSourceFile   = "file"
+	subscriberSourceMemory = "memory"
+)
+
+// Subscriber is a Reddit user who asked to be summoned to competition posts.
+type Subscriber struct {
+	// Username is the user's Reddit handle, including the "u/" prefix.
+	Username string `json:"username"`
+}
+
+// SubscriberSource lists the subscribers of a competition, in a stable order.
+type SubscriberSource interface {
+	Subscribers(ctx context.Context) ([]Subscriber, error)
+}
+
+// SubscriberSourceConfig selects and configures the SubscriberSource of a competition profile.
+type SubscriberSourceConfig struct {
+	// Type is one of "sheets" (the default), "file" or "memory".
+	Type string `yaml:"type"`
+
+	// The Google Sheet, and the range within it, listing one subscriber username per row.
+	SheetID    string `yaml:"sheetID"`
+	SheetRange string `yaml:"sheetRange"`
+
+	// Path of a CSV file with one username per row (in the first column), or of a JSON
+	// file holding an array of {"username": ...} objects.
+	Path string `yaml:"path"`
+
+	// Usernames of the subscribers, for the in-memory source.
+	Usernames []string `yaml:"usernames"`
+}
+
+func (c *SubscriberSourceConfig) applyDefaults() {
+	if c.Type == "" {
+		c.Type = subscriberSourceSheets
+	}
+	if c.Type == subscriberSourceSheets && c.SheetRange == "" {
+		c.SheetRange = defaultSheetRange
+	}
+}
+
+func (c *SubscriberSourceConfig) validate() error {
+	switch c.Type {
+	case subscriberSourceSheets:
+		if c.SheetID == "" {
+			return errors.New("sheetID must be set for a sheets subscriber source")
+		}
+	case subscriberSourceFile:
+		if c.Path == "" {
+			return errors.New("path must be set for a file subscriber source")
+		}
+	case subscriberSourceMemory:
+	default:
+		return fmt.Errorf("unknown subscriber source type %q", c.Type)
+	}
+	return nil
+}
+
+// newSubscriberSource creates the SubscriberSource described by the config. The Sheets
+// service is only needed, and may be nil otherwise, if the source reads a Google Sheet.
+func newSubscriberSource(c *SubscriberSourceConfig, sheetsService *sheets.Service) (SubscriberSource, error) {
+	switch c.Type {
+	case subscriberSourceSheets:
+		if sheetsService == nil {
+			return nil, errors.New("Google Sheets subscriber source configured without a Sheets service")
+		}
+		return &sheetsSubscriberSource{
+			sheetID:   c.SheetID,
+			readRange: c.SheetRange,
+			readSpreadsheetValuesFunc: func(spreadsheetID, readRange string) (*sheets.ValueRange, error) {
+				return sheetsService.Spreadsheets.Values.Get(spreadsheetID, readRange).Do()
+			},
+		}, nil
+	case subscriberSourceFile:
+		return &fileSubscriberSource{path: c.Path}, nil
+	case subscriberSourceMemory:
+		return newMemorySubscriberSource(c.Usernames), nil
+	}
+	return nil, fmt.Errorf("unknown subscriber source type %q", c.Type)
+}
+
+// sheetsSubscriberSource reads subscribers from the first column of a Google Sheets range.
+type sheetsSubscriberSource struct {
+	sheetID                   string
+	readRange                 string
+	readSpreadsheetValuesFunc func(string, string) (*sheets.ValueRange, error)
+}
+
+func (s *sheetsSubscriberSource) Subscribers(ctx context.Context) ([]Subscriber, error) {
+	const usernameIndex = 0 // Column A
+
+	start := time.Now()
+	resp, err := s.readSpreadsheetValuesFunc(s.sheetID, s.readRange)
+	observeCall("sheets", "ValuesGet", start)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from Google Sheets: %w", s.readRange, err)
+	}
+	subscribers := make([]Subscriber, 0, len(resp.Values))
+	for _, row := range resp.Values {
+		// The Sheets API omits trailing empty cells, so blank rows come back empty.
+		if len(row) <= usernameIndex {
+			continue
+		}
+		subscribers = append(subscribers, Subscriber{Username: strings.TrimSpace(fmt.Sprint(row[usernameIndex]))})
+	}
+	return subscribers, nil
+}
+
+// fileSubscriberSource reads subscribers from a local CSV or JSON file, chosen by extension.
+// The file is re-read on every call so that it can be edited while the bot runs.
+type fileSubscriberSource struct {
+	path string
+}
+
+func (s *fileSubscriberSource) Subscribers(ctx context.Context) ([]Subscriber, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(s.path), ".json") {
+		var subscribers []Subscriber
+		if err := json.NewDecoder(f).Decode(&subscribers); err != nil {
+			return nil, fmt.Errorf("parsing subscribers file %s: %w", s.path, err)
+		}
+		return subscribers, nil
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	var subscribers []Subscriber
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing subscribers file %s: %w", s.path, err)
+		}
+		username := strings.TrimSpace(record[0])
+		// Skip blank lines and an optional header row.
+		if username == "" || (line == 1 && strings.EqualFold(username, "username")) {
+			continue
+		}
+		subscribers = append(subscribers, Subscriber{Username: username})
+	}
+	return subscribers, nil
+}
+
+// memorySubscriberSource serves a fixed list of subscribers.
+type memorySubscriberSource struct {
+	subscribers []Subscriber
+}
+
+func newMemorySubscriberSource(usernames []string) *memorySubscriberSource {
+	s := &memorySubscriberSource{subscribers: make([]Subscriber, len(usernames))}
+	for i, username := range usernames {
+		s.subscribers[i] = Subscriber{Username: username}
+	}
+	return s
+}
+
+func (s *memorySubscriberSource) Subscribers(ctx context.Context) ([]Subscriber, error) {
+	return s.subscribers, nil
+}
+
+// redditUsernameRegex matches the usernames Reddit allows, prefixed with "u/" as subscribers are.
+var redditUsernameRegex = regexp.MustCompile(`^u/[A-Za-z0-9_-]{3,20}$`)
+
+// subscriberWarnings describes the problems with a subscriber list that summoning works around:
+// entries without the "u/" prefix are skipped, and users listed more than once are summoned once.
+func subscriberWarnings(subscribers []Subscriber) []string {
+	var warnings []string
+	first := map[string]int{}
+	for i, sub := range subscribers {
+		switch {
+		case !strings.HasPrefix(sub.Username, "u/"):
+			warnings = append(warnings, fmt.Sprintf("entry %d %q does not start with u/ and will be skipped", i, sub.Username))
+			continue
+		case !redditUsernameRegex.MatchString(sub.Username):
+			warnings = append(warnings, fmt.Sprintf("entry %d %q is not a valid Reddit username", i, sub.Username))
+		}
+		key := strings.ToLower(sub.Username)
+		if j, ok := first[key]; ok {
+			warnings = append(warnings, fmt.Sprintf("entry %d %q duplicates entry %d and will only be summoned once", i, sub.Username, j))
+			continue
+		}
+		first[key] = i
+	}
+	return warnings
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/khipkin/geddit"
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestSheetsSubscriberSource(t *testing.T) {
+	src := &sheetsSubscriberSource{
+		sheetID:   "sheet",
+		readRange: defaultSheetRange,
+		readSpreadsheetValuesFunc: func(sheetID, readRange string) (*sheets.ValueRange, error) {
+			if sheetID != "sheet" || readRange != defaultSheetRange {
+				t.Fatalf("read unexpected range %s of sheet %s", readRange, sheetID)
+			}
+			return &sheets.ValueRange{Values: [][]interface{}{
+				{"u/user-0"},
+				{}, // Blank row.
+				{" u/user-1 ", "extra column"},
+			}}, nil
+		},
+	}
+	subscribers, err := src.Subscribers(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribers call failed: %v", err)
+	}
+	want := []Subscriber{{Username: "u/user-0"}, {Username: "u/user-1"}}
+	if !reflect.DeepEqual(subscribers, want) {
+		t.Fatalf("Subscribers returned unexpected list (got: %v, want: %v)", subscribers, want)
+	}
+}
+
+func TestSheetsSubscriberSourceError(t *testing.T) {
+	src := &sheetsSubscriberSource{
+		readSpreadsheetValuesFunc: func(string, string) (*sheets.ValueRange, error) {
+			return nil, errors.New("quota exceeded")
+		},
+	}
+	if _, err := src.Subscribers(context.Background()); err == nil {
+		t.Fatal("Subscribers did not return the Sheets error")
+	}
+}
+
+func TestFileSubscriberSourceCSV(t *testing.T) {
+	path := writeConfigFile(t, "subscribers.csv", "username,signed up\nu/user-0,2023-01-01\n\nu/user-1\n")
+	subscribers, err := (&fileSubscriberSource{path: path}).Subscribers(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribers call failed: %v", err)
+	}
+	want := []Subscriber{{Username: "u/user-0"}, {Username: "u/user-1"}}
+	if !reflect.DeepEqual(subscribers, want) {
+		t.Fatalf("Subscribers returned unexpected list (got: %v, want: %v)", subscribers, want)
+	}
+}
+
+func TestFileSubscriberSourceJSON(t *testing.T) {
+	path := writeConfigFile(t, "subscribers.json", `[{"username": "u/user-0"}, {"username": "u/user-1"}]`)
+	subscribers, err := (&fileSubscriberSource{path: path}).Subscribers(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribers call failed: %v", err)
+	}
+	want := []Subscriber{{Username: "u/user-0"}, {Username: "u/user-1"}}
+	if !reflect.DeepEqual(subscribers, want) {
+		t.Fatalf("Subscribers returned unexpected list (got: %v, want: %v)", subscribers, want)
+	}
+}
+
+func TestFileSubscriberSourceMissingFile(t *testing.T) {
+	if _, err := (&fileSubscriberSource{path: "does-not-exist.csv"}).Subscribers(context.Background()); err == nil {
+		t.Fatal("Subscribers did not fail for a missing file")
+	}
+}
+
+func TestNewSubscriberSourceSheetsRequiresService(t *testing.T) {
+	if _, err := newSubscriberSource(&SubscriberSourceConfig{Type: subscriberSourceSheets, SheetID: "sheet"}, nil /*sheetsService*/); err == nil {
+		t.Fatal("newSubscriberSource created a Sheets source without a Sheets service")
+	}
+}
+
+func TestSummonContestantsFromFileSource(t *testing.T) {
+	const expectedNumComments = 2 // main comment, 1 child comment
+	path := writeConfigFile(t, "subscribers.csv", "u/user-0\nu/user-1\n")
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	testProfile(s).Subscribers = SubscriberSourceConfig{Type: subscriberSourceFile, Path: path}
+
+	if err := summonUnderLease(context.Background(), s, testProfile(s), &geddit.Submission{FullID: "t3_12345"}, nil /*PageToken*/); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+
+	fsr := s.redditSession.(*fakeRedditSession)
+	if fsr.numComments != expectedNumComments {
+		t.Fatalf("summonContestants made unexpected number of comments (got: %d, want: %d)", fsr.numComments, expectedNumComments)
+	}
+}
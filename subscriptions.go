@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+// How subscriptions made with Reddit commands combine with a profile's subscriber source.
+const (
+	// Reddit commands are not accepted.
+	redditSubscriptionsOff = "off"
+	// Reddit subscribers are added to the subscriber source, and Reddit unsubscriptions remove
+	// users from it.
+	redditSubscriptionsMerge = "merge"
+	// Only Reddit subscribers are summoned; the subscriber source is not read.
+	redditSubscriptionsReplace = "replace"
+)
+
+// Commands users can send the bot by private message, or by replying to one of its comments.
+const (
+	subscribeCommand   = "!subscribe"
+	unsubscribeCommand = "!unsubscribe"
+)
+
+// Subscription records a user's latest subscribe or unsubscribe command for a profile.
+// Subscriptions are keyed by lowercased username, without the "u/" prefix.
+type Subscription struct {
+	Username   string
+	Subscribed bool
+	UpdatedAt  time.Time
+}
+
+func subscriptionKeyName(username string) string {
+	return strings.ToLower(strings.TrimPrefix(username, "u/"))
+}
+
+// parseSubscriptionCommand finds a subscription command at the start of the message subject
+// or body. It returns the command, its argument (e.g. "r/Embroidery"), if any, and its category,
+// "results" for winners posts or else empty, e.g. for "!subscribe r/Embroidery results".
+func parseSubscriptionCommand(msg *inboxMessage) (command, arg, category string, ok bool) {
+	for _, text := range []string{msg.Body, msg.Subject} {
+		fields := strings.Fields(strings.ToLower(text))
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == subscribeCommand || fields[0] == unsubscribeCommand {
+			for _, field := range fields[1:min(len(fields), 3)] {
+				if field == subscriptionCategoryResults {
+					category = field
+				} else if arg == "" {
+					arg = field
+				}
+			}
+			return fields[0], arg, category, true
+		}
+	}
+	return "", "", "", false
+}
+
+// profileForMessage decides which profile a subscription command of the category applies to.
+// Comment replies apply to the profile of the subreddit they were made in. Private messages may
+// name the subreddit or profile; otherwise they apply to the only profile accepting Reddit
+// commands. If no profile applies, it returns an explanation to send back to the user instead.
+func (s *summoner) profileForMessage(msg *inboxMessage, arg, category string) (*CompetitionProfile, string) {
+	var enabled []*CompetitionProfile
+	for _, p := range s.config.Profiles {
+		if sp := p.subscriptionProfile(category); sp != nil && sp.RedditSubscriptions != redditSubscriptionsOff {
+			enabled = append(enabled, sp)
+		}
+	}
+
+	want := ""
+	switch {
+	case msg.WasComment:
+		want = msg.Subreddit
+	case arg != "":
+		want = strings.TrimPrefix(strings.TrimPrefix(arg, "/"), "r/")
+	case len(enabled) == 1:
+		return enabled[0], ""
+	}
+	if want != "" {
+		for _, p := range enabled {
+			if strings.EqualFold(p.Subreddit, want) || strings.EqualFold(p.Name, want) ||
+				(p.resultsOf != nil && strings.EqualFold(p.resultsOf.Name, want)) {
+				return p, ""
+			}
+		}
+	}
+
+	var names []string
+	for _, p := range enabled {
+		names = append(names, "r/"+p.Subreddit)
+	}
+	if len(names) == 0 {
+		if category == subscriptionCategoryResults {
+			return nil, "Subscribing to competition results through Reddit is not available."
+		}
+		return nil, "Subscribing through Reddit is not available. Please use the sign-up form instead."
+	}
+	return nil, fmt.Sprintf("Please say which competition you mean, e.g. `%s`. Available: %s.",
+		strings.TrimSpace(subscribeCommand+" r/"+enabled[0].Subreddit+" "+category), strings.Join(names, ", "))
+}
+
+// checkInbox handles subscription commands in the bot's unread messages, oldest first, so that
+// a user's latest command wins. Messages that are not commands are left unread for a human to
+// look at, as are commands that failed in a way a later run may not.
+func (s *summoner) checkInbox(ctx context.Context) error {
+	messages, err := s.redditSession.UnreadMessages()
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to list unread Reddit messages", "err", err)
+		return err
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Created < messages[j].Created })
+
+	var handled []string
+	for _, msg := range messages {
+		command, arg, category, ok := parseSubscriptionCommand(msg)
+		if !ok {
+			continue
+		}
+		done, err := s.handleSubscriptionCommand(ctx, msg, command, arg, category)
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to handle subscription command", "command", command, "author", msg.Author, "err", err)
+		}
+		if done {
+			handled = append(handled, msg.FullID)
+		}
+	}
+
+	if err := s.redditSession.MarkMessagesRead(handled...); err != nil {
+		loggerFrom(ctx).Error("Failed to mark Reddit messages as read", "err", err)
+		return err
+	}
+	return nil
+}
+
+// handleSubscriptionCommand records the command and replies to it. It reports whether the
+// message is done with, which it is once the command is recorded, even if the reply fails:
+// handling it again would only repeat the command. It is also done with once a reply fails
+// permanently, e.g. because the user blocked the bot.
+func (s *summoner) handleSubscriptionCommand(ctx context.Context, msg *inboxMessage, command, arg, category string) (done bool, err error) {
+	reply := func(text string) error {
+		// Replying to a message's full ID works for both private messages and comments.
+		_, err := s.redditSession.Reply(&geddit.Comment{FullID: msg.FullID}, text)
+		return err
+	}
+
+	p, problem := s.profileForMessage(msg, arg, category)
+	if p == nil {
+		err := reply(problem)
+		return err == nil || isPermanentRedditError(err), err
+	}
+
+	sub := &Subscription{
+		Username:   "u/" + msg.Author,
+		Subscribed: command == subscribeCommand,
+		UpdatedAt:  time.Unix(int64(msg.Created), 0).UTC(),
+	}
+	logger := loggerFrom(ctx).With("command", command, "username", sub.Username, "profile", p.Name)
+	logger.Info("Recording subscription command")
+	if err := s.store.PutSubscription(ctx, p.Namespace, sub); err != nil {
+		logger.Error("Failed to save Subscription", "err", err)
+		return false, err
+	}
+
+	var confirmation string
+	switch {
+	case category == subscriptionCategoryResults && sub.Subscribed:
+		confirmation = fmt.Sprintf("You are now subscribed to r/%s competition results and will be summoned when the next winners are announced. "+
+			"Send `%s %s` at any time to stop.", p.Subreddit, unsubscribeCommand, category)
+	case category == subscriptionCategoryResults:
+		confirmation = fmt.Sprintf("You have been unsubscribed from r/%s competition results. Send `%s %s` to sign up again.",
+			p.Subreddit, subscribeCommand, category)
+	case sub.Subscribed:
+		confirmation = fmt.Sprintf("You are now subscribed to r/%s competition posts and will be summoned when the next one goes live. "+
+			"Send `%s` at any time to stop.", p.Subreddit, unsubscribeCommand)
+	default:
+		confirmation = fmt.Sprintf("You have been unsubscribed from r/%s competition posts. Send `%s` to sign up again.",
+			p.Subreddit, subscribeCommand)
+	}
+	return true, reply(confirmation)
+}
+
+// readsSheets reports whether the subscribers of any profile, or of any profile summoning to
+// winners posts, are read from Google Sheets.
+func (c *Config) readsSheets() bool {
+	for _, p := range c.Profiles {
+		for _, sp := range []*CompetitionProfile{p, p.resultsProfile()} {
+			if sp != nil && sp.Subscribers.Type == subscriberSourceSheets && sp.RedditSubscriptions != redditSubscriptionsReplace {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subscriberSource returns the source of the profile's subscribers, taking Reddit subscriptions into account.
+func (s *summoner) subscriberSource(p *CompetitionProfile) (SubscriberSource, error) {
+	reddit := &redditSubscriberSource{store: s.store, profile: p}
+	if p.RedditSubscriptions == redditSubscriptionsReplace {
+		return reddit, nil
+	}
+
+	source, err := newSubscriberSource(&p.Subscribers, s.sheetsService)
+	if err != nil {
+		return nil, err
+	}
+	if p.RedditSubscriptions == redditSubscriptionsMerge {
+		return &mergedSubscriberSource{primary: source, reddit: reddit}, nil
+	}
+	return source, nil
+}
+
+// redditSubscriberSource lists the users subscribed to a profile through Reddit commands.
+type redditSubscriberSource struct {
+	store   store
+	profile *CompetitionProfile
+}
+
+// subscriptions returns all Subscriptions of the profile, ordered by username.
+func (s *redditSubscriberSource) subscriptions(ctx context.Context) ([]*Subscription, error) {
+	subs, err := s.store.Subscriptions(ctx, s.profile.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("listing Subscriptions: %w", err)
+	}
+	return subs, nil
+}
+
+func (s *redditSubscriberSource) Subscribers(ctx context.Context) ([]Subscriber, error) {
+	subs, err := s.subscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var subscribers []Subscriber
+	for _, sub := range subs {
+		if sub.Subscribed {
+			subscribers = append(subscribers, Subscriber{Username: sub.Username})
+		}
+	}
+	return subscribers, nil
+}
+
+// mergedSubscriberSource lists the primary source's subscribers, minus those who unsubscribed
+// through Reddit, followed by the Reddit subscribers the primary source does not already list.
+type mergedSubscriberSource struct {
+	primary SubscriberSource
+	reddit  *redditSubscriberSource
+}
+
+func (s *mergedSubscriberSource) Subscribers(ctx context.Context) ([]Subscriber, error) {
+	primary, err := s.primary.Subscribers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	subs, err := s.reddit.subscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]*Subscription{}
+	for _, sub := range subs {
+		latest[subscriptionKeyName(sub.Username)] = sub
+	}
+
+	var subscribers []Subscriber
+	listed := map[string]bool{}
+	for _, subscriber := range primary {
+		name := subscriptionKeyName(subscriber.Username)
+		if sub, ok := latest[name]; ok && !sub.Subscribed {
+			continue
+		}
+		listed[name] = true
+		subscribers = append(subscribers, subscriber)
+	}
+	for _, sub := range subs {
+		if sub.Subscribed && !listed[subscriptionKeyName(sub.Username)] {
+			subscribers = append(subscribers, Subscriber{Username: sub.Username})
+		}
+	}
+	return subscribers, nil
+}
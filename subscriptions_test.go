@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSubscriptionSummoner returns a summoner whose profiles accept Reddit subscription commands.
+func fakeSubscriptionSummoner(mode string, subscribers []string, inbox ...*inboxMessage) *summoner {
+	s := fakeSummoner(nil /*redditSubmissions*/, subscribers)
+	testProfile(s).RedditSubscriptions = mode
+	s.redditSession.(*fakeRedditSession).inbox = inbox
+	return s
+}
+
+func subscriberNames(t *testing.T, s *summoner) []string {
+	t.Helper()
+	src, err := s.subscriberSource(testProfile(s))
+	if err != nil {
+		t.Fatalf("subscriberSource call failed: %v", err)
+	}
+	subscribers, err := src.Subscribers(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribers call failed: %v", err)
+	}
+	var names []string
+	for _, sub := range subscribers {
+		names = append(names, sub.Username)
+	}
+	return names
+}
+
+func TestParseSubscriptionCommand(t *testing.T) {
+	tests := []struct {
+		msg          inboxMessage
+		wantCommand  string
+		wantArg      string
+		wantCategory string
+		wantOK       bool
+	}{
+		{inboxMessage{Body: "!subscribe"}, subscribeCommand, "", "", true},
+		{inboxMessage{Body: "  !UNSUBSCRIBE r/Embroidery please"}, unsubscribeCommand, "r/embroidery", "", true},
+		{inboxMessage{Subject: "!subscribe", Body: "Hi bot, sign me up!"}, subscribeCommand, "", "", true},
+		{inboxMessage{Body: "!subscribe Results"}, subscribeCommand, "", subscriptionCategoryResults, true},
+		{inboxMessage{Body: "!unsubscribe results r/Embroidery"}, unsubscribeCommand, "r/embroidery", subscriptionCategoryResults, true},
+		{inboxMessage{Subject: "Question", Body: "When is the next competition?"}, "", "", "", false},
+	}
+	for _, tc := range tests {
+		command, arg, category, ok := parseSubscriptionCommand(&tc.msg)
+		if command != tc.wantCommand || arg != tc.wantArg || category != tc.wantCategory || ok != tc.wantOK {
+			t.Errorf("parseSubscriptionCommand(%+v) = (%q, %q, %q, %t), want (%q, %q, %q, %t)",
+				tc.msg, command, arg, category, ok, tc.wantCommand, tc.wantArg, tc.wantCategory, tc.wantOK)
+		}
+	}
+}
+
+func TestCheckInboxHandlesCommands(t *testing.T) {
+	s := fakeSubscriptionSummoner(redditSubscriptionsReplace, nil, /*subscribers*/
+		&inboxMessage{FullID: "t4_1", Author: "alice", Body: "!subscribe"},
+		&inboxMessage{FullID: "t1_2", Author: "bob", Body: "!subscribe", WasComment: true, Subreddit: "CrossStitch"},
+		&inboxMessage{FullID: "t4_3", Author: "carol", Body: "!subscribe"},
+		&inboxMessage{FullID: "t4_4", Author: "carol", Body: "!unsubscribe"},
+		&inboxMessage{FullID: "t4_5", Author: "dave", Body: "Is this a bot?"},
+	)
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	if got, want := subscriberNames(t, s), []string{"u/alice", "u/bob"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("checkInbox recorded unexpected subscribers (got: %v, want: %v)", got, want)
+	}
+	fsr := s.redditSession.(*fakeRedditSession)
+	if want := []string{"t4_1", "t1_2", "t4_3", "t4_4"}; !reflect.DeepEqual(fsr.markedRead, want) {
+		t.Fatalf("checkInbox marked unexpected messages read (got: %v, want: %v)", fsr.markedRead, want)
+	}
+	if len(fsr.replies["t4_1"]) != 1 || !strings.Contains(fsr.replies["t4_1"][0], "now subscribed") {
+		t.Fatalf("checkInbox did not confirm subscription: %v", fsr.replies["t4_1"])
+	}
+	if len(fsr.replies["t4_4"]) != 1 || !strings.Contains(fsr.replies["t4_4"][0], "unsubscribed") {
+		t.Fatalf("checkInbox did not confirm unsubscription: %v", fsr.replies["t4_4"])
+	}
+	if len(fsr.replies["t4_5"]) != 0 {
+		t.Fatalf("checkInbox replied to a message that is not a command: %v", fsr.replies["t4_5"])
+	}
+}
+
+func TestCheckInboxHandlesCommandsOldestFirst(t *testing.T) {
+	subscribed, unsubscribed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 12, 5, 0, 0, time.UTC)
+	s := fakeSubscriptionSummoner(redditSubscriptionsReplace, nil, /*subscribers*/
+		// Reddit lists the newest messages first.
+		&inboxMessage{FullID: "t4_2", Author: "alice", Body: "!unsubscribe", Created: float64(unsubscribed.Unix())},
+		&inboxMessage{FullID: "t4_1", Author: "alice", Body: "!subscribe", Created: float64(subscribed.Unix())},
+	)
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	src := &redditSubscriberSource{store: s.store, profile: testProfile(s)}
+	subs, err := src.subscriptions(context.Background())
+	if err != nil {
+		t.Fatalf("subscriptions call failed: %v", err)
+	}
+	if len(subs) != 1 {
+		t.Fatalf("checkInbox recorded unexpected number of subscriptions (got: %d, want: 1)", len(subs))
+	}
+	if want := (Subscription{Username: "u/alice", Subscribed: false, UpdatedAt: unsubscribed}); !reflect.DeepEqual(*subs[0], want) {
+		t.Fatalf("checkInbox recorded unexpected subscription (got: %+v, want: %+v)", *subs[0], want)
+	}
+}
+
+func TestCheckInboxMarksRecordedCommandsRead(t *testing.T) {
+	s := fakeSubscriptionSummoner(redditSubscriptionsMerge, nil, /*subscribers*/
+		&inboxMessage{FullID: "t4_1", Author: "alice", Body: "!subscribe"},
+		&inboxMessage{FullID: "t4_2", Author: "bob", Body: "!subscribe r/Knitting"},
+	)
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.failReply = func(string) bool { return true }
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	if got, want := subscriberNames(t, s), []string{"u/alice"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("checkInbox recorded unexpected subscribers (got: %v, want: %v)", got, want)
+	}
+	// bob's command was not recorded, and nobody told him why, so it is left for the next run.
+	if want := []string{"t4_1"}; !reflect.DeepEqual(fsr.markedRead, want) {
+		t.Fatalf("checkInbox marked unexpected messages read (got: %v, want: %v)", fsr.markedRead, want)
+	}
+}
+
+func TestCheckInboxMarksPermanentlyFailedRepliesRead(t *testing.T) {
+	s := fakeSubscriptionSummoner(redditSubscriptionsMerge, nil, /*subscribers*/
+		&inboxMessage{FullID: "t1_1", Author: "alice", Body: "!subscribe", WasComment: true, Subreddit: "Knitting"},
+	)
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.failReply = func(string) bool { return true }
+	locked := &PermanentRedditError{Op: "reply", Err: newRedditCommentError([][]string{{"THREAD_LOCKED", "Comments are locked.", "parent"}})}
+	s.redditSession = &lockedRedditSession{fakeRedditSession: fsr, err: locked}
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	if want := []string{"t1_1"}; !reflect.DeepEqual(fsr.markedRead, want) {
+		t.Fatalf("checkInbox marked unexpected messages read (got: %v, want: %v)", fsr.markedRead, want)
+	}
+}
+
+func TestCheckInboxRejectsCommandsWhenDisabled(t *testing.T) {
+	s := fakeSubscriptionSummoner(redditSubscriptionsOff, nil, /*subscribers*/
+		&inboxMessage{FullID: "t4_1", Author: "alice", Body: "!subscribe"},
+	)
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	fsr := s.redditSession.(*fakeRedditSession)
+	if len(fsr.replies["t4_1"]) != 1 || !strings.Contains(fsr.replies["t4_1"][0], "not available") {
+		t.Fatalf("checkInbox did not explain that subscribing is unavailable: %v", fsr.replies["t4_1"])
+	}
+	src := &redditSubscriberSource{store: s.store, profile: testProfile(s)}
+	if subs, _ := src.Subscribers(context.Background()); len(subs) != 0 {
+		t.Fatalf("checkInbox recorded a subscription for a disabled profile: %v", subs)
+	}
+}
+
+func TestCheckInboxAsksWhichProfile(t *testing.T) {
+	s := fakeSubscriptionSummoner(redditSubscriptionsMerge, nil, /*subscribers*/
+		&inboxMessage{FullID: "t4_1", Author: "alice", Body: "!subscribe"},
+		&inboxMessage{FullID: "t4_2", Author: "bob", Body: "!subscribe r/Embroidery"},
+	)
+	embroidery := *testProfile(s)
+	embroidery.Name, embroidery.Namespace, embroidery.Subreddit = "embroidery", "embroidery", "Embroidery"
+	s.config.Profiles = append(s.config.Profiles, &embroidery)
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	fsr := s.redditSession.(*fakeRedditSession)
+	if len(fsr.replies["t4_1"]) != 1 || !strings.Contains(fsr.replies["t4_1"][0], "which competition") {
+		t.Fatalf("checkInbox did not ask which competition was meant: %v", fsr.replies["t4_1"])
+	}
+	if got := subscriberNames(t, s); len(got) != 0 {
+		t.Fatalf("checkInbox subscribed users to the wrong profile: %v", got)
+	}
+	src := &redditSubscriberSource{store: s.store, profile: &embroidery}
+	subs, err := src.Subscribers(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribers call failed: %v", err)
+	}
+	if want := []Subscriber{{Username: "u/bob"}}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("checkInbox recorded unexpected subscribers (got: %v, want: %v)", subs, want)
+	}
+}
+
+func TestMergedSubscriberSource(t *testing.T) {
+	s := fakeSubscriptionSummoner(redditSubscriptionsMerge, []string{"u/alice", "u/Bob", "u/carol"},
+		&inboxMessage{FullID: "t4_1", Author: "bob", Body: "!unsubscribe"},
+		&inboxMessage{FullID: "t4_2", Author: "dave", Body: "!subscribe"},
+		&inboxMessage{FullID: "t4_3", Author: "Carol", Body: "!subscribe"},
+	)
+
+	if err := s.checkInbox(context.Background()); err != nil {
+		t.Fatalf("checkInbox call failed: %v", err)
+	}
+
+	if got, want := subscriberNames(t, s), []string{"u/alice", "u/carol", "u/dave"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged source returned unexpected subscribers (got: %v, want: %v)", got, want)
+	}
+}
+
+func TestCheckPostsSummonsRedditSubscribers(t *testing.T) {
+	const expectedNumComments = 4 // subscription confirmation, main comment, 2 child comments
+	s := fakeSubscriptionSummoner(redditSubscriptionsMerge, generateFakeUsers(defaultMaxRedditTagsPerComment),
+		&inboxMessage{FullID: "t4_1", Author: "alice", Body: "!subscribe"},
+	)
+	fsr := s.redditSession.(*fakeRedditSession)
+	fsr.submittions = []*redditPost{fakePost("t3_12345", "[MOD] January's competition - more text")}
+
+	if _, err := s.checkPosts(context.Background()); err != nil {
+		t.Fatalf("checkPosts call failed: %v", err)
+	}
+
+	if fsr.numComments != expectedNumComments {
+		t.Fatalf("checkPosts made unexpected number of comments (got: %d, want: %d)", fsr.numComments, expectedNumComments)
+	}
+}
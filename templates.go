@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+const (
+	defaultFormURL     = "https://forms.gle/4seHL2YRRGTnT96E6"
+	defaultThemeRegex  = `(?i)competition\s*[-–—:]\s*(?P<theme>.+)$`
+	defaultMainComment = "This month's competition is live! Please submit your piece and/or vote for your favorite entries!\n\n" +
+		"To subscribe to future monthly competition posts, please fill out [this form]({{.FormURL}})" +
+		" and our friendly robot will summon you. You may unsubscribe at any time using the same form!"
+	defaultSummonComment = "Summoning contestants {{.Mentions}}"
+)
+
+// Reddit rejects comments longer than this many characters.
+const redditMaxCommentLength = 10000
+
+// Reddit usernames are at most this long, which is used to check summon comments fit.
+const redditMaxUsernameLength = 20
+
+// redditMentionRegex matches user mentions, which notify the user, in comment text.
+var redditMentionRegex = regexp.MustCompile(`(?:^|[^\w/])/?u/[\w-]+`)
+
+// commentData is what the main and summon comment templates are rendered with.
+type commentData struct {
+	Subreddit string
+	PostTitle string
+	// Month is the name of the month the competition post was made in.
+	Month string
+	// Theme is the part of the post title matched by the profile's theme regex, if any.
+	Theme           string
+	SubscriberCount int
+	FormURL         string
+	// Usernames lists the users tagged by a summon comment, and is empty for the main comment.
+	// Mentions is Usernames separated by commas.
+	Usernames []string
+	Mentions  string
+	// Deadline is when submissions close, e.g. "Monday, January 21 at 00:00 UTC", and DaysLeft
+	// the days left until then, rounded up. Both are set for reminder comments only.
+	Deadline string
+	DaysLeft int
+}
+
+// withUsernames returns a copy of the data for a summon comment tagging the given users.
+func (d *commentData) withUsernames(usernames []string) *commentData {
+	c := *d
+	c.Usernames = usernames
+	c.Mentions = strings.Join(usernames, ", ")
+	return &c
+}
+
+// newCommentData describes a competition post for the profile's comment templates.
+func newCommentData(p *CompetitionProfile, post *geddit.Submission, subscriberCount int, now time.Time) *commentData {
+	created := now
+	if post.DateCreated != 0 {
+		created = time.Unix(int64(post.DateCreated), 0)
+	}
+	return &commentData{
+		Subreddit:       p.Subreddit,
+		PostTitle:       post.Title,
+		Month:           created.UTC().Month().String(),
+		Theme:           p.theme(post.Title),
+		SubscriberCount: subscriberCount,
+		FormURL:         p.FormURL,
+	}
+}
+
+// theme extracts the competition theme from the post title: the "theme" group of the
+// profile's theme regex, or else its first group.
+func (p *CompetitionProfile) theme(title string) string {
+	if p.themeRegex == nil {
+		return ""
+	}
+	m := p.themeRegex.FindStringSubmatch(title)
+	if m == nil {
+		return ""
+	}
+	if i := p.themeRegex.SubexpIndex("theme"); i >= 0 {
+		return strings.TrimSpace(m[i])
+	}
+	if len(m) > 1 {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
+// compileTemplates parses the profile's comment templates and theme regex, and checks that a
+// summon comment tagging the most users, with the longest usernames, is still a valid comment.
+func (p *CompetitionProfile) compileTemplates(maxTags int) error {
+	var errs []error
+	var err error
+	if p.mainCommentTemplate, err = template.New("mainComment").Parse(p.MainComment); err != nil {
+		errs = append(errs, err)
+	}
+	if p.summonCommentTemplate, err = template.New("summonComment").Parse(p.SummonComment); err != nil {
+		errs = append(errs, err)
+	}
+	if p.themeRegex, err = regexp.Compile(p.ThemeRegex); err != nil {
+		errs = append(errs, fmt.Errorf("themeRegex: %w", err))
+	}
+	if err := p.Results.compile(); err != nil {
+		errs = append(errs, fmt.Errorf("results: %w", err))
+	}
+	if err := p.Winners.compile(); err != nil {
+		errs = append(errs, fmt.Errorf("winners: %w", err))
+	}
+	if err := p.ResultsSubscription.compile(p, maxTags); err != nil {
+		errs = append(errs, fmt.Errorf("resultsSubscription: %w", err))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	sample := &commentData{
+		Subreddit:       p.Subreddit,
+		PostTitle:       "[MOD] January competition - Sample theme",
+		Month:           "September",
+		Theme:           "Sample theme",
+		SubscriberCount: 1000,
+		FormURL:         p.FormURL,
+	}
+	if err := p.Calendar.compile(sample); err != nil {
+		errs = append(errs, fmt.Errorf("calendar: %w", err))
+	}
+	if _, err := p.renderMainComment(sample); err != nil {
+		errs = append(errs, err)
+	}
+	var usernames []string
+	for i := 0; i < maxTags; i++ {
+		usernames = append(usernames, fmt.Sprintf("u/%0*d", redditMaxUsernameLength, i))
+	}
+	if _, err := p.renderSummonComment(sample.withUsernames(usernames), maxTags); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (p *CompetitionProfile) renderMainComment(data *commentData) (string, error) {
+	text, err := renderComment(p.mainCommentTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	if len(text) > redditMaxCommentLength {
+		return "", fmt.Errorf("mainComment renders to %d characters, more than Reddit's limit of %d", len(text), redditMaxCommentLength)
+	}
+	return text, nil
+}
+
+// renderSummonComment renders a summon comment for data.Usernames, checking that it tags no
+// more than maxTags users, since Reddit ignores any further mentions.
+func (p *CompetitionProfile) renderSummonComment(data *commentData, maxTags int) (string, error) {
+	text, err := renderComment(p.summonCommentTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	if len(text) > redditMaxCommentLength {
+		return "", fmt.Errorf("summonComment renders to %d characters, more than Reddit's limit of %d", len(text), redditMaxCommentLength)
+	}
+	if n := len(redditMentionRegex.FindAllString(text, -1)); n > maxTags {
+		return "", fmt.Errorf("summonComment tags %d users, more than maxRedditTagsPerComment (%d)", n, maxTags)
+	}
+	return text, nil
+}
+
+func renderComment(tmpl *template.Template, data *commentData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
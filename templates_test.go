@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khipkin/geddit"
+)
+
+func TestSummonContestantsRendersTemplates(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, generateFakeUsers(defaultMaxRedditTagsPerComment+1))
+	p := testProfile(s)
+	p.MainComment = "{{.Month}}'s theme is {{.Theme}}! {{.SubscriberCount}} subscribers, sign up at {{.FormURL}}"
+	p.SummonComment = "Calling {{.Mentions}} to r/{{.Subreddit}}"
+	p.FormURL = "https://example.com/form"
+	if err := p.validate(s.config.MaxRedditTagsPerComment); err != nil {
+		t.Fatalf("validate call failed: %v", err)
+	}
+	fsr := s.redditSession.(*fakeRedditSession)
+
+	created := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+	post := &geddit.Submission{FullID: "t3_12345", Title: "[MOD] March competition - Spring Flowers", DateCreated: float64(created.Unix())}
+	if err := summonUnderLease(context.Background(), s, p, post, nil /*PageToken*/); err != nil {
+		t.Fatalf("summonContestants call failed: %v", err)
+	}
+
+	wantMain := []string{"March's theme is Spring Flowers! 4 subscribers, sign up at https://example.com/form"}
+	if got := fsr.replies["t3_12345"]; !reflect.DeepEqual(got, wantMain) {
+		t.Fatalf("summonContestants made unexpected main comment (got: %q, want: %q)", got, wantMain)
+	}
+	wantSummons := []string{
+		"Calling u/user-0, u/user-1, u/user-2 to r/CrossStitch",
+		"Calling u/user-3 to r/CrossStitch",
+	}
+	if got := fsr.replies["uniqueComment"]; !reflect.DeepEqual(got, wantSummons) {
+		t.Fatalf("summonContestants made unexpected summon comments (got: %q, want: %q)", got, wantSummons)
+	}
+}
+
+func TestProfileTheme(t *testing.T) {
+	s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+	p := testProfile(s)
+	for title, want := range map[string]string{
+		"[MOD] January's competition - Winter Wonderland": "Winter Wonderland",
+		"[MOD] February competition: Love Letters ":       "Love Letters",
+		"[MOD] March competition":                         "",
+	} {
+		if got := p.theme(title); got != want {
+			t.Errorf("theme(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestCompileTemplatesRejectsInvalidTemplates(t *testing.T) {
+	for name, test := range map[string]struct {
+		mainComment, summonComment, wantErr string
+	}{
+		"syntax error": {
+			mainComment: "{{.Month",
+			wantErr:     "mainComment",
+		},
+		"unknown field": {
+			summonComment: "{{.Usernamez}}",
+			wantErr:       "Usernamez",
+		},
+		"too many tags": {
+			summonComment: "{{.Mentions}}, and also u/CrossStitchBot",
+			wantErr:       "tags 4 users",
+		},
+		"too long": {
+			summonComment: strings.Repeat("x", redditMaxCommentLength) + "{{.Mentions}}",
+			wantErr:       "Reddit's limit",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := fakeSummoner(nil /*redditSubmissions*/, nil /*subscribers*/)
+			p := testProfile(s)
+			if test.mainComment != "" {
+				p.MainComment = test.mainComment
+			}
+			if test.summonComment != "" {
+				p.SummonComment = test.summonComment
+			}
+			err := p.compileTemplates(s.config.MaxRedditTagsPerComment)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("compileTemplates returned unexpected error (got: %v, want error containing %q)", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTemplates(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+profiles:
+  - subreddit: Embroidery
+    subscribers: {type: memory}
+    summonComment: "Stitchers assemble: {{.Mentions}}"
+    themeRegex: "theme is (\\w+)"
+`)
+	cfg, err := loadConfig(path, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig call failed: %v", err)
+	}
+	p := cfg.Profiles[0]
+	if got := p.theme("This month's theme is dragons"); got != "dragons" {
+		t.Fatalf("theme returned unexpected theme (got: %q, want: %q)", got, "dragons")
+	}
+	text, err := p.renderSummonComment((&commentData{}).withUsernames([]string{"u/a", "u/b"}), cfg.MaxRedditTagsPerComment)
+	if err != nil {
+		t.Fatalf("renderSummonComment call failed: %v", err)
+	}
+	if want := "Stitchers assemble: u/a, u/b"; text != want {
+		t.Fatalf("renderSummonComment returned unexpected text (got: %q, want: %q)", text, want)
+	}
+
+	path = writeConfigFile(t, "bad.yaml", "profiles:\n  - subreddit: Embroidery\n    subscribers: {type: memory}\n    mainComment: \"{{.Nope\"\n")
+	if _, err := loadConfig(path, fakeEnv(nil)); err == nil {
+		t.Fatal("loadConfig accepted a config with an invalid template")
+	}
+}